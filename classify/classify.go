@@ -0,0 +1,365 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package classify implements client classification. Requests are matched
+// against a set of configured classes, each defined by one or more match
+// expressions, and get tagged with the names of the classes they belong to.
+// Plugin configurations can then be restricted to requests of some classes.
+//
+// A match expression has the form `<field> <operator> <value>`, for example:
+//
+//	vendor-class prefix "PXEClient"
+//	mac-oui == 00:04:f2
+//	circuit-id ~ "^eth0/1/[0-9]+$"
+//
+// The supported fields are:
+//   - vendor-class: option 60 for DHCPv4, the data of option 16 for DHCPv6
+//   - user-class: option 77 for DHCPv4, option 15 for DHCPv6
+//   - mac: the client hardware address, as aa:bb:cc:dd:ee:ff
+//   - mac-oui: the first 3 bytes of the client hardware address, as aa:bb:cc
+//   - circuit-id: the relay agent circuit ID (option 82 sub-option 1) for
+//     DHCPv4, the relay Interface-ID (option 18) for DHCPv6
+//   - remote-id: the relay agent remote ID (option 82 sub-option 2) for
+//     DHCPv4, the relay Remote-ID (option 37) for DHCPv6
+//
+// The supported operators are `==` (equality), `prefix`, `contains` and `~`
+// (regular expression). Values can be given bare, or quoted with Go syntax if
+// they contain spaces or special characters. Hardware addresses are compared
+// case-insensitively.
+//
+// A class with several expressions matches if any of them matches. A field
+// with several values (eg. several user classes) matches if any of the values
+// matches.
+package classify
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/scratchpad"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// Relay agent information sub-options, as per RFC 3046
+const (
+	agentCircuitIDSubOption = 1
+	agentRemoteIDSubOption  = 2
+)
+
+// Classes is the set of classes a request belongs to
+type Classes []string
+
+// ClassesKey holds the classes of the request in its scratchpad, for plugins
+// that need more than restricting their configuration to some classes
+var ClassesKey = scratchpad.NewKey[Classes]("classes")
+
+// Has returns whether the given class is part of the set
+func (c Classes) Has(name string) bool {
+	for _, n := range c {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns whether a handler restricted to the given classes applies to
+// a request tagged with this set. An empty restriction applies to every
+// request.
+func (c Classes) Match(restrict []string) bool {
+	if len(restrict) == 0 {
+		return true
+	}
+	for _, name := range restrict {
+		if c.Has(name) {
+			return true
+		}
+	}
+	return false
+}
+
+type field struct {
+	get4 func(*dhcpv4.DHCPv4) []string
+	get6 func(dhcpv6.DHCPv6) []string
+	// hwaddr fields are compared case-insensitively
+	hwaddr bool
+}
+
+var fields = map[string]field{
+	"vendor-class": {get4: vendorClass4, get6: vendorClass6},
+	"user-class":   {get4: userClass4, get6: userClass6},
+	"mac":          {get4: mac4, get6: mac6, hwaddr: true},
+	"mac-oui":      {get4: oui(mac4), get6: oui(mac6), hwaddr: true},
+	"circuit-id":   {get4: relaySubOption4(agentCircuitIDSubOption), get6: interfaceID6},
+	"remote-id":    {get4: relaySubOption4(agentRemoteIDSubOption), get6: remoteID6},
+}
+
+type matcher struct {
+	expr      string
+	fieldName string
+	field     field
+	match     func(string) bool
+}
+
+func parseExpression(expr string) (*matcher, error) {
+	tokens := strings.Fields(expr)
+	if len(tokens) < 3 {
+		return nil, fmt.Errorf("want `<field> <operator> <value>`, got %q", expr)
+	}
+	f, ok := fields[tokens[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q in %q", tokens[0], expr)
+	}
+	// The value is everything after the operator, so that it can contain spaces
+	value := strings.TrimSpace(expr[strings.Index(expr, tokens[1])+len(tokens[1]):])
+	if strings.HasPrefix(value, `"`) {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted value %s in %q: %v", value, expr, err)
+		}
+		value = unquoted
+	}
+	if f.hwaddr {
+		value = strings.ToLower(value)
+	}
+
+	m := matcher{expr: expr, fieldName: tokens[0], field: f}
+	switch tokens[1] {
+	case "==":
+		m.match = func(s string) bool { return s == value }
+	case "prefix":
+		m.match = func(s string) bool { return strings.HasPrefix(s, value) }
+	case "contains":
+		m.match = func(s string) bool { return strings.Contains(s, value) }
+	case "~":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression in %q: %v", expr, err)
+		}
+		m.match = re.MatchString
+	default:
+		return nil, fmt.Errorf("unknown operator %q in %q", tokens[1], expr)
+	}
+	return &m, nil
+}
+
+func (m *matcher) any(values []string) bool {
+	for _, v := range values {
+		if m.field.hwaddr {
+			v = strings.ToLower(v)
+		}
+		if m.match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+type class struct {
+	name     string
+	matchers []*matcher
+}
+
+// Classifier evaluates the configured classes against requests. A nil
+// Classifier is valid, and never tags any request.
+type Classifier struct {
+	classes []class
+}
+
+// New compiles the given class definitions, mapping class names to lists of
+// match expressions, into a Classifier.
+func New(definitions map[string][]string) (*Classifier, error) {
+	c := Classifier{}
+	for name, exprs := range definitions {
+		if len(exprs) == 0 {
+			return nil, fmt.Errorf("class %s has no match expression", name)
+		}
+		cl := class{name: name}
+		for _, expr := range exprs {
+			m, err := parseExpression(expr)
+			if err != nil {
+				return nil, fmt.Errorf("class %s: %w", name, err)
+			}
+			cl.matchers = append(cl.matchers, m)
+		}
+		c.classes = append(c.classes, cl)
+	}
+	// Keep evaluation, and thus the resulting tags, in a stable order
+	sort.Slice(c.classes, func(i, j int) bool { return c.classes[i].name < c.classes[j].name })
+	return &c, nil
+}
+
+// Has returns whether a class with the given name is defined
+func (c *Classifier) Has(name string) bool {
+	if c == nil {
+		return false
+	}
+	for _, cl := range c.classes {
+		if cl.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Classifier) classify(get func(field) []string) Classes {
+	if c == nil {
+		return nil
+	}
+	var tags Classes
+	// Only extract each field once, even if used by several expressions
+	cache := make(map[string][]string)
+	for _, cl := range c.classes {
+		for _, m := range cl.matchers {
+			values, ok := cache[m.fieldName]
+			if !ok {
+				values = get(m.field)
+				cache[m.fieldName] = values
+			}
+			if m.any(values) {
+				tags = append(tags, cl.name)
+				break
+			}
+		}
+	}
+	return tags
+}
+
+// Classify4 returns the classes a DHCPv4 request belongs to
+func (c *Classifier) Classify4(req *dhcpv4.DHCPv4) Classes {
+	return c.classify(func(f field) []string { return f.get4(req) })
+}
+
+// Classify6 returns the classes a DHCPv6 request belongs to. The request can
+// be relayed, in which case relay information from every hop is considered
+func (c *Classifier) Classify6(req dhcpv6.DHCPv6) Classes {
+	return c.classify(func(f field) []string { return f.get6(req) })
+}
+
+func vendorClass4(req *dhcpv4.DHCPv4) []string {
+	if !req.Options.Has(dhcpv4.OptionClassIdentifier) {
+		return nil
+	}
+	return []string{req.ClassIdentifier()}
+}
+
+func userClass4(req *dhcpv4.DHCPv4) []string {
+	return req.UserClass()
+}
+
+func mac4(req *dhcpv4.DHCPv4) []string {
+	if len(req.ClientHWAddr) == 0 {
+		return nil
+	}
+	return []string{req.ClientHWAddr.String()}
+}
+
+func relaySubOption4(code uint8) func(*dhcpv4.DHCPv4) []string {
+	return func(req *dhcpv4.DHCPv4) []string {
+		rai := req.RelayAgentInfo()
+		if rai == nil {
+			return nil
+		}
+		v := rai.Get(dhcpv4.GenericOptionCode(code))
+		if v == nil {
+			return nil
+		}
+		return []string{string(v)}
+	}
+}
+
+func innerMessage(req dhcpv6.DHCPv6) *dhcpv6.Message {
+	msg, err := req.GetInnerMessage()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+func vendorClass6(req dhcpv6.DHCPv6) []string {
+	msg := innerMessage(req)
+	if msg == nil {
+		return nil
+	}
+	var values []string
+	for _, vc := range msg.Options.VendorClasses() {
+		for _, data := range vc.Data {
+			values = append(values, string(data))
+		}
+	}
+	return values
+}
+
+func userClass6(req dhcpv6.DHCPv6) []string {
+	msg := innerMessage(req)
+	if msg == nil {
+		return nil
+	}
+	var values []string
+	for _, uc := range msg.Options.UserClasses() {
+		values = append(values, string(uc))
+	}
+	return values
+}
+
+func mac6(req dhcpv6.DHCPv6) []string {
+	mac, err := dhcpv6.ExtractMAC(req)
+	if err != nil {
+		return nil
+	}
+	return []string{mac.String()}
+}
+
+// relayHops returns all the relay messages encapsulating a request, from the
+// outermost to the innermost
+func relayHops(req dhcpv6.DHCPv6) []*dhcpv6.RelayMessage {
+	var hops []*dhcpv6.RelayMessage
+	for req != nil && req.IsRelay() {
+		relay, ok := req.(*dhcpv6.RelayMessage)
+		if !ok {
+			break
+		}
+		hops = append(hops, relay)
+		req = relay.Options.RelayMessage()
+	}
+	return hops
+}
+
+func interfaceID6(req dhcpv6.DHCPv6) []string {
+	var values []string
+	for _, hop := range relayHops(req) {
+		if id := hop.Options.InterfaceID(); id != nil {
+			values = append(values, string(id))
+		}
+	}
+	return values
+}
+
+func remoteID6(req dhcpv6.DHCPv6) []string {
+	var values []string
+	for _, hop := range relayHops(req) {
+		if id := hop.Options.RemoteID(); id != nil {
+			values = append(values, string(id.RemoteID))
+		}
+	}
+	return values
+}
+
+// oui truncates the hardware addresses returned by get to their first 3 bytes
+func oui[T any](get func(T) []string) func(T) []string {
+	return func(req T) []string {
+		macs := get(req)
+		for i, mac := range macs {
+			// aa:bb:cc
+			if len(mac) >= 8 {
+				macs[i] = mac[:8]
+			}
+		}
+		return macs
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package classify
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testClasses = map[string][]string{
+	"pxe":   {`vendor-class prefix "PXEClient"`},
+	"ipxe":  {`user-class == iPXE`},
+	"voip":  {`mac-oui == 00:04:F2`, `vendor-class contains Polycom`},
+	"port1": {`circuit-id ~ "^eth0/1/[0-9]+$"`},
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"vendor-class prefix",
+		"color == blue",
+		"mac is 00:11:22:33:44:55",
+		`vendor-class == "unterminated`,
+		`circuit-id ~ "[a-"`,
+	} {
+		_, err := New(map[string][]string{"test": {expr}})
+		assert.Error(t, err, "expression %q should not compile", expr)
+	}
+	_, err := New(map[string][]string{"empty": {}})
+	assert.Error(t, err)
+}
+
+func TestClassify4(t *testing.T) {
+	c, err := New(testClasses)
+	require.NoError(t, err)
+
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0x00, 0x04, 0xf2, 0x01, 0x02, 0x03},
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00000:UNDI:002001")),
+		dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(
+			dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(agentCircuitIDSubOption), []byte("eth0/1/12")),
+		)),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, Classes{"port1", "pxe", "voip"}, c.Classify4(req))
+
+	req, err = dhcpv4.NewDiscovery(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+		dhcpv4.WithUserClass("iPXE", false),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, Classes{"ipxe"}, c.Classify4(req))
+
+	req, err = dhcpv4.NewDiscovery(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	require.NoError(t, err)
+	assert.Empty(t, c.Classify4(req))
+}
+
+func TestClassify6(t *testing.T) {
+	c, err := New(testClasses)
+	require.NoError(t, err)
+
+	req, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	req.AddOption(dhcpv6.OptClientID(&dhcpv6.DUIDLL{
+		HWType:        iana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0x00, 0x04, 0xf2, 0x01, 0x02, 0x03},
+	}))
+	req.AddOption(&dhcpv6.OptUserClass{UserClasses: [][]byte{[]byte("iPXE")}})
+
+	relayed, err := dhcpv6.EncapsulateRelay(req, dhcpv6.MessageTypeRelayForward, net.IPv6loopback, net.IPv6loopback)
+	require.NoError(t, err)
+	relayed.AddOption(dhcpv6.OptInterfaceID([]byte("eth0/1/3")))
+
+	assert.Equal(t, Classes{"ipxe", "port1", "voip"}, c.Classify6(relayed))
+}
+
+func TestNilClassifier(t *testing.T) {
+	var c *Classifier
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0x00, 0x04, 0xf2, 0x01, 0x02, 0x03})
+	require.NoError(t, err)
+	assert.Empty(t, c.Classify4(req))
+	assert.False(t, c.Has("voip"))
+}
+
+func TestMatch(t *testing.T) {
+	tags := Classes{"pxe", "voip"}
+	assert.True(t, tags.Match(nil))
+	assert.True(t, tags.Match([]string{"iot", "voip"}))
+	assert.False(t, tags.Match([]string{"iot"}))
+	assert.True(t, Classes(nil).Match(nil))
+	assert.False(t, Classes(nil).Match([]string{"iot"}))
+}
@@ -0,0 +1,297 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dhcpdConf = `
+# global settings
+default-lease-time 600;
+authoritative;
+option domain-name-servers 10.0.0.2, 10.0.0.3;
+ddns-update-style none;
+
+subnet 10.0.0.0 netmask 255.255.255.0 {
+	range 10.0.0.100 10.0.0.200;
+	option routers 10.0.0.1;
+	option domain-search "example.com";
+	next-server 10.0.0.5;
+	filename "pxelinux.0";
+}
+
+subnet 10.1.0.0 netmask 255.255.0.0 {
+	range 10.1.0.10 10.1.0.20;
+}
+
+host printer {
+	hardware ethernet 00:11:22:33:44:55;
+	fixed-address 10.0.0.50;
+}
+`
+
+const dhcpd6Conf = `
+server-duid LL ethernet 00:de:ad:be:ef:00;
+option dhcp6.name-servers 2001:db8::53;
+subnet6 2001:db8:1::/64 {
+	range6 2001:db8:1::100 2001:db8:1::200;
+	prefix6 2001:db8:100:: 2001:db8:100:ffff:: /64;
+}
+host nas {
+	hardware ethernet 00:11:22:33:44:66;
+	fixed-address6 2001:db8:1::50;
+}
+`
+
+const keaConf = `{
+  // Kea allows comments
+  "Dhcp4": {
+    "interfaces-config": { "interfaces": [ "eth0" ] },
+    "valid-lifetime": 4000,
+    "renew-timer": 1000,
+    "option-data": [ { "name": "domain-name-servers", "data": "192.0.2.2, 192.0.2.3" } ],
+    "subnet4": [ {
+      "id": 1,
+      "subnet": "192.0.2.0/24",
+      "pools": [ { "pool": "192.0.2.100 - 192.0.2.200" } ],
+      "option-data": [ { "name": "routers", "data": "192.0.2.1" } ],
+      "reservations": [
+        { "hw-address": "aa:bb:cc:dd:ee:ff", "ip-address": "192.0.2.10", "hostname": "web" },
+        { "duid": "01:02:03:04", "ip-address": "192.0.2.11" }
+      ]
+    } ]
+  },
+  "Dhcp6": {
+    "server-id": { "type": "LL", "identifier": "00deadbeef00" },
+    "valid-lifetime": 7200,
+    "preferred-lifetime": 3600,
+    "subnet6": [ {
+      "subnet": "2001:db8:1::/64",
+      "pd-pools": [ { "prefix": "2001:db8:8::", "prefix-len": 56, "delegated-len": 64 } ],
+      "reservations": [ { "hw-address": "aa:bb:cc:dd:ee:ff", "ip-addresses": [ "2001:db8:1::10" ] } ]
+    } ]
+  }
+}`
+
+func files(outputs []output) map[string]string {
+	m := make(map[string]string, len(outputs))
+	for _, out := range outputs {
+		m[out.name] = out.data
+	}
+	return m
+}
+
+func hasReport(c *conversion, substr string) bool {
+	for _, msg := range c.untranslated {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConvertDHCPD(t *testing.T) {
+	conv, err := convert(dhcpdConf, "")
+	require.NoError(t, err)
+	require.NotNil(t, conv.v4)
+	assert.Nil(t, conv.v6)
+
+	out := files(conv.emit())
+	assert.Equal(t, `# Generated by coredhcp-convert
+
+server4:
+    plugins:
+        - lease_time: 600s
+        # - server_id: <IP address of this server>
+        - dns: 10.0.0.2 10.0.0.3
+        - router: 10.0.0.1
+        - netmask: 255.255.255.0
+        - searchdomains: example.com
+        - nbp: tftp://10.0.0.5/pxelinux.0
+        - file: leases4.txt
+        - range: range4-leases.txt 10.0.0.100 10.0.0.200 600s
+`, out[configFile])
+	assert.Equal(t, "# printer\n00:11:22:33:44:55 10.0.0.50\n", out[leasesFile4])
+
+	assert.True(t, hasReport(conv, "line 6: `ddns-update-style none`"))
+	assert.True(t, hasReport(conv, "subnet 10.1.0.0/16: only the first subnet"))
+	assert.True(t, hasReport(conv, "no server identifier"))
+}
+
+func TestConvertPools(t *testing.T) {
+	conv, err := convert(`
+subnet 10.0.0.0 netmask 255.255.255.0 {
+	range 10.0.0.100 10.0.0.149;
+	range 10.0.0.200 10.0.0.249;
+}
+`, "dhcpd")
+	require.NoError(t, err)
+	out := files(conv.emit())
+	assert.Contains(t, out[configFile], "- range: range4-leases.txt 10.0.0.100-10.0.0.149,10.0.0.200-10.0.0.249 - 43200s\n")
+}
+
+func TestConvertTFTPServer(t *testing.T) {
+	conv, err := convert(`
+subnet 10.0.0.0 netmask 255.255.255.0 {
+	option tftp-server-name "10.0.0.6";
+	filename "pxelinux.0";
+}
+subnet 10.1.0.0 netmask 255.255.255.0 {
+	option tftp-server-name "tftp.example.com";
+}
+`, "dhcpd")
+	require.NoError(t, err)
+	out := files(conv.emit())
+	assert.Contains(t, out[configFile], "- nbp: tftp://10.0.0.6/pxelinux.0\n")
+	assert.True(t, hasReport(conv, "invalid address tftp.example.com, only an IPv4 address is supported"))
+}
+
+func TestConvertDHCPD6(t *testing.T) {
+	conv, err := convert(dhcpd6Conf, "dhcpd")
+	require.NoError(t, err)
+	require.NotNil(t, conv.v6)
+	assert.Nil(t, conv.v4)
+
+	out := files(conv.emit())
+	assert.Equal(t, `# Generated by coredhcp-convert
+
+server6:
+    plugins:
+        - server_id: LL 00:de:ad:be:ef:00
+        - dns: 2001:db8::53
+        - file: leases6.txt
+        - prefix: 2001:db8:100::/48 64
+        - range6: range6-leases.txt 2001:db8:1::100-2001:db8:1::200 43200s
+`, out[configFile])
+	assert.Equal(t, "# nas\n00:11:22:33:44:66 2001:db8:1::50\n", out[leasesFile6])
+	assert.True(t, hasReport(conv, "not aligned on a prefix"))
+}
+
+func TestConvertPools6(t *testing.T) {
+	conv, err := convert(`
+subnet6 2001:db8:1::/64 {
+	default-lease-time 3600;
+	range6 2001:db8:1::/112;
+	range6 2001:db8:1::1:0 2001:db8:1::1:ffff;
+}
+`, "dhcpd")
+	require.NoError(t, err)
+	out := files(conv.emit())
+	assert.Contains(t, out[configFile], "- range6: range6-leases.txt 2001:db8:1::-2001:db8:1::ffff 3600s\n")
+	assert.True(t, hasReport(conv, "range 2001:db8:1::1:0 - 2001:db8:1::1:ffff: only one DHCPv6 address pool"))
+}
+
+func TestConvertLifetimes6(t *testing.T) {
+	conv, err := convert(`
+default-lease-time 7200;
+preferred-lifetime 3600;
+subnet6 2001:db8:1::/64 {
+	range6 2001:db8:1::100 2001:db8:1::200;
+	prefix6 2001:db8:100:: 2001:db8:100:ffff:: /48;
+}
+`, "dhcpd")
+	require.NoError(t, err)
+	out := files(conv.emit())
+	assert.Contains(t, out[configFile], "- prefix: 2001:db8:100::/48 48 - 7200s 3600s\n")
+	assert.Contains(t, out[configFile], "- range6: range6-leases.txt 2001:db8:1::100-2001:db8:1::200 7200s 3600s\n")
+
+	// the preferred lifetime can't be longer than the valid one
+	conv, err = convert(`
+preferred-lifetime 3600;
+subnet6 2001:db8:1::/64 {
+	default-lease-time 600;
+	range6 2001:db8:1::100 2001:db8:1::200;
+}
+`, "dhcpd")
+	require.NoError(t, err)
+	out = files(conv.emit())
+	assert.Contains(t, out[configFile], "- range6: range6-leases.txt 2001:db8:1::100-2001:db8:1::200 600s 600s\n")
+	assert.True(t, hasReport(conv, "the preferred lifetime (1h0m0s) is longer"))
+
+	conv, err = convert("preferred-lifetime 3600;\nsubnet 10.0.0.0 netmask 255.255.255.0 {}", "dhcpd")
+	require.NoError(t, err)
+	assert.True(t, hasReport(conv, "only supported for DHCPv6"))
+}
+
+func TestConvertKea(t *testing.T) {
+	conv, err := convert(keaConf, "")
+	require.NoError(t, err)
+	require.NotNil(t, conv.v4)
+	require.NotNil(t, conv.v6)
+
+	out := files(conv.emit())
+	assert.Equal(t, `# Generated by coredhcp-convert
+
+server6:
+    plugins:
+        - server_id: LL 00:de:ad:be:ef:00
+        - file: leases6.txt
+        - prefix: 2001:db8:8::/56 64 - 7200s 3600s
+
+server4:
+    listen:
+        - "%eth0"
+    plugins:
+        - lease_time: 4000s
+        # - server_id: <IP address of this server>
+        - dns: 192.0.2.2 192.0.2.3
+        - router: 192.0.2.1
+        - netmask: 255.255.255.0
+        - file: leases4.txt
+        - range: range4-leases.txt 192.0.2.100 192.0.2.200 4000s
+`, out[configFile])
+	assert.Equal(t, "# web\naa:bb:cc:dd:ee:ff 192.0.2.10\n", out[leasesFile4])
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff 2001:db8:1::10\n", out[leasesFile6])
+
+	assert.True(t, hasReport(conv, "Dhcp4/renew-timer"))
+	assert.True(t, hasReport(conv, "Dhcp4/subnet4[0]/reservations[1]/duid"))
+}
+
+func TestKeaErrors(t *testing.T) {
+	_, err := convert(`{ "Dhcp4": `, "kea")
+	assert.Error(t, err)
+	_, err = convert("subnet 10.0.0.0 netmask 255.255.255.0 {", "dhcpd")
+	assert.Error(t, err)
+	_, err = convert("", "yaml")
+	assert.Error(t, err)
+}
+
+func TestStripComments(t *testing.T) {
+	assert.Equal(t,
+		"{\n\"a\": \"#not // a /* comment\", \n \"b\": 1}",
+		stripComments("{# comment\n\"a\": \"#not // a /* comment\", // comment\n /* multi\nline */\"b\": 1}"),
+	)
+}
+
+// TestLoadGenerated checks that the generated configuration is accepted by
+// coredhcp
+func TestLoadGenerated(t *testing.T) {
+	conv, err := convert(dhcpdConf, "dhcpd")
+	require.NoError(t, err)
+	file := path.Join(t.TempDir(), configFile)
+	require.NoError(t, ioutil.WriteFile(file, []byte(files(conv.emit())[configFile]), 0644))
+	conf, err := config.Load(file)
+	require.NoError(t, err)
+	require.NotNil(t, conf.Server4)
+	assert.Len(t, conf.Server4.Plugins, 8)
+	assert.Equal(t, "range", conf.Server4.Plugins[7].Name)
+
+	conv, err = convert(dhcpd6Conf, "dhcpd")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(file, []byte(files(conv.emit())[configFile]), 0644))
+	conf, err = config.Load(file)
+	require.NoError(t, err)
+	require.NotNil(t, conf.Server6)
+	assert.Len(t, conf.Server6.Plugins, 5)
+	assert.Equal(t, "range6", conf.Server6.Plugins[4].Name)
+}
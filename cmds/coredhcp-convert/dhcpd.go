@@ -0,0 +1,541 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+// Parser for the ISC dhcpd.conf format. Only the syntax is handled in a
+// generic way (statements, blocks, comments and strings); statements are then
+// interpreted one by one, and the ones we don't know are reported.
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type token struct {
+	text   string
+	quoted bool
+	line   int
+}
+
+type statement struct {
+	line  int
+	words []token
+	// block is non-nil for statements followed by a { } block
+	block []*statement
+}
+
+func (s *statement) String() string {
+	words := make([]string, 0, len(s.words))
+	for _, w := range s.words {
+		if w.quoted {
+			words = append(words, strconv.Quote(w.text))
+		} else {
+			words = append(words, w.text)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func tokenize(data string) ([]token, error) {
+	var tokens []token
+	line := 1
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case unicode.IsSpace(rune(c)) || c == ',':
+			// commas only separate list items, which are already separated
+			// by spaces in practice
+			i++
+		case c == '#':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == ';' || c == '{' || c == '}':
+			tokens = append(tokens, token{text: string(c), line: line})
+			i++
+		case c == '"':
+			var sb strings.Builder
+			start := line
+			i++
+			for ; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				if data[i] == '\n' {
+					line++
+				}
+				sb.WriteByte(data[i])
+			}
+			if i >= len(data) {
+				return nil, fmt.Errorf("line %d: unterminated string", start)
+			}
+			i++
+			tokens = append(tokens, token{text: sb.String(), quoted: true, line: start})
+		default:
+			start := i
+			for i < len(data) && !unicode.IsSpace(rune(data[i])) && !strings.ContainsRune(";{},\"#", rune(data[i])) {
+				i++
+			}
+			tokens = append(tokens, token{text: data[start:i], line: line})
+		}
+	}
+	return tokens, nil
+}
+
+// parseStatements reads statements until the end of the current block. It
+// returns the statements, and the position after the closing brace
+func parseStatements(tokens []token, pos int, nested bool) ([]*statement, int, error) {
+	var stmts []*statement
+	cur := &statement{}
+	for pos < len(tokens) {
+		t := tokens[pos]
+		pos++
+		if !t.quoted {
+			switch t.text {
+			case ";":
+				if len(cur.words) > 0 {
+					stmts = append(stmts, cur)
+				}
+				cur = &statement{}
+				continue
+			case "{":
+				if len(cur.words) == 0 {
+					return nil, 0, fmt.Errorf("line %d: block without a statement", t.line)
+				}
+				block, next, err := parseStatements(tokens, pos, true)
+				if err != nil {
+					return nil, 0, err
+				}
+				if block == nil {
+					block = []*statement{}
+				}
+				cur.block = block
+				stmts = append(stmts, cur)
+				cur = &statement{}
+				pos = next
+				continue
+			case "}":
+				if !nested {
+					return nil, 0, fmt.Errorf("line %d: unexpected '}'", t.line)
+				}
+				if len(cur.words) > 0 {
+					return nil, 0, fmt.Errorf("line %d: missing ';'", cur.line)
+				}
+				return stmts, pos, nil
+			}
+		}
+		if len(cur.words) == 0 {
+			cur.line = t.line
+		}
+		cur.words = append(cur.words, t)
+	}
+	if nested {
+		return nil, 0, fmt.Errorf("unexpected end of file, missing '}'")
+	}
+	if len(cur.words) > 0 {
+		return nil, 0, fmt.Errorf("line %d: missing ';'", cur.line)
+	}
+	return stmts, pos, nil
+}
+
+// dhcpdScope is the context in which statements are interpreted
+type dhcpdScope struct {
+	srv     *server
+	subnet  *subnet
+	options *options
+	// leaseTime and preferredLifetime point to the lifetimes of the subnet
+	// or server
+	leaseTime         *time.Duration
+	preferredLifetime *time.Duration
+	v6                bool
+}
+
+type dhcpdParser struct {
+	conv *conversion
+}
+
+// parseDHCPD converts a dhcpd.conf file. dhcpd uses separate configuration
+// files for DHCPv4 and DHCPv6, the version is guessed from the statements used
+func parseDHCPD(data string) (*conversion, error) {
+	tokens, err := tokenize(data)
+	if err != nil {
+		return nil, err
+	}
+	stmts, _, err := parseStatements(tokens, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	p := dhcpdParser{conv: &conversion{}}
+	scope := dhcpdScope{v6: isDHCPv6(stmts)}
+	if scope.v6 {
+		scope.srv = p.conv.server6()
+	} else {
+		scope.srv = p.conv.server4()
+	}
+	scope.options = &scope.srv.options
+	scope.leaseTime = &scope.srv.leaseTime
+	scope.preferredLifetime = &scope.srv.preferredLifetime
+	p.statements(stmts, scope)
+	return p.conv, nil
+}
+
+func isDHCPv6(stmts []*statement) bool {
+	for _, s := range stmts {
+		switch s.words[0].text {
+		case "subnet6", "range6", "prefix6", "fixed-address6", "server-duid":
+			return true
+		case "option":
+			if len(s.words) > 1 && strings.HasPrefix(s.words[1].text, "dhcp6.") {
+				return true
+			}
+		}
+		if s.block != nil && isDHCPv6(s.block) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *dhcpdParser) unsupported(s *statement, reason string) {
+	p.conv.report("line %d: `%s`: %s", s.line, s, reason)
+}
+
+func (p *dhcpdParser) statements(stmts []*statement, scope dhcpdScope) {
+	for _, s := range stmts {
+		p.statement(s, scope)
+	}
+}
+
+func (p *dhcpdParser) statement(s *statement, scope dhcpdScope) {
+	args := s.words[1:]
+	switch kw := s.words[0].text; kw {
+	case "authoritative":
+		// coredhcp always answers authoritatively
+	case "shared-network", "group", "pool", "pool6":
+		if s.block == nil {
+			p.unsupported(s, "expected a block")
+			return
+		}
+		p.statements(s.block, scope)
+	case "subnet", "subnet6":
+		p.subnet(s, scope)
+	case "host":
+		p.host(s, scope)
+	case "range", "range6":
+		p.rangeStatement(s, scope)
+	case "prefix6":
+		p.prefix6(s, scope)
+	case "option":
+		p.option(s, scope)
+	case "default-lease-time", "preferred-lifetime":
+		if kw == "preferred-lifetime" && !scope.v6 {
+			p.unsupported(s, "only supported for DHCPv6")
+			return
+		}
+		if len(args) != 1 {
+			p.unsupported(s, "expected a single value")
+			return
+		}
+		secs, err := strconv.Atoi(args[0].text)
+		if err != nil || secs < 0 {
+			p.unsupported(s, "invalid lease time")
+			return
+		}
+		if kw == "default-lease-time" {
+			*scope.leaseTime = time.Duration(secs) * time.Second
+		} else {
+			*scope.preferredLifetime = time.Duration(secs) * time.Second
+		}
+	case "next-server":
+		if len(args) != 1 || net.ParseIP(args[0].text).To4() == nil {
+			p.unsupported(s, "only an IPv4 address is supported")
+			return
+		}
+		scope.options.nextServer = net.ParseIP(args[0].text).To4()
+	case "filename":
+		if len(args) != 1 {
+			p.unsupported(s, "expected a single value")
+			return
+		}
+		scope.options.bootFile = args[0].text
+	case "server-identifier":
+		if len(args) != 1 || net.ParseIP(args[0].text).To4() == nil {
+			p.unsupported(s, "only an IPv4 address is supported")
+			return
+		}
+		scope.srv.serverID = args[0].text
+	case "server-duid":
+		p.serverDUID(s, scope)
+	default:
+		p.unsupported(s, "no coredhcp equivalent")
+	}
+}
+
+func (p *dhcpdParser) subnet(s *statement, scope dhcpdScope) {
+	if s.block == nil {
+		p.unsupported(s, "expected a block")
+		return
+	}
+	if scope.subnet != nil {
+		p.unsupported(s, "nested subnet")
+		return
+	}
+	sub := subnet{}
+	if s.words[0].text == "subnet6" {
+		if len(s.words) != 2 {
+			p.unsupported(s, "expected a prefix")
+			return
+		}
+		_, prefix, err := net.ParseCIDR(s.words[1].text)
+		if err != nil || prefix.IP.To4() != nil {
+			p.unsupported(s, "invalid IPv6 prefix")
+			return
+		}
+		sub.prefix = prefix
+	} else {
+		if len(s.words) != 4 || s.words[2].text != "netmask" {
+			p.unsupported(s, "expected `subnet <address> netmask <mask>`")
+			return
+		}
+		ip := net.ParseIP(s.words[1].text).To4()
+		mask := net.ParseIP(s.words[3].text).To4()
+		if ip == nil || mask == nil {
+			p.unsupported(s, "invalid IPv4 subnet")
+			return
+		}
+		sub.prefix = &net.IPNet{IP: ip, Mask: net.IPMask(mask)}
+	}
+	scope.srv.subnets = append(scope.srv.subnets, &sub)
+	scope.subnet = &sub
+	scope.options = &sub.options
+	scope.leaseTime = &sub.leaseTime
+	scope.preferredLifetime = &sub.preferredLifetime
+	p.statements(s.block, scope)
+}
+
+func (p *dhcpdParser) host(s *statement, scope dhcpdScope) {
+	if s.block == nil || len(s.words) != 2 {
+		p.unsupported(s, "expected `host <name> { ... }`")
+		return
+	}
+	res := reservation{name: s.words[1].text}
+	for _, hs := range s.block {
+		args := hs.words[1:]
+		switch hs.words[0].text {
+		case "hardware":
+			if len(args) != 2 || args[0].text != "ethernet" {
+				p.unsupported(hs, "only ethernet hardware addresses are supported")
+				continue
+			}
+			mac, err := net.ParseMAC(args[1].text)
+			if err != nil {
+				p.unsupported(hs, "invalid hardware address")
+				continue
+			}
+			res.mac = mac
+		case "fixed-address", "fixed-address6":
+			if len(args) != 1 {
+				p.unsupported(hs, "only a single fixed address is supported")
+				continue
+			}
+			ip := net.ParseIP(args[0].text)
+			if ip == nil {
+				p.unsupported(hs, "host names are not supported as fixed addresses")
+				continue
+			}
+			res.ip = ip
+		default:
+			p.unsupported(hs, "no coredhcp equivalent in a host declaration")
+		}
+	}
+	if res.mac == nil || res.ip == nil {
+		p.unsupported(s, "host declarations need both a hardware ethernet and a fixed address")
+		return
+	}
+	scope.srv.reservations = append(scope.srv.reservations, res)
+}
+
+func (p *dhcpdParser) rangeStatement(s *statement, scope dhcpdScope) {
+	args := s.words[1:]
+	if len(args) > 0 && args[0].text == "dynamic-bootp" {
+		args = args[1:]
+	}
+	var r ipRange
+	switch len(args) {
+	case 1:
+		// range6 <prefix>, or a range with a single address
+		if _, prefix, err := net.ParseCIDR(args[0].text); err == nil {
+			r = prefixRange(prefix)
+		} else {
+			r.start = net.ParseIP(args[0].text)
+			r.end = r.start
+		}
+	case 2:
+		r.start, r.end = net.ParseIP(args[0].text), net.ParseIP(args[1].text)
+	}
+	if r.start == nil || r.end == nil {
+		p.unsupported(s, "invalid range")
+		return
+	}
+	sub := scope.subnet
+	if sub == nil {
+		// pools in a shared-network belong to the subnet containing them
+		sub = findSubnet(scope.srv, r.start)
+	}
+	if sub == nil {
+		p.unsupported(s, "range outside of any declared subnet")
+		return
+	}
+	sub.pools = append(sub.pools, r)
+}
+
+func (p *dhcpdParser) prefix6(s *statement, scope dhcpdScope) {
+	if scope.subnet == nil {
+		p.unsupported(s, "prefix6 outside of a subnet6")
+		return
+	}
+	if len(s.words) != 4 || !strings.HasPrefix(s.words[3].text, "/") {
+		p.unsupported(s, "expected `prefix6 <start> <end> /<length>`")
+		return
+	}
+	start, end := net.ParseIP(s.words[1].text), net.ParseIP(s.words[2].text)
+	size, err := strconv.Atoi(s.words[3].text[1:])
+	if start == nil || end == nil || err != nil || size < 0 || size > 128 {
+		p.unsupported(s, "invalid prefix6 range")
+		return
+	}
+	prefix, exact := rangePrefix(start, end)
+	if !exact {
+		p.unsupported(s, fmt.Sprintf("the range is not aligned on a prefix, delegating from %s instead", prefix))
+	}
+	scope.subnet.delegations = append(scope.subnet.delegations, delegation{prefix: prefix, size: size})
+}
+
+func (p *dhcpdParser) serverDUID(s *statement, scope dhcpdScope) {
+	// server-duid LL [ethernet] <mac>
+	args := s.words[1:]
+	if len(args) < 2 || (args[0].text != "LL" && args[0].text != "LLT") {
+		p.unsupported(s, "only LL and LLT DUIDs are supported")
+		return
+	}
+	mac, err := net.ParseMAC(args[len(args)-1].text)
+	if err != nil {
+		p.unsupported(s, "only LL and LLT DUIDs with an ethernet address are supported")
+		return
+	}
+	scope.srv.serverID = mac.String()
+}
+
+func (p *dhcpdParser) option(s *statement, scope dhcpdScope) {
+	if len(s.words) < 3 {
+		p.unsupported(s, "option without a value")
+		return
+	}
+	name := s.words[1].text
+	var values []string
+	for _, w := range s.words[2:] {
+		values = append(values, w.text)
+	}
+	if err := setOption(scope.srv, scope.options, name, values, scope.v6); err != nil {
+		p.unsupported(s, err.Error())
+	}
+}
+
+// setOption translates an option with the given (dhcpd or Kea) name. The
+// names are the same in both, except for the dhcp6. prefix used by dhcpd
+func setOption(srv *server, opts *options, name string, values []string, v6 bool) error {
+	name = strings.TrimPrefix(name, "dhcp6.")
+	parseIPs := func(want4 bool) ([]net.IP, error) {
+		var ips []net.IP
+		for _, v := range values {
+			ip := net.ParseIP(v)
+			if ip == nil || (ip.To4() != nil) != want4 {
+				return nil, fmt.Errorf("invalid address %s", v)
+			}
+			ips = append(ips, ip)
+		}
+		return ips, nil
+	}
+	var err error
+	switch {
+	case !v6 && name == "routers":
+		opts.routers, err = parseIPs(true)
+	case !v6 && name == "domain-name-servers":
+		opts.dns, err = parseIPs(true)
+	case v6 && (name == "name-servers" || name == "dns-servers"):
+		opts.dns, err = parseIPs(false)
+	case !v6 && name == "subnet-mask":
+		var ips []net.IP
+		if ips, err = parseIPs(true); err == nil {
+			opts.netmask = net.IPMask(ips[0].To4())
+		}
+	case name == "domain-search":
+		opts.searchDomains = values
+	case !v6 && name == "interface-mtu":
+		opts.mtu, err = strconv.Atoi(values[0])
+	case !v6 && (name == "dhcp-server-identifier"):
+		if _, err = parseIPs(true); err == nil {
+			srv.serverID = values[0]
+		}
+	case v6 && name == "bootfile-url":
+		opts.bootURL = values[0]
+	case !v6 && (name == "tftp-server-name"):
+		// option 66 is used by clients when there is no next-server
+		ip := net.ParseIP(values[0]).To4()
+		switch {
+		case ip == nil:
+			err = fmt.Errorf("invalid address %s, only an IPv4 address is supported", values[0])
+		case opts.nextServer == nil:
+			opts.nextServer = ip
+		}
+	case !v6 && (name == "bootfile-name" || name == "boot-file-name"):
+		opts.bootFile = values[0]
+	default:
+		return fmt.Errorf("no coredhcp plugin for this option")
+	}
+	return err
+}
+
+// prefixRange returns the range of addresses covered by a prefix
+func prefixRange(prefix *net.IPNet) ipRange {
+	end := make(net.IP, len(prefix.IP))
+	for i := range prefix.IP {
+		end[i] = prefix.IP[i] | ^prefix.Mask[i]
+	}
+	return ipRange{start: prefix.IP, end: end}
+}
+
+// rangePrefix returns the smallest prefix containing the range, and whether
+// it covers exactly that range
+func rangePrefix(start, end net.IP) (*net.IPNet, bool) {
+	start, end = start.To16(), end.To16()
+	bits := 0
+	for bits < 128 {
+		mask := net.CIDRMask(bits+1, 128)
+		if !start.Mask(mask).Equal(end.Mask(mask)) {
+			break
+		}
+		bits++
+	}
+	prefix := &net.IPNet{IP: start.Mask(net.CIDRMask(bits, 128)), Mask: net.CIDRMask(bits, 128)}
+	r := prefixRange(prefix)
+	return prefix, r.start.Equal(start) && r.end.Equal(end)
+}
+
+func findSubnet(srv *server, ip net.IP) *subnet {
+	for _, sub := range srv.subnets {
+		if sub.prefix.Contains(ip) {
+			return sub
+		}
+	}
+	return nil
+}
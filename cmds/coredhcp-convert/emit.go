@@ -0,0 +1,261 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	configFile    = "config.yml"
+	leasesFile4   = "leases4.txt"
+	leasesFile6   = "leases6.txt"
+	rangeLeases4  = "range4-leases.txt"
+	rangeLeases6  = "range6-leases.txt"
+	defaultLease4 = 12 * time.Hour
+	defaultLease6 = 12 * time.Hour
+)
+
+// output is a file generated by the conversion
+type output struct {
+	name string
+	data string
+}
+
+// emit generates the coredhcp configuration and the lease files for the file
+// plugin. coredhcp serves a single network per server section, so only the
+// first subnet is translated; the others are reported.
+func (c *conversion) emit() []output {
+	var conf strings.Builder
+	conf.WriteString("# Generated by coredhcp-convert\n")
+	var files []output
+	if c.v6 != nil {
+		conf.WriteString("\nserver6:\n")
+		if leases := c.emit6(&conf); leases != "" {
+			files = append(files, output{name: leasesFile6, data: leases})
+		}
+	}
+	if c.v4 != nil {
+		conf.WriteString("\nserver4:\n")
+		if leases := c.emit4(&conf); leases != "" {
+			files = append(files, output{name: leasesFile4, data: leases})
+		}
+	}
+	return append([]output{{name: configFile, data: conf.String()}}, files...)
+}
+
+// plugin writes a plugin entry
+func plugin(w *strings.Builder, name string, args ...string) {
+	fmt.Fprintf(w, "        - %s: %s\n", name, strings.Join(args, " "))
+}
+
+func ipStrings(ips []net.IP) []string {
+	s := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return s
+}
+
+// firstSubnet returns the subnet to translate, with the global options merged
+// in, and reports the others
+func (c *conversion) firstSubnet(srv *server) *subnet {
+	if len(srv.subnets) == 0 {
+		return &subnet{options: srv.options}
+	}
+	for _, sub := range srv.subnets[1:] {
+		c.report("subnet %s: only the first subnet (%s) is translated, use a separate coredhcp instance for each network", sub.prefix, srv.subnets[0].prefix)
+	}
+	sub := *srv.subnets[0]
+	sub.options.merge(&srv.options)
+	return &sub
+}
+
+func (c *conversion) listen(w *strings.Builder, srv *server, format string) {
+	if len(srv.interfaces) == 0 {
+		return
+	}
+	w.WriteString("    listen:\n")
+	for _, iface := range srv.interfaces {
+		fmt.Fprintf(w, "        - \"%s\"\n", fmt.Sprintf(format, iface))
+	}
+}
+
+// leases generates the content of a file plugin lease file
+func leases(srv *server) string {
+	var sb strings.Builder
+	for _, res := range srv.reservations {
+		if res.name != "" {
+			fmt.Fprintf(&sb, "# %s\n", res.name)
+		}
+		fmt.Fprintf(&sb, "%s %s\n", res.mac, res.ip)
+	}
+	return sb.String()
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%ds", int64(d/time.Second))
+}
+
+func (c *conversion) emit4(w *strings.Builder) string {
+	srv := c.v4
+	sub := c.firstSubnet(srv)
+	opts := sub.options
+	c.listen(w, srv, "%%%s")
+	w.WriteString("    plugins:\n")
+
+	leaseTime := sub.leaseTime
+	if leaseTime == 0 {
+		leaseTime = srv.leaseTime
+	}
+	if leaseTime != 0 {
+		plugin(w, "lease_time", seconds(leaseTime))
+	}
+	if srv.serverID != "" {
+		plugin(w, "server_id", srv.serverID)
+	} else {
+		w.WriteString("        # - server_id: <IP address of this server>\n")
+		c.report("server4: no server identifier found, set the server_id plugin argument to an address of this server")
+	}
+
+	// The options go before the file plugin, which stops the processing of
+	// requests it can answer, so that they also apply to static leases
+	if len(opts.dns) > 0 {
+		plugin(w, "dns", ipStrings(opts.dns)...)
+	}
+	if len(opts.routers) > 0 {
+		plugin(w, "router", ipStrings(opts.routers)...)
+	}
+	netmask := opts.netmask
+	if netmask == nil && sub.prefix != nil {
+		netmask = sub.prefix.Mask
+	}
+	if netmask != nil {
+		plugin(w, "netmask", net.IP(netmask).String())
+	}
+	if len(opts.searchDomains) > 0 {
+		plugin(w, "searchdomains", opts.searchDomains...)
+	}
+	if opts.mtu != 0 {
+		plugin(w, "mtu", fmt.Sprint(opts.mtu))
+	}
+	switch {
+	case opts.bootFile == "":
+	case strings.HasPrefix(opts.bootFile, "http://"), strings.HasPrefix(opts.bootFile, "https://"), strings.HasPrefix(opts.bootFile, "ftp://"):
+		plugin(w, "nbp", opts.bootFile)
+	case opts.nextServer != nil:
+		plugin(w, "nbp", fmt.Sprintf("tftp://%s/%s", opts.nextServer, strings.TrimPrefix(opts.bootFile, "/")))
+	default:
+		c.report("boot file %s: no next-server to build a TFTP URL from", opts.bootFile)
+	}
+
+	leaseData := leases(srv)
+	if leaseData != "" {
+		plugin(w, "file", leasesFile4)
+	}
+
+	if len(sub.pools) > 0 {
+		if leaseTime == 0 {
+			leaseTime = defaultLease4
+		}
+		if len(sub.pools) == 1 {
+			pool := sub.pools[0]
+			plugin(w, "range", rangeLeases4, pool.start.String(), pool.end.String(), seconds(leaseTime))
+		} else {
+			// several pools share the same range instance, without
+			// exclusions
+			ranges := make([]string, 0, len(sub.pools))
+			for _, pool := range sub.pools {
+				ranges = append(ranges, fmt.Sprintf("%s-%s", pool.start, pool.end))
+			}
+			plugin(w, "range", rangeLeases4, strings.Join(ranges, ","), "-", seconds(leaseTime))
+		}
+	}
+	return leaseData
+}
+
+// lifetimes6 returns the valid and preferred lifetime arguments of the DHCPv6
+// plugins, or nil if the lifetimes are not set
+func (c *conversion) lifetimes6(sub *subnet) []string {
+	valid, preferred := sub.leaseTime, sub.preferredLifetime
+	if valid == 0 {
+		valid = c.v6.leaseTime
+	}
+	if preferred == 0 {
+		preferred = c.v6.preferredLifetime
+	}
+	switch {
+	case valid == 0 && preferred == 0:
+		return nil
+	case valid == 0:
+		valid = defaultLease6
+	}
+	if preferred == 0 {
+		return []string{seconds(valid)}
+	}
+	if preferred > valid {
+		c.report("server6: the preferred lifetime (%s) is longer than the valid lifetime (%s), using the valid lifetime", preferred, valid)
+		preferred = valid
+	}
+	return []string{seconds(valid), seconds(preferred)}
+}
+
+func (c *conversion) emit6(w *strings.Builder) string {
+	srv := c.v6
+	sub := c.firstSubnet(srv)
+	opts := sub.options
+	c.listen(w, srv, "[ff02::1:2%%%s]")
+	w.WriteString("    plugins:\n")
+
+	if srv.serverID != "" {
+		plugin(w, "server_id", "LL", srv.serverID)
+	} else {
+		w.WriteString("        # - server_id: LL <MAC address of this server>\n")
+		c.report("server6: no server DUID found, set the server_id plugin arguments to a DUID of this server")
+	}
+	if len(opts.dns) > 0 {
+		plugin(w, "dns", ipStrings(opts.dns)...)
+	}
+	if len(opts.searchDomains) > 0 {
+		plugin(w, "searchdomains", opts.searchDomains...)
+	}
+	if opts.bootURL != "" {
+		plugin(w, "nbp", opts.bootURL)
+	}
+
+	leaseData := leases(srv)
+	if leaseData != "" {
+		plugin(w, "file", leasesFile6)
+	}
+
+	lifetimes := c.lifetimes6(sub)
+	if len(sub.delegations) > 0 {
+		d := sub.delegations[0]
+		args := []string{d.prefix.String(), fmt.Sprint(d.size)}
+		if lifetimes != nil {
+			// the prefixes are only kept in memory, as without lifetimes
+			args = append(append(args, "-"), lifetimes...)
+		}
+		plugin(w, "prefix", args...)
+		for _, extra := range sub.delegations[1:] {
+			c.report("prefix delegation pool %s: only one pool per network is supported", extra.prefix)
+		}
+	}
+	if len(sub.pools) > 0 {
+		if lifetimes == nil {
+			lifetimes = []string{seconds(defaultLease6)}
+		}
+		pool := sub.pools[0]
+		args := append([]string{rangeLeases6, fmt.Sprintf("%s-%s", pool.start, pool.end)}, lifetimes...)
+		plugin(w, "range6", args...)
+		for _, extra := range sub.pools[1:] {
+			c.report("range %s - %s: only one DHCPv6 address pool per network is supported", extra.start, extra.end)
+		}
+	}
+	return leaseData
+}
@@ -0,0 +1,456 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+// Parser for the Kea Dhcp4/Dhcp6 JSON configuration. Kea extends JSON with
+// comments, which are stripped before decoding. Every key that isn't
+// translated is reported with its path in the document.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// stripComments removes shell, C and C++ style comments outside of strings
+func stripComments(data string) string {
+	var sb strings.Builder
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			sb.WriteByte(c)
+			if c == '\\' && i+1 < len(data) {
+				i++
+				sb.WriteByte(data[i])
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch {
+		case c == '"':
+			inString = true
+			sb.WriteByte(c)
+		case c == '#' || strings.HasPrefix(data[i:], "//"):
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			if i < len(data) {
+				sb.WriteByte('\n')
+			}
+		case strings.HasPrefix(data[i:], "/*"):
+			end := strings.Index(data[i+2:], "*/")
+			if end < 0 {
+				i = len(data)
+			} else {
+				i += end + 3
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+type object = map[string]interface{}
+
+type keaParser struct {
+	conv *conversion
+}
+
+// parseKea converts a Kea configuration file, with either or both of the Dhcp4
+// and Dhcp6 sections
+func parseKea(data string) (*conversion, error) {
+	var doc object
+	if err := json.Unmarshal([]byte(stripComments(data)), &doc); err != nil {
+		return nil, fmt.Errorf("invalid Kea JSON: %w", err)
+	}
+	p := keaParser{conv: &conversion{}}
+	for _, key := range sortedKeys(doc) {
+		switch key {
+		case "Dhcp4":
+			p.server(key, doc[key], p.conv.server4(), false)
+		case "Dhcp6":
+			p.server(key, doc[key], p.conv.server6(), true)
+		default:
+			p.unsupported(key, "no coredhcp equivalent")
+		}
+	}
+	return p.conv, nil
+}
+
+func sortedKeys(o object) []string {
+	keys := make([]string, 0, len(o))
+	for k := range o {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (p *keaParser) unsupported(path, reason string) {
+	p.conv.report("%s: %s", path, reason)
+}
+
+func (p *keaParser) object(path string, v interface{}) object {
+	o, ok := v.(object)
+	if !ok {
+		p.unsupported(path, "expected an object")
+	}
+	return o
+}
+
+func (p *keaParser) list(path string, v interface{}) []interface{} {
+	l, ok := v.([]interface{})
+	if !ok {
+		p.unsupported(path, "expected a list")
+	}
+	return l
+}
+
+func (p *keaParser) str(path string, v interface{}) (string, bool) {
+	s, ok := v.(string)
+	if !ok {
+		p.unsupported(path, "expected a string")
+	}
+	return s, ok
+}
+
+func (p *keaParser) lifetime(path string, v interface{}) (time.Duration, bool) {
+	secs, ok := v.(float64)
+	if !ok || secs < 0 {
+		p.unsupported(path, "expected a number of seconds")
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+func (p *keaParser) server(path string, v interface{}, srv *server, v6 bool) {
+	o := p.object(path, v)
+	subnetKey := "subnet4"
+	if v6 {
+		subnetKey = "subnet6"
+	}
+	for _, key := range sortedKeys(o) {
+		kpath := path + "/" + key
+		val := o[key]
+		switch key {
+		case "interfaces-config":
+			p.interfaces(kpath, val, srv)
+		case "valid-lifetime":
+			if lt, ok := p.lifetime(kpath, val); ok {
+				srv.leaseTime = lt
+			}
+		case "preferred-lifetime":
+			if !v6 {
+				p.unsupported(kpath, "only supported for DHCPv6")
+			} else if lt, ok := p.lifetime(kpath, val); ok {
+				srv.preferredLifetime = lt
+			}
+		case "option-data":
+			p.optionData(kpath, val, srv, &srv.options, v6)
+		case "next-server", "boot-file-name":
+			p.bootOption(kpath, key, val, &srv.options, v6)
+		case "reservations":
+			p.reservations(kpath, val, srv, v6)
+		case subnetKey:
+			p.subnets(kpath, val, srv, nil, v6)
+		case "shared-networks":
+			for i, sn := range p.list(kpath, val) {
+				p.sharedNetwork(fmt.Sprintf("%s[%d]", kpath, i), sn, srv, v6)
+			}
+		case "server-id":
+			p.serverID(kpath, val, srv)
+		default:
+			p.unsupported(kpath, "no coredhcp equivalent")
+		}
+	}
+}
+
+func (p *keaParser) interfaces(path string, v interface{}, srv *server) {
+	o := p.object(path, v)
+	for _, key := range sortedKeys(o) {
+		if key != "interfaces" {
+			p.unsupported(path+"/"+key, "no coredhcp equivalent")
+			continue
+		}
+		for i, iface := range p.list(path+"/"+key, o[key]) {
+			name, ok := p.str(fmt.Sprintf("%s/%s[%d]", path, key, i), iface)
+			if !ok {
+				continue
+			}
+			if name == "*" {
+				// listening everywhere is the default
+				continue
+			}
+			// Kea accepts interface/address to bind to a specific address
+			if idx := strings.IndexByte(name, '/'); idx >= 0 {
+				p.unsupported(path+"/"+key, fmt.Sprintf("only listening on interface %s, not on address %s", name[:idx], name[idx+1:]))
+				name = name[:idx]
+			}
+			srv.interfaces = append(srv.interfaces, name)
+		}
+	}
+}
+
+func (p *keaParser) serverID(path string, v interface{}, srv *server) {
+	o := p.object(path, v)
+	if t, _ := o["type"].(string); t != "LL" && t != "LLT" {
+		p.unsupported(path, "only LL and LLT server DUIDs are supported")
+		return
+	}
+	id, _ := o["identifier"].(string)
+	mac, err := hex.DecodeString(strings.ReplaceAll(id, ":", ""))
+	if err != nil || len(mac) != 6 {
+		p.unsupported(path, "only DUIDs with an ethernet address identifier are supported")
+		return
+	}
+	srv.serverID = net.HardwareAddr(mac).String()
+}
+
+func (p *keaParser) bootOption(path, key string, v interface{}, opts *options, v6 bool) {
+	s, ok := p.str(path, v)
+	if !ok {
+		return
+	}
+	if v6 {
+		p.unsupported(path, "only supported for DHCPv4")
+		return
+	}
+	if key == "boot-file-name" {
+		opts.bootFile = s
+	} else if ip := net.ParseIP(s).To4(); ip != nil {
+		opts.nextServer = ip
+	} else {
+		p.unsupported(path, "invalid IPv4 address")
+	}
+}
+
+func (p *keaParser) optionData(path string, v interface{}, srv *server, opts *options, v6 bool) {
+	for i, entry := range p.list(path, v) {
+		epath := fmt.Sprintf("%s[%d]", path, i)
+		o := p.object(epath, entry)
+		if o == nil {
+			continue
+		}
+		name, _ := o["name"].(string)
+		data, _ := o["data"].(string)
+		if name == "" {
+			p.unsupported(epath, "options without a name are not supported")
+			continue
+		}
+		if csv, ok := o["csv-format"].(bool); ok && !csv {
+			p.unsupported(epath, fmt.Sprintf("option %s: binary option data is not supported", name))
+			continue
+		}
+		if space, ok := o["space"].(string); ok && space != "dhcp4" && space != "dhcp6" {
+			p.unsupported(epath, fmt.Sprintf("option %s: option space %s is not supported", name, space))
+			continue
+		}
+		var values []string
+		for _, val := range strings.Split(data, ",") {
+			if val = strings.TrimSpace(val); val != "" {
+				values = append(values, val)
+			}
+		}
+		if len(values) == 0 {
+			p.unsupported(epath, fmt.Sprintf("option %s has no data", name))
+			continue
+		}
+		if err := setOption(srv, opts, name, values, v6); err != nil {
+			p.unsupported(epath, fmt.Sprintf("option %s: %v", name, err))
+		}
+	}
+}
+
+func (p *keaParser) sharedNetwork(path string, v interface{}, srv *server, v6 bool) {
+	o := p.object(path, v)
+	subnetKey := "subnet4"
+	if v6 {
+		subnetKey = "subnet6"
+	}
+	// options of the shared network apply to all its subnets
+	var shared options
+	for _, key := range sortedKeys(o) {
+		kpath := path + "/" + key
+		switch key {
+		case "name":
+		case "option-data":
+			p.optionData(kpath, o[key], srv, &shared, v6)
+		case "next-server", "boot-file-name":
+			p.bootOption(kpath, key, o[key], &shared, v6)
+		case subnetKey:
+		default:
+			p.unsupported(kpath, "no coredhcp equivalent")
+		}
+	}
+	if subnets, ok := o[subnetKey]; ok {
+		p.subnets(path+"/"+subnetKey, subnets, srv, &shared, v6)
+	}
+}
+
+func (p *keaParser) subnets(path string, v interface{}, srv *server, shared *options, v6 bool) {
+	for i, entry := range p.list(path, v) {
+		spath := fmt.Sprintf("%s[%d]", path, i)
+		o := p.object(spath, entry)
+		if o == nil {
+			continue
+		}
+		cidr, _ := o["subnet"].(string)
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err != nil || (prefix.IP.To4() == nil) != v6 {
+			p.unsupported(spath, "missing or invalid subnet prefix")
+			continue
+		}
+		sub := subnet{prefix: prefix}
+		for _, key := range sortedKeys(o) {
+			kpath := spath + "/" + key
+			val := o[key]
+			switch key {
+			case "subnet", "id":
+			case "pools":
+				p.pools(kpath, val, &sub)
+			case "pd-pools":
+				p.pdPools(kpath, val, &sub)
+			case "option-data":
+				p.optionData(kpath, val, srv, &sub.options, v6)
+			case "next-server", "boot-file-name":
+				p.bootOption(kpath, key, val, &sub.options, v6)
+			case "valid-lifetime":
+				if lt, ok := p.lifetime(kpath, val); ok {
+					sub.leaseTime = lt
+				}
+			case "preferred-lifetime":
+				if !v6 {
+					p.unsupported(kpath, "only supported for DHCPv6")
+				} else if lt, ok := p.lifetime(kpath, val); ok {
+					sub.preferredLifetime = lt
+				}
+			case "reservations":
+				p.reservations(kpath, val, srv, v6)
+			case "interface":
+				if name, ok := p.str(kpath, val); ok {
+					srv.interfaces = append(srv.interfaces, name)
+				}
+			default:
+				p.unsupported(kpath, "no coredhcp equivalent")
+			}
+		}
+		if shared != nil {
+			sub.options.merge(shared)
+		}
+		srv.subnets = append(srv.subnets, &sub)
+	}
+}
+
+func (p *keaParser) pools(path string, v interface{}, sub *subnet) {
+	for i, entry := range p.list(path, v) {
+		ppath := fmt.Sprintf("%s[%d]", path, i)
+		o := p.object(ppath, entry)
+		if o == nil {
+			continue
+		}
+		for _, key := range sortedKeys(o) {
+			if key != "pool" {
+				p.unsupported(ppath+"/"+key, "no coredhcp equivalent for pool settings")
+			}
+		}
+		spec, _ := o["pool"].(string)
+		var r ipRange
+		if _, prefix, err := net.ParseCIDR(strings.TrimSpace(spec)); err == nil {
+			r = prefixRange(prefix)
+		} else if bounds := strings.Split(spec, "-"); len(bounds) == 2 {
+			r.start = net.ParseIP(strings.TrimSpace(bounds[0]))
+			r.end = net.ParseIP(strings.TrimSpace(bounds[1]))
+		}
+		if r.start == nil || r.end == nil {
+			p.unsupported(ppath, fmt.Sprintf("invalid pool %q", spec))
+			continue
+		}
+		sub.pools = append(sub.pools, r)
+	}
+}
+
+func (p *keaParser) pdPools(path string, v interface{}, sub *subnet) {
+	for i, entry := range p.list(path, v) {
+		ppath := fmt.Sprintf("%s[%d]", path, i)
+		o := p.object(ppath, entry)
+		if o == nil {
+			continue
+		}
+		for _, key := range sortedKeys(o) {
+			if key != "prefix" && key != "prefix-len" && key != "delegated-len" {
+				p.unsupported(ppath+"/"+key, "no coredhcp equivalent for prefix delegation pool settings")
+			}
+		}
+		prefix, _ := o["prefix"].(string)
+		prefixLen, _ := o["prefix-len"].(float64)
+		delegatedLen, _ := o["delegated-len"].(float64)
+		_, pool, err := net.ParseCIDR(fmt.Sprintf("%s/%d", prefix, int(prefixLen)))
+		if err != nil || delegatedLen < prefixLen || delegatedLen > 128 {
+			p.unsupported(ppath, "invalid prefix delegation pool")
+			continue
+		}
+		sub.delegations = append(sub.delegations, delegation{prefix: pool, size: int(delegatedLen)})
+	}
+}
+
+func (p *keaParser) reservations(path string, v interface{}, srv *server, v6 bool) {
+	for i, entry := range p.list(path, v) {
+		rpath := fmt.Sprintf("%s[%d]", path, i)
+		o := p.object(rpath, entry)
+		if o == nil {
+			continue
+		}
+		var res reservation
+		for _, key := range sortedKeys(o) {
+			kpath := rpath + "/" + key
+			val := o[key]
+			switch {
+			case key == "hostname":
+				res.name, _ = p.str(kpath, val)
+			case key == "hw-address":
+				s, _ := p.str(kpath, val)
+				mac, err := net.ParseMAC(s)
+				if err != nil {
+					p.unsupported(kpath, "invalid hardware address")
+					continue
+				}
+				res.mac = mac
+			case key == "ip-address" && !v6:
+				s, _ := p.str(kpath, val)
+				if res.ip = net.ParseIP(s).To4(); res.ip == nil {
+					p.unsupported(kpath, "invalid IPv4 address")
+				}
+			case key == "ip-addresses" && v6:
+				addrs := p.list(kpath, val)
+				if len(addrs) != 1 {
+					p.unsupported(kpath, "only a single address per reservation is supported")
+				}
+				if len(addrs) > 0 {
+					s, _ := addrs[0].(string)
+					if res.ip = net.ParseIP(s); res.ip == nil || res.ip.To4() != nil {
+						p.unsupported(kpath, "invalid IPv6 address")
+						res.ip = nil
+					}
+				}
+			case key == "duid" || key == "client-id" || key == "circuit-id" || key == "flex-id":
+				p.unsupported(kpath, "only reservations by hw-address are supported")
+			default:
+				p.unsupported(kpath, "no coredhcp equivalent in a reservation")
+			}
+		}
+		if res.mac == nil || res.ip == nil {
+			p.unsupported(rpath, "reservations need both a hw-address and an address")
+			continue
+		}
+		srv.reservations = append(srv.reservations, res)
+	}
+}
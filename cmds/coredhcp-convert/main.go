@@ -0,0 +1,89 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// coredhcp-convert translates an ISC dhcpd.conf or a Kea JSON configuration
+// into a coredhcp configuration file, along with the lease files for the file
+// plugin holding the host reservations. Every construct that could not be
+// translated is reported on stderr.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+var (
+	flagFormat = flag.StringP("format", "f", "", "Input format, dhcpd or kea. Default: guessed from the content")
+	flagOutDir = flag.StringP("outdir", "o", ".", "Directory to write the configuration and lease files to")
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(),
+		"%s [-format dhcpd|kea] [-outdir dir] <config file>\n",
+		os.Args[0],
+	)
+	flag.PrintDefaults()
+}
+
+// detectFormat guesses the input format: Kea configurations are JSON objects
+func detectFormat(data string) string {
+	if strings.HasPrefix(strings.TrimSpace(stripComments(data)), "{") {
+		return "kea"
+	}
+	return "dhcpd"
+}
+
+func convert(data, format string) (*conversion, error) {
+	if format == "" {
+		format = detectFormat(data)
+	}
+	switch format {
+	case "dhcpd":
+		return parseDHCPD(data)
+	case "kea":
+		return parseKea(data)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	data, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to read configuration: %v", err)
+	}
+	conv, err := convert(string(data), *flagFormat)
+	if err != nil {
+		log.Fatalf("Failed to parse %s: %v", flag.Arg(0), err)
+	}
+	if conv.v4 == nil && conv.v6 == nil {
+		log.Fatalf("No DHCPv4 or DHCPv6 configuration found in %s", flag.Arg(0))
+	}
+	for _, out := range conv.emit() {
+		name := path.Join(*flagOutDir, out.name)
+		if err := ioutil.WriteFile(name, []byte(out.data), 0644); err != nil {
+			log.Fatalf("Failed to write %s: %v", name, err)
+		}
+		log.Printf("Generated %s", name)
+	}
+	if len(conv.untranslated) > 0 {
+		fmt.Fprintf(os.Stderr, "The following could not be translated:\n")
+		for _, msg := range conv.untranslated {
+			fmt.Fprintf(os.Stderr, "  %s\n", msg)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// The parsers for both input formats fill in this intermediate representation,
+// which holds the subset of the configuration that has a coredhcp equivalent.
+
+// ipRange is an inclusive range of addresses
+type ipRange struct {
+	start, end net.IP
+}
+
+// delegation is a pool of prefixes for prefix delegation
+type delegation struct {
+	prefix *net.IPNet
+	// size of the delegated prefixes
+	size int
+}
+
+// reservation is a fixed address for a given host
+type reservation struct {
+	name string
+	mac  net.HardwareAddr
+	ip   net.IP
+}
+
+// options holds the DHCP options that map to a coredhcp plugin. Only the
+// first value found for each option is kept.
+type options struct {
+	routers       []net.IP
+	dns           []net.IP
+	netmask       net.IPMask
+	searchDomains []string
+	mtu           int
+	// nextServer and bootFile are translated to an NBP URL
+	nextServer net.IP
+	bootFile   string
+	bootURL    string
+}
+
+// merge fills in the options unset in o from the ones in parent
+func (o *options) merge(parent *options) {
+	if o.routers == nil {
+		o.routers = parent.routers
+	}
+	if o.dns == nil {
+		o.dns = parent.dns
+	}
+	if o.netmask == nil {
+		o.netmask = parent.netmask
+	}
+	if o.searchDomains == nil {
+		o.searchDomains = parent.searchDomains
+	}
+	if o.mtu == 0 {
+		o.mtu = parent.mtu
+	}
+	if o.nextServer == nil {
+		o.nextServer = parent.nextServer
+	}
+	if o.bootFile == "" {
+		o.bootFile = parent.bootFile
+	}
+	if o.bootURL == "" {
+		o.bootURL = parent.bootURL
+	}
+}
+
+type subnet struct {
+	prefix      *net.IPNet
+	pools       []ipRange
+	delegations []delegation
+	options     options
+	leaseTime   time.Duration
+	// preferredLifetime only applies to DHCPv6
+	preferredLifetime time.Duration
+}
+
+// server is the configuration for one protocol version
+type server struct {
+	// interfaces to listen on, if specified
+	interfaces []string
+	// serverID is an IPv4 address for DHCPv4, or a MAC for a DHCPv6 DUID-LL
+	serverID  string
+	leaseTime time.Duration
+	// preferredLifetime only applies to DHCPv6
+	preferredLifetime time.Duration
+	options           options
+	subnets           []*subnet
+	reservations      []reservation
+}
+
+// conversion is the result of parsing an input file
+type conversion struct {
+	v4, v6 *server
+	// untranslated lists the constructs that have no coredhcp equivalent
+	untranslated []string
+}
+
+func (c *conversion) report(format string, args ...interface{}) {
+	c.untranslated = append(c.untranslated, fmt.Sprintf(format, args...))
+}
+
+func (c *conversion) server4() *server {
+	if c.v4 == nil {
+		c.v4 = &server{}
+	}
+	return c.v4
+}
+
+func (c *conversion) server6() *server {
+	if c.v6 == nil {
+		c.v6 = &server{}
+	}
+	return c.v6
+}
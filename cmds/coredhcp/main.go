@@ -18,6 +18,7 @@ import (
 
 	"github.com/coredhcp/coredhcp/plugins"
 	pl_dns "github.com/coredhcp/coredhcp/plugins/dns"
+	pl_exec "github.com/coredhcp/coredhcp/plugins/exec"
 	pl_file "github.com/coredhcp/coredhcp/plugins/file"
 	pl_leasetime "github.com/coredhcp/coredhcp/plugins/leasetime"
 	pl_mtu "github.com/coredhcp/coredhcp/plugins/mtu"
@@ -25,11 +26,13 @@ import (
 	pl_netmask "github.com/coredhcp/coredhcp/plugins/netmask"
 	pl_prefix "github.com/coredhcp/coredhcp/plugins/prefix"
 	pl_range "github.com/coredhcp/coredhcp/plugins/range"
+	pl_range6 "github.com/coredhcp/coredhcp/plugins/range6"
 	pl_router "github.com/coredhcp/coredhcp/plugins/router"
 	pl_searchdomains "github.com/coredhcp/coredhcp/plugins/searchdomains"
 	pl_serverid "github.com/coredhcp/coredhcp/plugins/serverid"
 	pl_sleep "github.com/coredhcp/coredhcp/plugins/sleep"
 	pl_staticroute "github.com/coredhcp/coredhcp/plugins/staticroute"
+	pl_temporary "github.com/coredhcp/coredhcp/plugins/temporary"
 
 	"github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
@@ -40,7 +43,7 @@ var (
 	flagLogNoStdout = flag.BoolP("nostdout", "N", false, "Disable logging to stdout/stderr")
 	flagLogLevel    = flag.StringP("loglevel", "L", "info", fmt.Sprintf("Log level. One of %v", getLogLevels()))
 	flagConfig      = flag.StringP("conf", "c", "", "Use this configuration file instead of the default location")
-	flagPlugins     = flag.BoolP("plugins", "P", false, "list plugins")
+	flagPlugins     = flag.BoolP("plugins", "P", false, "list plugins, or show the usage of the plugins given as arguments")
 )
 
 var logLevels = map[string]func(*logrus.Logger){
@@ -62,6 +65,7 @@ func getLogLevels() []string {
 
 var desiredPlugins = []*plugins.Plugin{
 	&pl_dns.Plugin,
+	&pl_exec.Plugin,
 	&pl_file.Plugin,
 	&pl_leasetime.Plugin,
 	&pl_mtu.Plugin,
@@ -69,21 +73,49 @@ var desiredPlugins = []*plugins.Plugin{
 	&pl_netmask.Plugin,
 	&pl_prefix.Plugin,
 	&pl_range.Plugin,
+	&pl_range6.Plugin,
 	&pl_router.Plugin,
 	&pl_searchdomains.Plugin,
 	&pl_serverid.Plugin,
 	&pl_sleep.Plugin,
 	&pl_staticroute.Plugin,
+	&pl_temporary.Plugin,
+}
+
+// showUsage prints the usage of the named plugins, and returns the exit code
+func showUsage(names []string) int {
+	code := 0
+	for i, name := range names {
+		var found *plugins.Plugin
+		for _, p := range desiredPlugins {
+			if p.Name == name {
+				found = p
+			}
+		}
+		if found == nil {
+			fmt.Fprintf(os.Stderr, "Unknown plugin '%s'\n", name)
+			code = 1
+			continue
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Print(plugins.Usage(found))
+	}
+	return code
 }
 
 func main() {
 	flag.Parse()
 
 	if *flagPlugins {
-		for _, p := range desiredPlugins {
-			fmt.Println(p.Name)
+		if flag.NArg() == 0 {
+			for _, p := range desiredPlugins {
+				fmt.Println(p.Name)
+			}
+			os.Exit(0)
 		}
-		os.Exit(0)
+		os.Exit(showUsage(flag.Args()))
 	}
 
 	log := logger.GetLogger("main")
@@ -106,14 +138,15 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 	// register plugins
+	registry := plugins.NewRegistry()
 	for _, plugin := range desiredPlugins {
-		if err := plugins.RegisterPlugin(plugin); err != nil {
+		if err := registry.Register(plugin); err != nil {
 			log.Fatalf("Failed to register plugin '%s': %v", plugin.Name, err)
 		}
 	}
 
 	// start server
-	srv, err := server.Start(config)
+	srv, err := server.Start(registry, config)
 	if err != nil {
 		log.Fatal(err)
 	}
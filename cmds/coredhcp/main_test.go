@@ -0,0 +1,40 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConfigExample checks that the example configuration loads, and only
+// uses plugins built in with valid arguments
+func TestConfigExample(t *testing.T) {
+	conf, err := config.Load("config.yml.example")
+	require.NoError(t, err)
+	require.NotNil(t, conf.Server6)
+	require.NotNil(t, conf.Server4)
+
+	registry := plugins.NewRegistry()
+	for _, p := range desiredPlugins {
+		require.NoError(t, registry.Register(p))
+	}
+	check := func(pluginConfs []config.PluginConfig, spec func(*plugins.Plugin) *plugins.ArgSpec) {
+		for _, pc := range pluginConfs {
+			p, ok := registry.Lookup(pc.Name)
+			if !assert.True(t, ok, "unknown plugin %s", pc.Name) {
+				continue
+			}
+			_, err := spec(p).Check(pc.Args)
+			assert.NoError(t, err, "arguments of %s", pc.Name)
+		}
+	}
+	check(conf.Server6.Plugins, func(p *plugins.Plugin) *plugins.ArgSpec { return p.Args6 })
+	check(conf.Server4.Plugins, func(p *plugins.Plugin) *plugins.ArgSpec { return p.Args4 })
+}
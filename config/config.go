@@ -5,6 +5,7 @@
 package config
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
@@ -44,14 +45,44 @@ func New() *Config {
 type ServerConfig struct {
 	Addresses []net.UDPAddr
 	Plugins   []PluginConfig
+	// Classes maps client class names to their match expressions, see the
+	// classify package for their syntax
+	Classes map[string][]string
+	// Lenient turns the violations of the plugin ordering constraints into
+	// warnings instead of errors
+	Lenient bool
+	// Trace selects the requests for which each step of the plugin chain is
+	// logged
+	Trace TraceConfig
+}
+
+// TraceConfig selects the requests to trace
+type TraceConfig struct {
+	// All traces every request
+	All bool
+	// Clients lists the hardware addresses or DUIDs of the clients to trace,
+	// as raw bytes
+	Clients [][]byte
+}
+
+// Enabled returns whether any request can be traced
+func (t TraceConfig) Enabled() bool {
+	return t.All || len(t.Clients) > 0
 }
 
 // PluginConfig holds the configuration of a plugin
 type PluginConfig struct {
 	Name string
 	Args []string
+	// Classes restricts the plugin to requests belonging to at least one of
+	// these client classes. If empty, the plugin applies to all requests
+	Classes []string
 }
 
+// classesKey is the key that can be set next to a plugin name in a plugin
+// entry, to restrict it to some client classes. No plugin can use this name
+const classesKey = "classes"
+
 // Load reads a configuration file and returns a Config object, or an error if
 // any.
 func Load(pathOverride string) (*Config, error) {
@@ -97,6 +128,11 @@ func parsePlugins(pluginList []interface{}) ([]PluginConfig, error) {
 		if conf == nil {
 			return nil, ConfigErrorFromString("dhcpv6: plugin #%d is not a string map", idx)
 		}
+		var classes []string
+		if v, ok := conf[classesKey]; ok {
+			classes = toStringList(v)
+			delete(conf, classesKey)
+		}
 		// make sure that only one item is specified, since it's a
 		// map name -> args
 		if len(conf) != 1 {
@@ -112,11 +148,27 @@ func parsePlugins(pluginList []interface{}) ([]PluginConfig, error) {
 			args = strings.Fields(cast.ToString(v))
 			break
 		}
-		plugins = append(plugins, PluginConfig{Name: name, Args: args})
+		plugins = append(plugins, PluginConfig{Name: name, Args: args, Classes: classes})
 	}
 	return plugins, nil
 }
 
+// toStringList reads a list of names that is either a list of strings, or a
+// single string of whitespace-separated words. Names are lowercased, like all
+// keys in the configuration file
+func toStringList(v interface{}) []string {
+	var list []string
+	if s, ok := v.(string); ok {
+		list = strings.Fields(s)
+	} else {
+		list = cast.ToStringSlice(v)
+	}
+	for i := range list {
+		list[i] = strings.ToLower(list[i])
+	}
+	return list
+}
+
 // BUG(Natolumin): listen specifications of the form `[ip6]%iface:port` or
 // `[ip6]%iface` are not supported, even though they are the default format of
 // the `ss` utility in linux. Use `[ip6%iface]:port` instead
@@ -206,6 +258,69 @@ func (c *Config) getPlugins(ver protocolVersion) ([]PluginConfig, error) {
 	return parsePlugins(pluginList)
 }
 
+// getClasses reads the client class definitions. Each class maps to either a
+// single match expression or a list of them
+func (c *Config) getClasses(ver protocolVersion) (map[string][]string, error) {
+	if err := protoVersionCheck(ver); err != nil {
+		return nil, err
+	}
+	raw := c.v.Get(fmt.Sprintf("server%d.classes", ver))
+	if raw == nil {
+		return nil, nil
+	}
+	defs, err := cast.ToStringMapE(raw)
+	if err != nil {
+		return nil, ConfigErrorFromString("dhcpv%d: invalid classes section, not a map of class names: %v", ver, err)
+	}
+	classes := make(map[string][]string, len(defs))
+	for name, v := range defs {
+		var exprs []string
+		if s, ok := v.(string); ok {
+			exprs = []string{s}
+		} else if exprs, err = cast.ToStringSliceE(v); err != nil {
+			return nil, ConfigErrorFromString("dhcpv%d: class %s is neither a match expression nor a list of them", ver, name)
+		}
+		if len(exprs) == 0 {
+			return nil, ConfigErrorFromString("dhcpv%d: class %s has no match expression", ver, name)
+		}
+		classes[name] = exprs
+	}
+	return classes, nil
+}
+
+// getTrace reads the trace setting, which is either a boolean, "all", or a
+// list of hardware addresses and DUIDs in colon-separated hexadecimal
+func (c *Config) getTrace(ver protocolVersion) (TraceConfig, error) {
+	var trace TraceConfig
+	if err := protoVersionCheck(ver); err != nil {
+		return trace, err
+	}
+	raw := c.v.Get(fmt.Sprintf("server%d.trace", ver))
+	if raw == nil {
+		return trace, nil
+	}
+	if b, ok := raw.(bool); ok {
+		trace.All = b
+		return trace, nil
+	}
+	if s, ok := raw.(string); ok && strings.EqualFold(s, "all") {
+		trace.All = true
+		return trace, nil
+	}
+	clients := toStringList(raw)
+	if len(clients) == 0 {
+		return trace, ConfigErrorFromString("dhcpv%d: invalid trace setting, want true, all, or a list of clients", ver)
+	}
+	for _, client := range clients {
+		id, err := hex.DecodeString(strings.NewReplacer(":", "", "-", "").Replace(client))
+		if err != nil || len(id) == 0 {
+			return trace, ConfigErrorFromString("dhcpv%d: invalid client to trace %q, want a hardware address or a DUID", ver, client)
+		}
+		trace.Clients = append(trace.Clients, id)
+	}
+	return trace, nil
+}
+
 func (c *Config) parseConfig(ver protocolVersion) error {
 	if err := protoVersionCheck(ver); err != nil {
 		return err
@@ -223,6 +338,21 @@ func (c *Config) parseConfig(ver protocolVersion) error {
 		log.Printf("DHCPv%d: found plugin `%s` with %d args: %v", ver, p.Name, len(p.Args), p.Args)
 	}
 
+	classes, err := c.getClasses(ver)
+	if err != nil {
+		return err
+	}
+
+	trace, err := c.getTrace(ver)
+	if err != nil {
+		return err
+	}
+
+	lenient, err := cast.ToBoolE(c.v.Get(fmt.Sprintf("server%d.lenient", ver)))
+	if err != nil {
+		return ConfigErrorFromString("dhcpv%d: invalid lenient setting, not a boolean: %v", ver, err)
+	}
+
 	listeners, err := c.parseListen(ver)
 	if err != nil {
 		return err
@@ -231,6 +361,9 @@ func (c *Config) parseConfig(ver protocolVersion) error {
 	sc := ServerConfig{
 		Addresses: listeners,
 		Plugins:   plugins,
+		Classes:   classes,
+		Lenient:   lenient,
+		Trace:     trace,
 	}
 	if ver == protocolV6 {
 		c.Server6 = &sc
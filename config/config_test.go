@@ -50,3 +50,86 @@ func TestSplitHostPort(t *testing.T) {
 		}
 	}
 }
+
+func TestParsePluginClasses(t *testing.T) {
+	plugins, err := parsePlugins([]interface{}{
+		map[string]interface{}{"dns": "192.0.2.1 192.0.2.2"},
+		map[string]interface{}{"nbp": "tftp://192.0.2.1/pxe", "classes": "PXE ipxe"},
+		map[string]interface{}{"router": "192.0.2.254", "classes": []interface{}{"voip"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plugins) != 3 {
+		t.Fatalf("expected 3 plugins, got %d", len(plugins))
+	}
+	if plugins[0].Name != "dns" || len(plugins[0].Args) != 2 || len(plugins[0].Classes) != 0 {
+		t.Errorf("unexpected unrestricted plugin: %+v", plugins[0])
+	}
+	if plugins[1].Name != "nbp" || len(plugins[1].Classes) != 2 ||
+		plugins[1].Classes[0] != "pxe" || plugins[1].Classes[1] != "ipxe" {
+		t.Errorf("unexpected classes from a string: %+v", plugins[1])
+	}
+	if plugins[2].Name != "router" || len(plugins[2].Classes) != 1 || plugins[2].Classes[0] != "voip" {
+		t.Errorf("unexpected classes from a list: %+v", plugins[2])
+	}
+
+	if _, err := parsePlugins([]interface{}{
+		map[string]interface{}{"classes": "pxe"},
+	}); err == nil {
+		t.Error("a plugin entry with only classes should be rejected")
+	}
+}
+
+func TestParseLenient(t *testing.T) {
+	c := New()
+	c.v.Set("server4", map[string]interface{}{
+		"listen":  []interface{}{"127.0.0.1:67"},
+		"plugins": []interface{}{map[string]interface{}{"range": "leases.txt 10.0.0.1 10.0.0.9 1h"}},
+		"lenient": true,
+	})
+	if err := c.parseConfig(protocolV4); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Server4.Lenient {
+		t.Error("lenient setting was not read")
+	}
+
+	c.v.Set("server4.lenient", nil)
+	if err := c.parseConfig(protocolV4); err != nil {
+		t.Fatal(err)
+	}
+	if c.Server4.Lenient {
+		t.Error("plugin chains should be checked strictly by default")
+	}
+
+	c.v.Set("server4.lenient", "sometimes")
+	if err := c.parseConfig(protocolV4); err == nil {
+		t.Error("a non-boolean lenient setting should be rejected")
+	}
+}
+
+func TestParseTrace(t *testing.T) {
+	c := New()
+	if trace, err := c.getTrace(protocolV4); err != nil || trace.Enabled() {
+		t.Errorf("tracing should be disabled by default, got %+v, %v", trace, err)
+	}
+	for _, all := range []interface{}{true, "all", "ALL"} {
+		c.v.Set("server4.trace", all)
+		if trace, err := c.getTrace(protocolV4); err != nil || !trace.All {
+			t.Errorf("trace: %v should trace all requests, got %+v, %v", all, trace, err)
+		}
+	}
+	c.v.Set("server6.trace", []interface{}{"aa:bb:cc:dd:ee:ff", "00:03:00:01:aa:bb:cc:dd:ee:ff"})
+	trace, err := c.getTrace(protocolV6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.All || len(trace.Clients) != 2 || len(trace.Clients[0]) != 6 || len(trace.Clients[1]) != 10 {
+		t.Errorf("unexpected trace clients: %+v", trace)
+	}
+	c.v.Set("server6.trace", "aa:bb:cc:dd:ee:zz")
+	if _, err := c.getTrace(protocolV6); err == nil {
+		t.Error("an invalid client to trace should be rejected")
+	}
+}
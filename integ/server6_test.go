@@ -59,13 +59,14 @@ func runServer(readyCh chan<- struct{}, nsName string, desiredPlugins []*plugins
 		log.Panicf("Failed to switch to netns `%s`: %v", nsName, err)
 	}
 	// register plugins
+	registry := plugins.NewRegistry()
 	for _, pl := range desiredPlugins {
-		if err := plugins.RegisterPlugin(pl); err != nil {
+		if err := registry.Register(pl); err != nil {
 			log.Panicf("Failed to register plugin `%s`: %v", pl.Name, err)
 		}
 	}
 	// start DHCP server
-	srv, err := server.Start(&serverConfig)
+	srv, err := server.Start(registry, &serverConfig)
 	if err != nil {
 		log.Panicf("Server could not start: %v", err)
 	}
@@ -33,6 +33,15 @@ type Allocator interface {
 	Free(net.IPNet) error
 }
 
+// KeyedAllocator is an Allocator that can choose the address of a client
+// from an identifier of the client
+type KeyedAllocator interface {
+	Allocator
+
+	// AllocateKey is like Allocate, for the client identified by key
+	AllocateKey(key []byte, hint net.IPNet) (net.IPNet, error)
+}
+
 // ErrDoubleFree is an error type returned by Allocator.Free() when a
 // non-allocated block is passed
 type ErrDoubleFree struct {
@@ -85,6 +85,40 @@ func (a *IPv4Allocator) Allocate(hint net.IPNet) (n net.IPNet, err error) {
 	return
 }
 
+// allocateExact reserves the given IP if it is in range and free
+func (a *IPv4Allocator) allocateExact(ip net.IP) (net.IPNet, bool) {
+	offset, err := a.toOffset(ip)
+	if err != nil {
+		return net.IPNet{}, false
+	}
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	if a.bitmap.Test(offset) {
+		return net.IPNet{}, false
+	}
+	a.bitmap.Set(offset)
+	return net.IPNet{IP: a.toIP(uint32(offset)), Mask: net.CIDRMask(32, 32)}, true
+}
+
+// allocateNext reserves the first free IP among the limit ones starting at
+// the given offset. If there is none, it returns how many were scanned.
+func (a *IPv4Allocator) allocateNext(offset uint, limit uint64) (net.IPNet, uint64, bool) {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	size := uint64(a.end-a.start) + 1
+	if next, ok := a.bitmap.NextClear(offset); ok && uint64(next-offset) < limit {
+		a.bitmap.Set(next)
+		return net.IPNet{IP: a.toIP(uint32(next)), Mask: net.CIDRMask(32, 32)}, 0, true
+	}
+	if scanned := size - uint64(offset); scanned < limit {
+		return net.IPNet{}, scanned, false
+	}
+	return net.IPNet{}, limit, false
+}
+
 // Free releases the given IP
 func (a *IPv4Allocator) Free(n net.IPNet) error {
 	offset, err := a.toOffset(n.IP)
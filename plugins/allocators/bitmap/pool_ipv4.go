@@ -0,0 +1,226 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package bitmap
+
+// This allocator gives out IPv4 addresses from several ranges, minus some
+// excluded addresses. The ranges are split around the exclusions into
+// contiguous segments, each tracked by an IPv4Allocator, so that excluded
+// addresses can neither be allocated nor freed.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// IPv4Range is a range of IPv4 addresses, bounds included
+type IPv4Range struct {
+	Start net.IP
+	End   net.IP
+}
+
+// String returns the range as `start-end`
+func (r IPv4Range) String() string {
+	return fmt.Sprintf("%s-%s", r.Start, r.End)
+}
+
+// span is a range of addresses as integers
+type span struct {
+	start, end uint32
+}
+
+func toSpan(r IPv4Range) (span, error) {
+	if r.Start.To4() == nil || r.End.To4() == nil {
+		return span{}, fmt.Errorf("invalid IPv4 range %s", r)
+	}
+	s := span{binary.BigEndian.Uint32(r.Start.To4()), binary.BigEndian.Uint32(r.End.To4())}
+	if s.start > s.end {
+		return span{}, fmt.Errorf("start of IP range %s is after its end", r)
+	}
+	return s, nil
+}
+
+// IPv4PoolAllocator allocates IPv4 addresses from several ranges. Addresses
+// are allocated in the order of the ranges, and within each range in order.
+type IPv4PoolAllocator struct {
+	// segments are sorted and don't overlap
+	segments []*IPv4Allocator
+}
+
+// NewIPv4PoolAllocator creates an allocator for the addresses of the ranges
+// that are not excluded. Ranges can't overlap, exclusions can be anywhere.
+func NewIPv4PoolAllocator(ranges, excluded []IPv4Range) (*IPv4PoolAllocator, error) {
+	var spans, holes []span
+	for _, r := range ranges {
+		s, err := toSpan(r)
+		if err != nil {
+			return nil, err
+		}
+		spans = append(spans, s)
+	}
+	for _, r := range excluded {
+		s, err := toSpan(r)
+		if err != nil {
+			return nil, err
+		}
+		holes = append(holes, s)
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	sort.Slice(holes, func(i, j int) bool { return holes[i].start < holes[j].start })
+	for i := 1; i < len(spans); i++ {
+		if spans[i].start <= spans[i-1].end {
+			return nil, fmt.Errorf("IP ranges %s and %s overlap", toRange(spans[i-1]), toRange(spans[i]))
+		}
+	}
+
+	a := &IPv4PoolAllocator{}
+	for _, s := range spans {
+		for _, seg := range subtract(s, holes) {
+			alloc, err := NewIPv4Allocator(toRange(seg).Start, toRange(seg).End)
+			if err != nil {
+				return nil, err
+			}
+			a.segments = append(a.segments, alloc)
+		}
+	}
+	if len(a.segments) == 0 {
+		return nil, errors.New("no IPs in the given ranges to allocate")
+	}
+	return a, nil
+}
+
+// subtract returns the parts of a span outside of the sorted holes
+func subtract(s span, holes []span) []span {
+	var segs []span
+	next := uint64(s.start)
+	for _, h := range holes {
+		if h.end < s.start || h.start > s.end {
+			continue
+		}
+		if uint64(h.start) > next {
+			segs = append(segs, span{uint32(next), h.start - 1})
+		}
+		if uint64(h.end)+1 > next {
+			next = uint64(h.end) + 1
+		}
+	}
+	if next <= uint64(s.end) {
+		segs = append(segs, span{uint32(next), s.end})
+	}
+	return segs
+}
+
+func toRange(s span) IPv4Range {
+	r := IPv4Range{Start: make(net.IP, net.IPv4len), End: make(net.IP, net.IPv4len)}
+	binary.BigEndian.PutUint32(r.Start, s.start)
+	binary.BigEndian.PutUint32(r.End, s.end)
+	return r
+}
+
+// segment returns the segment holding an address, if any
+func (a *IPv4PoolAllocator) segment(ip net.IP) *IPv4Allocator {
+	if i := a.index(ip); i >= 0 {
+		return a.segments[i]
+	}
+	return nil
+}
+
+// index returns the index of the segment holding an address, or -1
+func (a *IPv4PoolAllocator) index(ip net.IP) int {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return -1
+	}
+	n := binary.BigEndian.Uint32(ip4)
+	i := sort.Search(len(a.segments), func(i int) bool { return a.segments[i].end >= n })
+	if i < len(a.segments) && a.segments[i].start <= n {
+		return i
+	}
+	return -1
+}
+
+// Size returns the number of addresses the allocator can allocate
+func (a *IPv4PoolAllocator) Size() uint64 {
+	var n uint64
+	for _, seg := range a.segments {
+		n += uint64(seg.end-seg.start) + 1
+	}
+	return n
+}
+
+// Address returns the address at a position in the pool, counting the
+// addresses of the ranges in order, modulo the size of the pool
+func (a *IPv4PoolAllocator) Address(i uint64) net.IP {
+	i %= a.Size()
+	for _, seg := range a.segments {
+		if size := uint64(seg.end-seg.start) + 1; i >= size {
+			i -= size
+			continue
+		}
+		return seg.toIP(uint32(i))
+	}
+	panic("BUG: position out of bounds")
+}
+
+// AllocateNear reserves the first free address among the n ones starting at
+// the given address, in the order of Address and wrapping around to the
+// start of the pool
+func (a *IPv4PoolAllocator) AllocateNear(ip net.IP, n uint64) (net.IPNet, error) {
+	i := a.index(ip)
+	if i < 0 {
+		return net.IPNet{}, errNotInRange
+	}
+	offset, _ := a.segments[i].toOffset(ip)
+	if size := a.Size(); n > size {
+		n = size
+	}
+	for n > 0 {
+		r, scanned, ok := a.segments[i].allocateNext(offset, n)
+		if ok {
+			return r, nil
+		}
+		n -= scanned
+		i = (i + 1) % len(a.segments)
+		offset = 0
+	}
+	return net.IPNet{}, allocators.ErrNoAddrAvail
+}
+
+// Contains returns whether an address can be allocated by the allocator
+func (a *IPv4PoolAllocator) Contains(ip net.IP) bool {
+	return a.segment(ip) != nil
+}
+
+// Allocate reserves an IP for a client, the hinted one if it is free
+func (a *IPv4PoolAllocator) Allocate(hint net.IPNet) (net.IPNet, error) {
+	if seg := a.segment(hint.IP); seg != nil {
+		if n, ok := seg.allocateExact(hint.IP); ok {
+			return n, nil
+		}
+	}
+	for _, seg := range a.segments {
+		n, err := seg.Allocate(net.IPNet{})
+		if err == nil {
+			return n, nil
+		}
+		if err != allocators.ErrNoAddrAvail {
+			return n, err
+		}
+	}
+	return net.IPNet{}, allocators.ErrNoAddrAvail
+}
+
+// Free releases the given IP
+func (a *IPv4PoolAllocator) Free(n net.IPNet) error {
+	seg := a.segment(n.IP)
+	if seg == nil {
+		return errNotInRange
+	}
+	return seg.Free(n)
+}
@@ -0,0 +1,69 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package bitmap
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ipv4Range(start, end string) IPv4Range {
+	return IPv4Range{Start: net.ParseIP(start), End: net.ParseIP(end)}
+}
+
+func TestPoolAllocator(t *testing.T) {
+	alloc, err := NewIPv4PoolAllocator(
+		[]IPv4Range{ipv4Range("192.0.2.10", "192.0.2.15"), ipv4Range("192.0.2.0", "192.0.2.3")},
+		[]IPv4Range{ipv4Range("192.0.2.1", "192.0.2.1"), ipv4Range("192.0.2.12", "192.0.2.20")},
+	)
+	require.NoError(t, err)
+
+	var got []string
+	for {
+		n, err := alloc.Allocate(net.IPNet{})
+		if err == allocators.ErrNoAddrAvail {
+			break
+		}
+		require.NoError(t, err)
+		got = append(got, n.IP.String())
+	}
+	assert.Equal(t, []string{"192.0.2.0", "192.0.2.2", "192.0.2.3", "192.0.2.10", "192.0.2.11"}, got)
+
+	// excluded addresses can't be freed or allocated
+	assert.Error(t, alloc.Free(net.IPNet{IP: net.ParseIP("192.0.2.1")}))
+	assert.False(t, alloc.Contains(net.ParseIP("192.0.2.12")))
+	assert.True(t, alloc.Contains(net.ParseIP("192.0.2.11")))
+	assert.NoError(t, alloc.Free(net.IPNet{IP: net.ParseIP("192.0.2.11")}))
+	var dfree *allocators.ErrDoubleFree
+	assert.ErrorAs(t, alloc.Free(net.IPNet{IP: net.ParseIP("192.0.2.11")}), &dfree)
+	require.NoError(t, alloc.Free(net.IPNet{IP: net.ParseIP("192.0.2.2")}))
+
+	// hints are honored in any range
+	n, err := alloc.Allocate(net.IPNet{IP: net.ParseIP("192.0.2.11")})
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.11", n.IP.String())
+	n, err = alloc.Allocate(net.IPNet{IP: net.ParseIP("192.0.2.1")})
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.2", n.IP.String())
+}
+
+func TestPoolAllocatorErrors(t *testing.T) {
+	for _, tc := range []struct {
+		ranges, excluded []IPv4Range
+	}{
+		{ranges: nil},
+		{ranges: []IPv4Range{ipv4Range("192.0.2.10", "192.0.2.0")}},
+		{ranges: []IPv4Range{ipv4Range("192.0.2.0", "192.0.2.10"), ipv4Range("192.0.2.10", "192.0.2.20")}},
+		{ranges: []IPv4Range{ipv4Range("2001:db8::", "2001:db8::1")}},
+		{ranges: []IPv4Range{ipv4Range("192.0.2.0", "192.0.2.10")}, excluded: []IPv4Range{ipv4Range("192.0.1.0", "192.0.3.0")}},
+	} {
+		_, err := NewIPv4PoolAllocator(tc.ranges, tc.excluded)
+		assert.Error(t, err, tc)
+	}
+}
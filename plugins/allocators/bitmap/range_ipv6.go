@@ -0,0 +1,122 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package bitmap
+
+// This allocator hands out single IPv6 addresses from a range, which unlike
+// the prefix Allocator doesn't have to be aligned on a prefix. Offsets in
+// the range are computed with the allocators helpers.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/bits-and-blooms/bitset"
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// maxIPv6Range is the size of the largest range of IPv6 addresses the
+// allocator can track
+const maxIPv6Range = 1 << 32
+
+// IPv6RangeAllocator allocates single IPv6 addresses from a range
+type IPv6RangeAllocator struct {
+	start net.IP
+	size  uint64
+
+	bitmap *bitset.BitSet
+	l      sync.Mutex
+}
+
+// NewIPv6RangeAllocator creates an allocator for the addresses from start to
+// end, both included
+func NewIPv6RangeAllocator(start, end net.IP) (*IPv6RangeAllocator, error) {
+	if start.To16() == nil || start.To4() != nil || end.To16() == nil || end.To4() != nil {
+		return nil, fmt.Errorf("invalid IPv6 addresses given to create the allocator: [%s,%s]", start, end)
+	}
+	if bytes.Compare(start.To16(), end.To16()) > 0 {
+		return nil, errors.New("no IPs in the given range to allocate")
+	}
+	distance, err := allocators.Offset(end.To16(), start.To16(), 128)
+	if err != nil || distance >= maxIPv6Range {
+		return nil, fmt.Errorf("the range [%s,%s] has more than 2^32 addresses, use a smaller one", start, end)
+	}
+	if distance >= 1<<24 {
+		log.Warningf("Using a range of %d addresses may result in large memory consumption", distance+1)
+	}
+	return &IPv6RangeAllocator{
+		start:  start.To16(),
+		size:   distance + 1,
+		bitmap: bitset.New(uint(distance + 1)),
+	}, nil
+}
+
+func (a *IPv6RangeAllocator) toIndex(ip net.IP) (uint, error) {
+	if ip.To16() == nil || ip.To4() != nil {
+		return 0, errors.New("invalid IPv6 address passed as input")
+	}
+	if bytes.Compare(ip.To16(), a.start) < 0 {
+		return 0, errNotInRange
+	}
+	idx, err := allocators.Offset(ip.To16(), a.start, 128)
+	if err != nil || idx >= a.size {
+		return 0, errNotInRange
+	}
+	return uint(idx), nil
+}
+
+func (a *IPv6RangeAllocator) toIP(idx uint) net.IP {
+	ip, err := allocators.AddPrefixes(a.start, uint64(idx), 128)
+	if err != nil {
+		panic("BUG: index out of bounds")
+	}
+	return ip
+}
+
+// Contains returns whether an address is in the range
+func (a *IPv6RangeAllocator) Contains(ip net.IP) bool {
+	_, err := a.toIndex(ip)
+	return err == nil
+}
+
+// Allocate reserves an address, the hinted one if it is free
+func (a *IPv6RangeAllocator) Allocate(hint net.IPNet) (net.IPNet, error) {
+	ret := net.IPNet{Mask: net.CIDRMask(128, 128)}
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	if idx, err := a.toIndex(hint.IP); err == nil && !a.bitmap.Test(idx) {
+		a.bitmap.Set(idx)
+		ret.IP = a.toIP(idx)
+		return ret, nil
+	}
+	next, ok := a.bitmap.NextClear(0)
+	if !ok {
+		return ret, allocators.ErrNoAddrAvail
+	}
+	a.bitmap.Set(next)
+	ret.IP = a.toIP(next)
+	return ret, nil
+}
+
+// Free releases the given address
+func (a *IPv6RangeAllocator) Free(n net.IPNet) error {
+	idx, err := a.toIndex(n.IP)
+	if err != nil {
+		return err
+	}
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	if !a.bitmap.Test(idx) {
+		return &allocators.ErrDoubleFree{Loc: n}
+	}
+	a.bitmap.Clear(idx)
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package bitmap
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPv6RangeAllocator(t *testing.T) {
+	alloc, err := NewIPv6RangeAllocator(net.ParseIP("2001:db8::fffe"), net.ParseIP("2001:db8::1:1"))
+	require.NoError(t, err)
+
+	var got []string
+	for {
+		n, err := alloc.Allocate(net.IPNet{})
+		if err == allocators.ErrNoAddrAvail {
+			break
+		}
+		require.NoError(t, err)
+		ones, bits := n.Mask.Size()
+		assert.Equal(t, 128, ones)
+		assert.Equal(t, 128, bits)
+		got = append(got, n.IP.String())
+	}
+	assert.Equal(t, []string{"2001:db8::fffe", "2001:db8::ffff", "2001:db8::1:0", "2001:db8::1:1"}, got)
+
+	require.NoError(t, alloc.Free(net.IPNet{IP: net.ParseIP("2001:db8::1:0")}))
+	var dfree *allocators.ErrDoubleFree
+	assert.ErrorAs(t, alloc.Free(net.IPNet{IP: net.ParseIP("2001:db8::1:0")}), &dfree)
+	assert.Error(t, alloc.Free(net.IPNet{IP: net.ParseIP("2001:db8::1:2")}))
+	assert.Error(t, alloc.Free(net.IPNet{IP: net.ParseIP("2001:db8::")}))
+	assert.True(t, alloc.Contains(net.ParseIP("2001:db8::ffff")))
+	assert.False(t, alloc.Contains(net.ParseIP("192.0.2.1")))
+
+	// hints are honored when free
+	require.NoError(t, alloc.Free(net.IPNet{IP: net.ParseIP("2001:db8::ffff")}))
+	n, err := alloc.Allocate(net.IPNet{IP: net.ParseIP("2001:db8::1:0")})
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1:0", n.IP.String())
+	n, err = alloc.Allocate(net.IPNet{IP: net.ParseIP("2001:db8::1:0")})
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::ffff", n.IP.String())
+
+	for _, r := range [][2]string{
+		{"2001:db8::1", "2001:db8::"},
+		{"192.0.2.0", "192.0.2.1"},
+		{"2001:db8::", "2001:db9::"},
+	} {
+		_, err := NewIPv6RangeAllocator(net.ParseIP(r[0]), net.ParseIP(r[1]))
+		assert.Error(t, err, r)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package hash implements an allocation strategy that gives each client the
+// same address every time, even without any record of its previous leases:
+// the address is chosen from a hash of an identifier of the client.
+//
+// When the address is already allocated to another client, the following
+// ones are tried in order (linear probing), and then any free address.
+// Which client gets the address on a collision depends on the order they
+// come in, so the leases should still be recorded to keep giving clients the
+// same address.
+package hash
+
+import (
+	"hash/fnv"
+	"net"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// DefaultProbes is how many addresses are tried from the hashed one before
+// falling back to any free address
+const DefaultProbes = 64
+
+// Pool is the set of addresses the hash allocator picks from, for example a
+// bitmap.IPv4PoolAllocator
+type Pool interface {
+	allocators.Allocator
+	// Contains returns whether an address is part of the pool
+	Contains(ip net.IP) bool
+	// Size returns the number of addresses of the pool
+	Size() uint64
+	// Address returns the address at a position in the pool
+	Address(i uint64) net.IP
+	// AllocateNear allocates the first free address among the n ones
+	// starting at ip
+	AllocateNear(ip net.IP, n uint64) (net.IPNet, error)
+}
+
+// Allocator allocates the addresses of a pool by hashing the key of the
+// clients. It is also an allocator of the pool, for callers without a key.
+type Allocator struct {
+	pool   Pool
+	probes uint64
+}
+
+// New creates a hash allocator for a pool, trying up to probes addresses
+// from the hashed one on collisions
+func New(pool Pool, probes uint64) *Allocator {
+	if probes == 0 {
+		probes = DefaultProbes
+	}
+	return &Allocator{pool: pool, probes: probes}
+}
+
+// Address returns the address a key hashes to
+func (a *Allocator) Address(key []byte) net.IP {
+	h := fnv.New64a()
+	h.Write(key)
+	return a.pool.Address(h.Sum64())
+}
+
+// AllocateKey allocates the hinted address if it is free, else the address
+// the key hashes to or one of the following ones, else any free address
+func (a *Allocator) AllocateKey(key []byte, hint net.IPNet) (net.IPNet, error) {
+	if hint.IP != nil {
+		if n, err := a.pool.AllocateNear(hint.IP, 1); err == nil {
+			return n, nil
+		}
+	}
+	if n, err := a.pool.AllocateNear(a.Address(key), a.probes); err == nil {
+		return n, nil
+	}
+	return a.pool.Allocate(net.IPNet{})
+}
+
+// Allocate allocates an address of the pool, as the pool does
+func (a *Allocator) Allocate(hint net.IPNet) (net.IPNet, error) {
+	return a.pool.Allocate(hint)
+}
+
+// Free returns an address to the pool
+func (a *Allocator) Free(n net.IPNet) error {
+	return a.pool.Free(n)
+}
+
+// Contains returns whether an address is part of the pool
+func (a *Allocator) Contains(ip net.IP) bool {
+	return a.pool.Contains(ip)
+}
@@ -0,0 +1,89 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package hash
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPool(t *testing.T) *bitmap.IPv4PoolAllocator {
+	pool, err := bitmap.NewIPv4PoolAllocator(
+		[]bitmap.IPv4Range{{Start: net.IPv4(192, 0, 2, 0), End: net.IPv4(192, 0, 2, 7)}, {Start: net.IPv4(192, 0, 2, 16), End: net.IPv4(192, 0, 2, 23)}},
+		nil,
+	)
+	require.NoError(t, err)
+	return pool
+}
+
+var _ allocators.KeyedAllocator = &Allocator{}
+
+func TestAllocateKey(t *testing.T) {
+	a := New(newPool(t), 2)
+	key := []byte("02:00:00:00:00:01")
+	want := a.Address(key)
+	assert.True(t, a.Contains(want))
+
+	// the address is stable across allocators
+	n, err := a.AllocateKey(key, net.IPNet{})
+	require.NoError(t, err)
+	assert.Equal(t, want.String(), n.IP.String())
+	assert.Equal(t, want.String(), New(newPool(t), 2).Address(key).String())
+	require.NoError(t, a.Free(n))
+
+	// collisions are resolved by linear probing, then any free address
+	taken, err := a.Allocate(net.IPNet{IP: want})
+	require.NoError(t, err)
+	n, err = a.AllocateKey(key, net.IPNet{})
+	require.NoError(t, err)
+	assert.NotEqual(t, want.String(), n.IP.String())
+	next, err := a.AllocateKey(key, net.IPNet{})
+	require.NoError(t, err)
+	assert.NotEqual(t, n.IP.String(), next.IP.String())
+	require.NoError(t, a.Free(taken))
+
+	// free hints win over the hashed address
+	n, err = a.AllocateKey(key, net.IPNet{IP: net.IPv4(192, 0, 2, 20)})
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.20", n.IP.String())
+}
+
+func TestAllocateKeyExhausted(t *testing.T) {
+	a := New(newPool(t), 0)
+	for i := 0; i < 16; i++ {
+		_, err := a.AllocateKey([]byte{byte(i)}, net.IPNet{})
+		require.NoError(t, err)
+	}
+	_, err := a.AllocateKey([]byte("one more"), net.IPNet{})
+	assert.Equal(t, allocators.ErrNoAddrAvail, err)
+}
+
+func TestAllocateNear(t *testing.T) {
+	pool := newPool(t)
+	assert.Equal(t, uint64(16), pool.Size())
+	assert.Equal(t, "192.0.2.16", pool.Address(8).String())
+	assert.Equal(t, "192.0.2.0", pool.Address(16).String())
+
+	// probing wraps across the ranges and around the pool
+	for _, ip := range []string{"192.0.2.7", "192.0.2.16", "192.0.2.23"} {
+		_, err := pool.Allocate(net.IPNet{IP: net.ParseIP(ip)})
+		require.NoError(t, err)
+	}
+	n, err := pool.AllocateNear(net.ParseIP("192.0.2.7"), 3)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.17", n.IP.String())
+	n, err = pool.AllocateNear(net.ParseIP("192.0.2.23"), 2)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.0", n.IP.String())
+	_, err = pool.AllocateNear(net.ParseIP("192.0.2.23"), 1)
+	assert.Equal(t, allocators.ErrNoAddrAvail, err)
+	_, err = pool.AllocateNear(net.ParseIP("192.0.2.10"), 1)
+	assert.Error(t, err)
+}
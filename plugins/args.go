@@ -0,0 +1,213 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ArgType is the type of a plugin argument, used to validate its value
+type ArgType string
+
+// Argument types understood by LoadPlugins
+const (
+	ArgString   ArgType = "string"
+	ArgInt      ArgType = "int"
+	ArgDuration ArgType = "duration"
+	ArgIP       ArgType = "ip"
+	ArgIPv4     ArgType = "ipv4"
+	ArgIPv6     ArgType = "ipv6"
+	ArgPrefix   ArgType = "prefix"
+	ArgMAC      ArgType = "mac"
+	ArgURL      ArgType = "url"
+)
+
+// Arg describes a positional plugin argument
+type Arg struct {
+	Name        string
+	Type        ArgType
+	Description string
+	// Optional arguments can be omitted, and are replaced by Default if it is
+	// not empty. Only the last arguments can be optional.
+	Optional bool
+	Default  string
+	// Variadic is only valid for the last argument, which then takes all the
+	// remaining values. A required variadic argument needs at least one value.
+	Variadic bool
+	// Choices restricts the argument to some values, compared
+	// case-insensitively
+	Choices []string
+}
+
+// ArgSpec describes the arguments a plugin accepts for one protocol version
+type ArgSpec struct {
+	Args []Arg
+	// Examples are argument strings, as they would appear in the
+	// configuration file
+	Examples []string
+}
+
+func (a *Arg) check(value string) error {
+	if len(a.Choices) > 0 {
+		for _, c := range a.Choices {
+			if strings.EqualFold(c, value) {
+				return nil
+			}
+		}
+		return fmt.Errorf("want one of %s, got %q", strings.Join(a.Choices, ", "), value)
+	}
+	var err error
+	switch a.Type {
+	case ArgInt:
+		_, err = strconv.Atoi(value)
+	case ArgDuration:
+		_, err = time.ParseDuration(value)
+	case ArgIP:
+		if net.ParseIP(value) == nil {
+			err = fmt.Errorf("not an IP address")
+		}
+	case ArgIPv4:
+		if net.ParseIP(value).To4() == nil {
+			err = fmt.Errorf("not an IPv4 address")
+		}
+	case ArgIPv6:
+		if ip := net.ParseIP(value); ip == nil || ip.To4() != nil {
+			err = fmt.Errorf("not an IPv6 address")
+		}
+	case ArgPrefix:
+		_, _, err = net.ParseCIDR(value)
+	case ArgMAC:
+		_, err = net.ParseMAC(value)
+	case ArgURL:
+		_, err = url.Parse(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %v", a.Type, value, err)
+	}
+	return nil
+}
+
+// Check validates arguments against the specification, and returns them with
+// the defaults of omitted optional arguments filled in. A nil ArgSpec
+// accepts any arguments.
+func (s *ArgSpec) Check(args []string) ([]string, error) {
+	if s == nil {
+		return args, nil
+	}
+	var checked []string
+	consumed := 0
+	for i := range s.Args {
+		a := &s.Args[i]
+		if i >= len(args) {
+			if !a.Optional {
+				return nil, fmt.Errorf("missing argument %s, usage: %s", a.Name, s.Synopsis())
+			}
+			if a.Default != "" {
+				checked = append(checked, a.Default)
+			}
+			continue
+		}
+		values := args[i : i+1]
+		if a.Variadic {
+			values = args[i:]
+		}
+		for _, v := range values {
+			if err := a.check(v); err != nil {
+				return nil, fmt.Errorf("argument %s: %v", a.Name, err)
+			}
+		}
+		checked = append(checked, values...)
+		consumed += len(values)
+	}
+	if consumed < len(args) {
+		return nil, fmt.Errorf("too many arguments, want at most %d, got %d, usage: %s", len(s.Args), len(args), s.Synopsis())
+	}
+	return checked, nil
+}
+
+// Synopsis returns a one-line usage of the arguments, like
+// `<file> [autorefresh]`
+func (s *ArgSpec) Synopsis() string {
+	if s == nil {
+		return ""
+	}
+	var parts []string
+	for _, a := range s.Args {
+		name := a.Name
+		if a.Variadic {
+			name += "..."
+		}
+		if a.Optional {
+			parts = append(parts, "["+name+"]")
+		} else {
+			parts = append(parts, "<"+name+">")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (s *ArgSpec) usage(name string, w *bytes.Buffer) {
+	fmt.Fprintf(w, "  - %s: %s\n", name, s.Synopsis())
+	if len(s.Args) > 0 {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, a := range s.Args {
+			var notes []string
+			if a.Optional {
+				notes = append(notes, "optional")
+			}
+			if a.Default != "" {
+				notes = append(notes, "default: "+a.Default)
+			}
+			if len(a.Choices) > 0 {
+				notes = append(notes, "one of: "+strings.Join(a.Choices, ", "))
+			}
+			desc := a.Description
+			if len(notes) > 0 {
+				desc += " (" + strings.Join(notes, ", ") + ")"
+			}
+			fmt.Fprintf(tw, "    %s\t%s\t%s\n", a.Name, a.Type, desc)
+		}
+		tw.Flush()
+	}
+	if len(s.Examples) > 0 {
+		fmt.Fprintf(w, "  Examples:\n")
+		for _, ex := range s.Examples {
+			fmt.Fprintf(w, "    - %s: %s\n", name, ex)
+		}
+	}
+}
+
+// Usage returns a human readable description of the arguments of a plugin
+func Usage(p *Plugin) string {
+	var w bytes.Buffer
+	fmt.Fprintf(&w, "Plugin %s\n", p.Name)
+	for _, v := range []struct {
+		proto     string
+		supported bool
+		spec      *ArgSpec
+	}{
+		{"DHCPv6", p.hasSetup6(), p.Args6},
+		{"DHCPv4", p.hasSetup4(), p.Args4},
+	} {
+		fmt.Fprintf(&w, "\n%s:", v.proto)
+		switch {
+		case !v.supported:
+			fmt.Fprintf(&w, " not supported\n")
+		case v.spec == nil:
+			fmt.Fprintf(&w, " arguments not described\n")
+		default:
+			fmt.Fprintf(&w, "\n")
+			v.spec.usage(p.Name, &w)
+		}
+	}
+	return w.String()
+}
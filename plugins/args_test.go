@@ -0,0 +1,110 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"testing"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSpec = &ArgSpec{
+	Args: []Arg{
+		{Name: "file", Type: ArgString},
+		{Name: "start", Type: ArgIPv4},
+		{Name: "lease_time", Type: ArgDuration, Optional: true, Default: "1h"},
+		{Name: "mode", Type: ArgString, Optional: true, Choices: []string{"fast", "slow"}},
+	},
+	Examples: []string{"leases.txt 10.0.0.1 30m fast"},
+}
+
+func TestArgSpecCheck(t *testing.T) {
+	args, err := testSpec.Check([]string{"leases.txt", "10.0.0.1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"leases.txt", "10.0.0.1", "1h"}, args)
+
+	args, err = testSpec.Check([]string{"leases.txt", "10.0.0.1", "30m", "FAST"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"leases.txt", "10.0.0.1", "30m", "FAST"}, args)
+
+	for _, bad := range [][]string{
+		{"leases.txt"},
+		{"leases.txt", "2001:db8::1"},
+		{"leases.txt", "10.0.0.1", "forever"},
+		{"leases.txt", "10.0.0.1", "30m", "medium"},
+		{"leases.txt", "10.0.0.1", "30m", "fast", "extra"},
+	} {
+		_, err := testSpec.Check(bad)
+		assert.Error(t, err, "%v should be rejected", bad)
+	}
+
+	// a nil spec accepts anything
+	args, err = (*ArgSpec)(nil).Check([]string{"anything"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"anything"}, args)
+}
+
+func TestArgSpecVariadic(t *testing.T) {
+	required := &ArgSpec{Args: []Arg{{Name: "server", Type: ArgIP, Variadic: true}}}
+	_, err := required.Check(nil)
+	assert.Error(t, err)
+	args, err := required.Check([]string{"192.0.2.1", "2001:db8::1"})
+	require.NoError(t, err)
+	assert.Len(t, args, 2)
+	_, err = required.Check([]string{"192.0.2.1", "foo"})
+	assert.Error(t, err)
+
+	optional := &ArgSpec{Args: []Arg{{Name: "domain", Type: ArgString, Optional: true, Variadic: true}}}
+	args, err = optional.Check(nil)
+	require.NoError(t, err)
+	assert.Empty(t, args)
+}
+
+func TestSynopsis(t *testing.T) {
+	assert.Equal(t, "<file> <start> [lease_time] [mode]", testSpec.Synopsis())
+	spec := &ArgSpec{Args: []Arg{{Name: "server", Variadic: true}}}
+	assert.Equal(t, "<server...>", spec.Synopsis())
+}
+
+func TestUsage(t *testing.T) {
+	usage := Usage(&Plugin{
+		Name:   "test",
+		Setup4: func(args ...string) (handler.Handler4, error) { return nil, nil },
+		Args4:  testSpec,
+	})
+	assert.Contains(t, usage, "DHCPv6: not supported")
+	assert.Contains(t, usage, "- test: <file> <start> [lease_time] [mode]")
+	assert.Contains(t, usage, "(optional, default: 1h)")
+	assert.Contains(t, usage, "- test: leases.txt 10.0.0.1 30m fast")
+}
+
+func TestLoadPluginsChecksArgs(t *testing.T) {
+	var got []string
+	reg := NewRegistry()
+	require.NoError(t, reg.Register(&Plugin{
+		Name: "test_args",
+		Setup4: func(args ...string) (handler.Handler4, error) {
+			got = args
+			return passthrough4, nil
+		},
+		Args4: testSpec,
+	}))
+
+	conf := config.New()
+	conf.Server4 = &config.ServerConfig{Plugins: []config.PluginConfig{
+		{Name: "test_args", Args: []string{"leases.txt", "10.0.0.1"}},
+	}}
+	_, _, err := LoadPlugins(reg, conf)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"leases.txt", "10.0.0.1", "1h"}, got)
+
+	conf.Server4.Plugins[0].Args = []string{"leases.txt", "not-an-ip"}
+	_, _, err = LoadPlugins(reg, conf)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "DHCPv4: plugin `test_args`: argument start")
+}
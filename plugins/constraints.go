@@ -0,0 +1,111 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// Constraints describe where a plugin can be placed in the plugin chain of a
+// server, relative to the other configured plugins. Constraints referring to
+// plugins that are not configured are ignored.
+type Constraints struct {
+	// Precedes lists the plugins that must come after this plugin, for
+	// example because they can stop the processing of requests
+	Precedes []string
+	// Follows lists the plugins that must come before this plugin
+	Follows []string
+	// RequiresOneOf lists plugins, at least one of which must be configured
+	// for this plugin to be useful
+	RequiresOneOf []string
+}
+
+// checkChain verifies that the plugins of a server configuration support the
+// protocol and satisfy their ordering constraints. Violations are returned as
+// an error, or only logged if the configuration is lenient.
+func checkChain(ver int, reg *Registry, sc *config.ServerConfig) error {
+	proto := fmt.Sprintf("DHCPv%d", ver)
+	var problems []string
+	// positions of the plugin entries, by plugin name
+	positions := make(map[string][]int)
+	for i, pc := range sc.Plugins {
+		positions[pc.Name] = append(positions[pc.Name], i+1)
+	}
+
+	unsupported := func(name string) {
+		// in lenient mode, the plugin is skipped with a warning when loading
+		if !sc.Lenient {
+			problems = append(problems, fmt.Sprintf("plugin `%s` does not support %s", name, proto))
+		}
+	}
+
+	for i, pc := range sc.Plugins {
+		plugin, ok := reg.Lookup(pc.Name)
+		if !ok {
+			// reported when loading
+			continue
+		}
+		var cons *Constraints
+		if ver == 6 {
+			if !plugin.hasSetup6() {
+				unsupported(pc.Name)
+				continue
+			}
+			cons = plugin.Constraints6
+		} else {
+			if !plugin.hasSetup4() {
+				unsupported(pc.Name)
+				continue
+			}
+			cons = plugin.Constraints4
+		}
+		if cons == nil {
+			continue
+		}
+		pos := i + 1
+		for _, other := range cons.Precedes {
+			for _, otherPos := range positions[other] {
+				if otherPos < pos {
+					problems = append(problems, fmt.Sprintf("plugin `%s` (#%d) must precede plugin `%s` (#%d)", pc.Name, pos, other, otherPos))
+					break
+				}
+			}
+		}
+		for _, other := range cons.Follows {
+			for _, otherPos := range positions[other] {
+				if otherPos > pos {
+					problems = append(problems, fmt.Sprintf("plugin `%s` (#%d) must follow plugin `%s` (#%d)", pc.Name, pos, other, otherPos))
+					break
+				}
+			}
+		}
+		if len(cons.RequiresOneOf) > 0 {
+			found := false
+			for _, other := range cons.RequiresOneOf {
+				if len(positions[other]) > 0 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("plugin `%s` requires one of `%s`", pc.Name, strings.Join(cons.RequiresOneOf, "`, `")))
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	if sc.Lenient {
+		for _, p := range problems {
+			log.Warningf("%s: %s", proto, p)
+		}
+		return nil
+	}
+	return config.ConfigErrorFromString("%s: invalid plugin chain: %s", proto, strings.Join(problems, "; "))
+}
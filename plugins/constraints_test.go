@@ -0,0 +1,92 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"testing"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func constraintsRegistry(t *testing.T) *Registry {
+	reg := NewRegistry()
+	setup := func(args ...string) (handler.Handler4, error) { return passthrough4, nil }
+	for _, p := range []*Plugin{
+		{Name: "first", Setup4: setup, Constraints4: &Constraints{Precedes: []string{"static", "dynamic"}}},
+		{Name: "static", Setup4: setup},
+		{Name: "dynamic", Setup4: setup, Constraints4: &Constraints{Follows: []string{"static"}}},
+		{Name: "option", Setup4: setup, Constraints4: &Constraints{RequiresOneOf: []string{"static", "dynamic"}}},
+		{Name: "v6only", Setup6: func(args ...string) (handler.Handler6, error) { return nil, nil }},
+	} {
+		require.NoError(t, reg.Register(p))
+	}
+	return reg
+}
+
+func chain(names ...string) *config.ServerConfig {
+	sc := &config.ServerConfig{}
+	for _, name := range names {
+		sc.Plugins = append(sc.Plugins, config.PluginConfig{Name: name})
+	}
+	return sc
+}
+
+func TestCheckChain(t *testing.T) {
+	reg := constraintsRegistry(t)
+
+	for _, valid := range [][]string{
+		{"first", "option", "static", "dynamic"},
+		{"option", "dynamic"},
+		// constraints on plugins that are not configured are ignored
+		{"dynamic"},
+		{"first"},
+		{"unknown"},
+	} {
+		assert.NoError(t, checkChain(4, reg, chain(valid...)), "%v should be valid", valid)
+	}
+
+	for _, tc := range []struct {
+		chain []string
+		err   string
+	}{
+		{[]string{"static", "first"}, "plugin `first` (#2) must precede plugin `static` (#1)"},
+		{[]string{"dynamic", "static"}, "plugin `dynamic` (#1) must follow plugin `static` (#2)"},
+		{[]string{"static", "dynamic", "static"}, "plugin `dynamic` (#2) must follow plugin `static` (#3)"},
+		{[]string{"first", "option"}, "plugin `option` requires one of `static`, `dynamic`"},
+		{[]string{"v6only"}, "plugin `v6only` does not support DHCPv4"},
+	} {
+		err := checkChain(4, reg, chain(tc.chain...))
+		if assert.Error(t, err, "%v should be invalid", tc.chain) {
+			assert.Contains(t, err.Error(), tc.err)
+		}
+	}
+
+	// all the violations are reported at once
+	err := checkChain(4, reg, chain("dynamic", "option", "static", "first"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "must precede")
+	assert.Contains(t, err.Error(), "must follow")
+}
+
+func TestCheckChainLenient(t *testing.T) {
+	reg := constraintsRegistry(t)
+	sc := chain("dynamic", "static", "first", "v6only")
+	sc.Lenient = true
+	assert.NoError(t, checkChain(4, reg, sc))
+
+	conf := config.New()
+	conf.Server4 = sc
+	h4, _, err := LoadPlugins(reg, conf)
+	require.NoError(t, err)
+	// plugins not supporting the protocol are skipped
+	assert.Len(t, h4, 3)
+
+	sc.Lenient = false
+	_, _, err = LoadPlugins(reg, conf)
+	assert.Error(t, err)
+}
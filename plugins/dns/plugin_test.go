@@ -26,12 +26,12 @@ func TestAddServer6(t *testing.T) {
 	}
 	stub.MessageType = dhcpv6.MessageTypeReply
 
-	dnsServers6 = []net.IP{
+	dnsServers6 := []net.IP{
 		net.ParseIP("2001:db8::1"),
 		net.ParseIP("2001:db8::3"),
 	}
 
-	resp, stop := Handler6(req, stub)
+	resp, stop := makeHandler6(dnsServers6)(req, stub)
 	if resp == nil {
 		t.Fatal("plugin did not return a message")
 	}
@@ -69,11 +69,11 @@ func TestNotRequested6(t *testing.T) {
 	}
 	stub.MessageType = dhcpv6.MessageTypeReply
 
-	dnsServers6 = []net.IP{
+	dnsServers6 := []net.IP{
 		net.ParseIP("2001:db8::1"),
 	}
 
-	resp, stop := Handler6(req, stub)
+	resp, stop := makeHandler6(dnsServers6)(req, stub)
 	if resp == nil {
 		t.Fatal("plugin did not return a message")
 	}
@@ -97,12 +97,12 @@ func TestAddServer4(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	dnsServers4 = []net.IP{
+	dnsServers4 := []net.IP{
 		net.ParseIP("192.0.2.1"),
 		net.ParseIP("192.0.2.3"),
 	}
 
-	resp, stop := Handler4(req, stub)
+	resp, stop := makeHandler4(dnsServers4)(req, stub)
 	if resp == nil {
 		t.Fatal("plugin did not return a message")
 	}
@@ -130,12 +130,12 @@ func TestNotRequested4(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	dnsServers4 = []net.IP{
+	dnsServers4 := []net.IP{
 		net.ParseIP("192.0.2.1"),
 	}
 	req.UpdateOption(dhcpv4.OptParameterRequestList(dhcpv4.OptionBroadcastAddress))
 
-	resp, stop := Handler4(req, stub)
+	resp, stop := makeHandler4(dnsServers4)(req, stub)
 	if resp == nil {
 		t.Fatal("plugin did not return a message")
 	}
@@ -51,6 +51,10 @@ var log = logger.GetLogger("plugins/example")
 // A `nil` setup function means that that protocol won't be handled by this
 // plugin.
 //
+// Plugins that own resources, like open files or goroutines, can instead use
+// SetupLifecycle6 and SetupLifecycle4, which also return a `plugins.Lifecycle`.
+// The server starts it before handling requests, and closes it when it stops.
+//
 // Note that importing the plugin is not enough to use it: you have to
 // explicitly specify the intention to use it in the `config.yml` file, in the
 // plugins section. For example:
@@ -99,6 +103,10 @@ func setup4(args ...string) (handler.Handler4, error) {
 // respond to the client (or drop the response, if nil). If `false`, the server
 // will call the next plugin in the chan, using the returned response packet as
 // input for the next plugin.
+// To pass information to the plugins that come later in the chain without
+// modifying the response, use the scratchpad of the request:
+// `scratchpad.For6(req)` returns a bag of values shared by all the plugins
+// handling this request, see the `scratchpad` package.
 func exampleHandler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 	log.Printf("received DHCPv6 packet: %s", req.Summary())
 	// return the unmodified response, and false. This means that the next
@@ -0,0 +1,305 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package execplugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxLineSize is the maximum size of a reply line read from the helper
+	maxLineSize = 1024 * 1024
+	// maxTimeouts is the number of consecutive timeouts after which the
+	// helper is considered stuck and is killed, to be restarted
+	maxTimeouts = 3
+	// closeTimeout is how long the helper is given to exit once its standard
+	// input is closed, before it is killed
+	closeTimeout = 2 * time.Second
+	// maxQueuedWrites is the number of requests waiting to be written to the
+	// standard input of the helper
+	maxQueuedWrites = 64
+)
+
+// helper manages the external process, restarting it when it exits. Several
+// requests can be in flight at the same time, replies are matched to them by
+// their ID.
+type helper struct {
+	path    string
+	args    []string
+	timeout time.Duration
+	// restartDelay is the minimum time between two starts of the process
+	restartDelay time.Duration
+
+	mu        sync.Mutex
+	proc      *process
+	nextID    uint64
+	lastStart time.Time
+	startErr  error
+	closed    bool
+	// timeouts counts the consecutive requests the helper did not reply to.
+	// It is not guarded by mu, so that counting a timeout never waits.
+	timeouts atomic.Int32
+}
+
+// process is a running instance of the helper
+type process struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	// writes queues the encoded requests, written to stdin one at a time so
+	// that a helper that stops reading can't block its callers
+	writes chan []byte
+	// done is closed once the process exited
+	done chan struct{}
+
+	mu      sync.Mutex
+	pending map[uint64]chan *reply
+}
+
+func newHelper(path string, args []string, timeout time.Duration) *helper {
+	return &helper{
+		path:         path,
+		args:         args,
+		timeout:      timeout,
+		restartDelay: time.Second,
+	}
+}
+
+// start starts a new instance of the helper process
+func (h *helper) start() (*process, error) {
+	cmd := exec.Command(h.path, h.args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := &process{
+		cmd:     cmd,
+		stdin:   stdin,
+		writes:  make(chan []byte, maxQueuedWrites),
+		done:    make(chan struct{}),
+		pending: make(map[uint64]chan *reply),
+	}
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		s := bufio.NewScanner(stderr)
+		for s.Scan() {
+			log.Warningf("helper %d: %s", cmd.Process.Pid, s.Text())
+		}
+	}()
+	go p.write()
+	go func() {
+		p.read(stdout)
+		// all reads from the pipes must be done before calling Wait
+		<-stderrDone
+		err := cmd.Wait()
+		log.Warningf("helper %d exited: %v", cmd.Process.Pid, err)
+		close(p.done)
+	}()
+	log.Printf("started helper %s with PID %d", h.path, cmd.Process.Pid)
+	return p, nil
+}
+
+// read dispatches the replies of the process to the pending requests, until
+// its standard output is closed
+func (p *process) read(stdout io.Reader) {
+	s := bufio.NewScanner(stdout)
+	s.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for s.Scan() {
+		var r reply
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			log.Warningf("invalid reply from helper: %v", err)
+			continue
+		}
+		p.mu.Lock()
+		ch, ok := p.pending[r.ID]
+		delete(p.pending, r.ID)
+		p.mu.Unlock()
+		if !ok {
+			log.Debugf("ignoring reply %d from helper, the request timed out", r.ID)
+			continue
+		}
+		ch <- &r
+	}
+	if err := s.Err(); err != nil {
+		log.Warningf("cannot read from helper: %v", err)
+		// the process can't be talked to anymore
+		p.kill()
+	}
+}
+
+// write writes the queued requests to the standard input of the process,
+// until it exits
+func (p *process) write() {
+	for {
+		select {
+		case line := <-p.writes:
+			if _, err := p.stdin.Write(line); err != nil {
+				log.Warningf("cannot write to helper: %v", err)
+				// the process can't be talked to anymore
+				p.kill()
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *process) register(id uint64) chan *reply {
+	ch := make(chan *reply, 1)
+	p.mu.Lock()
+	p.pending[id] = ch
+	p.mu.Unlock()
+	return ch
+}
+
+func (p *process) unregister(id uint64) {
+	p.mu.Lock()
+	delete(p.pending, id)
+	p.mu.Unlock()
+}
+
+func (p *process) kill() {
+	if err := p.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		log.Warningf("cannot kill helper %d: %v", p.cmd.Process.Pid, err)
+	}
+}
+
+// running returns the running instance of the helper, starting a new one if
+// it is not running. h.mu must be held.
+func (h *helper) running() (*process, error) {
+	if h.proc != nil {
+		select {
+		case <-h.proc.done:
+			h.proc = nil
+		default:
+			return h.proc, nil
+		}
+	}
+	if h.closed {
+		return nil, errors.New("helper is closed")
+	}
+	if wait := h.restartDelay - time.Since(h.lastStart); wait > 0 {
+		return nil, fmt.Errorf("helper is not running, restarting in %s", wait.Round(time.Millisecond))
+	}
+	h.lastStart = time.Now()
+	h.timeouts.Store(0)
+	h.proc, h.startErr = h.start()
+	if h.startErr != nil {
+		return nil, fmt.Errorf("cannot start helper: %w", h.startErr)
+	}
+	return h.proc, nil
+}
+
+// call sends a request to the helper and waits for its reply
+func (h *helper) call(req *request) (*reply, error) {
+	h.mu.Lock()
+	p, err := h.running()
+	if err != nil {
+		h.mu.Unlock()
+		return nil, err
+	}
+	h.nextID++
+	req.ID = h.nextID
+	h.mu.Unlock()
+	line, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode request: %w", err)
+	}
+	ch := p.register(req.ID)
+	defer p.unregister(req.ID)
+
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+	select {
+	case p.writes <- append(line, '\n'):
+	case <-p.done:
+		return nil, errors.New("helper exited before replying")
+	case <-timer.C:
+		return nil, h.timedOut(p)
+	}
+	select {
+	case r := <-ch:
+		h.timeouts.Store(0)
+		return r, nil
+	case <-p.done:
+		return nil, errors.New("helper exited before replying")
+	case <-timer.C:
+		return nil, h.timedOut(p)
+	}
+}
+
+// timedOut counts a request the helper did not reply to in time, and kills
+// the helper if it looks stuck
+func (h *helper) timedOut(p *process) error {
+	if h.timeouts.Add(1) >= maxTimeouts {
+		log.Warningf("helper did not reply to %d requests in a row, killing it", maxTimeouts)
+		p.kill()
+	}
+	return fmt.Errorf("no reply from helper within %s", h.timeout)
+}
+
+// Start starts the helper, so that a helper that can't be run is reported
+// before the server handles requests
+func (h *helper) Start() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.running()
+	return err
+}
+
+// Close stops the helper, by closing its standard input and killing it if it
+// doesn't exit in time
+func (h *helper) Close() error {
+	h.mu.Lock()
+	h.closed = true
+	p := h.proc
+	h.proc = nil
+	h.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	p.stdin.Close()
+	select {
+	case <-p.done:
+	case <-time.After(closeTimeout):
+		p.kill()
+		<-p.done
+	}
+	return nil
+}
+
+// Healthy reports whether the helper could be started and answers requests
+func (h *helper) Healthy() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.proc == nil && h.startErr != nil {
+		return fmt.Errorf("cannot start helper: %w", h.startErr)
+	}
+	if n := h.timeouts.Load(); n >= maxTimeouts {
+		return fmt.Errorf("helper did not reply to the last %d requests", n)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package execplugin
+
+// This plugin delegates the handling of requests to a long-lived external
+// helper process, so that policies can be written in any language.
+//
+// Example configuration of the `exec` plugin:
+//
+// server4:
+//   plugins:
+//     - server_id: 10.10.10.1
+//     - exec: 500ms fail-open /usr/bin/python3 /etc/coredhcp/policy.py
+//
+// The arguments are the timeout for each request, the failure policy, and the
+// command to run with its arguments. The helper is started along with the
+// server and restarted when it exits.
+//
+// For each request, one line of JSON is written to the standard input of the
+// helper, holding the request and the response built by the previous plugins:
+//
+//   {"id": 1, "version": 4,
+//    "request": {"raw": "<base64>", "type": "DISCOVER", "xid": "0x12345678",
+//                "chaddr": "aa:bb:cc:dd:ee:ff", "ciaddr": "0.0.0.0", ...,
+//                "options": [{"code": 53, "name": "DHCP Message Type",
+//                             "value": "DISCOVER", "data": "AQ=="}, ...]},
+//    "response": {...},
+//    "scratchpad": {"classes": ["voip"]}}
+//
+// For DHCPv6, "version" is 6, there are no chaddr/ciaddr/yiaddr/siaddr/giaddr
+// fields, and the options are the ones of the inner message of relayed
+// requests. "scratchpad" holds the values set by the previous plugins, see the
+// scratchpad package.
+// The helper answers with one line of JSON with the same id, in any order,
+// with all fields optional:
+//
+//   {"id": 1, "drop": false, "stop": false, "yiaddr": "10.10.10.42",
+//    "ia_na": [{"iaid": "00000001", "address": "2001:db8::42",
+//               "preferred_lifetime": 3600, "valid_lifetime": 7200}],
+//    "set_options": [{"code": 3, "data": "CgoKAQ=="}],
+//    "delete_options": [12],
+//    "error": ""}
+//
+// "yiaddr" is only valid for DHCPv4 and "ia_na" for DHCPv6. "drop" drops the
+// request, and "stop" skips the next plugins.
+// If the helper doesn't reply in time, replies with an error or with invalid
+// changes, or isn't running, the failure policy applies: with fail-open the
+// response is passed unchanged to the next plugin, with fail-closed the
+// request is dropped.
+// Anything the helper writes to its standard error is logged.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/scratchpad"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger("plugins/exec")
+
+// Plugin wraps plugin registration information
+var Plugin = plugins.Plugin{
+	Name:            "exec",
+	SetupLifecycle6: setup6,
+	SetupLifecycle4: setup4,
+	Args6:           execArgs,
+	Args4:           execArgs,
+}
+
+var execArgs = &plugins.ArgSpec{
+	Args: []plugins.Arg{
+		{Name: "timeout", Type: plugins.ArgDuration, Description: "time to wait for the reply to each request"},
+		{Name: "policy", Type: plugins.ArgString, Description: "what to do when the helper fails",
+			Choices: []string{"fail-open", "fail-closed"}},
+		{Name: "command", Type: plugins.ArgString, Description: "path of the helper program"},
+		{Name: "args", Type: plugins.ArgString, Optional: true, Variadic: true, Description: "arguments of the helper program"},
+	},
+	Examples: []string{"500ms fail-open /usr/bin/python3 /etc/coredhcp/policy.py"},
+}
+
+// execPlugin is an instance of the exec plugin
+type execPlugin struct {
+	*helper
+	failOpen bool
+}
+
+func setup6(args ...string) (handler.Handler6, plugins.Lifecycle, error) {
+	p, err := setupExec(args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.Handler6, p, nil
+}
+
+func setup4(args ...string) (handler.Handler4, plugins.Lifecycle, error) {
+	p, err := setupExec(args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.Handler4, p, nil
+}
+
+func setupExec(args ...string) (*execPlugin, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("want at least 3 arguments, got %d", len(args))
+	}
+	timeout, err := time.ParseDuration(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout %q: %v", args[0], err)
+	}
+	if timeout <= 0 {
+		return nil, errors.New("timeout must be positive")
+	}
+	var failOpen bool
+	switch strings.ToLower(args[1]) {
+	case "fail-open":
+		failOpen = true
+	case "fail-closed":
+	default:
+		return nil, fmt.Errorf("invalid policy %q, want fail-open or fail-closed", args[1])
+	}
+	log.Printf("loaded exec plugin running %v, timeout %s, %s", args[2:], timeout, strings.ToLower(args[1]))
+	return &execPlugin{
+		helper:   newHelper(args[2], args[3:], timeout),
+		failOpen: failOpen,
+	}, nil
+}
+
+// Handler6 handles DHCPv6 packets for the exec plugin
+func (p *execPlugin) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	r, err := p.call6(req, resp)
+	if err == nil {
+		err = r.apply6(resp)
+	}
+	if err != nil {
+		log.Warningf("DHCPv6 request: %v", err)
+		if p.failOpen {
+			return resp, false
+		}
+		return nil, true
+	}
+	if r.Drop {
+		return nil, true
+	}
+	return resp, r.Stop
+}
+
+func (p *execPlugin) call6(req, resp dhcpv6.DHCPv6) (*reply, error) {
+	encReq, err := encode6(req)
+	if err != nil {
+		return nil, err
+	}
+	encResp, err := encode6(resp)
+	if err != nil {
+		return nil, err
+	}
+	r, err := p.call(&request{Version: 6, Request: encReq, Response: encResp,
+		Scratchpad: scratchpad.For6(req).Fields()})
+	if err != nil {
+		return nil, err
+	}
+	if r.Error != "" {
+		return nil, fmt.Errorf("helper error: %s", r.Error)
+	}
+	return r, nil
+}
+
+// Handler4 handles DHCPv4 packets for the exec plugin
+func (p *execPlugin) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	r, err := p.call(&request{Version: 4, Request: encode4(req), Response: encode4(resp),
+		Scratchpad: scratchpad.For4(req).Fields()})
+	if err == nil && r.Error != "" {
+		err = fmt.Errorf("helper error: %s", r.Error)
+	}
+	if err == nil {
+		err = r.apply4(resp)
+	}
+	if err != nil {
+		log.Warningf("DHCPv4 request %s from %s: %v", req.TransactionID, req.ClientHWAddr, err)
+		if p.failOpen {
+			return resp, false
+		}
+		return nil, true
+	}
+	if r.Drop {
+		return nil, true
+	}
+	return resp, r.Stop
+}
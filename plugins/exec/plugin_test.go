@@ -0,0 +1,251 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package execplugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// helperEnv selects the behaviour of the test binary when it is run as a
+// helper by the tests
+const helperEnv = "COREDHCP_TEST_EXEC_HELPER"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(helperEnv); mode != "" {
+		runHelper(mode)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runHelper implements a helper speaking the JSON protocol, in one of several
+// modes
+func runHelper(mode string) {
+	if mode == "deaf" {
+		// never read the requests, so that the pipe fills up
+		time.Sleep(time.Hour)
+	}
+	s := bufio.NewScanner(os.Stdin)
+	enc := json.NewEncoder(os.Stdout)
+	for s.Scan() {
+		var req request
+		if err := json.Unmarshal(s.Bytes(), &req); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid request: %v\n", err)
+			os.Exit(1)
+		}
+		r := reply{ID: req.ID}
+		switch mode {
+		case "assign":
+			// echo the decoded message type to show the request was decoded
+			r.SetOptions = []option{{Code: 12, Data: []byte(req.Request.Type)}}
+			if req.Version == 4 {
+				r.YourIPAddr = "10.0.0.42"
+				r.DeleteOptions = []uint16{uint16(dhcpv4.OptionDomainNameServer)}
+			} else {
+				r.SetOptions = nil
+				r.IANA = []iaAddress{{IAID: "00000001", Address: "2001:db8::42", PreferredLifetime: 3600, ValidLifetime: 7200}}
+			}
+		case "drop":
+			r.Drop = true
+		case "stop":
+			r.Stop = true
+		case "error":
+			r.Error = "inventory unavailable"
+		case "invalid":
+			r.YourIPAddr = "not an IP"
+		case "hang":
+			continue
+		case "once":
+			if err := enc.Encode(r); err != nil {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		case "crash":
+			os.Exit(2)
+		}
+		if err := enc.Encode(r); err != nil {
+			os.Exit(1)
+		}
+	}
+}
+
+func newTestPlugin(t *testing.T, mode, timeout, policy string) *execPlugin {
+	t.Setenv(helperEnv, mode)
+	p, err := setupExec(timeout, policy, os.Args[0])
+	require.NoError(t, err)
+	p.restartDelay = 0
+	require.NoError(t, p.Start())
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func newRequest4(t *testing.T) (*dhcpv4.DHCPv4, *dhcpv4.DHCPv4) {
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithOption(dhcpv4.OptDNS(net.IPv4(192, 0, 2, 53))))
+	require.NoError(t, err)
+	return req, resp
+}
+
+func TestSetup(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"1s", "fail-open"},
+		{"forever", "fail-open", "/bin/true"},
+		{"0s", "fail-open", "/bin/true"},
+		{"1s", "fail-sometimes", "/bin/true"},
+	} {
+		_, err := setupExec(args...)
+		assert.Error(t, err, "%v should be rejected", args)
+	}
+	p, err := setupExec("1s", "FAIL-CLOSED", "/bin/cat", "-u")
+	require.NoError(t, err)
+	assert.False(t, p.failOpen)
+	assert.Equal(t, []string{"-u"}, p.args)
+
+	p, err = setupExec("1s", "fail-open", "/nonexistent/helper")
+	require.NoError(t, err)
+	assert.Error(t, p.Start())
+	assert.Error(t, p.Healthy())
+	assert.NoError(t, p.Close())
+}
+
+func TestHandler4(t *testing.T) {
+	p := newTestPlugin(t, "assign", "5s", "fail-closed")
+	req, resp := newRequest4(t)
+	resp, stop := p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.False(t, stop)
+	assert.Equal(t, "10.0.0.42", resp.YourIPAddr.String())
+	assert.Equal(t, "DISCOVER", resp.HostName())
+	assert.False(t, resp.Options.Has(dhcpv4.OptionDomainNameServer))
+	assert.NoError(t, p.Healthy())
+}
+
+func TestHandler6(t *testing.T) {
+	p := newTestPlugin(t, "assign", "5s", "fail-closed")
+	req, err := dhcpv6.NewSolicit(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	require.NoError(t, err)
+	resp, err := dhcpv6.NewAdvertiseFromSolicit(req)
+	require.NoError(t, err)
+
+	result, stop := p.Handler6(req, resp)
+	require.NotNil(t, result)
+	assert.False(t, stop)
+	ianas := result.(*dhcpv6.Message).Options.IANA()
+	require.Len(t, ianas, 1)
+	assert.Equal(t, [4]byte{0, 0, 0, 1}, ianas[0].IaId)
+	addr := ianas[0].Options.OneAddress()
+	require.NotNil(t, addr)
+	assert.Equal(t, "2001:db8::42", addr.IPv6Addr.String())
+	assert.Equal(t, 2*time.Hour, addr.ValidLifetime)
+}
+
+func TestDecisions(t *testing.T) {
+	req, resp := newRequest4(t)
+	p := newTestPlugin(t, "drop", "5s", "fail-open")
+	result, stop := p.Handler4(req, resp)
+	assert.Nil(t, result)
+	assert.True(t, stop)
+
+	p = newTestPlugin(t, "stop", "5s", "fail-open")
+	result, stop = p.Handler4(req, resp)
+	assert.NotNil(t, result)
+	assert.True(t, stop)
+}
+
+func TestFailurePolicy(t *testing.T) {
+	for _, mode := range []string{"error", "invalid", "crash"} {
+		req, resp := newRequest4(t)
+		p := newTestPlugin(t, mode, "5s", "fail-open")
+		result, stop := p.Handler4(req, resp)
+		assert.Same(t, resp, result, mode)
+		assert.False(t, stop, mode)
+		// invalid changes are not partially applied
+		assert.True(t, result.YourIPAddr.IsUnspecified(), mode)
+
+		p = newTestPlugin(t, mode, "5s", "fail-closed")
+		result, stop = p.Handler4(req, resp)
+		assert.Nil(t, result, mode)
+		assert.True(t, stop, mode)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	req, resp := newRequest4(t)
+	p := newTestPlugin(t, "hang", "20ms", "fail-closed")
+	proc := p.proc
+	for i := 0; i < maxTimeouts; i++ {
+		result, stop := p.Handler4(req, resp)
+		assert.Nil(t, result)
+		assert.True(t, stop)
+	}
+	assert.Error(t, p.Healthy())
+	// the stuck helper is killed
+	select {
+	case <-proc.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stuck helper was not killed")
+	}
+}
+
+func TestDeafHelper(t *testing.T) {
+	p := newTestPlugin(t, "deaf", "20ms", "fail-closed")
+	proc := p.proc
+	// each request is larger than the pipe buffer, so writing it blocks
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < maxTimeouts; i++ {
+			_, err := p.call(&request{Version: 4, Request: &message{Raw: make([]byte, 1024*1024)}})
+			assert.Error(t, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call blocked on a helper not reading its input")
+	}
+	assert.Error(t, p.Healthy())
+	select {
+	case <-proc.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stuck helper was not killed")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	req, resp := newRequest4(t)
+	p := newTestPlugin(t, "once", "5s", "fail-closed")
+	for i := 0; i < 3; i++ {
+		result, _ := p.Handler4(req, resp)
+		assert.NotNil(t, result, "request %d", i)
+		// wait for the helper that replied to exit
+		<-p.proc.done
+	}
+}
+
+func TestRestartDelay(t *testing.T) {
+	req, resp := newRequest4(t)
+	p := newTestPlugin(t, "once", "5s", "fail-closed")
+	p.restartDelay = time.Hour
+	result, _ := p.Handler4(req, resp)
+	assert.NotNil(t, result)
+	<-p.proc.done
+	result, _ = p.Handler4(req, resp)
+	assert.Nil(t, result)
+}
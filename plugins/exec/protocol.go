@@ -0,0 +1,243 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package execplugin
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// request is sent to the helper, as a single line of JSON
+type request struct {
+	ID       uint64   `json:"id"`
+	Version  int      `json:"version"`
+	Request  *message `json:"request"`
+	Response *message `json:"response"`
+	// Scratchpad holds the values set by the previous plugins, by name
+	Scratchpad map[string]interface{} `json:"scratchpad,omitempty"`
+}
+
+// message describes a DHCP packet. The DHCPv4 header fields are only set for
+// DHCPv4, and the options of relayed DHCPv6 messages are the ones of the
+// inner message.
+type message struct {
+	// Raw is the whole packet, base64-encoded
+	Raw           []byte   `json:"raw"`
+	Type          string   `json:"type"`
+	TransactionID string   `json:"xid"`
+	ClientHWAddr  string   `json:"chaddr,omitempty"`
+	ClientIPAddr  net.IP   `json:"ciaddr,omitempty"`
+	YourIPAddr    net.IP   `json:"yiaddr,omitempty"`
+	ServerIPAddr  net.IP   `json:"siaddr,omitempty"`
+	GatewayIPAddr net.IP   `json:"giaddr,omitempty"`
+	Options       []option `json:"options"`
+}
+
+// option is a DHCP option, both decoded in a human readable form and as raw
+// bytes
+type option struct {
+	Code  uint16 `json:"code"`
+	Name  string `json:"name,omitempty"`
+	Value string `json:"value,omitempty"`
+	// Data is base64-encoded
+	Data []byte `json:"data"`
+}
+
+// reply is read from the helper, as a single line of JSON
+type reply struct {
+	ID uint64 `json:"id"`
+	// Error reports that the helper could not process the request. The
+	// failure policy of the plugin applies.
+	Error string `json:"error"`
+	// Drop drops the request, no response is sent
+	Drop bool `json:"drop"`
+	// Stop skips the plugins after this one
+	Stop bool `json:"stop"`
+	// YourIPAddr is the DHCPv4 address assigned to the client
+	YourIPAddr string `json:"yiaddr"`
+	// IANA lists the DHCPv6 addresses assigned to the client
+	IANA          []iaAddress `json:"ia_na"`
+	SetOptions    []option    `json:"set_options"`
+	DeleteOptions []uint16    `json:"delete_options"`
+}
+
+// iaAddress is an address assigned in an IA_NA. The lifetimes are in seconds
+type iaAddress struct {
+	IAID              string `json:"iaid"`
+	Address           string `json:"address"`
+	PreferredLifetime uint32 `json:"preferred_lifetime"`
+	ValidLifetime     uint32 `json:"valid_lifetime"`
+}
+
+// splitOption splits the string form of an option into its name and value
+func splitOption(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, ":"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i+1:])
+	}
+	return s, ""
+}
+
+func encode4(m *dhcpv4.DHCPv4) *message {
+	if m == nil {
+		return nil
+	}
+	codes := make([]int, 0, len(m.Options))
+	for code := range m.Options {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	opts := make([]option, 0, len(codes))
+	for _, c := range codes {
+		code := uint8(c)
+		name, value := splitOption(dhcpv4.Options{code: m.Options[code]}.String())
+		opts = append(opts, option{Code: uint16(code), Name: name, Value: value, Data: m.Options[code]})
+	}
+	return &message{
+		Raw:           m.ToBytes(),
+		Type:          m.MessageType().String(),
+		TransactionID: m.TransactionID.String(),
+		ClientHWAddr:  m.ClientHWAddr.String(),
+		ClientIPAddr:  m.ClientIPAddr,
+		YourIPAddr:    m.YourIPAddr,
+		ServerIPAddr:  m.ServerIPAddr,
+		GatewayIPAddr: m.GatewayIPAddr,
+		Options:       opts,
+	}
+}
+
+func encode6(d dhcpv6.DHCPv6) (*message, error) {
+	if d == nil {
+		return nil, nil
+	}
+	msg, err := d.GetInnerMessage()
+	if err != nil {
+		return nil, err
+	}
+	opts := make([]option, 0, len(msg.Options.Options))
+	for _, o := range msg.Options.Options {
+		name := o.Code().String()
+		value := strings.TrimSpace(strings.TrimPrefix(o.String(), name+":"))
+		opts = append(opts, option{Code: uint16(o.Code()), Name: name, Value: value, Data: o.ToBytes()})
+	}
+	return &message{
+		Raw:           d.ToBytes(),
+		Type:          msg.Type().String(),
+		TransactionID: msg.TransactionID.String(),
+		Options:       opts,
+	}, nil
+}
+
+// apply4 applies the changes of a reply to a DHCPv4 response. The reply is
+// validated before the response is modified.
+func (r *reply) apply4(resp *dhcpv4.DHCPv4) error {
+	var yiaddr net.IP
+	if r.YourIPAddr != "" {
+		if yiaddr = net.ParseIP(r.YourIPAddr).To4(); yiaddr == nil {
+			return fmt.Errorf("invalid yiaddr %q", r.YourIPAddr)
+		}
+	}
+	if len(r.IANA) > 0 {
+		return errors.New("ia_na is only valid for DHCPv6")
+	}
+	for _, o := range r.SetOptions {
+		if o.Code == 0 || o.Code >= 255 {
+			return fmt.Errorf("invalid DHCPv4 option code %d", o.Code)
+		}
+	}
+	for _, code := range r.DeleteOptions {
+		if code == 0 || code >= 255 {
+			return fmt.Errorf("invalid DHCPv4 option code %d", code)
+		}
+	}
+
+	if yiaddr != nil {
+		resp.YourIPAddr = yiaddr
+	}
+	for _, code := range r.DeleteOptions {
+		resp.Options.Del(dhcpv4.GenericOptionCode(code))
+	}
+	for _, o := range r.SetOptions {
+		resp.Options.Update(dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(o.Code), o.Data))
+	}
+	return nil
+}
+
+// apply6 applies the changes of a reply to a DHCPv6 response. The reply is
+// validated before the response is modified.
+func (r *reply) apply6(resp dhcpv6.DHCPv6) error {
+	msg, ok := resp.(*dhcpv6.Message)
+	if !ok {
+		return errors.New("cannot modify a relayed response")
+	}
+	if r.YourIPAddr != "" {
+		return errors.New("yiaddr is only valid for DHCPv4")
+	}
+	set := make([]dhcpv6.Option, 0, len(r.SetOptions))
+	for _, o := range r.SetOptions {
+		opt, err := dhcpv6.ParseOption(dhcpv6.OptionCode(o.Code), o.Data)
+		if err != nil {
+			return fmt.Errorf("invalid option %d: %v", o.Code, err)
+		}
+		set = append(set, opt)
+	}
+	// addresses grouped by IA, in the order of the reply
+	var ias []*dhcpv6.OptIANA
+	byID := make(map[[4]byte]*dhcpv6.OptIANA)
+	for _, a := range r.IANA {
+		raw, err := hex.DecodeString(a.IAID)
+		if err != nil || len(raw) != 4 {
+			return fmt.Errorf("invalid IAID %q, want 4 bytes in hexadecimal", a.IAID)
+		}
+		addr := net.ParseIP(a.Address)
+		if addr == nil || addr.To4() != nil {
+			return fmt.Errorf("invalid IA_NA address %q", a.Address)
+		}
+		var iaid [4]byte
+		copy(iaid[:], raw)
+		ia, ok := byID[iaid]
+		if !ok {
+			ia = &dhcpv6.OptIANA{IaId: iaid}
+			byID[iaid] = ia
+			ias = append(ias, ia)
+		}
+		ia.Options.Add(&dhcpv6.OptIAAddress{
+			IPv6Addr:          addr,
+			PreferredLifetime: time.Duration(a.PreferredLifetime) * time.Second,
+			ValidLifetime:     time.Duration(a.ValidLifetime) * time.Second,
+		})
+	}
+
+	for _, code := range r.DeleteOptions {
+		msg.Options.Del(dhcpv6.OptionCode(code))
+	}
+	for _, opt := range set {
+		msg.Options.Del(opt.Code())
+		msg.AddOption(opt)
+	}
+	if len(ias) > 0 {
+		// assigned IAs replace the ones with the same IAID
+		kept := msg.Options.Options[:0]
+		for _, o := range msg.Options.Options {
+			if ia, ok := o.(*dhcpv6.OptIANA); ok && byID[ia.IaId] != nil {
+				continue
+			}
+			kept = append(kept, o)
+		}
+		msg.Options.Options = kept
+		for _, ia := range ias {
+			msg.AddOption(ia)
+		}
+	}
+	return nil
+}
@@ -63,12 +63,28 @@ var log = logger.GetLogger("plugins/file")
 
 // Plugin wraps plugin registration information
 var Plugin = plugins.Plugin{
-	Name:   "file",
-	Setup6: setup6,
-	Setup4: setup4,
+	Name:            "file",
+	SetupLifecycle6: setup6,
+	SetupLifecycle4: setup4,
+	Args6: &plugins.ArgSpec{
+		Args:     fileArgs,
+		Examples: []string{"leases.txt", "leases.txt autorefresh"},
+	},
+	Args4: &plugins.ArgSpec{
+		Args:     fileArgs,
+		Examples: []string{"leases.txt", "leases.txt autorefresh"},
+	},
+	// static leases stop the processing, dynamic allocation only applies to
+	// the other clients
+	Constraints6: &plugins.Constraints{Precedes: []string{"range6"}},
+	Constraints4: &plugins.Constraints{Precedes: []string{"range"}},
 }
 
-var recLock sync.RWMutex
+var fileArgs = []plugins.Arg{
+	{Name: "file", Type: plugins.ArgString, Description: "file holding one lease per line"},
+	{Name: autoRefreshArg, Type: plugins.ArgString, Optional: true, Choices: []string{autoRefreshArg},
+		Description: "reload the leases whenever the file changes"},
+}
 
 type lookupType struct {
 	name      string
@@ -108,8 +124,12 @@ type ipConfig struct {
 	gateway net.IP     // or nil value if undefined
 }
 
-// StaticRecords holds a address mappings of different types
-var StaticRecords map[lookupValue]ipConfig
+// leaseDB holds the address mappings of different types of one instance of
+// the plugin
+type leaseDB struct {
+	sync.RWMutex
+	records map[lookupValue]ipConfig
+}
 
 // LoadDHCPv4Records loads the DHCPv4Records global map with records stored on
 // the specified file. The records have to be one per line, a mac address and an
@@ -224,7 +244,7 @@ func LoadDHCPv6Records(filename string) (map[lookupValue]ipConfig, error) {
 }
 
 // Handler6 handles DHCPv6 packets for the file plugin
-func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+func (db *leaseDB) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 	m, err := req.GetInnerMessage()
 	if err != nil {
 		log.Errorf("BUG: could not decapsulate: %v", err)
@@ -243,10 +263,10 @@ func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 	}
 	log.Debugf("looking up an IP address for MAC %s", mac.String())
 
-	recLock.RLock()
-	defer recLock.RUnlock()
+	db.RLock()
+	defer db.RUnlock()
 
-	config, ok := StaticRecords[LookupMAC(mac.String())]
+	config, ok := db.records[LookupMAC(mac.String())]
 	if !ok {
 		log.Warningf("MAC address %s is unknown", mac.String())
 		return resp, false
@@ -295,12 +315,12 @@ func lookupsFromRequest(req *dhcpv4.DHCPv4) (lookups []lookupValue) {
 }
 
 // Handler4 handles DHCPv4 packets for the file plugin
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	recLock.RLock()
-	defer recLock.RUnlock()
+func (db *leaseDB) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	db.RLock()
+	defer db.RUnlock()
 
 	for _, lookup := range lookupsFromRequest(req) {
-		config, ok := StaticRecords[lookup]
+		config, ok := db.records[lookup]
 		if ok {
 			resp.YourIPAddr = config.ip
 
@@ -320,17 +340,95 @@ func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
 	return resp, false
 }
 
-func setup6(args ...string) (handler.Handler6, error) {
-	h6, _, err := setupFile(true, args...)
-	return h6, err
+func setup6(args ...string) (handler.Handler6, plugins.Lifecycle, error) {
+	db, lc, err := setupFile(true, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db.Handler6, lc, nil
+}
+
+func setup4(args ...string) (handler.Handler4, plugins.Lifecycle, error) {
+	db, lc, err := setupFile(false, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db.Handler4, lc, nil
+}
+
+// size returns the number of address mappings
+func (db *leaseDB) size() int {
+	db.RLock()
+	defer db.RUnlock()
+	return len(db.records)
+}
+
+// refresher watches the lease file, and reloads the lease mapping on any
+// event on the file
+type refresher struct {
+	db       *leaseDB
+	v6       bool
+	filename string
+	watcher  *fsnotify.Watcher
+	// done is closed when the watching goroutine exits, nil if not started
+	done chan struct{}
+
+	mu sync.Mutex
+	// err is the error of the last reload, if it failed
+	err error
+}
+
+// Start starts watching the lease file
+func (r *refresher) Start() error {
+	r.done = make(chan struct{})
+	go r.watch()
+	return nil
+}
+
+func (r *refresher) watch() {
+	defer close(r.done)
+	for {
+		select {
+		case _, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			err := r.db.loadFromFile(r.v6, r.filename)
+			r.mu.Lock()
+			r.err = err
+			r.mu.Unlock()
+			if err != nil {
+				log.Warningf("failed to refresh from %s: %s", r.filename, err)
+				continue
+			}
+			log.Infof("updated to %d leases from %s", r.db.size(), r.filename)
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Warningf("error watching %s: %v", r.filename, err)
+		}
+	}
 }
 
-func setup4(args ...string) (handler.Handler4, error) {
-	_, h4, err := setupFile(false, args...)
-	return h4, err
+// Close stops watching the lease file, and waits for the watching goroutine
+// to exit
+func (r *refresher) Close() error {
+	err := r.watcher.Close()
+	if r.done != nil {
+		<-r.done
+	}
+	return err
+}
+
+// Healthy reports whether the last refresh of the lease file succeeded
+func (r *refresher) Healthy() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
 }
 
-func setupFile(v6 bool, args ...string) (handler.Handler6, handler.Handler4, error) {
+func setupFile(v6 bool, args ...string) (*leaseDB, plugins.Lifecycle, error) {
 	var err error
 	if len(args) < 1 {
 		return nil, nil, errors.New("need a file name")
@@ -341,12 +439,14 @@ func setupFile(v6 bool, args ...string) (handler.Handler6, handler.Handler4, err
 	}
 
 	// load initial database from lease file
-	if err = loadFromFile(v6, filename); err != nil {
+	db := &leaseDB{}
+	if err = db.loadFromFile(v6, filename); err != nil {
 		return nil, nil, err
 	}
+	log.Infof("loaded %d leases from %s", db.size(), filename)
 
 	// when the 'autorefresh' argument was passed, watch the lease file for
-	// changes and reload the lease mapping on any event
+	// changes and reload the lease mapping on any event, once started
 	if len(args) > 1 && args[1] == autoRefreshArg {
 		// creates a new file watcher
 		watcher, err := fsnotify.NewWatcher()
@@ -356,30 +456,17 @@ func setupFile(v6 bool, args ...string) (handler.Handler6, handler.Handler4, err
 
 		// have file watcher watch over lease file
 		if err = watcher.Add(filename); err != nil {
+			watcher.Close()
 			return nil, nil, fmt.Errorf("failed to watch %s: %w", filename, err)
 		}
-
-		// very simple watcher on the lease file to trigger a refresh on any event
-		// on the file
-		go func() {
-			for range watcher.Events {
-				err := loadFromFile(v6, filename)
-				if err != nil {
-					log.Warningf("failed to refresh from %s: %s", filename, err)
-
-					continue
-				}
-
-				log.Infof("updated to %d leases from %s", len(StaticRecords), filename)
-			}
-		}()
+		return db, &refresher{db: db, v6: v6, filename: filename, watcher: watcher}, nil
 	}
 
-	log.Infof("loaded %d leases from %s", len(StaticRecords), filename)
-	return Handler6, Handler4, nil
+	return db, nil, nil
 }
 
-func loadFromFile(v6 bool, filename string) error {
+// loadFromFile replaces the address mappings with the ones in a lease file
+func (db *leaseDB) loadFromFile(v6 bool, filename string) error {
 	var err error
 	var records map[lookupValue]ipConfig
 	var protver int
@@ -394,10 +481,10 @@ func loadFromFile(v6 bool, filename string) error {
 		return fmt.Errorf("failed to load DHCPv%d records: %w", protver, err)
 	}
 
-	recLock.Lock()
-	defer recLock.Unlock()
+	db.Lock()
+	defer db.Unlock()
 
-	StaticRecords = records
+	db.records = records
 
 	return nil
 }
@@ -336,6 +336,7 @@ func TestLoadDHCPv6Records(t *testing.T) {
 
 func TestHandler4(t *testing.T) {
 	t.Run("unknown MAC", func(t *testing.T) {
+		db := &leaseDB{}
 		// prepare DHCPv4 request
 		mac := "00:11:22:33:44:55"
 		claddr, _ := net.ParseMAC(mac)
@@ -347,13 +348,14 @@ func TestHandler4(t *testing.T) {
 
 		// if we handle this DHCP request, nothing should change since the lease is
 		// unknown
-		result, stop := Handler4(req, resp)
+		result, stop := db.Handler4(req, resp)
 		assert.Same(t, result, resp)
 		assert.False(t, stop)
 		assert.Nil(t, result.YourIPAddr)
 	})
 
 	t.Run("known MAC", func(t *testing.T) {
+		db := &leaseDB{}
 		// prepare DHCPv4 request
 		mac := "00:11:22:33:44:55"
 		claddr, _ := net.ParseMAC(mac)
@@ -365,24 +367,22 @@ func TestHandler4(t *testing.T) {
 
 		// add lease for the MAC in the lease map
 		clIPAddr := net.ParseIP("192.0.2.100")
-		StaticRecords = map[lookupValue]ipConfig{
+		db.records = map[lookupValue]ipConfig{
 			LookupMAC(mac): ipConfig{ip: clIPAddr},
 		}
 
 		// if we handle this DHCP request, the YourIPAddr field should be set
 		// in the result
-		result, stop := Handler4(req, resp)
+		result, stop := db.Handler4(req, resp)
 		assert.Same(t, result, resp)
 		assert.True(t, stop)
 		assert.Equal(t, clIPAddr, result.YourIPAddr)
 		assert.Nil(t, net.IP(result.Options.Get(dhcpv4.OptionRouter)))
 		assert.Nil(t, net.IPMask(result.Options.Get(dhcpv4.OptionSubnetMask)))
-
-		// cleanup
-		StaticRecords = make(map[lookupValue]ipConfig)
 	})
 
 	t.Run("known, including netmask (but no gateway)", func(t *testing.T) {
+		db := &leaseDB{}
 		// prepare DHCPv4 request
 		mac := "00:11:22:33:44:55"
 		claddr, _ := net.ParseMAC(mac)
@@ -397,7 +397,7 @@ func TestHandler4(t *testing.T) {
 		// add lease for the MAC in the lease map
 		clIPAddr := net.ParseIP("192.0.2.100")
 		clNetmask := net.IPv4Mask(255, 255, 255, 0)
-		StaticRecords = map[lookupValue]ipConfig{
+		db.records = map[lookupValue]ipConfig{
 			LookupMAC(mac): {
 				ip:      clIPAddr,
 				netmask: clNetmask,
@@ -406,18 +406,16 @@ func TestHandler4(t *testing.T) {
 
 		// if we handle this DHCP request, the YourIPAddr field should be set
 		// in the result
-		result, stop := Handler4(req, resp)
+		result, stop := db.Handler4(req, resp)
 		assert.Same(t, result, resp)
 		assert.True(t, stop)
 		assert.Equal(t, clIPAddr, result.YourIPAddr)
 		assert.Nil(t, net.IP(result.Options.Get(dhcpv4.OptionRouter)))
 		assert.Equal(t, clNetmask.String(), net.IPMask(result.Options.Get(dhcpv4.OptionSubnetMask)).String())
-
-		// cleanup
-		StaticRecords = make(map[lookupValue]ipConfig)
 	})
 
 	t.Run("known, including netmask and gateway", func(t *testing.T) {
+		db := &leaseDB{}
 		// prepare DHCPv4 request
 		mac := "00:11:22:33:44:55"
 		claddr, _ := net.ParseMAC(mac)
@@ -433,7 +431,7 @@ func TestHandler4(t *testing.T) {
 		clIPAddr := net.ParseIP("192.0.2.100")
 		clNetmask := net.IPv4Mask(255, 255, 255, 0)
 		clRouter := net.ParseIP("192.0.2.1")
-		StaticRecords = map[lookupValue]ipConfig{
+		db.records = map[lookupValue]ipConfig{
 			LookupMAC(mac): {
 				ip:      clIPAddr,
 				netmask: clNetmask,
@@ -443,15 +441,12 @@ func TestHandler4(t *testing.T) {
 
 		// if we handle this DHCP request, the YourIPAddr field should be set
 		// in the result
-		result, stop := Handler4(req, resp)
+		result, stop := db.Handler4(req, resp)
 		assert.Same(t, result, resp)
 		assert.True(t, stop)
 		assert.Equal(t, clIPAddr, result.YourIPAddr)
 		assert.Equal(t, clRouter.String(), net.IP(result.Options.Get(dhcpv4.OptionRouter)).String())
 		assert.Equal(t, clNetmask.String(), net.IPMask(result.Options.Get(dhcpv4.OptionSubnetMask)).String())
-
-		// cleanup
-		StaticRecords = make(map[lookupValue]ipConfig)
 	})
 
 	/*
@@ -471,6 +466,7 @@ func TestHandler4(t *testing.T) {
 	testPacket1 := []byte("\x52\x15\x02\x0c\x02\x0a\x00\x00\x0a\xff\xc6\x01\x11\x00\x00\x00\x06\x05\x50\x4f\x52\x54\x31\xff")
 
 	t.Run("known Subscriber-ID", func(t *testing.T) {
+		db := &leaseDB{}
 		// prepare DHCPv4 request
 		mac := "00:11:22:33:44:55"
 		claddr, _ := net.ParseMAC(mac)
@@ -488,22 +484,20 @@ func TestHandler4(t *testing.T) {
 		// add lease for the Subscriber-ID in the lease map
 		clIPAddr := net.ParseIP("192.0.2.100")
 
-		StaticRecords = map[lookupValue]ipConfig{
+		db.records = map[lookupValue]ipConfig{
 			LookupSubscriberID(expectedSubscriberId): ipConfig{ip: clIPAddr},
 		}
 
 		// if we handle this DHCP request, the YourIPAddr field should be set
 		// in the result
-		result, stop := Handler4(req, resp)
+		result, stop := db.Handler4(req, resp)
 		assert.Same(t, result, resp)
 		assert.True(t, stop)
 		assert.Equal(t, clIPAddr, result.YourIPAddr)
-
-		// cleanup
-		StaticRecords = make(map[lookupValue]ipConfig)
 	})
 
 	t.Run("known Remote-ID", func(t *testing.T) {
+		db := &leaseDB{}
 		// prepare DHCPv4 request
 		mac := "00:11:22:33:44:55"
 		claddr, _ := net.ParseMAC(mac)
@@ -521,24 +515,22 @@ func TestHandler4(t *testing.T) {
 		// add lease for the Remote-ID in the lease map
 		clIPAddr := net.ParseIP("192.0.2.100")
 
-		StaticRecords = map[lookupValue]ipConfig{
+		db.records = map[lookupValue]ipConfig{
 			LookupRemoteID(expectedRemoteId): ipConfig{ip: clIPAddr},
 		}
 
 		// if we handle this DHCP request, the YourIPAddr field should be set
 		// in the result
-		result, stop := Handler4(req, resp)
+		result, stop := db.Handler4(req, resp)
 		assert.Same(t, result, resp)
 		assert.True(t, stop)
 		assert.Equal(t, clIPAddr, result.YourIPAddr)
-
-		// cleanup
-		StaticRecords = make(map[lookupValue]ipConfig)
 	})
 
 	testPacket2 := []byte("\x52\x11\x01\x07\x01\x05\x4e\x65\x78\x75\x73\x02\x06\x88\xf0\x31\xa4\x46\xc1\xff")
 
 	t.Run("Known Circuit-ID", func(t *testing.T) {
+		db := &leaseDB{}
 		// prepare DHCPv4 request
 		mac := "00:11:22:33:44:55"
 		claddr, _ := net.ParseMAC(mac)
@@ -556,24 +548,22 @@ func TestHandler4(t *testing.T) {
 		// add lease for the Remote-ID in the lease map
 		clIPAddr := net.ParseIP("192.0.2.100")
 
-		StaticRecords = map[lookupValue]ipConfig{
+		db.records = map[lookupValue]ipConfig{
 			LookupCircuitID(expectedCircuitId): ipConfig{ip: clIPAddr},
 		}
 
 		// if we handle this DHCP request, the YourIPAddr field should be set
 		// in the result
-		result, stop := Handler4(req, resp)
+		result, stop := db.Handler4(req, resp)
 		assert.Same(t, result, resp)
 		assert.True(t, stop)
 		assert.Equal(t, clIPAddr, result.YourIPAddr)
-
-		// cleanup
-		StaticRecords = make(map[lookupValue]ipConfig)
 	})
 }
 
 func TestHandler6(t *testing.T) {
 	t.Run("unknown MAC", func(t *testing.T) {
+		db := &leaseDB{}
 		// prepare DHCPv6 request
 		mac := "11:22:33:44:55:66"
 		claddr, _ := net.ParseMAC(mac)
@@ -585,12 +575,13 @@ func TestHandler6(t *testing.T) {
 
 		// if we handle this DHCP request, nothing should change since the lease is
 		// unknown
-		result, stop := Handler6(req, resp)
+		result, stop := db.Handler6(req, resp)
 		assert.False(t, stop)
 		assert.Equal(t, 0, len(result.GetOption(dhcpv6.OptionIANA)))
 	})
 
 	t.Run("known MAC", func(t *testing.T) {
+		db := &leaseDB{}
 		// prepare DHCPv6 request
 		mac := "11:22:33:44:55:66"
 		claddr, _ := net.ParseMAC(mac)
@@ -603,21 +594,18 @@ func TestHandler6(t *testing.T) {
 		// add lease for the MAC in the lease map
 		clIPAddr := net.ParseIP("2001:db8::10:1")
 
-		StaticRecords = map[lookupValue]ipConfig{
+		db.records = map[lookupValue]ipConfig{
 			LookupMAC(mac): ipConfig{ip: clIPAddr},
 		}
 
 		// if we handle this DHCP request, there should be a specific IANA option
 		// set in the resulting response
-		result, stop := Handler6(req, resp)
+		result, stop := db.Handler6(req, resp)
 		assert.False(t, stop)
 		if assert.Equal(t, 1, len(result.GetOption(dhcpv6.OptionIANA))) {
 			opt := result.GetOneOption(dhcpv6.OptionIANA)
 			assert.Contains(t, opt.String(), "IP=2001:db8::10:1")
 		}
-
-		// cleanup
-		StaticRecords = make(map[lookupValue]ipConfig)
 	})
 }
 
@@ -651,20 +639,23 @@ func TestSetupFile(t *testing.T) {
 		_, err = tmp.WriteString("11:22:33:44:55:66 2001:db8::10:2\n")
 		require.NoError(t, err)
 
-		assert.Equal(t, 0, len(StaticRecords))
-
-		// leases should show up in StaticRecords
-		_, _, err = setupFile(true, tmp.Name())
+		// leases should show up in the database
+		db, lc, err := setupFile(true, tmp.Name())
 		if assert.NoError(t, err) {
-			assert.Equal(t, 2, len(StaticRecords))
+			assert.Equal(t, 2, db.size())
+			assert.Nil(t, lc)
 		}
 	})
 
 	t.Run("autorefresh enabled", func(t *testing.T) {
-		_, _, err = setupFile(true, tmp.Name(), autoRefreshArg)
-		if assert.NoError(t, err) {
-			assert.Equal(t, 2, len(StaticRecords))
-		}
+		db, lc, err := setupFile(true, tmp.Name(), autoRefreshArg)
+		require.NoError(t, err)
+		assert.Equal(t, 2, db.size())
+		require.NotNil(t, lc)
+		require.NoError(t, lc.Start())
+		defer func() {
+			assert.NoError(t, lc.Close())
+		}()
 		// we add more leases to the file
 		// this should trigger an event to refresh the leases database
 		// without calling setupFile again
@@ -673,10 +664,7 @@ func TestSetupFile(t *testing.T) {
 		// since the event is processed asynchronously, give it a little time
 		time.Sleep(time.Millisecond * 100)
 		// an additional record should show up in the database
-		// but we should respect the locking first
-		recLock.RLock()
-		defer recLock.RUnlock()
-
-		assert.Equal(t, 3, len(StaticRecords))
+		assert.Equal(t, 3, db.size())
+		assert.NoError(t, lc.Healthy())
 	})
 }
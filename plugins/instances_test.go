@@ -0,0 +1,59 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/plugins/dns"
+	"github.com/coredhcp/coredhcp/plugins/serverid"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIndependentInstances loads the same plugins twice with different
+// arguments, and checks that each instance keeps its own configuration
+func TestIndependentInstances(t *testing.T) {
+	reg := plugins.NewRegistry()
+	for _, pl := range []*plugins.Plugin{&dns.Plugin, &serverid.Plugin} {
+		require.NoError(t, reg.Register(pl))
+	}
+
+	conf := config.New()
+	conf.Server4 = &config.ServerConfig{Plugins: []config.PluginConfig{
+		{Name: "server_id", Args: []string{"192.0.2.1"}},
+		{Name: "dns", Args: []string{"192.0.2.53"}},
+		{Name: "server_id", Args: []string{"198.51.100.1"}},
+		{Name: "dns", Args: []string{"198.51.100.53", "198.51.100.54"}},
+	}}
+	handlers4, _, err := plugins.LoadPlugins(reg, conf)
+	require.NoError(t, err)
+	require.Len(t, handlers4, 4)
+
+	run := func(handlers ...plugins.LoadedHandler4) *dhcpv4.DHCPv4 {
+		req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+			dhcpv4.WithRequestedOptions(dhcpv4.OptionDomainNameServer))
+		require.NoError(t, err)
+		resp, err := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, err)
+		for _, h := range handlers {
+			resp, _ = h.Handler4(req, resp)
+			require.NotNil(t, resp)
+		}
+		return resp
+	}
+
+	first := run(handlers4[0], handlers4[1])
+	assert.Equal(t, "192.0.2.1", first.ServerIdentifier().String())
+	assert.Equal(t, []net.IP{net.ParseIP("192.0.2.53").To4()}, first.DNS())
+
+	second := run(handlers4[2], handlers4[3])
+	assert.Equal(t, "198.51.100.1", second.ServerIdentifier().String())
+	assert.Equal(t, []net.IP{net.ParseIP("198.51.100.53").To4(), net.ParseIP("198.51.100.54").To4()}, second.DNS())
+}
@@ -0,0 +1,314 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasestore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/logger"
+)
+
+var log = logger.GetLogger("plugins/leasestore")
+
+// The lease file is a journal of changes, one per line, replayed in order
+// when the file is opened:
+//
+//	<key> <address or prefix> <expiry in RFC3339 format>
+//	- <address or prefix>
+//
+// The first form adds or replaces a lease, the second one deletes it. Single
+// addresses are written without a prefix length. Empty lines and lines
+// starting with # are ignored.
+//
+// The first line is a header holding the version of the format:
+//
+//	#leasestore version 1
+//
+// Files without a header are version 0: they were written by the range
+// plugin before the lease store existed, and hold leases keyed by hardware
+// address only. They are read the same way as version 1 files, and upgraded
+// when they are compacted. Files with a newer version are rejected.
+//
+// The journal is compacted into a snapshot of the current leases when the
+// file is opened, and then whenever it holds more than twice as many records
+// as there are leases. The snapshot is written to a temporary file which
+// then replaces the journal, so that a crash leaves either of them intact.
+const deleteMarker = "-"
+
+// fileVersion is the version of the format written to the lease files
+const fileVersion = 1
+
+const headerPrefix = "#leasestore version "
+
+// compactMin is the minimum number of records in the journal before it is
+// compacted, so that small journals aren't rewritten on every change
+const compactMin = 1000
+
+// fileJournal appends the changes to the lease file
+type fileJournal struct {
+	path string
+	file *os.File
+	// records is the number of records in the file
+	records    int
+	compactMin int
+}
+
+// OpenFile opens a store persisted to a file, which is created if it doesn't
+// exist. Transactions return once they are synced to the file, concurrent
+// transactions share the same sync.
+func OpenFile(filename string) (Store, error) {
+	idx := newIndex()
+	if err := loadFile(filename, idx); err != nil {
+		return nil, err
+	}
+	j := &fileJournal{path: filename, compactMin: compactMin}
+	if err := j.compact(idx, true); err != nil {
+		return nil, fmt.Errorf("cannot compact lease file %s: %w", filename, err)
+	}
+	return &store{idx: idx, journal: j, pending: newBatch()}, nil
+}
+
+func loadFile(filename string, idx *index) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot open lease file %s: %w", filename, err)
+	}
+	defer f.Close()
+	if err := load(f, idx); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
+
+// load replays a journal into an index. The last record may have been torn by
+// a crash while it was written: it is skipped if it is incomplete or corrupt.
+// Corrupt records before it are errors.
+func load(r io.Reader, idx *index) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	// records end with a newline, what follows the last one is incomplete
+	if torn := strings.TrimSpace(lines[len(lines)-1]); torn != "" {
+		log.Warningf("Skipping incomplete record at line %d: %s", len(lines), torn)
+	}
+	lines = lines[:len(lines)-1]
+	if len(lines) > 0 {
+		if _, err := parseHeader(lines[0]); err != nil {
+			return err
+		}
+	}
+	last := -1
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			last = i
+		}
+	}
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		c, err := parseLine(line)
+		if err != nil {
+			if i == last {
+				log.Warningf("Skipping corrupt record at line %d: %v", i+1, err)
+				continue
+			}
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+		idx.apply(c)
+	}
+	return nil
+}
+
+// parseHeader returns the version of the format of a lease file from its
+// first line
+func parseHeader(line string) (int, error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, headerPrefix) {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(line, headerPrefix))
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("malformed header: %s", line)
+	}
+	if version > fileVersion {
+		return 0, fmt.Errorf("unsupported lease file version %d, want at most %d", version, fileVersion)
+	}
+	return version, nil
+}
+
+func parseAddr(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func formatAddr(p netip.Prefix) string {
+	if p.IsSingleIP() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
+
+func parseLine(line string) (change, error) {
+	tokens := strings.Fields(line)
+	if len(tokens) == 2 && tokens[0] == deleteMarker {
+		addr, err := parseAddr(tokens[1])
+		if err != nil {
+			return change{}, fmt.Errorf("malformed address: %w", err)
+		}
+		return change{lease: Lease{Addr: addr}, deleted: true}, nil
+	}
+	if len(tokens) != 3 {
+		return change{}, fmt.Errorf("malformed line, want 3 fields, got %d: %s", len(tokens), line)
+	}
+	addr, err := parseAddr(tokens[1])
+	if err != nil {
+		return change{}, fmt.Errorf("malformed address: %w", err)
+	}
+	expires, err := time.Parse(time.RFC3339, tokens[2])
+	if err != nil {
+		return change{}, fmt.Errorf("expected time of expiry in RFC3339 format, got: %v", tokens[2])
+	}
+	return change{lease: Lease{Key: tokens[0], Addr: addr, Expires: expires}}, nil
+}
+
+func formatChange(c change) string {
+	if c.deleted {
+		return deleteMarker + " " + formatAddr(c.lease.Addr) + "\n"
+	}
+	return c.lease.Key + " " + formatAddr(c.lease.Addr) + " " + c.lease.Expires.UTC().Format(time.RFC3339) + "\n"
+}
+
+func (j *fileJournal) write(changes []change) error {
+	if j.file == nil {
+		return ErrClosed
+	}
+	var b strings.Builder
+	for _, c := range changes {
+		b.WriteString(formatChange(c))
+	}
+	// the whole batch is written at once, and removed if it can't be
+	// written completely
+	info, err := j.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.WriteString(b.String()); err != nil {
+		if terr := j.file.Truncate(info.Size()); terr != nil {
+			log.Warningf("Could not remove partially written leases from %s: %v", j.path, terr)
+		}
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.records += len(changes)
+	return nil
+}
+
+func (j *fileJournal) compact(idx *index, force bool) error {
+	if !force && (j.records < j.compactMin || j.records <= 2*idx.Len()) {
+		return nil
+	}
+	leases := make([]Lease, 0, idx.Len())
+	idx.Each(func(l Lease) bool {
+		leases = append(leases, l)
+		return true
+	})
+	sortByAddr(leases)
+
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if _, err := fmt.Fprintf(w, "%s%d\n", headerPrefix, fileVersion); err != nil {
+		f.Close()
+		return err
+	}
+	for _, l := range leases {
+		if _, err := w.WriteString(formatChange(change{lease: l})); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(j.path))
+
+	// This is closed along with the store, see Close
+	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = file
+	j.records = len(leases)
+	return nil
+}
+
+// syncDir makes a rename in a directory durable. Failures are only logged,
+// since some platforms can't sync directories.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		log.Warningf("Could not sync directory %s: %v", dir, err)
+		return
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		log.Debugf("Could not sync directory %s: %v", dir, err)
+	}
+}
+
+func (j *fileJournal) close() error {
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
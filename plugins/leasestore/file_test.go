@@ -0,0 +1,214 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasestore
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var leasefile = `02:00:00:00:00:00 10.0.0.0 2000-01-01T00:00:00Z
+02:00:00:00:00:01 10.0.0.1 2000-01-01T00:00:00Z
+02:00:00:00:00:02 10.0.0.2 2000-01-01T00:00:00Z
+00030001aabbccddeeff 2001:db8::/64 2000-01-01T00:00:00Z
+`
+
+const header = "#leasestore version 1\n"
+
+var records = []Lease{
+	{Key: "02:00:00:00:00:00", Addr: netip.MustParsePrefix("10.0.0.0/32"), Expires: expire},
+	{Key: "02:00:00:00:00:01", Addr: netip.MustParsePrefix("10.0.0.1/32"), Expires: expire},
+	{Key: "02:00:00:00:00:02", Addr: netip.MustParsePrefix("10.0.0.2/32"), Expires: expire},
+	{Key: "00030001aabbccddeeff", Addr: netip.MustParsePrefix("2001:db8::/64"), Expires: expire},
+}
+
+func TestLoad(t *testing.T) {
+	idx := newIndex()
+	require.NoError(t, load(strings.NewReader(leasefile), idx))
+	for _, rec := range records {
+		l, ok := idx.ByAddr(rec.Addr)
+		assert.True(t, ok)
+		assert.Equal(t, rec, l)
+	}
+	assert.Equal(t, len(records), idx.Len())
+
+	// later lines override earlier ones
+	idx = newIndex()
+	require.NoError(t, load(strings.NewReader(leasefile+`
+# the first client left
+- 10.0.0.0
+02:00:00:00:00:03 10.0.0.1 2000-01-01T00:00:00Z
+`), idx))
+	assert.Equal(t, len(records)-1, idx.Len())
+	assert.Empty(t, idx.ByKey("02:00:00:00:00:00"))
+	assert.Empty(t, idx.ByKey("02:00:00:00:00:01"))
+	assert.Len(t, idx.ByKey("02:00:00:00:00:03"), 1)
+
+	for _, bad := range []string{
+		"02:00:00:00:00:00 10.0.0.0\n",
+		"02:00:00:00:00:00 10.0.0.300 2000-01-01T00:00:00Z\n",
+		"02:00:00:00:00:00 10.0.0.0 yesterday\n",
+		"- 10.0.0.0/33\n",
+	} {
+		assert.Error(t, load(strings.NewReader(bad+leasefile), newIndex()), bad)
+	}
+}
+
+func TestLoadTornRecord(t *testing.T) {
+	for _, torn := range []string{
+		// incomplete record, even if it looks valid
+		"02:00:00:00:00:09 10.0.0.9 2000-01-01T00:00:00Z",
+		"02:00:00:00:00:09 10.0",
+		// corrupt last record
+		"02:00:00:00:00:09 10.0\x00\x00\x00\n",
+		"02:00:00:00:00:09 10.0.0.9 2000-01-01\x00\x00\n# comment\n\n",
+	} {
+		idx := newIndex()
+		require.NoError(t, load(strings.NewReader(leasefile+torn), idx), torn)
+		assert.Equal(t, len(records), idx.Len(), torn)
+		assert.Empty(t, idx.ByKey("02:00:00:00:00:09"), torn)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.txt")
+	s, err := OpenFile(filename)
+	require.NoError(t, err)
+	for _, rec := range records {
+		require.NoError(t, s.Put(rec))
+	}
+	require.NoError(t, s.Close())
+
+	written, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, header+leasefile, string(written), "Data written to the file doesn't match records")
+
+	// reopening the file restores the leases, and appends to it
+	s, err = OpenFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, len(records), s.Len())
+	require.NoError(t, s.Update(func(tx Tx) error {
+		if err := tx.Delete(records[0].Addr); err != nil {
+			return err
+		}
+		return tx.Delete(records[1].Addr)
+	}))
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, s.Put(records[0]), ErrClosed, "writing after Close should fail")
+	assert.NoError(t, s.Close(), "closing again is harmless")
+
+	written, err = os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, header+leasefile+"- 10.0.0.0\n- 10.0.0.1\n", string(written))
+
+	s, err = OpenFile(filename)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, len(records)-2, s.Len())
+}
+
+func TestOpenFileRecovery(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.txt")
+	require.NoError(t, os.WriteFile(filename, []byte(leasefile+"02:00:00:00:00:09 10.0"), 0640))
+	s, err := OpenFile(filename)
+	require.NoError(t, err)
+	require.NoError(t, s.Put(Lease{Key: "02:00:00:00:00:09", Addr: netip.MustParsePrefix("10.0.0.9/32"), Expires: expire}))
+	require.NoError(t, s.Close())
+
+	// the torn record is dropped when compacting on startup, so that new
+	// records don't follow it on the same line
+	written, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, header+leasefile+"02:00:00:00:00:09 10.0.0.9 2000-01-01T00:00:00Z\n", string(written))
+}
+
+func TestCompaction(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.txt")
+	// a journal with repeated renewals is compacted on startup
+	journal := strings.Repeat(leasefile, 5) + "- 10.0.0.0\n"
+	require.NoError(t, os.WriteFile(filename, []byte(journal), 0640))
+	s, err := OpenFile(filename)
+	require.NoError(t, err)
+	written, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, header+strings.SplitAfterN(leasefile, "\n", 2)[1], string(written))
+
+	// and then when it grows past twice the number of leases
+	j := s.(*store).journal.(*fileJournal)
+	j.compactMin = 10
+	for i := 0; i < 6; i++ {
+		require.NoError(t, s.Put(records[1]))
+	}
+	written, err = os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, 10, strings.Count(string(written), "\n"))
+	require.NoError(t, s.Put(records[1]))
+	written, err = os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, header+strings.SplitAfterN(leasefile, "\n", 2)[1], string(written))
+	require.NoError(t, s.Close())
+
+	_, err = os.Stat(filename + ".tmp")
+	assert.True(t, os.IsNotExist(err), "the temporary file should be renamed")
+}
+
+func TestGroupCommit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.txt")
+	s, err := OpenFile(filename)
+	require.NoError(t, err)
+
+	const clients = 50
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l := Lease{
+				Key:     fmt.Sprintf("client%d", i),
+				Addr:    netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 32),
+				Expires: expire,
+			}
+			assert.NoError(t, s.Put(l))
+		}(i)
+	}
+	wg.Wait()
+	require.NoError(t, s.Close())
+
+	s, err = OpenFile(filename)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, clients, s.Len())
+}
+
+func TestVersion(t *testing.T) {
+	idx := newIndex()
+	require.NoError(t, load(strings.NewReader(header+leasefile), idx))
+	assert.Equal(t, len(records), idx.Len())
+
+	idx = newIndex()
+	require.NoError(t, load(strings.NewReader("#leasestore version 0\n"+leasefile), idx))
+	assert.Equal(t, len(records), idx.Len())
+
+	assert.Error(t, load(strings.NewReader("#leasestore version 2\n"+leasefile), newIndex()))
+	assert.Error(t, load(strings.NewReader("#leasestore version x\n"+leasefile), newIndex()))
+}
+
+func TestOpenFileErrors(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.txt")
+	require.NoError(t, os.WriteFile(filename, []byte("garbage\n"+leasefile), 0600))
+	_, err := OpenFile(filename)
+	assert.Error(t, err)
+
+	_, err = OpenFile(filepath.Join(t.TempDir(), "missing", "leases.txt"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,501 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package leasestore implements the storage of the leases given out by the
+// address-assigning plugins.
+//
+// A lease binds an address or a prefix to a client, identified by an opaque
+// key (for example its hardware address or DUID), until it expires. A client
+// can hold several leases, but an address is leased to at most one client.
+//
+// Two backends are provided: NewMemory keeps the leases in memory only, and
+// OpenFile also records every change in a file, so that the leases survive
+// restarts.
+package leasestore
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned when writing to a closed store
+var ErrClosed = errors.New("lease store is closed")
+
+// Lease is an address or a prefix assigned to a client
+type Lease struct {
+	// Key identifies the client holding the lease. It can't be empty or
+	// contain spaces.
+	Key string
+	// Addr is the leased prefix. Single addresses are stored as prefixes of
+	// the full address length, see FromIP.
+	Addr netip.Prefix
+	// Expires is the time after which the lease is no longer valid
+	Expires time.Time
+}
+
+// FromIP returns the prefix holding a single address, suitable for
+// Lease.Addr. IPv4-mapped IPv6 addresses are converted to IPv4.
+func FromIP(ip net.IP) netip.Prefix {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Prefix{}
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// FromIPNet returns the prefix equivalent to a net.IPNet
+func FromIPNet(n net.IPNet) netip.Prefix {
+	addr, ok := netip.AddrFromSlice(n.IP)
+	if !ok {
+		return netip.Prefix{}
+	}
+	ones, _ := n.Mask.Size()
+	if addr.Is4In6() && len(n.Mask) == net.IPv4len {
+		addr = addr.Unmap()
+	}
+	return netip.PrefixFrom(addr, ones).Masked()
+}
+
+// IP returns the address of the lease as a net.IP
+func (l Lease) IP() net.IP {
+	return net.IP(l.Addr.Addr().AsSlice())
+}
+
+// IPNet returns the prefix of the lease as a net.IPNet
+func (l Lease) IPNet() net.IPNet {
+	return net.IPNet{
+		IP:   l.IP(),
+		Mask: net.CIDRMask(l.Addr.Bits(), l.Addr.Addr().BitLen()),
+	}
+}
+
+// Expired returns whether the lease expired at the given time
+func (l Lease) Expired(at time.Time) bool {
+	return !l.Expires.After(at)
+}
+
+func (l Lease) validate() error {
+	if l.Key == "" || strings.ContainsAny(l.Key, " \t\r\n") || l.Key == deleteMarker {
+		return fmt.Errorf("invalid lease key %q", l.Key)
+	}
+	if !l.Addr.IsValid() {
+		return errors.New("invalid lease address")
+	}
+	return nil
+}
+
+// Reader gives read access to the leases
+type Reader interface {
+	// ByKey returns the leases held by a client, sorted by address
+	ByKey(key string) []Lease
+	// ByAddr returns the lease of an address or prefix, if any
+	ByAddr(addr netip.Prefix) (Lease, bool)
+	// Each calls fn for each lease, in no particular order, until it
+	// returns false
+	Each(fn func(Lease) bool)
+	// ExpiredBefore returns the leases that expired at the given time,
+	// sorted by expiry
+	ExpiredBefore(t time.Time) []Lease
+	// Len returns the number of leases
+	Len() int
+}
+
+// Tx is a transaction. Changes made in a transaction are visible to its reads,
+// and are only visible outside of it once it is committed.
+type Tx interface {
+	Reader
+	// Put adds or replaces the lease of an address. If the address was leased
+	// to another client, the previous lease is replaced.
+	Put(l Lease) error
+	// Delete removes the lease of an address, if any
+	Delete(addr netip.Prefix) error
+}
+
+// Store is a lease database, safe for concurrent use
+type Store interface {
+	Tx
+	// Update runs fn in a transaction, which is committed if fn returns nil
+	// and discarded otherwise. Transactions are serialized, fn must only
+	// access the store through tx.
+	Update(fn func(tx Tx) error) error
+	// Close releases the resources of the store. Writes fail afterwards,
+	// reads still work.
+	Close() error
+}
+
+// change is a modification of the store, used in transactions and journals.
+// Deletions only have the address of the lease set.
+type change struct {
+	lease   Lease
+	deleted bool
+}
+
+// journal persists the changes made to a store
+type journal interface {
+	// write persists changes, and returns once they are durable
+	write(changes []change) error
+	// compact rewrites the journal from the current leases if it has grown
+	// enough since the last compaction, or if force is set
+	compact(idx *index, force bool) error
+	close() error
+}
+
+// index holds the leases by address and by key. It is not safe for
+// concurrent use.
+type index struct {
+	byAddr map[netip.Prefix]Lease
+	byKey  map[string]map[netip.Prefix]struct{}
+}
+
+func newIndex() *index {
+	return &index{
+		byAddr: make(map[netip.Prefix]Lease),
+		byKey:  make(map[string]map[netip.Prefix]struct{}),
+	}
+}
+
+// apply makes a change to the index, and returns the change undoing it
+func (idx *index) apply(c change) change {
+	addr := c.lease.Addr
+	undo := change{lease: Lease{Addr: addr}, deleted: true}
+	if old, ok := idx.byAddr[addr]; ok {
+		undo = change{lease: old}
+		delete(idx.byKey[old.Key], addr)
+		if len(idx.byKey[old.Key]) == 0 {
+			delete(idx.byKey, old.Key)
+		}
+		delete(idx.byAddr, addr)
+	}
+	if c.deleted {
+		return undo
+	}
+	idx.byAddr[addr] = c.lease
+	addrs, ok := idx.byKey[c.lease.Key]
+	if !ok {
+		addrs = make(map[netip.Prefix]struct{})
+		idx.byKey[c.lease.Key] = addrs
+	}
+	addrs[addr] = struct{}{}
+	return undo
+}
+
+func sortByAddr(leases []Lease) []Lease {
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Addr.Addr().Less(leases[j].Addr.Addr()) })
+	return leases
+}
+
+func (idx *index) ByKey(key string) []Lease {
+	var leases []Lease
+	for addr := range idx.byKey[key] {
+		leases = append(leases, idx.byAddr[addr])
+	}
+	return sortByAddr(leases)
+}
+
+func (idx *index) ByAddr(addr netip.Prefix) (Lease, bool) {
+	l, ok := idx.byAddr[addr]
+	return l, ok
+}
+
+func (idx *index) Each(fn func(Lease) bool) {
+	for _, l := range idx.byAddr {
+		if !fn(l) {
+			return
+		}
+	}
+}
+
+func (idx *index) Len() int {
+	return len(idx.byAddr)
+}
+
+func expiredBefore(r Reader, t time.Time) []Lease {
+	var leases []Lease
+	r.Each(func(l Lease) bool {
+		if l.Expired(t) {
+			leases = append(leases, l)
+		}
+		return true
+	})
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Expires.Before(leases[j].Expires) })
+	return leases
+}
+
+func (idx *index) ExpiredBefore(t time.Time) []Lease {
+	return expiredBefore(idx, t)
+}
+
+// tx records the changes of a transaction on top of an index
+type tx struct {
+	idx     *index
+	changes []change
+	// latest is the last change made to each address
+	latest map[netip.Prefix]change
+}
+
+func newTx(idx *index) *tx {
+	return &tx{idx: idx, latest: make(map[netip.Prefix]change)}
+}
+
+func (t *tx) ByKey(key string) []Lease {
+	var leases []Lease
+	for addr := range t.idx.byKey[key] {
+		if _, changed := t.latest[addr]; !changed {
+			leases = append(leases, t.idx.byAddr[addr])
+		}
+	}
+	for _, c := range t.latest {
+		if !c.deleted && c.lease.Key == key {
+			leases = append(leases, c.lease)
+		}
+	}
+	return sortByAddr(leases)
+}
+
+func (t *tx) ByAddr(addr netip.Prefix) (Lease, bool) {
+	if c, ok := t.latest[addr]; ok {
+		return c.lease, !c.deleted
+	}
+	return t.idx.ByAddr(addr)
+}
+
+func (t *tx) Each(fn func(Lease) bool) {
+	for addr, l := range t.idx.byAddr {
+		if _, changed := t.latest[addr]; changed {
+			continue
+		}
+		if !fn(l) {
+			return
+		}
+	}
+	for _, c := range t.latest {
+		if !c.deleted && !fn(c.lease) {
+			return
+		}
+	}
+}
+
+func (t *tx) ExpiredBefore(at time.Time) []Lease {
+	return expiredBefore(t, at)
+}
+
+func (t *tx) Len() int {
+	n := t.idx.Len()
+	for addr, c := range t.latest {
+		_, existed := t.idx.byAddr[addr]
+		switch {
+		case existed && c.deleted:
+			n--
+		case !existed && !c.deleted:
+			n++
+		}
+	}
+	return n
+}
+
+func (t *tx) Put(l Lease) error {
+	if err := l.validate(); err != nil {
+		return err
+	}
+	c := change{lease: l}
+	t.changes = append(t.changes, c)
+	t.latest[l.Addr] = c
+	return nil
+}
+
+func (t *tx) Delete(addr netip.Prefix) error {
+	if !addr.IsValid() {
+		return errors.New("invalid lease address")
+	}
+	if _, ok := t.ByAddr(addr); !ok {
+		return nil
+	}
+	c := change{lease: Lease{Addr: addr}, deleted: true}
+	t.changes = append(t.changes, c)
+	t.latest[addr] = c
+	return nil
+}
+
+// batch is a group of transactions written to the journal together
+type batch struct {
+	changes []change
+	// undo reverts the changes of the batch, in reverse order
+	undo []change
+	done chan struct{}
+	err  error
+}
+
+func newBatch() *batch {
+	return &batch{done: make(chan struct{})}
+}
+
+// store implements Store on top of an index, optionally persisting changes
+// to a journal.
+//
+// Committed transactions are applied to the index right away, then written
+// to the journal in batches: while a batch is being written, the next
+// transactions are queued in the pending batch, so that they share a single
+// sync. If writing a batch fails, it is reverted along with the transactions
+// queued after it, which may depend on it.
+type store struct {
+	mu      sync.RWMutex
+	idx     *index
+	journal journal
+	pending *batch
+	closed  bool
+	// syncMu is held while writing a batch to the journal
+	syncMu sync.Mutex
+}
+
+// NewMemory returns a store keeping the leases in memory only
+func NewMemory() Store {
+	return &store{idx: newIndex()}
+}
+
+func (s *store) ByKey(key string) []Lease {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.idx.ByKey(key)
+}
+
+func (s *store) ByAddr(addr netip.Prefix) (Lease, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.idx.ByAddr(addr)
+}
+
+func (s *store) Each(fn func(Lease) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.idx.Each(fn)
+}
+
+func (s *store) ExpiredBefore(t time.Time) []Lease {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.idx.ExpiredBefore(t)
+}
+
+func (s *store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.idx.Len()
+}
+
+func (s *store) Put(l Lease) error {
+	return s.Update(func(tx Tx) error { return tx.Put(l) })
+}
+
+func (s *store) Delete(addr netip.Prefix) error {
+	return s.Update(func(tx Tx) error { return tx.Delete(addr) })
+}
+
+func (s *store) Update(fn func(tx Tx) error) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	t := newTx(s.idx)
+	if err := fn(t); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if s.journal == nil {
+		for _, c := range t.changes {
+			s.idx.apply(c)
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	if len(t.changes) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	b := s.pending
+	for _, c := range t.changes {
+		b.undo = append(b.undo, s.idx.apply(c))
+	}
+	b.changes = append(b.changes, t.changes...)
+	s.mu.Unlock()
+	return s.commit(b)
+}
+
+// commit waits until a batch is written to the journal, writing it if no
+// other transaction did
+func (s *store) commit(b *batch) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	select {
+	case <-b.done:
+		return b.err
+	default:
+	}
+	s.mu.Lock()
+	s.pending = newBatch()
+	s.mu.Unlock()
+	s.flush(b)
+	return b.err
+}
+
+// flush writes a batch to the journal, and compacts it if needed. It must be
+// called with syncMu held.
+func (s *store) flush(b *batch) {
+	err := s.journal.write(b.changes)
+	s.mu.Lock()
+	if err != nil {
+		later := s.pending
+		s.pending = newBatch()
+		revert(s.idx, later)
+		revert(s.idx, b)
+		if len(later.changes) > 0 {
+			later.err = err
+			close(later.done)
+		}
+	} else if len(s.pending.changes) == 0 {
+		// the journal then matches the index exactly
+		if cerr := s.journal.compact(s.idx, false); cerr != nil {
+			log.Warningf("Could not compact the lease journal: %v", cerr)
+		}
+	}
+	s.mu.Unlock()
+	b.err = err
+	close(b.done)
+}
+
+// revert undoes the changes of a batch. The caller holds the store lock.
+func revert(idx *index, b *batch) {
+	for i := len(b.undo) - 1; i >= 0; i-- {
+		idx.apply(b.undo[i])
+	}
+}
+
+func (s *store) Close() error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	if s.journal == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	b := s.pending
+	s.pending = newBatch()
+	s.mu.Unlock()
+	if len(b.changes) > 0 {
+		s.flush(b)
+	}
+	return s.journal.close()
+}
@@ -0,0 +1,150 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasestore
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var expire = time.Date(2000, 01, 01, 00, 00, 00, 00, time.UTC)
+
+func TestFromIP(t *testing.T) {
+	assert.Equal(t, netip.MustParsePrefix("10.0.0.1/32"), FromIP(net.IPv4(10, 0, 0, 1)))
+	assert.Equal(t, netip.MustParsePrefix("2001:db8::1/128"), FromIP(net.ParseIP("2001:db8::1")))
+	assert.False(t, FromIP(nil).IsValid())
+
+	_, n, err := net.ParseCIDR("2001:db8:0:1::/64")
+	require.NoError(t, err)
+	p := FromIPNet(*n)
+	assert.Equal(t, netip.MustParsePrefix("2001:db8:0:1::/64"), p)
+	assert.Equal(t, *n, Lease{Addr: p}.IPNet())
+}
+
+func TestMemory(t *testing.T) {
+	s := NewMemory()
+	a1 := netip.MustParsePrefix("10.0.0.1/32")
+	a2 := netip.MustParsePrefix("10.0.0.2/32")
+
+	require.NoError(t, s.Put(Lease{Key: "client1", Addr: a2, Expires: expire}))
+	require.NoError(t, s.Put(Lease{Key: "client1", Addr: a1, Expires: expire.Add(time.Hour)}))
+	require.NoError(t, s.Put(Lease{Key: "client2", Addr: netip.MustParsePrefix("10.0.0.3/32"), Expires: expire.Add(2 * time.Hour)}))
+	assert.Equal(t, 3, s.Len())
+
+	leases := s.ByKey("client1")
+	require.Len(t, leases, 2)
+	assert.Equal(t, a1, leases[0].Addr, "leases should be sorted by address")
+	assert.Equal(t, a2, leases[1].Addr)
+	assert.Empty(t, s.ByKey("nobody"))
+
+	l, ok := s.ByAddr(a2)
+	assert.True(t, ok)
+	assert.Equal(t, "client1", l.Key)
+
+	expired := s.ExpiredBefore(expire.Add(time.Hour))
+	require.Len(t, expired, 2)
+	assert.Equal(t, a2, expired[0].Addr, "expired leases should be sorted by expiry")
+	assert.Equal(t, a1, expired[1].Addr)
+
+	// giving an address to another client moves the lease
+	require.NoError(t, s.Put(Lease{Key: "client2", Addr: a2, Expires: expire}))
+	assert.Len(t, s.ByKey("client1"), 1)
+	assert.Len(t, s.ByKey("client2"), 2)
+
+	require.NoError(t, s.Delete(a1))
+	require.NoError(t, s.Delete(a1), "deleting a missing lease is harmless")
+	assert.Empty(t, s.ByKey("client1"))
+	_, ok = s.ByAddr(a1)
+	assert.False(t, ok)
+
+	n := 0
+	s.Each(func(Lease) bool { n++; return true })
+	assert.Equal(t, 2, n)
+	n = 0
+	s.Each(func(Lease) bool { n++; return false })
+	assert.Equal(t, 1, n, "Each should stop when fn returns false")
+
+	assert.Error(t, s.Put(Lease{Key: "", Addr: a1}))
+	assert.Error(t, s.Put(Lease{Key: "a b", Addr: a1}))
+	assert.Error(t, s.Put(Lease{Key: "-", Addr: a1}))
+	assert.Error(t, s.Put(Lease{Key: "client", Addr: netip.Prefix{}}))
+
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, s.Put(Lease{Key: "client1", Addr: a1}), ErrClosed)
+	assert.Equal(t, 2, s.Len(), "reads should work after Close")
+}
+
+func TestUpdate(t *testing.T) {
+	s := NewMemory()
+	a1 := netip.MustParsePrefix("2001:db8::/64")
+	a2 := netip.MustParsePrefix("2001:db8:0:1::/64")
+	require.NoError(t, s.Put(Lease{Key: "client", Addr: a1, Expires: expire}))
+
+	err := s.Update(func(tx Tx) error {
+		require.NoError(t, tx.Put(Lease{Key: "client", Addr: a2, Expires: expire}))
+		require.NoError(t, tx.Delete(a1))
+		// changes are visible inside the transaction
+		assert.Equal(t, []Lease{{Key: "client", Addr: a2, Expires: expire}}, tx.ByKey("client"))
+		assert.Equal(t, 1, tx.Len())
+		_, ok := tx.ByAddr(a1)
+		assert.False(t, ok)
+		assert.Len(t, tx.ExpiredBefore(expire), 1)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []Lease{{Key: "client", Addr: a2, Expires: expire}}, s.ByKey("client"))
+
+	failure := errors.New("failure")
+	err = s.Update(func(tx Tx) error {
+		require.NoError(t, tx.Delete(a2))
+		return failure
+	})
+	assert.ErrorIs(t, err, failure)
+	_, ok := s.ByAddr(a2)
+	assert.True(t, ok, "failed transactions should be discarded")
+}
+
+// failingJournal fails to write after a number of changes
+type failingJournal struct {
+	left int
+}
+
+func (j *failingJournal) write(changes []change) error {
+	if j.left < len(changes) {
+		return errors.New("disk full")
+	}
+	j.left -= len(changes)
+	return nil
+}
+
+func (j *failingJournal) compact(*index, bool) error { return nil }
+
+func (j *failingJournal) close() error { return nil }
+
+func TestJournalFailure(t *testing.T) {
+	s := &store{idx: newIndex(), journal: &failingJournal{left: 1}, pending: newBatch()}
+	a1 := netip.MustParsePrefix("10.0.0.1/32")
+	a2 := netip.MustParsePrefix("10.0.0.2/32")
+	require.NoError(t, s.Put(Lease{Key: "client1", Addr: a1, Expires: expire}))
+
+	err := s.Update(func(tx Tx) error {
+		if err := tx.Delete(a1); err != nil {
+			return err
+		}
+		return tx.Put(Lease{Key: "client2", Addr: a2, Expires: expire})
+	})
+	assert.Error(t, err)
+	// the changes are reverted
+	assert.Equal(t, []Lease{{Key: "client1", Addr: a1, Expires: expire}}, s.ByKey("client1"))
+	assert.Empty(t, s.ByKey("client2"))
+	assert.Equal(t, 1, s.Len())
+	assert.NoError(t, s.Close())
+}
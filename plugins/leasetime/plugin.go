@@ -20,23 +20,29 @@ var Plugin = plugins.Plugin{
 	// currently not supported for DHCPv6
 	Setup6: nil,
 	Setup4: setup4,
+	Args4: &plugins.ArgSpec{
+		Args: []plugins.Arg{
+			{Name: "duration", Type: plugins.ArgDuration, Description: "default lease time, unless set by another plugin"},
+		},
+		Examples: []string{"3600s"},
+	},
 }
 
-var (
-	log         = logger.GetLogger("plugins/lease_time")
-	v4LeaseTime time.Duration
-)
-
-// Handler4 handles DHCPv4 packets for the lease_time plugin.
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	if req.OpCode != dhcpv4.OpcodeBootRequest {
+var log = logger.GetLogger("plugins/lease_time")
+
+// makeHandler4 returns a handler for DHCPv4 packets for the lease_time plugin,
+// setting the given lease time.
+func makeHandler4(v4LeaseTime time.Duration) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if req.OpCode != dhcpv4.OpcodeBootRequest {
+			return resp, false
+		}
+		// Set lease time unless it has already been set
+		if !resp.Options.Has(dhcpv4.OptionIPAddressLeaseTime) {
+			resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(v4LeaseTime))
+		}
 		return resp, false
 	}
-	// Set lease time unless it has already been set
-	if !resp.Options.Has(dhcpv4.OptionIPAddressLeaseTime) {
-		resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(v4LeaseTime))
-	}
-	return resp, false
 }
 
 func setup4(args ...string) (handler.Handler4, error) {
@@ -51,7 +57,6 @@ func setup4(args ...string) (handler.Handler4, error) {
 		log.Errorf("invalid duration: %v", args[0])
 		return nil, errors.New("lease_time failed to initialize")
 	}
-	v4LeaseTime = leaseTime
 
-	return Handler4, nil
+	return makeHandler4(leaseTime), nil
 }
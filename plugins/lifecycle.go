@@ -0,0 +1,93 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"github.com/coredhcp/coredhcp/handler"
+)
+
+// Lifecycle is implemented by plugin instances that own resources, like open
+// files or goroutines, so that the server can release them when it stops.
+type Lifecycle interface {
+	// Start is called once all the plugins are loaded, before requests are
+	// handled. Background work should be started here rather than in the
+	// setup function.
+	Start() error
+	// Close releases the resources held by the instance. It is called exactly
+	// once, and may be called without Start having been called, for example
+	// when loading another plugin failed.
+	Close() error
+	// Healthy returns an error if the instance can't currently handle
+	// requests properly.
+	Healthy() error
+}
+
+// NopLifecycle implements Lifecycle with methods that do nothing. Embed it to
+// only implement some of the methods.
+type NopLifecycle struct{}
+
+// Start does nothing
+func (NopLifecycle) Start() error { return nil }
+
+// Close does nothing
+func (NopLifecycle) Close() error { return nil }
+
+// Healthy always reports the instance as healthy
+func (NopLifecycle) Healthy() error { return nil }
+
+// SetupLifecycleFunc6 defines a setup function for DHCPv6 plugins that own
+// resources. The returned Lifecycle can be nil if this particular instance
+// doesn't need one.
+type SetupLifecycleFunc6 func(args ...string) (handler.Handler6, Lifecycle, error)
+
+// SetupLifecycleFunc4 defines a setup function for DHCPv4 plugins that own
+// resources. The returned Lifecycle can be nil if this particular instance
+// doesn't need one.
+type SetupLifecycleFunc4 func(args ...string) (handler.Handler4, Lifecycle, error)
+
+func (p *Plugin) hasSetup6() bool {
+	return p.Setup6 != nil || p.SetupLifecycle6 != nil
+}
+
+func (p *Plugin) hasSetup4() bool {
+	return p.Setup4 != nil || p.SetupLifecycle4 != nil
+}
+
+func (p *Plugin) setup6(args ...string) (handler.Handler6, Lifecycle, error) {
+	if p.SetupLifecycle6 != nil {
+		return p.SetupLifecycle6(args...)
+	}
+	h6, err := p.Setup6(args...)
+	return h6, nil, err
+}
+
+func (p *Plugin) setup4(args ...string) (handler.Handler4, Lifecycle, error) {
+	if p.SetupLifecycle4 != nil {
+		return p.SetupLifecycle4(args...)
+	}
+	h4, err := p.Setup4(args...)
+	return h4, nil, err
+}
+
+// CloseHandlers closes the lifecycles of the given handlers, in the reverse
+// order of loading. Errors are logged, not returned, so that every instance
+// gets a chance to release its resources.
+func CloseHandlers(handlers4 []LoadedHandler4, handlers6 []LoadedHandler6) {
+	for i := len(handlers4) - 1; i >= 0; i-- {
+		closeLifecycle("DHCPv4", handlers4[i].Name, handlers4[i].Lifecycle)
+	}
+	for i := len(handlers6) - 1; i >= 0; i-- {
+		closeLifecycle("DHCPv6", handlers6[i].Name, handlers6[i].Lifecycle)
+	}
+}
+
+func closeLifecycle(proto, name string, lc Lifecycle) {
+	if lc == nil {
+		return
+	}
+	if err := lc.Close(); err != nil {
+		log.Warningf("%s: failed to close plugin `%s`: %v", proto, name, err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testLifecycle struct {
+	NopLifecycle
+	closed int
+}
+
+func (l *testLifecycle) Close() error {
+	l.closed++
+	return nil
+}
+
+func passthrough4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	return resp, false
+}
+
+func TestLoadPluginsClosesOnError(t *testing.T) {
+	var instances []*testLifecycle
+	reg := NewRegistry()
+	require.NoError(t, reg.Register(&Plugin{
+		Name: "test_lifecycle",
+		SetupLifecycle4: func(args ...string) (handler.Handler4, Lifecycle, error) {
+			lc := &testLifecycle{}
+			instances = append(instances, lc)
+			return passthrough4, lc, nil
+		},
+	}))
+	require.NoError(t, reg.Register(&Plugin{
+		Name: "test_failing",
+		Setup4: func(args ...string) (handler.Handler4, error) {
+			return nil, errors.New("setup failed")
+		},
+	}))
+
+	conf := config.New()
+	conf.Server4 = &config.ServerConfig{Plugins: []config.PluginConfig{
+		{Name: "test_lifecycle"},
+		{Name: "test_lifecycle"},
+	}}
+	h4, _, err := LoadPlugins(reg, conf)
+	require.NoError(t, err)
+	require.Len(t, h4, 2)
+	assert.Equal(t, "test_lifecycle", h4[0].Name)
+	assert.Equal(t, instances[0], h4[0].Lifecycle)
+
+	CloseHandlers(h4, nil)
+	for _, lc := range instances {
+		assert.Equal(t, 1, lc.closed)
+	}
+
+	// instances loaded before a failing plugin are released
+	instances = nil
+	conf.Server4.Plugins = append(conf.Server4.Plugins, config.PluginConfig{Name: "test_failing"})
+	_, _, err = LoadPlugins(reg, conf)
+	require.Error(t, err)
+	require.Len(t, instances, 2)
+	for _, lc := range instances {
+		assert.Equal(t, 1, lc.closed)
+	}
+}
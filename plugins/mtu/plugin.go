@@ -22,29 +22,33 @@ var log = logger.GetLogger("plugins/mtu")
 var Plugin = plugins.Plugin{
 	Name:   "mtu",
 	Setup4: setup4,
+	Args4: &plugins.ArgSpec{
+		Args: []plugins.Arg{
+			{Name: "mtu", Type: plugins.ArgInt, Description: "interface MTU to advertise"},
+		},
+		Examples: []string{"1500"},
+	},
 	// No Setup6 since DHCPv6 does not have MTU-related options
 }
 
-var (
-	mtu int
-)
-
 func setup4(args ...string) (handler.Handler4, error) {
 	if len(args) != 1 {
 		return nil, errors.New("need one mtu value")
 	}
-	var err error
-	if mtu, err = strconv.Atoi(args[0]); err != nil {
+	mtu, err := strconv.Atoi(args[0])
+	if err != nil {
 		return nil, fmt.Errorf("invalid mtu: %v", args[0])
 	}
 	log.Infof("loaded mtu %d.", mtu)
-	return Handler4, nil
+	return makeHandler4(mtu), nil
 }
 
-// Handler4 handles DHCPv4 packets for the mtu plugin
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	if req.IsOptionRequested(dhcpv4.OptionInterfaceMTU) {
-		resp.Options.Update(dhcpv4.Option{Code: dhcpv4.OptionInterfaceMTU, Value: dhcpv4.Uint16(mtu)})
+// makeHandler4 returns a handler for DHCPv4 packets advertising the given mtu
+func makeHandler4(mtu int) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if req.IsOptionRequested(dhcpv4.OptionInterfaceMTU) {
+			resp.Options.Update(dhcpv4.Option{Code: dhcpv4.OptionInterfaceMTU, Value: dhcpv4.Uint16(mtu)})
+		}
+		return resp, false
 	}
-	return resp, false
 }
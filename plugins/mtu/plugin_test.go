@@ -21,9 +21,9 @@ func TestAddServer4(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	mtu = 1500
+	mtu := 1500
 
-	resp, stop := Handler4(req, stub)
+	resp, stop := makeHandler4(mtu)(req, stub)
 	if resp == nil {
 		t.Fatal("plugin did not return a message")
 	}
@@ -50,10 +50,10 @@ func TestNotRequested4(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	mtu = 1500
+	mtu := 1500
 	req.UpdateOption(dhcpv4.OptParameterRequestList(dhcpv4.OptionBroadcastAddress))
 
-	resp, stop := Handler4(req, stub)
+	resp, stop := makeHandler4(mtu)(req, stub)
 	if resp == nil {
 		t.Fatal("plugin did not return a message")
 	}
@@ -47,13 +47,20 @@ var Plugin = plugins.Plugin{
 	Name:   "nbp",
 	Setup6: setup6,
 	Setup4: setup4,
+	Args6: &plugins.ArgSpec{
+		Args: []plugins.Arg{
+			{Name: "url", Type: plugins.ArgURL, Description: "URL of the network boot program"},
+		},
+		Examples: []string{"http://[2001:db8:a::1]/nbp"},
+	},
+	Args4: &plugins.ArgSpec{
+		Args: []plugins.Arg{
+			{Name: "url", Type: plugins.ArgURL, Description: "URL of the network boot program, split into TFTP server and file name unless http, https or ftp"},
+		},
+		Examples: []string{"tftp://10.0.0.254/nbp", "http://10.0.0.254/nbp"},
+	},
 }
 
-var (
-	opt59, opt60 dhcpv6.Option
-	opt66, opt67 *dhcpv4.Option
-)
-
 func parseArgs(args ...string) (*url.URL, error) {
 	if len(args) != 1 {
 		return nil, fmt.Errorf("Exactly one argument must be passed to NBP plugin, got %d", len(args))
@@ -66,7 +73,8 @@ func setup6(args ...string) (handler.Handler6, error) {
 	if err != nil {
 		return nil, err
 	}
-	opt59 = dhcpv6.OptBootFileURL(u.String())
+	opt59 := dhcpv6.OptBootFileURL(u.String())
+	var opt60 dhcpv6.Option
 	params := u.Query().Get("params")
 	if params != "" {
 		opt60 = &dhcpv6.OptionGeneric{
@@ -75,7 +83,7 @@ func setup6(args ...string) (handler.Handler6, error) {
 		}
 	}
 	log.Printf("loaded NBP plugin for DHCPv6.")
-	return nbpHandler6, nil
+	return makeNBPHandler6(opt59, opt60), nil
 }
 
 func setup4(args ...string) (handler.Handler4, error) {
@@ -85,6 +93,7 @@ func setup4(args ...string) (handler.Handler4, error) {
 	}
 
 	var otsn, obfn dhcpv4.Option
+	var opt66 *dhcpv4.Option
 	switch u.Scheme {
 	case "http", "https", "ftp":
 		obfn = dhcpv4.OptBootFileName(u.String())
@@ -94,49 +103,48 @@ func setup4(args ...string) (handler.Handler4, error) {
 		opt66 = &otsn
 	}
 
-	opt67 = &obfn
 	log.Printf("loaded NBP plugin for DHCPv4.")
-	return nbpHandler4, nil
+	return makeNBPHandler4(opt66, &obfn), nil
 }
 
-func nbpHandler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
-	if opt59 == nil {
-		// nothing to do
-		return resp, true
-	}
-	decap, err := req.GetInnerMessage()
-	if err != nil {
-		log.Errorf("Could not decapsulate request: %v", err)
-		// drop the request, this is probably a critical error in the packet.
-		return nil, true
-	}
-	for _, code := range decap.Options.RequestedOptions() {
-		if code == dhcpv6.OptionBootfileURL {
-			// bootfile URL is requested
-			resp.AddOption(opt59)
-		} else if code == dhcpv6.OptionBootfileParam {
-			// optionally add opt60, bootfile params, if requested
-			if opt60 != nil {
-				resp.AddOption(opt60)
+// makeNBPHandler6 returns a handler adding the bootfile URL (option 59) and
+// the optional bootfile parameters (option 60) to DHCPv6 responses
+func makeNBPHandler6(opt59, opt60 dhcpv6.Option) handler.Handler6 {
+	return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		decap, err := req.GetInnerMessage()
+		if err != nil {
+			log.Errorf("Could not decapsulate request: %v", err)
+			// drop the request, this is probably a critical error in the packet.
+			return nil, true
+		}
+		for _, code := range decap.Options.RequestedOptions() {
+			if code == dhcpv6.OptionBootfileURL {
+				// bootfile URL is requested
+				resp.AddOption(opt59)
+			} else if code == dhcpv6.OptionBootfileParam {
+				// optionally add opt60, bootfile params, if requested
+				if opt60 != nil {
+					resp.AddOption(opt60)
+				}
 			}
 		}
+		log.Debugf("Added NBP %s to request", opt59)
+		return resp, true
 	}
-	log.Debugf("Added NBP %s to request", opt59)
-	return resp, true
 }
 
-func nbpHandler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	if opt67 == nil {
-		// nothing to do
+// makeNBPHandler4 returns a handler adding the optional TFTP server name
+// (option 66) and the bootfile name (option 67) to DHCPv4 responses
+func makeNBPHandler4(opt66, opt67 *dhcpv4.Option) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if req.IsOptionRequested(dhcpv4.OptionTFTPServerName) && opt66 != nil {
+			resp.Options.Update(*opt66)
+			log.Debugf("Added NBP %s / %s to request", opt66, opt67)
+		}
+		if req.IsOptionRequested(dhcpv4.OptionBootfileName) {
+			resp.Options.Update(*opt67)
+			log.Debugf("Added NBP %s to request", opt67)
+		}
 		return resp, true
 	}
-	if req.IsOptionRequested(dhcpv4.OptionTFTPServerName) && opt66 != nil {
-		resp.Options.Update(*opt66)
-		log.Debugf("Added NBP %s / %s to request", opt66, opt67)
-	}
-	if req.IsOptionRequested(dhcpv4.OptionBootfileName) {
-		resp.Options.Update(*opt67)
-		log.Debugf("Added NBP %s to request", opt67)
-	}
-	return resp, true
 }
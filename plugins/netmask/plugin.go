@@ -21,12 +21,16 @@ var log = logger.GetLogger("plugins/netmask")
 var Plugin = plugins.Plugin{
 	Name:   "netmask",
 	Setup4: setup4,
+	Args4: &plugins.ArgSpec{
+		Args: []plugins.Arg{
+			{Name: "netmask", Type: plugins.ArgIPv4, Description: "network mask to advertise"},
+		},
+		Examples: []string{"255.255.255.0"},
+	},
+	// only useful along with an address
+	Constraints4: &plugins.Constraints{RequiresOneOf: []string{"file", "range", "exec"}},
 }
 
-var (
-	netmask net.IPMask
-)
-
 func setup4(args ...string) (handler.Handler4, error) {
 	log.Printf("loaded plugin for DHCPv4.")
 	if len(args) != 1 {
@@ -40,18 +44,21 @@ func setup4(args ...string) (handler.Handler4, error) {
 	if netmaskIP == nil {
 		return nil, errors.New("expected an netmask address, got: " + args[0])
 	}
-	netmask = net.IPv4Mask(netmaskIP[0], netmaskIP[1], netmaskIP[2], netmaskIP[3])
+	netmask := net.IPv4Mask(netmaskIP[0], netmaskIP[1], netmaskIP[2], netmaskIP[3])
 	if !checkValidNetmask(netmask) {
 		return nil, errors.New("netmask is not valid, got: " + args[0])
 	}
 	log.Printf("loaded client netmask")
-	return Handler4, nil
+	return makeHandler4(netmask), nil
 }
 
-//Handler4 handles DHCPv4 packets for the netmask plugin
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	resp.Options.Update(dhcpv4.OptSubnetMask(netmask))
-	return resp, false
+// makeHandler4 returns a handler for DHCPv4 packets advertising the given
+// netmask
+func makeHandler4(netmask net.IPMask) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		resp.Options.Update(dhcpv4.OptSubnetMask(netmask))
+		return resp, false
+	}
 }
 
 func checkValidNetmask(netmask net.IPMask) bool {
@@ -25,7 +25,7 @@ func TestCheckValidNetmask(t *testing.T) {
 
 func TestHandler4(t *testing.T) {
 	// set plugin netmask
-	netmask = net.IPv4Mask(255, 255, 255, 0)
+	netmask := net.IPv4Mask(255, 255, 255, 0)
 
 	// prepare DHCPv4 request
 	req := &dhcpv4.DHCPv4{}
@@ -35,7 +35,7 @@ func TestHandler4(t *testing.T) {
 
 	// if we handle this DHCP request, the netmask should be one of the options
 	// of the result
-	result, stop := Handler4(req, resp)
+	result, stop := makeHandler4(netmask)(req, resp)
 	assert.Same(t, result, resp)
 	assert.False(t, stop)
 	assert.EqualValues(t, netmask, resp.Options.Get(dhcpv4.OptionSubnetMask))
@@ -43,9 +43,12 @@ func TestHandler4(t *testing.T) {
 
 func TestSetup4(t *testing.T) {
 	// valid configuration
-	_, err := setup4("255.255.255.0")
-	assert.NoError(t, err)
-	assert.EqualValues(t, netmask, net.IPv4Mask(255, 255, 255, 0))
+	handler4, err := setup4("255.255.255.0")
+	if assert.NoError(t, err) {
+		resp := &dhcpv4.DHCPv4{Options: dhcpv4.Options{}}
+		handler4(&dhcpv4.DHCPv4{}, resp)
+		assert.EqualValues(t, net.IPv4Mask(255, 255, 255, 0), resp.Options.Get(dhcpv4.OptionSubnetMask))
+	}
 
 	// no configuration
 	_, err = setup4()
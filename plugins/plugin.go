@@ -17,13 +17,51 @@ var log = logger.GetLogger("plugins")
 // Plugin represents a plugin object.
 // Setup6 and Setup4 are the setup functions for DHCPv6 and DHCPv4 handlers
 // respectively. Both setup functions can be nil.
+// Plugins owning resources that need to be released set SetupLifecycle6 and
+// SetupLifecycle4 instead, which take precedence over Setup6 and Setup4.
+// Args6 and Args4 optionally describe the arguments of the setup functions.
+// When set, the arguments are validated before calling the setup functions,
+// and the description is shown by `coredhcp -P <plugin>`.
+// Constraints6 and Constraints4 optionally restrict where the plugin can
+// appear in the plugin chain, see Constraints.
 type Plugin struct {
-	Name   string
-	Setup6 SetupFunc6
-	Setup4 SetupFunc4
+	Name            string
+	Setup6          SetupFunc6
+	Setup4          SetupFunc4
+	SetupLifecycle6 SetupLifecycleFunc6
+	SetupLifecycle4 SetupLifecycleFunc4
+	Args6           *ArgSpec
+	Args4           *ArgSpec
+	Constraints6    *Constraints
+	Constraints4    *Constraints
 }
 
-// RegisteredPlugins maps a plugin name to a Plugin instance.
+// LoadedHandler6 is a DHCPv6 handler set up from a plugin configuration
+type LoadedHandler6 struct {
+	handler.Handler6
+	// Name is the name of the plugin the handler comes from
+	Name string
+	// Lifecycle manages the resources of the plugin instance, if any
+	Lifecycle Lifecycle
+	// Classes restricts the handler to requests tagged with one of these
+	// client classes. If empty, the handler applies to all requests
+	Classes []string
+}
+
+// LoadedHandler4 is a DHCPv4 handler set up from a plugin configuration
+type LoadedHandler4 struct {
+	handler.Handler4
+	// Name is the name of the plugin the handler comes from
+	Name string
+	// Lifecycle manages the resources of the plugin instance, if any
+	Lifecycle Lifecycle
+	// Classes restricts the handler to requests tagged with one of these
+	// client classes. If empty, the handler applies to all requests
+	Classes []string
+}
+
+// RegisteredPlugins maps a plugin name to a Plugin instance. It backs
+// DefaultRegistry, and is kept for compatibility; use a Registry instead.
 var RegisteredPlugins = make(map[string]*Plugin)
 
 // SetupFunc6 defines a plugin setup function for DHCPv6
@@ -32,56 +70,69 @@ type SetupFunc6 func(args ...string) (handler.Handler6, error)
 // SetupFunc4 defines a plugin setup function for DHCPv6
 type SetupFunc4 func(args ...string) (handler.Handler4, error)
 
-// RegisterPlugin registers a plugin.
+// RegisterPlugin registers a plugin in DefaultRegistry. It returns an error if
+// a plugin with the same name is already registered.
 func RegisterPlugin(plugin *Plugin) error {
-	if plugin == nil {
-		return errors.New("cannot register nil plugin")
-	}
-	log.Printf("Registering plugin '%s'", plugin.Name)
-	if _, ok := RegisteredPlugins[plugin.Name]; ok {
-		// TODO this highlights that asking the plugins to register themselves
-		// is not the right approach. Need to register them in the main program.
-		log.Panicf("Plugin '%s' is already registered", plugin.Name)
-	}
-	RegisteredPlugins[plugin.Name] = plugin
-	return nil
+	return DefaultRegistry.Register(plugin)
 }
 
 // LoadPlugins reads a Config object and loads the plugins as specified in the
 // `plugins` section, in order. For a plugin to be available, it must have been
-// previously registered with plugins.RegisterPlugin. This is normally done at
-// plugin import time.
-// This function returns the list of loaded v6 plugins, the list of loaded v4
-// plugins, and an error if any.
-func LoadPlugins(conf *config.Config) ([]handler.Handler4, []handler.Handler6, error) {
+// previously registered in the registry, which defaults to DefaultRegistry if
+// nil.
+// This function returns the list of loaded v4 plugins, the list of loaded v6
+// plugins, and an error if any. On error, the plugin instances loaded so far
+// are closed.
+func LoadPlugins(reg *Registry, conf *config.Config) (_ []LoadedHandler4, _ []LoadedHandler6, err error) {
 	log.Print("Loading plugins...")
-	handlers4 := make([]handler.Handler4, 0)
-	handlers6 := make([]handler.Handler6, 0)
+	handlers4 := make([]LoadedHandler4, 0)
+	handlers6 := make([]LoadedHandler6, 0)
+	defer func() {
+		if err != nil {
+			CloseHandlers(handlers4, handlers6)
+		}
+	}()
 
+	if reg == nil {
+		reg = DefaultRegistry
+	}
 	if conf.Server6 == nil && conf.Server4 == nil {
 		return nil, nil, errors.New("no configuration found for either DHCPv6 or DHCPv4")
 	}
 
 	// now load the plugins. We need to call its setup function with
-	// the arguments extracted above. The setup function is mapped in
-	// plugins.RegisteredPlugins .
+	// the arguments extracted above. The setup function is looked up in
+	// the registry.
 
 	// Load DHCPv6 plugins.
 	if conf.Server6 != nil {
+		if err := checkChain(6, reg, conf.Server6); err != nil {
+			return nil, nil, err
+		}
 		for _, pluginConf := range conf.Server6.Plugins {
-			if plugin, ok := RegisteredPlugins[pluginConf.Name]; ok {
+			if err := checkClasses(6, conf.Server6, pluginConf); err != nil {
+				return nil, nil, err
+			}
+			if plugin, ok := reg.Lookup(pluginConf.Name); ok {
 				log.Printf("DHCPv6: loading plugin `%s`", pluginConf.Name)
-				if plugin.Setup6 == nil {
+				if !plugin.hasSetup6() {
 					log.Warningf("DHCPv6: plugin `%s` has no setup function for DHCPv6", pluginConf.Name)
 					continue
 				}
-				h6, err := plugin.Setup6(pluginConf.Args...)
+				args, err := plugin.Args6.Check(pluginConf.Args)
+				if err != nil {
+					return nil, nil, config.ConfigErrorFromString("DHCPv6: plugin `%s`: %v", pluginConf.Name, err)
+				}
+				h6, lc, err := plugin.setup6(args...)
 				if err != nil {
 					return nil, nil, err
-				} else if h6 == nil {
+				}
+				// track the instance before checking it, so it's closed on error
+				loaded := LoadedHandler6{Handler6: h6, Name: pluginConf.Name, Lifecycle: lc, Classes: pluginConf.Classes}
+				handlers6 = append(handlers6, loaded)
+				if h6 == nil {
 					return nil, nil, config.ConfigErrorFromString("no DHCPv6 handler for plugin %s", pluginConf.Name)
 				}
-				handlers6 = append(handlers6, h6)
 			} else {
 				return nil, nil, config.ConfigErrorFromString("DHCPv6: unknown plugin `%s`", pluginConf.Name)
 			}
@@ -90,20 +141,33 @@ func LoadPlugins(conf *config.Config) ([]handler.Handler4, []handler.Handler6, e
 	// Load DHCPv4 plugins. Yes, duplicated code, there's not really much that
 	// can be deduplicated here.
 	if conf.Server4 != nil {
+		if err := checkChain(4, reg, conf.Server4); err != nil {
+			return nil, nil, err
+		}
 		for _, pluginConf := range conf.Server4.Plugins {
-			if plugin, ok := RegisteredPlugins[pluginConf.Name]; ok {
+			if err := checkClasses(4, conf.Server4, pluginConf); err != nil {
+				return nil, nil, err
+			}
+			if plugin, ok := reg.Lookup(pluginConf.Name); ok {
 				log.Printf("DHCPv4: loading plugin `%s`", pluginConf.Name)
-				if plugin.Setup4 == nil {
+				if !plugin.hasSetup4() {
 					log.Warningf("DHCPv4: plugin `%s` has no setup function for DHCPv4", pluginConf.Name)
 					continue
 				}
-				h4, err := plugin.Setup4(pluginConf.Args...)
+				args, err := plugin.Args4.Check(pluginConf.Args)
+				if err != nil {
+					return nil, nil, config.ConfigErrorFromString("DHCPv4: plugin `%s`: %v", pluginConf.Name, err)
+				}
+				h4, lc, err := plugin.setup4(args...)
 				if err != nil {
 					return nil, nil, err
-				} else if h4 == nil {
+				}
+				// track the instance before checking it, so it's closed on error
+				loaded := LoadedHandler4{Handler4: h4, Name: pluginConf.Name, Lifecycle: lc, Classes: pluginConf.Classes}
+				handlers4 = append(handlers4, loaded)
+				if h4 == nil {
 					return nil, nil, config.ConfigErrorFromString("no DHCPv4 handler for plugin %s", pluginConf.Name)
 				}
-				handlers4 = append(handlers4, h4)
 			} else {
 				return nil, nil, config.ConfigErrorFromString("DHCPv4: unknown plugin `%s`", pluginConf.Name)
 			}
@@ -112,3 +176,13 @@ func LoadPlugins(conf *config.Config) ([]handler.Handler4, []handler.Handler6, e
 
 	return handlers4, handlers6, nil
 }
+
+// checkClasses verifies that a plugin is only restricted to defined classes
+func checkClasses(ver int, sc *config.ServerConfig, pluginConf config.PluginConfig) error {
+	for _, name := range pluginConf.Classes {
+		if _, ok := sc.Classes[name]; !ok {
+			return config.ConfigErrorFromString("DHCPv%d: plugin `%s` refers to undefined class `%s`", ver, pluginConf.Name, name)
+		}
+	}
+	return nil
+}
@@ -9,16 +9,21 @@
 // - prefix: The base prefix from which assigned prefixes are carved
 // - max: maximum size of the prefix delegated to clients. When a client requests a larger prefix
 // than this, this is the size of the offered prefix
+// - file: optional file storing the delegated prefixes, so that clients keep them across restarts,
+// or "-" to only keep them in memory
+// - valid, preferred, T1, T2: optional lifetimes of the delegated prefixes and renewal times. Clients
+// can ask for shorter lifetimes in their hints, down to minLifetime
+// - grace: optional time after which expired prefixes are delegated again, defaults to the valid
+// lifetime
 package prefix
 
-// FIXME: various settings will be hardcoded (default size, minimum size, lease times) pending a
-// better configuration system
-
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"strconv"
 	"sync"
 	"time"
@@ -32,49 +37,166 @@ import (
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/coredhcp/coredhcp/plugins/allocators"
 	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/coredhcp/coredhcp/plugins/leasestore"
 )
 
 var log = logger.GetLogger("plugins/prefix")
 
 // Plugin registers the prefix. Prefix delegation only exists for DHCPv6
 var Plugin = plugins.Plugin{
-	Name:   "prefix",
-	Setup6: setupPrefix,
+	Name:            "prefix",
+	SetupLifecycle6: setupPrefix,
+	Args6: &plugins.ArgSpec{
+		Args: []plugins.Arg{
+			{Name: "prefix", Type: plugins.ArgPrefix, Description: "pool the delegated prefixes are carved from"},
+			{Name: "size", Type: plugins.ArgInt, Description: "maximum length of the delegated prefixes"},
+			{Name: "file", Type: plugins.ArgString, Optional: true,
+				Description: "file storing the delegated prefixes across restarts, they are only kept in memory if omitted or -"},
+			{Name: "valid_lifetime", Type: plugins.ArgDuration, Optional: true,
+				Description: "valid lifetime of the delegated prefixes, defaults to 1h"},
+			{Name: "preferred_lifetime", Type: plugins.ArgDuration, Optional: true,
+				Description: "preferred lifetime of the delegated prefixes, defaults to the valid lifetime"},
+			{Name: "t1", Type: plugins.ArgDuration, Optional: true,
+				Description: "time after which clients renew, defaults to half the preferred lifetime"},
+			{Name: "t2", Type: plugins.ArgDuration, Optional: true,
+				Description: "time after which clients rebind, defaults to 0.8 times the preferred lifetime"},
+			{Name: "grace", Type: plugins.ArgDuration, Optional: true,
+				Description: "time after which expired prefixes are delegated again, defaults to the valid lifetime"},
+		},
+		Examples: []string{"2001:db8::/48 64", "2001:db8::/48 64 leases-pd.txt", "2001:db8::/48 56 - 24h 12h 6h 9h"},
+	},
 }
 
-const leaseDuration = 3600 * time.Second
+const (
+	// defaultLifetime is the valid lifetime of the delegated prefixes, when
+	// not configured
+	defaultLifetime = 3600 * time.Second
+	// minLifetime is the shortest lifetime clients can get by asking for it
+	// in their hints
+	minLifetime = 5 * time.Minute
+	// noFile is the file argument to keep the delegated prefixes in memory
+	noFile = "-"
+	// reapInterval is how often expired leases are looked for
+	reapInterval = time.Minute
+)
+
+func parseDuration(name, s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s: %v", name, s)
+	}
+	return d, nil
+}
 
-func setupPrefix(args ...string) (handler.Handler6, error) {
-	// - prefix: 2001:db8::/48 64
+func setupPrefix(args ...string) (handler.Handler6, plugins.Lifecycle, error) {
+	// - prefix: 2001:db8::/48 64 [leases-pd.txt]
 	if len(args) < 2 {
-		return nil, errors.New("Need both a subnet and an allocation max size")
+		return nil, nil, errors.New("Need both a subnet and an allocation max size")
 	}
 
 	_, prefix, err := net.ParseCIDR(args[0])
 	if err != nil {
-		return nil, fmt.Errorf("Invalid pool subnet: %v", err)
+		return nil, nil, fmt.Errorf("Invalid pool subnet: %v", err)
 	}
 
 	allocSize, err := strconv.Atoi(args[1])
 	if err != nil || allocSize > 128 || allocSize < 0 {
-		return nil, fmt.Errorf("Invalid prefix length: %v", err)
+		return nil, nil, fmt.Errorf("Invalid prefix length: %v", err)
 	}
 
 	// TODO: select allocators based on heuristics or user configuration
 	alloc, err := bitmap.NewBitmapAllocator(*prefix, allocSize)
 	if err != nil {
-		return nil, fmt.Errorf("Could not initialize prefix allocator: %v", err)
+		return nil, nil, fmt.Errorf("Could not initialize prefix allocator: %v", err)
 	}
 
-	return (&Handler{
-		Records:   make(map[string][]lease),
-		allocator: alloc,
-	}).Handle, nil
+	h := &Handler{
+		pool:              prefix,
+		size:              allocSize,
+		allocator:         alloc,
+		validLifetime:     defaultLifetime,
+		preferredLifetime: defaultLifetime,
+		reapInterval:      reapInterval,
+	}
+	var lifetimes []string
+	if len(args) > 3 {
+		lifetimes = args[3:]
+	}
+	if err := h.parseLifetimes(lifetimes...); err != nil {
+		return nil, nil, err
+	}
+	if len(args) < 3 || args[2] == noFile {
+		h.leases = leasestore.NewMemory()
+		return h.Handle, h, nil
+	}
+	filename := args[2]
+	if filename == "" {
+		return nil, nil, errors.New("file name cannot be empty")
+	}
+	h.leases, err = leasestore.OpenFile(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load records from file: %v", err)
+	}
+	orphans, err := h.reallocate()
+	if err != nil {
+		h.leases.Close()
+		return nil, nil, err
+	}
+	log.Printf("Loaded %d delegated prefixes from %s", h.leases.Len(), filename)
+	if orphans > 0 {
+		log.Warningf("%d delegated prefixes are outside of %s, and are kept until they expire", orphans, prefix)
+	}
+	return h.Handle, h, nil
 }
 
-type lease struct {
-	Prefix net.IPNet
-	Expire time.Time
+// parseLifetimes parses the valid and preferred lifetimes, T1, T2 and the
+// grace period, in this order and all optional
+func (h *Handler) parseLifetimes(args ...string) error {
+	var err error
+	if len(args) > 0 {
+		if h.validLifetime, err = parseDuration("valid lifetime", args[0]); err != nil {
+			return err
+		}
+		h.preferredLifetime = h.validLifetime
+	}
+	if len(args) > 1 {
+		if h.preferredLifetime, err = parseDuration("preferred lifetime", args[1]); err != nil {
+			return err
+		}
+		if h.preferredLifetime > h.validLifetime {
+			return errors.New("the preferred lifetime cannot be longer than the valid lifetime")
+		}
+	}
+	// RFC 8415 section 21.4 recommends 0.5 and 0.8 times the preferred
+	// lifetime
+	h.t1 = h.preferredLifetime / 2
+	h.t2 = h.preferredLifetime * 4 / 5
+	if len(args) > 2 {
+		if h.t1, err = parseDuration("T1", args[2]); err != nil {
+			return err
+		}
+		if h.t2 < h.t1 {
+			h.t2 = h.t1
+		}
+	}
+	if len(args) > 3 {
+		if h.t2, err = parseDuration("T2", args[3]); err != nil {
+			return err
+		}
+	}
+	if h.t1 > h.t2 {
+		return errors.New("T1 cannot be later than T2")
+	}
+	if h.t2 > h.preferredLifetime {
+		return errors.New("T1 and T2 cannot be later than the preferred lifetime")
+	}
+	h.grace = h.validLifetime
+	if len(args) > 4 {
+		if h.grace, err = parseDuration("grace period", args[4]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Handler holds state of allocations for the plugin
@@ -82,10 +204,225 @@ type Handler struct {
 	// Mutex here is the simplest implementation fit for purpose.
 	// We can revisit for perf when we move lease management to separate plugins
 	sync.Mutex
-	// Records has a string'd []byte as key, because []byte can't be a key itself
-	// Since it's not valid utf-8 we can't use any other string function though
-	Records   map[string][]lease
+	pool *net.IPNet
+	size int
+	// configured lifetimes of the delegated prefixes, which are the longest
+	// ones clients get
+	validLifetime     time.Duration
+	preferredLifetime time.Duration
+	t1, t2            time.Duration
+	// grace is how long expired leases are kept, so that returning clients
+	// get the same prefix
+	grace        time.Duration
+	reapInterval time.Duration
+	stop         chan struct{}
+	done         chan struct{}
+	// leases holds the delegated prefixes, keyed by client DUID
+	leases    leasestore.Store
 	allocator allocators.Allocator
+	closed    bool
+	// saveErr is the error of the last failed attempt to persist a lease, if
+	// the following ones failed as well
+	saveErr error
+}
+
+// orphaned returns whether a delegated prefix is outside of the pool, after
+// the pool was changed in the configuration
+func (h *Handler) orphaned(p netip.Prefix) bool {
+	ones, _ := h.pool.Mask.Size()
+	return !h.pool.Contains(p.Addr().AsSlice()) || p.Bits() < ones
+}
+
+// reallocate marks the prefixes of the stored leases as allocated, and
+// returns how many leases are outside of the pool
+func (h *Handler) reallocate() (int, error) {
+	var (
+		err     error
+		orphans int
+	)
+	h.leases.Each(func(l leasestore.Lease) bool {
+		if _, e := hex.DecodeString(l.Key); e != nil {
+			err = fmt.Errorf("malformed client key: %s", l.Key)
+			return false
+		}
+		if !l.Addr.Addr().Is6() || l.Addr.Addr().Is4In6() {
+			err = fmt.Errorf("expected an IPv6 prefix, got: %v", l.Addr)
+			return false
+		}
+		if h.orphaned(l.Addr) {
+			orphans++
+			return true
+		}
+		if l.Addr.Bits() < h.size {
+			err = fmt.Errorf("delegated prefix %v is larger than the allocation size /%d", l.Addr, h.size)
+			return false
+		}
+		prefix, e := h.allocator.Allocate(l.IPNet())
+		if e != nil {
+			err = fmt.Errorf("failed to re-allocate delegated prefix %v: %v", l.Addr, e)
+			return false
+		}
+		if leasestore.FromIPNet(prefix) != l.Addr {
+			err = fmt.Errorf("allocator did not re-allocate delegated prefix %v: %v", l.Addr, prefix.String())
+			return false
+		}
+		return true
+	})
+	return orphans, err
+}
+
+// Start starts reclaiming the expired leases
+func (h *Handler) Start() error {
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		return errors.New("lease file is closed")
+	}
+	if h.stop != nil {
+		return nil
+	}
+	h.stop = make(chan struct{})
+	h.done = make(chan struct{})
+	go h.reaper()
+	return nil
+}
+
+// reaper periodically frees the expired leases, until the plugin is closed
+func (h *Handler) reaper() {
+	defer close(h.done)
+	ticker := time.NewTicker(h.reapInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := h.reap(time.Now()); err != nil {
+			log.Errorf("Could not free expired leases: %v", err)
+		} else if n > 0 {
+			log.Printf("Freed %d expired delegated prefixes", n)
+		}
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reap frees the leases that expired for longer than the grace period at the
+// given time, and returns how many were freed
+func (h *Handler) reap(now time.Time) (int, error) {
+	h.Lock()
+	defer h.Unlock()
+	var expired []leasestore.Lease
+	err := h.leases.Update(func(tx leasestore.Tx) error {
+		expired = tx.ExpiredBefore(now.Add(-h.grace))
+		for _, l := range expired {
+			if err := tx.Delete(l.Addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range expired {
+		log.Debugf("Freeing prefix %s of %s, expired at %s", l.Addr, l.Key, l.Expires)
+		h.free(l)
+	}
+	return len(expired), nil
+}
+
+// free returns the prefix of a lease to the allocator, unless it is outside
+// of the pool
+func (h *Handler) free(l leasestore.Lease) {
+	if h.orphaned(l.Addr) {
+		return
+	}
+	if err := h.allocator.Free(l.IPNet()); err != nil {
+		log.Warningf("Could not free prefix %s: %v", l.Addr, err)
+	}
+}
+
+// Close stops reclaiming expired leases and closes the lease file. No
+// prefixes can be delegated afterwards
+func (h *Handler) Close() error {
+	h.Lock()
+	if h.closed {
+		h.Unlock()
+		return nil
+	}
+	h.closed = true
+	stop, done := h.stop, h.done
+	h.Unlock()
+	// the reaper takes the lock
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return h.leases.Close()
+}
+
+// Healthy reports whether leases can be persisted to the lease file
+func (h *Handler) Healthy() error {
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		return errors.New("lease file is closed")
+	}
+	if h.saveErr != nil {
+		return fmt.Errorf("failed to persist leases: %w", h.saveErr)
+	}
+	return nil
+}
+
+// lifetime returns the lifetime asked for by a client if it is within the
+// bounds, else the configured one
+func lifetime(asked, configured time.Duration) time.Duration {
+	if asked == 0 || asked > configured {
+		return configured
+	}
+	if asked < minLifetime {
+		if configured < minLifetime {
+			return configured
+		}
+		return minLifetime
+	}
+	return asked
+}
+
+// lifetimes returns the preferred and valid lifetimes of a prefix delegated
+// for a hint
+func (h *Handler) lifetimes(hint *dhcpv6.OptIAPrefix) (preferred, valid time.Duration) {
+	valid = lifetime(hint.ValidLifetime, h.validLifetime)
+	preferred = lifetime(hint.PreferredLifetime, h.preferredLifetime)
+	if preferred > valid {
+		preferred = valid
+	}
+	return preferred, valid
+}
+
+// setTimers sets T1 and T2 of an IA_PD, which are not later than 0.5 and 0.8
+// times the shortest preferred lifetime of its prefixes
+func (h *Handler) setTimers(ia *dhcpv6.OptIAPD) {
+	shortest := time.Duration(-1)
+	for _, p := range ia.Options.Prefixes() {
+		// prefixes the client can't use anymore don't count
+		if p.ValidLifetime == 0 {
+			continue
+		}
+		if shortest < 0 || p.PreferredLifetime < shortest {
+			shortest = p.PreferredLifetime
+		}
+	}
+	if shortest < 0 {
+		return
+	}
+	ia.T1, ia.T2 = h.t1, h.t2
+	if t1 := shortest / 2; t1 < ia.T1 {
+		ia.T1 = t1
+	}
+	if t2 := shortest * 4 / 5; t2 < ia.T2 {
+		ia.T2 = t2
+	}
 }
 
 // samePrefix returns true if both prefixes are defined and equal
@@ -97,9 +434,100 @@ func samePrefix(a, b *net.IPNet) bool {
 	return a.IP.Equal(b.IP) && bytes.Equal(a.Mask, b.Mask)
 }
 
-// recordKey computes the key for the Records array from the client ID
+// explicit returns whether a hint names a prefix, rather than only a length
+func explicit(hint *dhcpv6.OptIAPrefix) bool {
+	return hint.Prefix != nil && hint.Prefix.IP != nil && !hint.Prefix.IP.Equal(net.IPv6zero)
+}
+
+// hasPrefix returns whether an IA_PD contains a prefix
+func hasPrefix(ia *dhcpv6.OptIAPD, prefix *net.IPNet) bool {
+	for _, p := range ia.Options.Prefixes() {
+		if samePrefix(p.Prefix, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownBinding answers an IA_PD of a Renew or a Rebind from a client without
+// delegated prefixes (RFC 8415 sections 18.3.4 and 18.3.5). The prefixes of a
+// Rebind that are not from the pool get zero lifetimes, and the other ones a
+// NoBinding status, so that the client sends a Request.
+func (h *Handler) unknownBinding(mt dhcpv6.MessageType, iapd *dhcpv6.OptIAPD) *dhcpv6.OptIAPD {
+	ia := &dhcpv6.OptIAPD{IaId: iapd.IaId}
+	if mt == dhcpv6.MessageTypeRebind {
+		for _, hint := range iapd.Options.Prefixes() {
+			if explicit(hint) && !h.pool.Contains(hint.Prefix.IP) {
+				ia.Options.Add(&dhcpv6.OptIAPrefix{Prefix: dup(hint.Prefix)})
+			}
+		}
+	}
+	if len(ia.Options.Options) == 0 {
+		ia.Options.Add(&dhcpv6.OptStatusCode{
+			StatusCode:    dhcpIana.StatusNoBinding,
+			StatusMessage: "no binding for the IA_PD",
+		})
+	}
+	return ia
+}
+
+// release frees the prefixes named in the IA_PDs of a Release. The IA_PDs
+// without any of the prefixes delegated to the client get a NoBinding status
+func (h *Handler) release(client dhcpv6.DUID, iapds []*dhcpv6.OptIAPD, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	h.Lock()
+	defer h.Unlock()
+	var (
+		released []leasestore.Lease
+		unbound  []*dhcpv6.OptIAPD
+	)
+	err := h.leases.Update(func(tx leasestore.Tx) error {
+		released, unbound = nil, nil
+		for _, iapd := range iapds {
+			found := false
+			for _, hint := range iapd.Options.Prefixes() {
+				for _, l := range tx.ByKey(recordKey(client)) {
+					prefix := l.IPNet()
+					if !samePrefix(hint.Prefix, &prefix) {
+						continue
+					}
+					if err := tx.Delete(l.Addr); err != nil {
+						return err
+					}
+					released = append(released, l)
+					found = true
+				}
+			}
+			if !found {
+				unbound = append(unbound, iapd)
+			}
+		}
+		return nil
+	})
+	h.saveErr = err
+	if err != nil {
+		log.Errorf("Could not store the leases of %s: %v", client, err)
+		return nil, true
+	}
+	for _, l := range released {
+		log.Printf("Prefix %s was released by %s", l.Addr, client)
+		h.free(l)
+	}
+	for _, iapd := range unbound {
+		ia := &dhcpv6.OptIAPD{IaId: iapd.IaId}
+		ia.Options.Add(&dhcpv6.OptStatusCode{
+			StatusCode:    dhcpIana.StatusNoBinding,
+			StatusMessage: "no binding for the IA_PD",
+		})
+		resp.AddOption(ia)
+	}
+	// other plugins may answer for other IAs of the same message
+	resp.UpdateOption(&dhcpv6.OptStatusCode{StatusCode: dhcpIana.StatusSuccess, StatusMessage: "prefixes released"})
+	return resp, false
+}
+
+// recordKey computes the lease key from the client ID
 func recordKey(d dhcpv6.DUID) string {
-	return string(d.ToBytes())
+	return hex.EncodeToString(d.ToBytes())
 }
 
 // Handle processes DHCPv6 packets for the prefix plugin for a given allocator/leaseset
@@ -116,6 +544,16 @@ func (h *Handler) Handle(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		return nil, true
 	}
 
+	switch msg.Type() {
+	case dhcpv6.MessageTypeRelease:
+		return h.release(client, msg.Options.IAPD(), resp)
+	case dhcpv6.MessageTypeDecline, dhcpv6.MessageTypeConfirm:
+		// RFC 8415 sections 18.2.3 and 18.2.8: these are only about
+		// addresses, the IA_PDs are ignored
+		return resp, false
+	}
+	renewing := msg.Type() == dhcpv6.MessageTypeRenew || msg.Type() == dhcpv6.MessageTypeRebind
+
 	// Each request IA_PD requires an IA_PD response
 	for _, iapd := range msg.Options.IAPD() {
 		if err != nil {
@@ -143,7 +581,19 @@ func (h *Handler) Handle(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		// A possible simple optimization here would be to be able to lock single map values
 		// individually instead of the whole map, since we lock for some amount of time
 		h.Lock()
-		knownLeases := h.Records[recordKey(client)]
+		var knownLeases []leasestore.Lease
+		for _, l := range h.leases.ByKey(recordKey(client)) {
+			// prefixes outside of the pool are not extended, see reallocate
+			if !h.orphaned(l.Addr) {
+				knownLeases = append(knownLeases, l)
+			}
+		}
+		if renewing && len(knownLeases) == 0 {
+			h.Unlock()
+			log.Printf("%s for unknown binding of %s (IAID: %x)", msg.Type(), client, iapd.IaId)
+			resp.AddOption(h.unknownBinding(msg.Type(), iapd))
+			continue
+		}
 		// Bitmap to track which leases are already given in this exchange
 		givenOut := bitset.New(uint(len(knownLeases)))
 
@@ -153,27 +603,26 @@ func (h *Handler) Handle(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		// Try to find leases that exactly match a hint, and extend them to satisfy the request
 		// This is the safest heuristic, if the lease matches exactly we know we aren't missing
 		// assigning it to a better candidate request
-		for hintIdx, h := range hints {
+		for hintIdx, hint := range hints {
+			preferred, valid := h.lifetimes(hint)
 			for leaseIdx := range knownLeases {
-				if samePrefix(h.Prefix, &knownLeases[leaseIdx].Prefix) {
-					expire := time.Now().Add(leaseDuration)
-					if knownLeases[leaseIdx].Expire.Before(expire) {
-						knownLeases[leaseIdx].Expire = expire
-					}
+				leasePrefix := knownLeases[leaseIdx].IPNet()
+				if samePrefix(hint.Prefix, &leasePrefix) {
+					knownLeases[leaseIdx].Expires = time.Now().Add(valid)
 					satisfied.Set(uint(hintIdx))
 					givenOut.Set(uint(leaseIdx))
-					addPrefix(iapdResp, knownLeases[leaseIdx])
+					addPrefix(iapdResp, knownLeases[leaseIdx], preferred)
 				}
 			}
 		}
 
 		// Then handle the empty hints, by giving out any remaining lease we
 		// have already assigned to this client
-		for hintIdx, h := range hints {
-			if satisfied.Test(uint(hintIdx)) ||
-				(h.Prefix != nil && !h.Prefix.IP.Equal(net.IPv6zero)) {
+		for hintIdx, hint := range hints {
+			if satisfied.Test(uint(hintIdx)) || explicit(hint) {
 				continue
 			}
+			preferred, valid := h.lifetimes(hint)
 			for leaseIdx, l := range knownLeases {
 				if givenOut.Test(uint(leaseIdx)) {
 					continue
@@ -181,19 +630,16 @@ func (h *Handler) Handle(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 
 				// If a length was requested, only give out prefixes of that length
 				// This is a bad heuristic depending on the allocator behavior, to be improved
-				if hintPrefixLen, _ := h.Prefix.Mask.Size(); hintPrefixLen != 0 {
-					leasePrefixLen, _ := l.Prefix.Mask.Size()
+				if hintPrefixLen, _ := hint.Prefix.Mask.Size(); hintPrefixLen != 0 {
+					leasePrefixLen := l.Addr.Bits()
 					if hintPrefixLen != leasePrefixLen {
 						continue
 					}
 				}
-				expire := time.Now().Add(leaseDuration)
-				if knownLeases[leaseIdx].Expire.Before(expire) {
-					knownLeases[leaseIdx].Expire = expire
-				}
+				knownLeases[leaseIdx].Expires = time.Now().Add(valid)
 				satisfied.Set(uint(hintIdx))
 				givenOut.Set(uint(leaseIdx))
-				addPrefix(iapdResp, knownLeases[leaseIdx])
+				addPrefix(iapdResp, knownLeases[leaseIdx], preferred)
 			}
 		}
 
@@ -206,9 +652,11 @@ func (h *Handler) Handle(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		// with an empty, or length-only hint)
 
 		// Assign a new lease to satisfy the request
-		var newLeases []lease
+		var newLeases []leasestore.Lease
 		for i, prefix := range hints {
-			if satisfied.Test(uint(i)) {
+			// prefixes named in a Renew or a Rebind that aren't the
+			// client's are ended below, rather than replaced
+			if satisfied.Test(uint(i)) || renewing && explicit(prefix) {
 				continue
 			}
 
@@ -222,27 +670,64 @@ func (h *Handler) Handle(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 				log.Debugf("Nothing allocated for hinted prefix %s", prefix)
 				continue
 			}
-			l := lease{
-				Expire: time.Now().Add(leaseDuration),
-				Prefix: allocated,
+			preferred, valid := h.lifetimes(prefix)
+			l := leasestore.Lease{
+				Key:     recordKey(client),
+				Addr:    leasestore.FromIPNet(allocated),
+				Expires: time.Now().Add(valid),
 			}
 
-			addPrefix(iapdResp, l)
-			newLeases = append(knownLeases, l)
+			addPrefix(iapdResp, l, preferred)
+			newLeases = append(newLeases, l)
 			log.Debugf("Allocated %s to %s (IAID: %x)", &allocated, client, iapd.IaId)
 		}
 
-		if newLeases != nil {
-			h.Records[recordKey(client)] = newLeases
+		// only the leases extended or created by this exchange are stored
+		changed := newLeases
+		for leaseIdx, l := range knownLeases {
+			if givenOut.Test(uint(leaseIdx)) {
+				changed = append(changed, l)
+			}
+		}
+		err := h.leases.Update(func(tx leasestore.Tx) error {
+			for _, l := range changed {
+				if err := tx.Put(l); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		h.saveErr = err
+		if err != nil {
+			for _, l := range newLeases {
+				if err := h.allocator.Free(l.IPNet()); err != nil {
+					log.Warningf("Could not free prefix %s: %v", l.Addr, err)
+				}
+			}
+			h.Unlock()
+			log.Errorf("Could not store the leases of %s: %v", client, err)
+			return nil, true
 		}
 		h.Unlock()
 
+		// RFC 8415 section 18.3.4: the prefixes that are not renewed are
+		// returned with zero lifetimes
+		if renewing {
+			for _, hint := range hints {
+				if !explicit(hint) || hasPrefix(iapdResp, hint.Prefix) {
+					continue
+				}
+				iapdResp.Options.Add(&dhcpv6.OptIAPrefix{Prefix: dup(hint.Prefix)})
+			}
+		}
+
 		if len(iapdResp.Options.Options) == 0 {
 			log.Debugf("No valid prefix to return for IAID %x", iapd.IaId)
 			iapdResp.Options.Add(&dhcpv6.OptStatusCode{
 				StatusCode: dhcpIana.StatusNoPrefixAvail,
 			})
 		}
+		h.setTimers(iapdResp)
 
 		resp.AddOption(iapdResp)
 	}
@@ -250,13 +735,18 @@ func (h *Handler) Handle(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 	return resp, false
 }
 
-func addPrefix(resp *dhcpv6.OptIAPD, l lease) {
-	lifetime := time.Until(l.Expire)
+func addPrefix(resp *dhcpv6.OptIAPD, l leasestore.Lease, preferred time.Duration) {
+	// lifetimes are sent in seconds
+	valid := time.Until(l.Expires).Round(time.Second)
+	if preferred > valid {
+		preferred = valid
+	}
+	prefix := l.IPNet()
 
 	resp.Options.Add(&dhcpv6.OptIAPrefix{
-		PreferredLifetime: lifetime,
-		ValidLifetime:     lifetime,
-		Prefix:            dup(&l.Prefix),
+		PreferredLifetime: preferred,
+		ValidLifetime:     valid,
+		Prefix:            dup(&prefix),
 	})
 }
 
@@ -6,10 +6,17 @@ package prefix
 
 import (
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/coredhcp/coredhcp/handler"
 	"github.com/insomniacslk/dhcp/dhcpv6"
 	dhcpIana "github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRoundTrip(t *testing.T) {
@@ -34,7 +41,7 @@ func TestRoundTrip(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	handler, err := setupPrefix("2001:db8::/48", "64")
+	handler, _, err := setupPrefix("2001:db8::/48", "64")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -91,3 +98,247 @@ func TestDup(t *testing.T) {
 		t.Fatalf("dup doesn't work: got %v expected %v", dupPrefix, prefix)
 	}
 }
+
+// exchange sends a message with an IA_PD through the handler, and returns the
+// reply
+func exchange(t *testing.T, h handler.Handler6, mt dhcpv6.MessageType, mac net.HardwareAddr, hints ...*dhcpv6.OptIAPrefix) *dhcpv6.Message {
+	req, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	req.MessageType = mt
+	req.AddOption(dhcpv6.OptClientID(&dhcpv6.DUIDLL{HWType: dhcpIana.HWTypeEthernet, LinkLayerAddr: mac}))
+	iapd := &dhcpv6.OptIAPD{IaId: [4]byte{0, 0, 0, 1}}
+	for _, hint := range hints {
+		iapd.Options.Add(hint)
+	}
+	req.AddOption(iapd)
+	resp, err := dhcpv6.NewReplyFromMessage(req)
+	require.NoError(t, err)
+	r, stop := h(req, resp)
+	require.NotNil(t, r)
+	assert.False(t, stop)
+	return r.(*dhcpv6.Message)
+}
+
+// requestIAPD sends a Request with an IA_PD through the handler, and returns
+// the IA_PD of the reply
+func requestIAPD(t *testing.T, h handler.Handler6, mac net.HardwareAddr, hints ...*dhcpv6.OptIAPrefix) *dhcpv6.OptIAPD {
+	iapd := exchange(t, h, dhcpv6.MessageTypeRequest, mac, hints...).Options.OneIAPD()
+	require.NotNil(t, iapd)
+	return iapd
+}
+
+// request sends a Request with an IA_PD through the handler, and returns the
+// delegated prefix, if any
+func request(t *testing.T, h handler.Handler6, mac net.HardwareAddr) string {
+	prefixes := requestIAPD(t, h, mac).Options.Prefixes()
+	if len(prefixes) == 0 {
+		return ""
+	}
+	require.Len(t, prefixes, 1)
+	return prefixes[0].Prefix.String()
+}
+
+func TestPersistence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases-pd.txt")
+	h, lc, err := setupPrefix("2001:db8::/62", "64", filename)
+	require.NoError(t, err)
+	first := request(t, h, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	second := request(t, h, net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	assert.NotEqual(t, first, second)
+	require.NoError(t, lc.Close())
+
+	// clients keep their prefix across restarts, and the prefixes are not
+	// given to others
+	h, lc, err = setupPrefix("2001:db8::/62", "64", filename)
+	require.NoError(t, err)
+	defer lc.Close()
+	assert.Equal(t, second, request(t, h, net.HardwareAddr{2, 0, 0, 0, 0, 2}))
+	third := request(t, h, net.HardwareAddr{2, 0, 0, 0, 0, 3})
+	assert.NotEqual(t, first, third)
+	assert.NotEqual(t, second, third)
+}
+
+func TestPersistChangesOnly(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases-pd.txt")
+	h, lc, err := setupPrefix("2001:db8::/62", "64", filename)
+	require.NoError(t, err)
+	defer lc.Close()
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	first := request(t, h, mac)
+
+	// the lease of the first prefix is not extended by asking for another
+	// one, and isn't written again
+	iapd := requestIAPD(t, h, mac, hint(t, "2001:db8:0:2::/64"))
+	prefixes := iapd.Options.Prefixes()
+	require.Len(t, prefixes, 1)
+	assert.Equal(t, "2001:db8:0:2::/64", prefixes[0].Prefix.String())
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), first), string(data))
+
+	// but it is when it is renewed
+	requestIAPD(t, h, mac, hint(t, first))
+	data, err = os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), first), string(data))
+}
+
+func TestLoadLeases(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases-pd.txt")
+	leases := `00030001020000000001 2001:db8::/64 2000-01-01T00:00:00Z
+00030001020000000002 2001:db8:1::/64 2000-01-01T00:00:00Z
+`
+	require.NoError(t, os.WriteFile(filename, []byte(leases), 0640))
+	h, lc, err := setupPrefix("2001:db8::/63", "64", filename)
+	require.NoError(t, err)
+	defer lc.Close()
+	assert.Equal(t, "2001:db8:0:1::/64", request(t, h, net.HardwareAddr{2, 0, 0, 0, 0, 3}))
+
+	for _, bad := range []string{
+		"client 2001:db8::/64 2000-01-01T00:00:00Z\n",
+		"0003 10.0.0.0/24 2000-01-01T00:00:00Z\n",
+		"0003 2001:db8::/63 2000-01-01T00:00:00Z\n",
+		"0003 2001:db8::/64 2000-01-01T00:00:00Z\n0004 2001:db8::/65 2000-01-01T00:00:00Z\n",
+	} {
+		filename := filepath.Join(t.TempDir(), "leases-pd.txt")
+		require.NoError(t, os.WriteFile(filename, []byte(bad), 0640))
+		_, _, err := setupPrefix("2001:db8::/62", "64", filename)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestLifetimes(t *testing.T) {
+	h, _, err := setupPrefix("2001:db8::/48", "64", "-", "24h", "12h", "6h", "9h")
+	require.NoError(t, err)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	iapd := requestIAPD(t, h, mac)
+	assert.Equal(t, 6*time.Hour, iapd.T1)
+	assert.Equal(t, 9*time.Hour, iapd.T2)
+	prefix := iapd.Options.Prefixes()[0]
+	assert.Equal(t, 12*time.Hour, prefix.PreferredLifetime)
+	assert.InDelta(t, float64(24*time.Hour), float64(prefix.ValidLifetime), float64(time.Second))
+
+	// shorter lifetimes asked by the client are honored, within bounds, and
+	// T1 and T2 follow the preferred lifetime
+	for _, c := range []struct {
+		preferred, valid         time.Duration
+		wantPreferred, wantValid time.Duration
+		wantT1, wantT2           time.Duration
+	}{
+		{time.Hour, 2 * time.Hour, time.Hour, 2 * time.Hour, 30 * time.Minute, 48 * time.Minute},
+		{time.Minute, time.Minute, 5 * time.Minute, 5 * time.Minute, 150 * time.Second, 4 * time.Minute},
+		{48 * time.Hour, 48 * time.Hour, 12 * time.Hour, 24 * time.Hour, 6 * time.Hour, 9 * time.Hour},
+		{0, 0, 12 * time.Hour, 24 * time.Hour, 6 * time.Hour, 9 * time.Hour},
+	} {
+		iapd := requestIAPD(t, h, mac, &dhcpv6.OptIAPrefix{
+			PreferredLifetime: c.preferred,
+			ValidLifetime:     c.valid,
+			Prefix:            &net.IPNet{},
+		})
+		prefix := iapd.Options.Prefixes()[0]
+		assert.Equal(t, c.wantPreferred, prefix.PreferredLifetime, c)
+		assert.InDelta(t, float64(c.wantValid), float64(prefix.ValidLifetime), float64(time.Second), c)
+		assert.Equal(t, c.wantT1, iapd.T1, c)
+		assert.Equal(t, c.wantT2, iapd.T2, c)
+	}
+
+	for _, bad := range [][]string{
+		{"2001:db8::/48", "64", "-", "1h", "2h"},
+		{"2001:db8::/48", "64", "-", "1h", "1h", "40m", "30m"},
+		{"2001:db8::/48", "64", "-", "1h", "1h", "40m", "2h"},
+		{"2001:db8::/48", "64", "-", "1h", "1h", "2h"},
+		{"2001:db8::/48", "64", "-", "1h", "30m", "20m", "40m"},
+		{"2001:db8::/48", "64", "-", "-1h"},
+	} {
+		_, _, err := setupPrefix(bad...)
+		assert.Error(t, err, bad)
+	}
+}
+
+// hint returns an IA prefix option naming a prefix
+func hint(t *testing.T, prefix string) *dhcpv6.OptIAPrefix {
+	_, n, err := net.ParseCIDR(prefix)
+	require.NoError(t, err)
+	return &dhcpv6.OptIAPrefix{Prefix: n}
+}
+
+func iapdStatus(m *dhcpv6.Message) dhcpIana.StatusCode {
+	status := m.Options.OneIAPD().Options.Status()
+	if status == nil {
+		return dhcpIana.StatusSuccess
+	}
+	return status.StatusCode
+}
+
+func TestRelease(t *testing.T) {
+	h, _, err := setupPrefix("2001:db8::/63", "64")
+	require.NoError(t, err)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	first := request(t, h, mac)
+	second := request(t, h, net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	assert.Equal(t, "", request(t, h, net.HardwareAddr{2, 0, 0, 0, 0, 3}))
+
+	// only the prefixes of the client are released
+	reply := exchange(t, h, dhcpv6.MessageTypeRelease, mac, hint(t, second))
+	assert.Equal(t, dhcpIana.StatusSuccess, reply.Options.Status().StatusCode)
+	assert.Equal(t, dhcpIana.StatusNoBinding, iapdStatus(reply))
+	reply = exchange(t, h, dhcpv6.MessageTypeRelease, mac, hint(t, first))
+	assert.Equal(t, dhcpIana.StatusSuccess, reply.Options.Status().StatusCode)
+	assert.Nil(t, reply.Options.OneIAPD())
+
+	// and can be delegated again
+	assert.Equal(t, first, request(t, h, net.HardwareAddr{2, 0, 0, 0, 0, 3}))
+}
+
+func TestUnknownBindings(t *testing.T) {
+	h, _, err := setupPrefix("2001:db8::/48", "64")
+	require.NoError(t, err)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	reply := exchange(t, h, dhcpv6.MessageTypeRenew, mac, hint(t, "2001:db8::/64"))
+	assert.Equal(t, dhcpIana.StatusNoBinding, iapdStatus(reply))
+	reply = exchange(t, h, dhcpv6.MessageTypeRebind, mac, hint(t, "2001:db8::/64"))
+	assert.Equal(t, dhcpIana.StatusNoBinding, iapdStatus(reply))
+
+	// prefixes from elsewhere are invalidated on Rebind
+	reply = exchange(t, h, dhcpv6.MessageTypeRebind, mac, hint(t, "2001:db8:1::/64"))
+	assert.Equal(t, dhcpIana.StatusSuccess, iapdStatus(reply))
+	prefixes := reply.Options.OneIAPD().Options.Prefixes()
+	require.Len(t, prefixes, 1)
+	assert.Equal(t, "2001:db8:1::/64", prefixes[0].Prefix.String())
+	assert.Equal(t, time.Duration(0), prefixes[0].ValidLifetime)
+
+	// known clients renew their prefix, and the other ones get zero lifetimes
+	prefix := request(t, h, mac)
+	reply = exchange(t, h, dhcpv6.MessageTypeRenew, mac, hint(t, prefix), hint(t, "2001:db8:1::/64"))
+	lifetimes := make(map[string]time.Duration)
+	for _, p := range reply.Options.OneIAPD().Options.Prefixes() {
+		lifetimes[p.Prefix.String()] = p.ValidLifetime.Round(time.Minute)
+	}
+	assert.Equal(t, map[string]time.Duration{prefix: time.Hour, "2001:db8:1::/64": 0}, lifetimes)
+	assert.Equal(t, 30*time.Minute, reply.Options.OneIAPD().T1)
+}
+
+func TestReap(t *testing.T) {
+	h, lc, err := setupPrefix("2001:db8::/64", "64", "-", "1h", "1h", "30m", "48m", "10m")
+	require.NoError(t, err)
+	defer lc.Close()
+	p := lc.(*Handler)
+	prefix := request(t, h, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	assert.Equal(t, "2001:db8::/64", prefix)
+	assert.Equal(t, "", request(t, h, net.HardwareAddr{2, 0, 0, 0, 0, 2}))
+
+	// expired prefixes are kept for the grace period
+	n, err := p.reap(time.Now().Add(65 * time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	n, err = p.reap(time.Now().Add(75 * time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, prefix, request(t, h, net.HardwareAddr{2, 0, 0, 0, 0, 2}))
+
+	require.NoError(t, lc.Start())
+	require.NoError(t, lc.Close())
+	assert.Error(t, lc.Healthy())
+}
@@ -0,0 +1,102 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// keyPolicy computes the key of the lease of a client from its request.
+//
+// Leases keyed by hardware address are stored with the bare address, as in
+// the lease files written before the key policies existed. Other keys are
+// prefixed with their kind: `id:<hex client identifier>` and
+// `relay<sub-option>:<hex value>`.
+type keyPolicy func(req *dhcpv4.DHCPv4) string
+
+// parseKeyPolicy parses the name of a key policy:
+//   - client-id: the client identifier (option 61), else the hardware address
+//   - chaddr: the hardware address only
+//   - circuit-id, remote-id or relay:<code>: a sub-option of the relay agent
+//     information (option 82), else the hardware address
+func parseKeyPolicy(name string) (keyPolicy, error) {
+	switch strings.ToLower(name) {
+	case "client-id":
+		return clientIDKey, nil
+	case "chaddr":
+		return chaddrKey, nil
+	case "circuit-id":
+		return relayKey(dhcpv4.AgentCircuitIDSubOption.Code()), nil
+	case "remote-id":
+		return relayKey(dhcpv4.AgentRemoteIDSubOption.Code()), nil
+	}
+	if code, ok := cutPrefixFold(name, "relay:"); ok {
+		sub, err := strconv.ParseUint(code, 10, 8)
+		if err != nil || sub == 0 {
+			return nil, fmt.Errorf("invalid relay sub-option %q", code)
+		}
+		return relayKey(uint8(sub)), nil
+	}
+	return nil, fmt.Errorf("invalid key policy %q, want client-id, chaddr, circuit-id, remote-id or relay:<code>", name)
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+func chaddrKey(req *dhcpv4.DHCPv4) string {
+	return req.ClientHWAddr.String()
+}
+
+func clientIDKey(req *dhcpv4.DHCPv4) string {
+	if id := req.Options.Get(dhcpv4.OptionClientIdentifier); len(id) > 0 {
+		return "id:" + hex.EncodeToString(id)
+	}
+	return chaddrKey(req)
+}
+
+func relayKey(sub uint8) keyPolicy {
+	return func(req *dhcpv4.DHCPv4) string {
+		if info := req.RelayAgentInfo(); info != nil {
+			if v := info.Get(dhcpv4.GenericOptionCode(sub)); len(v) > 0 {
+				return fmt.Sprintf("relay%d:%s", sub, hex.EncodeToString(v))
+			}
+		}
+		return chaddrKey(req)
+	}
+}
+
+// validKey returns whether a key of the lease file could have been computed
+// by one of the key policies
+func validKey(key string) bool {
+	kind, value, ok := strings.Cut(key, ":")
+	if ok && (kind == "id" || strings.HasPrefix(kind, "relay")) {
+		if kind != "id" {
+			if sub, err := strconv.ParseUint(kind[len("relay"):], 10, 8); err != nil || sub == 0 {
+				return false
+			}
+		}
+		b, err := hex.DecodeString(value)
+		return err == nil && len(b) > 0
+	}
+	// hardware addresses of any length, as formatted by net.HardwareAddr
+	for _, b := range strings.Split(key, ":") {
+		if len(b) != 2 {
+			return false
+		}
+		if _, err := hex.DecodeString(b); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyPolicy(t *testing.T) {
+	req, _ := newRequest(t, "02:00:00:00:00:01")
+	withID, _ := newRequest(t, "02:00:00:00:00:01")
+	withID.UpdateOption(dhcpv4.OptClientIdentifier([]byte{0x01, 0xaa, 0xbb}))
+	relayed, _ := newRequest(t, "02:00:00:00:00:01")
+	relayed.UpdateOption(dhcpv4.OptRelayAgentInfo(
+		dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("eth0")),
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(9), []byte{0x42}),
+	))
+
+	for _, tt := range []struct {
+		policy string
+		req    *dhcpv4.DHCPv4
+		want   string
+	}{
+		{"client-id", withID, "id:01aabb"},
+		{"client-id", req, "02:00:00:00:00:01"},
+		{"chaddr", withID, "02:00:00:00:00:01"},
+		{"circuit-id", relayed, "relay1:65746830"},
+		{"remote-id", relayed, "02:00:00:00:00:01"},
+		{"relay:9", relayed, "relay9:42"},
+		{"Relay:9", req, "02:00:00:00:00:01"},
+	} {
+		key, err := parseKeyPolicy(tt.policy)
+		require.NoError(t, err, tt.policy)
+		got := key(tt.req)
+		assert.Equal(t, tt.want, got, tt.policy)
+		assert.True(t, validKey(got), got)
+	}
+
+	for _, bad := range []string{"", "mac", "relay:", "relay:0", "relay:256", "relay:x"} {
+		_, err := parseKeyPolicy(bad)
+		assert.Error(t, err, bad)
+	}
+	for _, bad := range []string{"foo", "id:", "id:xyz", "relay0:42", "relayx:42", "02:00:0"} {
+		assert.False(t, validKey(bad), bad)
+	}
+	// 20 bytes InfiniBand hardware addresses
+	assert.True(t, validKey(net.HardwareAddr(make([]byte, 20)).String()))
+}
+
+func TestClientIDLeases(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.txt")
+	require.NoError(t, os.WriteFile(filename, []byte(leasefile), 0640))
+	h, lc, err := setupRange(filename, "10.0.0.0", "10.0.0.10", "1h")
+	require.NoError(t, err)
+	defer lc.Close()
+
+	// two clients behind the same hardware address get different leases, the
+	// first one taking over the lease of the hardware address
+	for _, tt := range []struct {
+		id   byte
+		want net.IP
+	}{{1, net.IPv4(10, 0, 0, 1)}, {2, net.IPv4(10, 0, 0, 3)}, {1, net.IPv4(10, 0, 0, 1)}} {
+		req, resp := newRequest(t, "02:00:00:00:00:01")
+		req.UpdateOption(dhcpv4.OptClientIdentifier([]byte{0, tt.id}))
+		resp, _ = h(req, resp)
+		require.NotNil(t, resp)
+		assert.True(t, resp.YourIPAddr.Equal(tt.want), "client %d got %s, want %s", tt.id, resp.YourIPAddr, tt.want)
+	}
+	p := lc.(*PluginState)
+	assert.Empty(t, p.leases.ByKey("02:00:00:00:00:01"))
+	assert.Len(t, p.leases.ByKey("id:0001"), 1)
+
+	_, _, err = setupRange(filename, "10.0.0.0", "10.0.0.10", "1h", "1h", "foo")
+	assert.Error(t, err)
+}
@@ -0,0 +1,144 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// offerTimeout is how long the address offered to a client in response to a
+// DISCOVER stays reserved, waiting for its REQUEST
+const offerTimeout = 30 * time.Second
+
+// offer is an address reserved for a client between its DISCOVER and its
+// REQUEST. Offers are only kept in memory, so that clients that never send a
+// REQUEST don't hold an address for the whole lease time.
+type offer struct {
+	ip      net.IPNet
+	expires time.Time
+	// probing is set until the address is found free, see inUse
+	probing bool
+}
+
+func (p *PluginState) handleDiscover(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	key := p.key(req)
+	ip, fresh, err := p.reserve(key, chaddrKey(req), requestedIP(req))
+	// the address is probed without holding any lock, so that other clients
+	// are handled in the meantime
+	for probes := 1; err == nil && fresh && p.probe != nil; probes++ {
+		if !p.inUse(req, ip) {
+			p.probed(key, ip)
+			break
+		}
+		p.abandon(key, ip)
+		if probes == maxProbes {
+			err = fmt.Errorf("%d addresses in a row are already in use", probes)
+			break
+		}
+		ip, fresh, err = p.reserve(key, chaddrKey(req), nil)
+	}
+	if err == errProbing {
+		log.Debugf("Ignoring DISCOVER of client %s while its offer is probed", key)
+		return nil, true
+	}
+	if err != nil {
+		log.Errorf("Could not allocate IP for client %s: %v", key, err)
+		return nil, true
+	}
+	resp.YourIPAddr = ip
+	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(p.LeaseTime.Round(time.Second)))
+	log.Printf("offering IP address %s to client %s", ip, key)
+	return resp, false
+}
+
+// reserve returns the address to offer to a client: the one it holds if any
+// and it is not orphaned, or one reserved until the offer expires. The requested address is reserved
+// if it is free. fresh is set when the address was just reserved, and has to
+// be probed.
+func (p *PluginState) reserve(key, chaddr string, requested net.IP) (ip net.IP, fresh bool, err error) {
+	for _, k := range []string{key, chaddr} {
+		if leases := p.leases.ByKey(k); len(leases) > 0 && !p.orphaned(leases[0].IP()) {
+			return leases[0].IP(), false, nil
+		}
+	}
+	p.offersMu.Lock()
+	defer p.offersMu.Unlock()
+	now := time.Now()
+	o, ok := p.offers[key]
+	if ok && o.probing {
+		return nil, false, errProbing
+	}
+	if ok && (requested == nil || o.ip.IP.Equal(requested)) {
+		o.expires = now.Add(p.offerTimeout)
+		p.offers[key] = o
+		return o.ip.IP, false, nil
+	}
+	a, err := p.allocate(key, requested)
+	if err != nil && !ok {
+		// make room with the offers nobody took, and the addresses
+		// abandoned long enough
+		if p.expireOffersLocked(now)+p.expireAbandonedLocked(now) > 0 {
+			a, err = p.allocate(key, requested)
+		}
+	}
+	switch {
+	case err != nil && !ok:
+		return nil, false, err
+	case ok && (err != nil || !a.IP.Equal(requested)):
+		// the requested address is not free, keep the current offer
+		if err == nil {
+			p.free(a)
+		}
+		o.expires = now.Add(p.offerTimeout)
+		p.offers[key] = o
+		return o.ip.IP, false, nil
+	case ok:
+		// the client asks for another address than the one offered
+		p.free(o.ip)
+	}
+	p.offers[key] = offer{ip: a, expires: now.Add(p.offerTimeout), probing: p.probe != nil}
+	return a.IP, true, nil
+}
+
+// takeOffer removes the offer made to a client, and returns it if it has not
+// expired. The caller is responsible for freeing its address.
+func (p *PluginState) takeOffer(key string) (offer, bool) {
+	p.offersMu.Lock()
+	defer p.offersMu.Unlock()
+	o, ok := p.offers[key]
+	if !ok {
+		return o, false
+	}
+	delete(p.offers, key)
+	if !o.expires.After(time.Now()) {
+		p.free(o.ip)
+		return o, false
+	}
+	return o, true
+}
+
+// expireOffers frees the addresses of the offers expired at the given time,
+// and returns how many were freed
+func (p *PluginState) expireOffers(now time.Time) int {
+	p.offersMu.Lock()
+	defer p.offersMu.Unlock()
+	return p.expireOffersLocked(now)
+}
+
+func (p *PluginState) expireOffersLocked(now time.Time) int {
+	n := 0
+	for key, o := range p.offers {
+		if !o.expires.After(now) {
+			delete(p.offers, key)
+			p.free(o.ip)
+			n++
+		}
+	}
+	return n
+}
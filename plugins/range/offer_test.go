@@ -0,0 +1,117 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var serverID = net.IPv4(10, 0, 0, 254)
+
+func exchange(t *testing.T, h func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool),
+	mac string, msgType dhcpv4.MessageType, requested, server net.IP) *dhcpv4.DHCPv4 {
+	req, resp := newRequestFor(t, mac, msgType, requested)
+	if server != nil {
+		req.UpdateOption(dhcpv4.OptServerIdentifier(server))
+	}
+	resp.UpdateOption(dhcpv4.OptServerIdentifier(serverID))
+	resp, _ = h(req, resp)
+	return resp
+}
+
+func TestOffers(t *testing.T) {
+	h, lc, err := setupRange(filepath.Join(t.TempDir(), "leases.txt"), "10.0.0.0", "10.0.0.10", "1h")
+	require.NoError(t, err)
+	defer lc.Close()
+	p := lc.(*PluginState)
+
+	// offers are reserved, and not committed
+	resp := exchange(t, h, "02:00:00:00:00:00", dhcpv4.MessageTypeDiscover, nil, nil)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 0)))
+	assert.Equal(t, 0, p.leases.Len())
+	resp = exchange(t, h, "02:00:00:00:00:00", dhcpv4.MessageTypeDiscover, nil, nil)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 0)), "offers should be stable")
+	resp = exchange(t, h, "02:00:00:00:00:01", dhcpv4.MessageTypeDiscover, nil, nil)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 1)))
+	resp = exchange(t, h, "02:00:00:00:00:02", dhcpv4.MessageTypeDiscover, net.IPv4(10, 0, 0, 5), nil)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 5)), "the requested address should be offered")
+
+	// the offer is committed by a request for our server
+	resp = exchange(t, h, "02:00:00:00:00:00", dhcpv4.MessageTypeRequest, net.IPv4(10, 0, 0, 0), serverID)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 0)))
+	assert.Len(t, p.leases.ByKey("02:00:00:00:00:00"), 1)
+
+	// and released by a request for another server
+	resp = exchange(t, h, "02:00:00:00:00:01", dhcpv4.MessageTypeRequest, net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 253))
+	assert.Nil(t, resp)
+	assert.Equal(t, 1, p.leases.Len())
+	resp = exchange(t, h, "02:00:00:00:00:03", dhcpv4.MessageTypeDiscover, nil, nil)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 1)), "the released address should be offered again")
+
+	// requests for another address than offered don't leak the offer
+	resp = exchange(t, h, "02:00:00:00:00:02", dhcpv4.MessageTypeRequest, net.IPv4(10, 0, 0, 6), serverID)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 6)))
+	resp = exchange(t, h, "02:00:00:00:00:04", dhcpv4.MessageTypeDiscover, net.IPv4(10, 0, 0, 5), nil)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 5)))
+
+	// known clients are offered their lease, which is not extended
+	resp = exchange(t, h, "02:00:00:00:00:00", dhcpv4.MessageTypeDiscover, nil, nil)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 0)))
+
+	// other messages are ignored
+	req, resp := newRequestFor(t, "02:00:00:00:00:09", dhcpv4.MessageTypeInform, nil)
+	resp, stop := h(req, resp)
+	require.NotNil(t, resp)
+	assert.False(t, stop)
+	assert.True(t, resp.YourIPAddr.IsUnspecified())
+}
+
+func TestOfferExpiry(t *testing.T) {
+	h, lc, err := setupRange(filepath.Join(t.TempDir(), "leases.txt"), "10.0.0.0", "10.0.0.1", "1h")
+	require.NoError(t, err)
+	defer lc.Close()
+	p := lc.(*PluginState)
+	expireAll := func() {
+		p.offersMu.Lock()
+		defer p.offersMu.Unlock()
+		for key, o := range p.offers {
+			o.expires = time.Now()
+			p.offers[key] = o
+		}
+	}
+
+	for _, mac := range []string{"02:00:00:00:00:00", "02:00:00:00:00:01"} {
+		require.NotNil(t, exchange(t, h, mac, dhcpv4.MessageTypeDiscover, nil, nil))
+	}
+	assert.Nil(t, exchange(t, h, "02:00:00:00:00:02", dhcpv4.MessageTypeDiscover, nil, nil), "the pool should be exhausted")
+	assert.Equal(t, 0, p.expireOffers(time.Now()))
+
+	// expired offers are freed when the pool is exhausted
+	expireAll()
+	require.NotNil(t, exchange(t, h, "02:00:00:00:00:02", dhcpv4.MessageTypeDiscover, nil, nil))
+
+	// and can't be committed
+	expireAll()
+	_, ok := p.takeOffer("02:00:00:00:00:02")
+	assert.False(t, ok)
+	resp := exchange(t, h, "02:00:00:00:00:02", dhcpv4.MessageTypeRequest, net.IPv4(10, 0, 0, 3), serverID)
+	require.NotNil(t, resp)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+
+	// the reaper frees them
+	require.NotNil(t, exchange(t, h, "02:00:00:00:00:03", dhcpv4.MessageTypeDiscover, nil, nil))
+	assert.Equal(t, 1, p.expireOffers(time.Now().Add(time.Minute)))
+	assert.Empty(t, p.offers)
+}
@@ -0,0 +1,49 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// poolAllocator allocates the addresses of the ranges, and tells which
+// addresses are part of them
+type poolAllocator interface {
+	allocators.Allocator
+	Contains(ip net.IP) bool
+}
+
+// orphanPolicy is what clients holding an orphaned lease get when they renew
+// it. Leases are orphaned when the ranges change and no longer include their
+// address: they are kept until they expire or the client moves to another
+// address, but not renewed.
+type orphanPolicy int
+
+const (
+	// orphanNak refuses the renewal, so that the client starts over and
+	// gets an address in the ranges
+	orphanNak orphanPolicy = iota
+	// orphanMove gives the client a new address in the ranges
+	orphanMove
+)
+
+func parseOrphanPolicy(name string) (orphanPolicy, error) {
+	switch strings.ToLower(name) {
+	case "nak":
+		return orphanNak, nil
+	case "move":
+		return orphanMove, nil
+	}
+	return 0, fmt.Errorf("invalid orphan policy %q, want nak or move", name)
+}
+
+// orphaned returns whether a lease is outside of the ranges
+func (p *PluginState) orphaned(ip net.IP) bool {
+	return !p.allocator.Contains(ip)
+}
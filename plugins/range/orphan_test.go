@@ -0,0 +1,80 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins/leasestore"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// orphanfile holds leases inside and outside of 10.0.0.0-10.0.0.3
+var orphanfile = `02:00:00:00:00:00 10.0.0.0 2100-01-01T00:00:00Z
+02:00:00:00:00:01 10.0.1.1 2100-01-01T00:00:00Z
+02:00:00:00:00:02 10.0.1.2 2000-01-01T00:00:00Z
+`
+
+func TestOrphans(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.txt")
+	require.NoError(t, os.WriteFile(filename, []byte(orphanfile), 0640))
+
+	h, lc, err := setupRange(filename, "10.0.0.0", "10.0.0.3", "1h")
+	require.NoError(t, err)
+	defer lc.Close()
+	p := lc.(*PluginState)
+	assert.Equal(t, 3, p.leases.Len(), "orphaned leases should be kept")
+
+	// renewals of orphaned leases are refused
+	resp := exchange(t, h, "02:00:00:00:00:01", dhcpv4.MessageTypeRequest, net.IPv4(10, 0, 1, 1), nil)
+	require.NotNil(t, resp)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+	resp = exchange(t, h, "02:00:00:00:00:01", dhcpv4.MessageTypeRequest, nil, nil)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+
+	// and the client is offered a new address
+	resp = exchange(t, h, "02:00:00:00:00:01", dhcpv4.MessageTypeDiscover, nil, nil)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 1)))
+	resp = exchange(t, h, "02:00:00:00:00:01", dhcpv4.MessageTypeRequest, net.IPv4(10, 0, 0, 1), serverID)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 1)))
+	leases := p.leases.ByKey("02:00:00:00:00:01")
+	require.Len(t, leases, 1)
+	assert.True(t, leases[0].IP().Equal(net.IPv4(10, 0, 0, 1)), "the orphaned lease should be replaced")
+
+	// expired orphaned leases are dropped
+	n, err := p.reap(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 2, p.leases.Len())
+}
+
+func TestOrphansMove(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.txt")
+	require.NoError(t, os.WriteFile(filename, []byte(orphanfile), 0640))
+
+	h, lc, err := setupRange(filename, "10.0.0.0", "10.0.0.3", "1h", "1h", "client-id", "none", "1s", "1h", "move")
+	require.NoError(t, err)
+	defer lc.Close()
+	p := lc.(*PluginState)
+
+	// renewals move to an address in the range
+	resp := exchange(t, h, "02:00:00:00:00:01", dhcpv4.MessageTypeRequest, net.IPv4(10, 0, 1, 1), nil)
+	require.NotNil(t, resp)
+	assert.NotEqual(t, dhcpv4.MessageTypeNak, resp.MessageType())
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 1)))
+	_, ok := p.leases.ByAddr(leasestore.FromIP(net.IPv4(10, 0, 1, 1)))
+	assert.False(t, ok, "the orphaned lease should be replaced")
+
+	_, _, err = setupRange(filename, "10.0.0.0", "10.0.0.3", "1h", "1h", "client-id", "none", "1s", "1h", "keep")
+	assert.Error(t, err)
+}
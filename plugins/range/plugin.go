@@ -5,11 +5,10 @@
 package rangeplugin
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
-	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,6 +17,8 @@ import (
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/coredhcp/coredhcp/plugins/allocators"
 	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/coredhcp/coredhcp/plugins/allocators/hash"
+	"github.com/coredhcp/coredhcp/plugins/leasestore"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 )
 
@@ -25,121 +26,549 @@ var log = logger.GetLogger("plugins/range")
 
 // Plugin wraps plugin registration information
 var Plugin = plugins.Plugin{
-	Name:   "range",
-	Setup4: setupRange,
+	Name:            "range",
+	SetupLifecycle4: setupRange,
+	Args4: &plugins.ArgSpec{
+		Args: []plugins.Arg{
+			{Name: "file", Type: plugins.ArgString, Description: "file storing the allocated leases across restarts"},
+			{Name: "start", Type: plugins.ArgString,
+				Description: "first address of the range, or a comma-separated list of addresses, start-end ranges and CIDRs"},
+			{Name: "end", Type: plugins.ArgString,
+				Description: "last address of the range, or the list of addresses excluded from the ranges (- for none)"},
+			{Name: "lease_time", Type: plugins.ArgDuration, Description: "duration of the leases"},
+			{Name: "grace", Type: plugins.ArgDuration, Optional: true,
+				Description: "time after which expired leases are freed, defaults to the lease duration"},
+			{Name: "key", Type: plugins.ArgString, Optional: true,
+				Description: "what identifies clients: client-id (the default), chaddr, circuit-id, remote-id or relay:<sub-option>"},
+			{Name: "probe", Type: plugins.ArgString, Optional: true, Choices: []string{"none", "icmp", "arp"},
+				Description: "how to check that addresses are unused before offering them, defaults to none"},
+			{Name: "probe_timeout", Type: plugins.ArgDuration, Optional: true,
+				Description: "how long to wait for an answer to a probe, defaults to 500ms"},
+			{Name: "cooldown", Type: plugins.ArgDuration, Optional: true,
+				Description: "how long addresses found in use are left out of the pool, defaults to 1h"},
+			{Name: "orphans", Type: plugins.ArgString, Optional: true, Choices: []string{"nak", "move"},
+				Description: "what clients renewing a lease outside of the ranges get: nak (the default) or a new address with move"},
+			{Name: "strategy", Type: plugins.ArgString, Optional: true, Choices: []string{"bitmap", "hash"},
+				Description: "how addresses are chosen: the first free one with bitmap (the default), or one derived from the client key with hash"},
+		},
+		Examples: []string{
+			"leases.txt 10.10.10.100 10.10.10.200 60s",
+			"leases.txt 10.10.10.100-10.10.10.200,10.10.20.0/24 10.10.10.150,10.10.20.0-10.10.20.9 60s",
+			"leases.txt 10.10.10.100 10.10.10.200 1h 24h",
+			"leases.txt 10.10.10.100 10.10.10.200 1h 1h circuit-id",
+			"leases.txt 10.10.10.100 10.10.10.200 1h 1h client-id arp 200ms",
+		},
+	},
 }
 
-//Record holds an IP lease record
-type Record struct {
-	IP      net.IP
-	expires time.Time
-}
+// reapInterval is how often expired leases and offers are looked for
+const reapInterval = time.Minute
 
 // PluginState is the data held by an instance of the range plugin
 type PluginState struct {
-	// Rough lock for the whole plugin, we'll get better performance once we use leasestorage
+	// Lock for the plugin state below. Allocations are serialized by the
+	// lease store transactions, so that an address is not given to two
+	// clients at once.
 	sync.Mutex
-	// Recordsv4 holds a MAC -> IP address and lease time mapping
-	Recordsv4 map[string]*Record
 	LeaseTime time.Duration
-	leasefile *os.File
-	allocator allocators.Allocator
+	// grace is how long expired leases are kept, so that returning clients
+	// get the same address
+	grace        time.Duration
+	reapInterval time.Duration
+	stop         chan struct{}
+	done         chan struct{}
+	// key identifies the clients in the leases
+	key keyPolicy
+	// leases holds the client -> IP address leases
+	leases    leasestore.Store
+	allocator poolAllocator
+	// orphans is the policy for the leases outside of the ranges
+	orphans orphanPolicy
+	closed  bool
+	// saveErr is the error of the last failed attempt to persist a lease, if
+	// the following ones failed as well
+	saveErr error
+
+	// offersMu protects the offers and the abandoned addresses, which are
+	// not persisted
+	offersMu     sync.Mutex
+	offers       map[string]offer
+	offerTimeout time.Duration
+	// probe checks the addresses before they are offered, if set. Those
+	// in use are abandoned until the cooldown expires.
+	probe        prober
+	probeTimeout time.Duration
+	cooldown     time.Duration
+	abandoned    map[string]abandoned
+}
+
+// errNak aborts the transaction of a request that is refused
+var errNak = errors.New("request refused")
+
+// binding is the outcome of a request on the leases of a client
+type binding struct {
+	lease leasestore.Lease
+	// allocated is the address allocated for the request, if any
+	allocated *net.IPNet
+	// freed is the address the client held before moving to the one it
+	// requested, to free once the move is committed
+	freed *net.IPNet
+	// nak is why the request is refused, if it is
+	nak string
 }
 
-// Handler4 handles DHCPv4 packets for the range plugin
+// Handler4 handles DHCPv4 packets for the range plugin. A DISCOVER gets an
+// offer, and a REQUEST (or a BOOTP request) commits the lease.
 func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	p.Lock()
-	defer p.Unlock()
-	record, ok := p.Recordsv4[req.ClientHWAddr.String()]
-	if !ok {
-		// Allocating new address since there isn't one allocated
-		log.Printf("MAC address %s is new, leasing new IPv4 address", req.ClientHWAddr.String())
-		ip, err := p.allocator.Allocate(net.IPNet{})
-		if err != nil {
-			log.Errorf("Could not allocate IP for MAC %s: %v", req.ClientHWAddr.String(), err)
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		return p.handleDiscover(req, resp)
+	case dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeNone:
+		return p.handleRequest(req, resp)
+	}
+	return resp, false
+}
+
+func (p *PluginState) handleRequest(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	key := p.key(req)
+	if sid := req.ServerIdentifier(); sid != nil && !sid.IsUnspecified() {
+		if ours := resp.ServerIdentifier(); ours != nil && !sid.Equal(ours) {
+			// the client selected the offer of another server
+			if o, ok := p.takeOffer(key); ok {
+				log.Debugf("Client %s selected server %s, releasing offer of %s", key, sid, o.ip.IP)
+				p.free(o.ip)
+			}
 			return nil, true
 		}
-		rec := Record{
-			IP:      ip.IP.To4(),
-			expires: time.Now().Add(p.LeaseTime),
-		}
-		err = p.saveIPAddress(req.ClientHWAddr, &rec)
-		if err != nil {
-			log.Errorf("SaveIPAddress for MAC %s failed: %v", req.ClientHWAddr.String(), err)
-		}
-		p.Recordsv4[req.ClientHWAddr.String()] = &rec
-		record = &rec
-	} else {
-		// Ensure we extend the existing lease at least past when the one we're giving expires
-		if record.expires.Before(time.Now().Add(p.LeaseTime)) {
-			record.expires = time.Now().Add(p.LeaseTime).Round(time.Second)
-			err := p.saveIPAddress(req.ClientHWAddr, record)
-			if err != nil {
-				log.Errorf("Could not persist lease for MAC %s: %v", req.ClientHWAddr.String(), err)
-			}
+	}
+	requested := requestedIP(req)
+	isRequest := req.MessageType() == dhcpv4.MessageTypeRequest
+	var (
+		b        binding
+		allocErr error
+	)
+	o, offered := p.takeOffer(key)
+	// concurrent requests are written to the lease file together
+	err := p.leases.Update(func(tx leasestore.Tx) error {
+		var (
+			reserved *net.IPNet
+			err      error
+		)
+		if offered {
+			reserved = &o.ip
 		}
+		b, err = p.bind(tx, key, chaddrKey(req), requested, reserved, isRequest)
+		if err != nil && err != errNak {
+			allocErr = err
+		}
+		return err
+	})
+	if offered && (b.allocated == nil || !b.allocated.IP.Equal(o.ip.IP)) {
+		// the offer was not used for this request
+		p.free(o.ip)
+	}
+	if b.nak != "" {
+		log.Printf("Refusing request of client %s: %s", key, b.nak)
+		return nak(resp, b.nak), true
+	}
+	if allocErr != nil {
+		log.Errorf("Could not allocate IP for client %s: %v", key, allocErr)
+		return nil, true
+	}
+	p.Lock()
+	p.saveErr = err
+	p.Unlock()
+	if err != nil {
+		log.Errorf("Could not persist lease for client %s: %v", key, err)
+		// don't give out an address that may be given to another client
+		// after a restart
+		if b.allocated != nil {
+			p.free(*b.allocated)
+		}
+		if b.allocated != nil || b.lease.Key == "" {
+			return nil, true
+		}
+	} else if b.freed != nil {
+		p.free(*b.freed)
 	}
-	resp.YourIPAddr = record.IP
+	record := b.lease
+	resp.YourIPAddr = record.IP()
 	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(p.LeaseTime.Round(time.Second)))
-	log.Printf("found IP address %s for MAC %s", record.IP, req.ClientHWAddr.String())
+	log.Printf("found IP address %s for client %s", record.IP(), key)
 	return resp, false
 }
 
-func setupRange(args ...string) (handler.Handler4, error) {
+// allocate allocates an address for a client, the hinted one if it is free.
+// With the hash strategy, other clients get an address derived from their
+// key.
+func (p *PluginState) allocate(key string, hint net.IP) (net.IPNet, error) {
+	if keyed, ok := p.allocator.(allocators.KeyedAllocator); ok {
+		return keyed.AllocateKey([]byte(key), net.IPNet{IP: hint})
+	}
+	return p.allocator.Allocate(net.IPNet{IP: hint})
+}
+
+// free returns an address to the allocator
+func (p *PluginState) free(ip net.IPNet) {
+	if err := p.allocator.Free(ip); err != nil {
+		log.Warningf("Could not free IP %s: %v", ip.IP, err)
+	}
+}
+
+// bind finds or allocates the lease of a client. The requested address, if
+// any, is used when it is free; if it can't be granted for a REQUEST, the
+// request is refused with errNak. The address reserved by the offer made to
+// the client, if any, is used unless it requested another one.
+func (p *PluginState) bind(tx leasestore.Tx, key, chaddr string, requested net.IP, reserved *net.IPNet, isRequest bool) (binding, error) {
+	var b binding
+	leases := tx.ByKey(key)
+	if len(leases) == 0 && key != chaddr {
+		// take over the lease of the hardware address, for example from a
+		// lease file written before the client was identified otherwise
+		if leases = tx.ByKey(chaddr); len(leases) > 0 {
+			log.Printf("Client %s takes over the lease of MAC address %s", key, chaddr)
+			leases[0].Key = key
+			if err := tx.Put(leases[0]); err != nil {
+				return b, err
+			}
+		}
+	}
+	// orphaned leases are not renewed
+	orphan := len(leases) > 0 && p.orphaned(leases[0].IP())
+	if orphan && (requested == nil || leases[0].IP().Equal(requested)) {
+		if isRequest && p.orphans == orphanNak {
+			b.nak = fmt.Sprintf("address %s is no longer served", leases[0].IP())
+			return b, errNak
+		}
+		log.Printf("Moving client %s out of orphaned lease of %s", key, leases[0].IP())
+		requested = nil
+	}
+	if len(leases) > 0 && !orphan && (requested == nil || leases[0].IP().Equal(requested)) {
+		return p.renew(tx, leases[0])
+	}
+	if reserved != nil && (requested == nil || reserved.IP.Equal(requested)) {
+		b.allocated = reserved
+		return p.commit(tx, b, key, leases)
+	}
+	if requested == nil {
+		// Allocating new address since there isn't one allocated
+		log.Printf("Client %s is new, leasing new IPv4 address", key)
+	}
+	ip, err := p.allocate(key, requested)
+	if err != nil && !(requested != nil && isRequest) {
+		return b, err
+	}
+	if err != nil || (requested != nil && !ip.IP.Equal(requested)) {
+		if err == nil {
+			p.free(ip)
+		}
+		if isRequest {
+			b.nak = fmt.Sprintf("requested address %s is not available", requested)
+			return b, errNak
+		}
+		// offer the address the client holds, or another one
+		if len(leases) > 0 && !orphan {
+			return p.renew(tx, leases[0])
+		}
+		if ip, err = p.allocate(key, nil); err != nil {
+			return b, err
+		}
+	}
+	b.allocated = &ip
+	return p.commit(tx, b, key, leases)
+}
+
+// commit leases the address allocated for a binding to a client, which moves
+// from the address it held if any
+func (p *PluginState) commit(tx leasestore.Tx, b binding, key string, leases []leasestore.Lease) (binding, error) {
+	if len(leases) > 0 {
+		// the client moves to the address it requested
+		if err := tx.Delete(leases[0].Addr); err != nil {
+			return b, err
+		}
+		if old := leases[0].IPNet(); !p.orphaned(old.IP) {
+			b.freed = &old
+		}
+	}
+	b.lease = leasestore.Lease{
+		Key:     key,
+		Addr:    leasestore.FromIP(b.allocated.IP),
+		Expires: p.expiry(),
+	}
+	return b, tx.Put(b.lease)
+}
+
+// renew extends an existing lease at least past when the one we're giving
+// expires
+func (p *PluginState) renew(tx leasestore.Tx, l leasestore.Lease) (binding, error) {
+	if l.Expires.Before(time.Now().Add(p.LeaseTime)) {
+		l.Expires = p.expiry()
+		return binding{lease: l}, tx.Put(l)
+	}
+	return binding{lease: l}, nil
+}
+
+// requestedIP returns the address a client asks for: the Requested IP Address
+// option when selecting an offer or rebooting, or ciaddr when renewing
+func requestedIP(req *dhcpv4.DHCPv4) net.IP {
+	if ip := req.RequestedIPAddress(); ip != nil && !ip.IsUnspecified() {
+		return ip.To4()
+	}
+	if ip := req.ClientIPAddr; ip != nil && !ip.IsUnspecified() {
+		return ip.To4()
+	}
+	return nil
+}
+
+// nak turns a response into a DHCPNAK, which only holds the options allowed
+// by RFC 2131 (table 3)
+func nak(resp *dhcpv4.DHCPv4, message string) *dhcpv4.DHCPv4 {
+	serverID := resp.Options.Get(dhcpv4.OptionServerIdentifier)
+	resp.Options = dhcpv4.Options{}
+	resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+	if serverID != nil {
+		resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionServerIdentifier, serverID))
+	}
+	resp.UpdateOption(dhcpv4.OptMessage(message))
+	resp.YourIPAddr = net.IPv4zero
+	resp.ServerIPAddr = net.IPv4zero
+	resp.ServerHostName = ""
+	resp.BootFileName = ""
+	return resp
+}
+
+// expiry returns the expiry of a lease given now, rounded up to the second
+// as it is stored
+func (p *PluginState) expiry() time.Time {
+	return time.Now().Add(p.LeaseTime).Truncate(time.Second).Add(time.Second)
+}
+
+// Start starts the reaper, which periodically frees the expired leases,
+// offers and abandoned addresses until Close stops it. The lease file is
+// opened during setup.
+func (p *PluginState) Start() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return errors.New("lease file is closed")
+	}
+	if p.stop != nil {
+		return nil
+	}
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.reaper()
+	return nil
+}
+
+// reaper periodically frees the expired leases, until the plugin is closed
+func (p *PluginState) reaper() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.reapInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := p.reap(time.Now()); err != nil {
+			log.Errorf("Could not free expired leases: %v", err)
+		} else if n > 0 {
+			log.Printf("Freed %d expired leases", n)
+		}
+		if n := p.expireOffers(time.Now()); n > 0 {
+			log.Debugf("Freed %d expired offers", n)
+		}
+		if n := p.expireAbandoned(time.Now()); n > 0 {
+			log.Printf("Returned %d abandoned addresses to the pool", n)
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reap frees the leases that expired for longer than the grace period at the
+// given time, and returns how many were freed
+func (p *PluginState) reap(now time.Time) (int, error) {
+	var expired []leasestore.Lease
+	// leases renewed in the meantime are no longer expired in the
+	// transaction, and are kept
+	err := p.leases.Update(func(tx leasestore.Tx) error {
+		expired = tx.ExpiredBefore(now.Add(-p.grace))
+		for _, l := range expired {
+			if err := tx.Delete(l.Addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range expired {
+		if p.orphaned(l.IP()) {
+			log.Printf("Dropping orphaned lease of %s for client %s, expired at %s", l.IP(), l.Key, l.Expires)
+			continue
+		}
+		log.Debugf("Freeing IP address %s of client %s, expired at %s", l.IP(), l.Key, l.Expires)
+		p.free(l.IPNet())
+	}
+	return len(expired), nil
+}
+
+// Close stops freeing expired leases and closes the lease file. No leases can
+// be allocated afterwards
+func (p *PluginState) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.stop != nil {
+		close(p.stop)
+		<-p.done
+	}
+	return p.leases.Close()
+}
+
+// Healthy reports whether leases can be persisted to the lease file
+func (p *PluginState) Healthy() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return errors.New("lease file is closed")
+	}
+	if p.saveErr != nil {
+		return fmt.Errorf("failed to persist leases: %w", p.saveErr)
+	}
+	return nil
+}
+
+func setupRange(args ...string) (handler.Handler4, plugins.Lifecycle, error) {
 	var (
 		err error
 		p   PluginState
 	)
 
 	if len(args) < 4 {
-		return nil, fmt.Errorf("invalid number of arguments, want: 4 (file name, start IP, end IP, lease time), got: %d", len(args))
+		return nil, nil, fmt.Errorf("invalid number of arguments, want: 4 (file name, start IP or ranges, end IP or exclusions, lease time), got: %d", len(args))
 	}
 	filename := args[0]
 	if filename == "" {
-		return nil, errors.New("file name cannot be empty")
-	}
-	ipRangeStart := net.ParseIP(args[1])
-	if ipRangeStart.To4() == nil {
-		return nil, fmt.Errorf("invalid IPv4 address: %v", args[1])
+		return nil, nil, errors.New("file name cannot be empty")
 	}
-	ipRangeEnd := net.ParseIP(args[2])
-	if ipRangeEnd.To4() == nil {
-		return nil, fmt.Errorf("invalid IPv4 address: %v", args[2])
-	}
-	if binary.BigEndian.Uint32(ipRangeStart.To4()) >= binary.BigEndian.Uint32(ipRangeEnd.To4()) {
-		return nil, errors.New("start of IP range has to be lower than the end of an IP range")
+	ranges, excluded, err := parsePool(args[1], args[2])
+	if err != nil {
+		return nil, nil, err
 	}
-
-	p.allocator, err = bitmap.NewIPv4Allocator(ipRangeStart, ipRangeEnd)
+	pool, err := bitmap.NewIPv4PoolAllocator(ranges, excluded)
 	if err != nil {
-		return nil, fmt.Errorf("could not create an allocator: %w", err)
+		return nil, nil, fmt.Errorf("could not create an allocator: %w", err)
 	}
+	p.allocator = pool
 
 	p.LeaseTime, err = time.ParseDuration(args[3])
 	if err != nil {
-		return nil, fmt.Errorf("invalid lease duration: %v", args[3])
+		return nil, nil, fmt.Errorf("invalid lease duration: %v", args[3])
 	}
-
-	p.Recordsv4, err = loadRecordsFromFile(filename)
-	if err != nil {
-		return nil, fmt.Errorf("could not load records from file: %v", err)
+	p.grace = p.LeaseTime
+	if len(args) > 4 {
+		p.grace, err = time.ParseDuration(args[4])
+		if err != nil || p.grace < 0 {
+			return nil, nil, fmt.Errorf("invalid grace period: %v", args[4])
+		}
 	}
-
-	log.Printf("Loaded %d DHCPv4 leases from %s", len(p.Recordsv4), filename)
-
-	for _, v := range p.Recordsv4 {
-		ip, err := p.allocator.Allocate(net.IPNet{IP: v.IP})
-		if err != nil {
-			return nil, fmt.Errorf("failed to re-allocate leased ip %v: %v", v.IP.String(), err)
+	p.reapInterval = reapInterval
+	p.offers = make(map[string]offer)
+	p.offerTimeout = offerTimeout
+	p.key = clientIDKey
+	if len(args) > 5 {
+		if p.key, err = parseKeyPolicy(args[5]); err != nil {
+			return nil, nil, err
+		}
+	}
+	p.probeTimeout = probeTimeout
+	p.cooldown = abandonTime
+	p.abandoned = make(map[string]abandoned)
+	if len(args) > 6 {
+		if p.probe, err = parseProber(args[6]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(args) > 7 {
+		p.probeTimeout, err = time.ParseDuration(args[7])
+		if err != nil || p.probeTimeout <= 0 {
+			return nil, nil, fmt.Errorf("invalid probe timeout: %v", args[7])
+		}
+	}
+	if len(args) > 8 {
+		p.cooldown, err = time.ParseDuration(args[8])
+		if err != nil || p.cooldown < 0 {
+			return nil, nil, fmt.Errorf("invalid cooldown: %v", args[8])
 		}
-		if ip.IP.String() != v.IP.String() {
-			return nil, fmt.Errorf("allocator did not re-allocate requested leased ip %v: %v", v.IP.String(), ip.String())
+	}
+	if len(args) > 9 {
+		if p.orphans, err = parseOrphanPolicy(args[9]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(args) > 10 {
+		switch strings.ToLower(args[10]) {
+		case "bitmap":
+		case "hash":
+			p.allocator = hash.New(pool, hash.DefaultProbes)
+		default:
+			return nil, nil, fmt.Errorf("invalid allocation strategy %q, want bitmap or hash", args[10])
 		}
 	}
 
-	if err := p.registerBackingFile(filename); err != nil {
-		return nil, fmt.Errorf("could not setup lease storage: %w", err)
+	p.leases, err = leasestore.OpenFile(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load records from file: %v", err)
 	}
+	orphans, err := p.reallocate()
+	if err != nil {
+		p.leases.Close()
+		return nil, nil, err
+	}
+	log.Printf("Loaded %d DHCPv4 leases from %s", p.leases.Len(), filename)
+	if orphans > 0 {
+		log.Warningf("%d leases are outside of the ranges, and are kept until they expire", orphans)
+	}
+
+	return p.Handler4, &p, nil
+}
 
-	return p.Handler4, nil
+// reallocate marks the addresses of the stored leases as allocated, and
+// returns how many leases are outside of the ranges
+func (p *PluginState) reallocate() (int, error) {
+	var (
+		err     error
+		orphans int
+	)
+	p.leases.Each(func(l leasestore.Lease) bool {
+		if !validKey(l.Key) {
+			err = fmt.Errorf("malformed client key: %s", l.Key)
+			return false
+		}
+		if !l.Addr.Addr().Is4() || !l.Addr.IsSingleIP() {
+			err = fmt.Errorf("expected an IPv4 address, got: %v", l.Addr)
+			return false
+		}
+		if p.orphaned(l.IP()) {
+			orphans++
+			return true
+		}
+		ip, e := p.allocator.Allocate(net.IPNet{IP: l.IP()})
+		if e != nil {
+			err = fmt.Errorf("failed to re-allocate leased ip %v: %v", l.IP(), e)
+			return false
+		}
+		if !ip.IP.Equal(l.IP()) {
+			err = fmt.Errorf("allocator did not re-allocate requested leased ip %v: %v", l.IP(), ip.String())
+			return false
+		}
+		return true
+	})
+	return orphans, err
 }
@@ -0,0 +1,254 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var leasefile string = `02:00:00:00:00:00 10.0.0.0 2000-01-01T00:00:00Z
+02:00:00:00:00:01 10.0.0.1 2000-01-01T00:00:00Z
+02:00:00:00:00:02 10.0.0.2 2000-01-01T00:00:00Z
+`
+
+func newRequest(t *testing.T, mac string) (req, resp *dhcpv4.DHCPv4) {
+	hwaddr, err := net.ParseMAC(mac)
+	require.NoError(t, err)
+	req, err = dhcpv4.NewDiscovery(hwaddr)
+	require.NoError(t, err)
+	req.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeRequest))
+	resp, err = dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	return req, resp
+}
+
+func TestLoadLeases(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.txt")
+	require.NoError(t, os.WriteFile(filename, []byte(leasefile), 0640))
+
+	h, lc, err := setupRange(filename, "10.0.0.0", "10.0.0.3", "1h")
+	require.NoError(t, err)
+	defer lc.Close()
+
+	// known clients keep their address
+	req, resp := newRequest(t, "02:00:00:00:00:01")
+	resp, stop := h(req, resp)
+	require.NotNil(t, resp)
+	assert.False(t, stop)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 1)))
+
+	// new clients get the last free address
+	req, resp = newRequest(t, "02:00:00:00:00:03")
+	resp, _ = h(req, resp)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 3)))
+	assert.Equal(t, time.Hour, resp.IPAddressLeaseTime(0))
+
+	// and then there are none
+	req, resp = newRequest(t, "02:00:00:00:00:04")
+	resp, stop = h(req, resp)
+	assert.Nil(t, resp)
+	assert.True(t, stop)
+}
+
+func TestLoadLeasesErrors(t *testing.T) {
+	for _, bad := range []string{
+		"02:00:00:00:00:00 10.0.0.0\n02:00:00:00:00:01 10.0.0.1 2000-01-01T00:00:00Z\n",
+		"foo 10.0.0.0 2000-01-01T00:00:00Z\n",
+		"02:00:00:00:00:00 2001:db8::1 2000-01-01T00:00:00Z\n",
+		"02:00:00:00:00:00 10.0.0.0/24 2000-01-01T00:00:00Z\n",
+	} {
+		filename := filepath.Join(t.TempDir(), "leases.txt")
+		require.NoError(t, os.WriteFile(filename, []byte(bad), 0640))
+		_, _, err := setupRange(filename, "10.0.0.0", "10.0.0.3", "1h")
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestWriteLeases(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.txt")
+	h, lc, err := setupRange(filename, "10.0.0.0", "10.0.0.10", "1h")
+	require.NoError(t, err)
+
+	for _, mac := range []string{"02:00:00:00:00:00", "02:00:00:00:00:01", "02:00:00:00:00:00"} {
+		req, resp := newRequest(t, mac)
+		resp, _ = h(req, resp)
+		require.NotNil(t, resp)
+	}
+	require.NoError(t, lc.Close())
+
+	written, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(written)), "\n")
+	require.Len(t, lines, 3, "renewing an unexpired lease should not write to the file")
+	assert.Equal(t, "#leasestore version 1", lines[0])
+	lines = lines[1:]
+	assert.True(t, strings.HasPrefix(lines[0], "02:00:00:00:00:00 10.0.0.0 "), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "02:00:00:00:00:01 10.0.0.1 "), lines[1])
+
+	// the leases are restored after a restart
+	h, lc, err = setupRange(filename, "10.0.0.0", "10.0.0.10", "1h")
+	require.NoError(t, err)
+	defer lc.Close()
+	req, resp := newRequest(t, "02:00:00:00:00:01")
+	resp, _ = h(req, resp)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 1)))
+}
+
+func TestClose(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.txt")
+	h, lc, err := setupRange(filename, "10.0.0.0", "10.0.0.10", "1h")
+	require.NoError(t, err)
+	assert.NoError(t, lc.Healthy())
+
+	require.NoError(t, lc.Close())
+	assert.Error(t, lc.Healthy())
+	req, resp := newRequest(t, "02:00:00:00:00:00")
+	resp, stop := h(req, resp)
+	assert.Nil(t, resp, "allocating after Close should fail")
+	assert.True(t, stop)
+	// closing again is harmless
+	assert.NoError(t, lc.Close())
+}
+
+func TestReap(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.txt")
+	recent := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	require.NoError(t, os.WriteFile(filename, []byte(leasefile+
+		"02:00:00:00:00:03 10.0.0.3 "+recent+"\n"), 0640))
+
+	h, lc, err := setupRange(filename, "10.0.0.0", "10.0.0.3", "1h", "10m")
+	require.NoError(t, err)
+	p := lc.(*PluginState)
+	defer p.Close()
+
+	// the leases expired for longer than the grace period are freed
+	n, err := p.reap(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, 1, p.leases.Len())
+
+	// and their addresses can be given to new clients
+	req, resp := newRequest(t, "02:00:00:00:00:04")
+	resp, _ = h(req, resp)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 0)))
+
+	// a client coming back within the grace period keeps its address
+	req, resp = newRequest(t, "02:00:00:00:00:03")
+	resp, _ = h(req, resp)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 3)))
+	// and its lease is renewed
+	n, err = p.reap(time.Now().Add(30 * time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 2, p.leases.Len())
+
+	// the freed leases are removed from the lease file
+	require.NoError(t, p.Close())
+	_, lc, err = setupRange(filename, "10.0.0.0", "10.0.0.3", "1h")
+	require.NoError(t, err)
+	defer lc.Close()
+	assert.Equal(t, 2, lc.(*PluginState).leases.Len())
+
+	_, _, err = setupRange(filename, "10.0.0.0", "10.0.0.3", "1h", "-1h")
+	assert.Error(t, err, "negative grace period")
+}
+
+func TestReaper(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.txt")
+	require.NoError(t, os.WriteFile(filename, []byte(leasefile), 0640))
+
+	_, lc, err := setupRange(filename, "10.0.0.0", "10.0.0.3", "1h", "0s")
+	require.NoError(t, err)
+	p := lc.(*PluginState)
+	p.reapInterval = 10 * time.Millisecond
+	require.NoError(t, p.Start())
+	assert.Eventually(t, func() bool { return p.leases.Len() == 0 }, time.Second, 10*time.Millisecond)
+	// closing stops the reaper
+	require.NoError(t, p.Close())
+	assert.Error(t, p.Start())
+}
+
+func newRequestFor(t *testing.T, mac string, msgType dhcpv4.MessageType, requested net.IP) (req, resp *dhcpv4.DHCPv4) {
+	req, resp = newRequest(t, mac)
+	req.UpdateOption(dhcpv4.OptMessageType(msgType))
+	if requested != nil {
+		req.UpdateOption(dhcpv4.OptRequestedIPAddress(requested))
+	}
+	return req, resp
+}
+
+func TestRequestedIP(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases.txt")
+	require.NoError(t, os.WriteFile(filename, []byte(leasefile), 0640))
+	h, lc, err := setupRange(filename, "10.0.0.0", "10.0.0.10", "1h")
+	require.NoError(t, err)
+	defer lc.Close()
+
+	for _, tt := range []struct {
+		name      string
+		mac       string
+		msgType   dhcpv4.MessageType
+		requested net.IP
+		ciaddr    net.IP
+		want      net.IP
+		nak       bool
+	}{
+		{name: "discover for a free address", mac: "02:00:00:00:00:05", msgType: dhcpv4.MessageTypeDiscover,
+			requested: net.IPv4(10, 0, 0, 5), want: net.IPv4(10, 0, 0, 5)},
+		{name: "discover for a leased address", mac: "02:00:00:00:00:06", msgType: dhcpv4.MessageTypeDiscover,
+			requested: net.IPv4(10, 0, 0, 1), want: net.IPv4(10, 0, 0, 3)},
+		{name: "discover out of range, known client", mac: "02:00:00:00:00:02", msgType: dhcpv4.MessageTypeDiscover,
+			requested: net.IPv4(192, 168, 0, 1), want: net.IPv4(10, 0, 0, 2)},
+		{name: "reboot into a lost lease", mac: "02:00:00:00:00:07", msgType: dhcpv4.MessageTypeRequest,
+			requested: net.IPv4(10, 0, 0, 7), want: net.IPv4(10, 0, 0, 7)},
+		{name: "reboot into a leased address", mac: "02:00:00:00:00:08", msgType: dhcpv4.MessageTypeRequest,
+			requested: net.IPv4(10, 0, 0, 1), nak: true},
+		{name: "reboot out of range", mac: "02:00:00:00:00:09", msgType: dhcpv4.MessageTypeRequest,
+			requested: net.IPv4(192, 168, 0, 1), nak: true},
+		{name: "renew", mac: "02:00:00:00:00:01", msgType: dhcpv4.MessageTypeRequest,
+			ciaddr: net.IPv4(10, 0, 0, 1), want: net.IPv4(10, 0, 0, 1)},
+		{name: "renew someone else's lease", mac: "02:00:00:00:00:00", msgType: dhcpv4.MessageTypeRequest,
+			ciaddr: net.IPv4(10, 0, 0, 1), nak: true},
+		{name: "move to another address", mac: "02:00:00:00:00:00", msgType: dhcpv4.MessageTypeRequest,
+			requested: net.IPv4(10, 0, 0, 9), want: net.IPv4(10, 0, 0, 9)},
+		{name: "the previous address is freed", mac: "02:00:00:00:00:0a", msgType: dhcpv4.MessageTypeDiscover,
+			want: net.IPv4(10, 0, 0, 0)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, resp := newRequestFor(t, tt.mac, tt.msgType, tt.requested)
+			if tt.ciaddr != nil {
+				req.ClientIPAddr = tt.ciaddr
+			}
+			resp.UpdateOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 254)))
+			resp.UpdateOption(dhcpv4.OptRouter(net.IPv4(10, 0, 0, 254)))
+			resp, stop := h(req, resp)
+			require.NotNil(t, resp)
+			if tt.nak {
+				assert.True(t, stop)
+				assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+				assert.True(t, resp.YourIPAddr.Equal(net.IPv4zero))
+				assert.True(t, resp.ServerIdentifier().Equal(net.IPv4(10, 0, 0, 254)))
+				assert.NotEmpty(t, resp.Message())
+				assert.Nil(t, resp.Options.Get(dhcpv4.OptionRouter), "NAKs should only hold the allowed options")
+				return
+			}
+			assert.False(t, stop)
+			assert.True(t, resp.YourIPAddr.Equal(tt.want), "got %s, want %s", resp.YourIPAddr, tt.want)
+		})
+	}
+}
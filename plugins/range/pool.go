@@ -0,0 +1,89 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+)
+
+// noExclusions stands for an empty list of exclusions
+const noExclusions = "-"
+
+// parsePool parses the addresses a range instance allocates from, given as
+// either:
+//   - a start and an end address, as in `10.0.0.10 10.0.0.200`
+//   - a list of ranges and a list of excluded addresses, as in
+//     `10.0.0.10-10.0.0.99,10.0.1.0/24 10.0.0.50,10.0.0.60-10.0.0.69`.
+//     Ranges and exclusions are comma-separated, and are each a single
+//     address, a `start-end` range or a CIDR. `-` stands for no exclusions.
+func parsePool(start, end string) (ranges, excluded []bitmap.IPv4Range, err error) {
+	startIP, endIP := net.ParseIP(start).To4(), net.ParseIP(end).To4()
+	if startIP != nil && endIP != nil {
+		if binary.BigEndian.Uint32(startIP) >= binary.BigEndian.Uint32(endIP) {
+			return nil, nil, errors.New("start of IP range has to be lower than the end of an IP range")
+		}
+		return []bitmap.IPv4Range{{Start: startIP, End: endIP}}, nil, nil
+	}
+	if ranges, err = parseRanges(start); err != nil {
+		return nil, nil, err
+	}
+	if end != noExclusions {
+		if excluded, err = parseRanges(end); err != nil {
+			return nil, nil, fmt.Errorf("invalid exclusions: %w", err)
+		}
+	}
+	return ranges, excluded, nil
+}
+
+// parseRanges parses a comma-separated list of addresses, ranges and CIDRs
+func parseRanges(list string) ([]bitmap.IPv4Range, error) {
+	var ranges []bitmap.IPv4Range
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		r, err := parseRange(item)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func parseRange(s string) (bitmap.IPv4Range, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil || ipnet.IP.To4() == nil {
+			return bitmap.IPv4Range{}, fmt.Errorf("invalid IPv4 CIDR: %v", s)
+		}
+		start := binary.BigEndian.Uint32(ipnet.IP.To4())
+		end := start | ^binary.BigEndian.Uint32(ipnet.Mask)
+		r := bitmap.IPv4Range{Start: make(net.IP, net.IPv4len), End: make(net.IP, net.IPv4len)}
+		binary.BigEndian.PutUint32(r.Start, start)
+		binary.BigEndian.PutUint32(r.End, end)
+		return r, nil
+	}
+	first, last, isRange := strings.Cut(s, "-")
+	start := net.ParseIP(first).To4()
+	if start == nil {
+		return bitmap.IPv4Range{}, fmt.Errorf("invalid IPv4 address: %v", first)
+	}
+	if !isRange {
+		return bitmap.IPv4Range{Start: start, End: start}, nil
+	}
+	end := net.ParseIP(last).To4()
+	if end == nil {
+		return bitmap.IPv4Range{}, fmt.Errorf("invalid IPv4 address: %v", last)
+	}
+	if binary.BigEndian.Uint32(start) > binary.BigEndian.Uint32(end) {
+		return bitmap.IPv4Range{}, fmt.Errorf("start of IP range %s is after its end", s)
+	}
+	return bitmap.IPv4Range{Start: start, End: end}, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePool(t *testing.T) {
+	ranges, excluded, err := parsePool("10.0.0.10", "10.0.0.20")
+	require.NoError(t, err)
+	assert.Equal(t, "[10.0.0.10-10.0.0.20]", fmt.Sprint(ranges))
+	assert.Empty(t, excluded)
+
+	ranges, excluded, err = parsePool("10.0.0.10-10.0.0.20, 10.0.1.0/30,10.0.2.1", "10.0.0.15,10.0.0.16-10.0.0.17")
+	require.NoError(t, err)
+	assert.Equal(t, "[10.0.0.10-10.0.0.20 10.0.1.0-10.0.1.3 10.0.2.1-10.0.2.1]", fmt.Sprint(ranges))
+	assert.Equal(t, "[10.0.0.15-10.0.0.15 10.0.0.16-10.0.0.17]", fmt.Sprint(excluded))
+
+	ranges, excluded, err = parsePool("10.0.1.0/30", "-")
+	require.NoError(t, err)
+	assert.Equal(t, "[10.0.1.0-10.0.1.3]", fmt.Sprint(ranges))
+	assert.Empty(t, excluded)
+
+	for _, tc := range [][2]string{
+		{"10.0.0.20", "10.0.0.10"},
+		{"10.0.0.10-", "-"},
+		{"10.0.0.20-10.0.0.10", "-"},
+		{"2001:db8::/64", "-"},
+		{"10.0.0.0/24", "10.0.0.300"},
+		{"10.0.0.0/24", ""},
+	} {
+		_, _, err := parsePool(tc[0], tc[1])
+		assert.Error(t, err, tc)
+	}
+}
+
+func TestPools(t *testing.T) {
+	h, lc, err := setupRange(filepath.Join(t.TempDir(), "leases.txt"), "10.0.0.0-10.0.0.3,10.0.1.0/31", "10.0.0.1-10.0.0.2", "1h")
+	require.NoError(t, err)
+	defer lc.Close()
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		resp := exchange(t, h, net.HardwareAddr{2, 0, 0, 0, 0, byte(i)}.String(), dhcpv4.MessageTypeRequest, nil, nil)
+		if resp == nil {
+			break
+		}
+		got = append(got, resp.YourIPAddr.String())
+	}
+	assert.Equal(t, []string{"10.0.0.0", "10.0.0.3", "10.0.1.0", "10.0.1.1"}, got)
+
+	// excluded addresses are refused
+	resp := exchange(t, h, "02:00:00:00:01:00", dhcpv4.MessageTypeRequest, net.IPv4(10, 0, 0, 1), nil)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+}
+
+func TestHashStrategy(t *testing.T) {
+	args := []string{"10.0.0.0", "10.0.0.255", "1h", "1h", "client-id", "none", "1s", "1h", "nak", "hash"}
+	macs := []string{"02:00:00:00:00:00", "02:00:00:00:00:01", "02:00:00:00:00:02"}
+
+	lease := func() []string {
+		// a new lease file every time
+		h, lc, err := setupRange(append([]string{filepath.Join(t.TempDir(), "leases.txt")}, args...)...)
+		require.NoError(t, err)
+		defer lc.Close()
+		var got []string
+		for _, mac := range macs {
+			resp := exchange(t, h, mac, dhcpv4.MessageTypeRequest, nil, nil)
+			require.NotNil(t, resp)
+			got = append(got, resp.YourIPAddr.String())
+		}
+		return got
+	}
+	first := lease()
+	assert.NotEqual(t, []string{"10.0.0.0", "10.0.0.1", "10.0.0.2"}, first, "addresses should be hashed")
+	macs[0], macs[2] = macs[2], macs[0]
+	second := lease()
+	assert.Equal(t, []string{first[2], first[1], first[0]}, second, "addresses should not depend on the order of the clients")
+
+	args[len(args)-1] = "random"
+	_, _, err := setupRange(append([]string{filepath.Join(t.TempDir(), "leases.txt")}, args...)...)
+	assert.Error(t, err)
+}
@@ -0,0 +1,183 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/scratchpad"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// probeTimeout is how long to wait for an answer to a probe
+	probeTimeout = 500 * time.Millisecond
+	// abandonTime is how long an address that answered a probe is kept
+	// out of the pool
+	abandonTime = time.Hour
+	// maxProbes is how many addresses are probed for a DISCOVER before
+	// giving up, so that a client on a crowded network still gets an answer
+	// before it retransmits
+	maxProbes = 4
+)
+
+// prober checks whether an address is already in use, by sending it a probe
+// and waiting for an answer until the timeout. ifindex is the index of the
+// interface the client is attached to, or 0 if it is unknown.
+type prober func(ip net.IP, ifindex int, timeout time.Duration) (bool, error)
+
+// errProbing is returned while the address offered to a client is probed,
+// for the retransmissions of its DISCOVER
+var errProbing = errors.New("offered address is being probed")
+
+// parseProber parses the name of a probe method:
+//   - none: addresses are offered without probing
+//   - icmp: an ICMP echo request is sent to the address
+//   - arp: an ARP request for the address is sent on the interface the
+//     request was received on. Relayed requests are probed with ICMP, since
+//     their clients are not on that link.
+func parseProber(name string) (prober, error) {
+	switch strings.ToLower(name) {
+	case "none":
+		return nil, nil
+	case "icmp":
+		return probeICMP, nil
+	case "arp":
+		return probeARP, nil
+	}
+	return nil, fmt.Errorf("invalid probe method %q, want none, icmp or arp", name)
+}
+
+// inUse probes an address before it is offered in response to a request.
+// Failures to probe are logged, and the address is considered free.
+func (p *PluginState) inUse(req *dhcpv4.DHCPv4, ip net.IP) bool {
+	ifindex := 0
+	if req.GatewayIPAddr == nil || req.GatewayIPAddr.IsUnspecified() {
+		ifindex, _ = scratchpad.InterfaceIndex.Get(scratchpad.For4(req))
+	}
+	used, err := p.probe(ip, ifindex, p.probeTimeout)
+	if err != nil {
+		log.Warningf("Could not probe IP %s: %v", ip, err)
+		return false
+	}
+	return used
+}
+
+// abandon keeps an address offered to a client out of the pool until the
+// cooldown expires, because something else answered at that address. The
+// offer is removed, unless the client already requested it.
+func (p *PluginState) abandon(key string, ip net.IP) {
+	p.offersMu.Lock()
+	defer p.offersMu.Unlock()
+	o, ok := p.offers[key]
+	if !ok || !o.ip.IP.Equal(ip) {
+		return
+	}
+	delete(p.offers, key)
+	log.Warningf("IP %s is already in use, abandoning it for %s", ip, p.cooldown)
+	p.abandoned[ip.String()] = abandoned{ip: o.ip, expires: time.Now().Add(p.cooldown)}
+}
+
+// probed marks the offer made to a client as ready to be sent, once its
+// address didn't answer the probe
+func (p *PluginState) probed(key string, ip net.IP) {
+	p.offersMu.Lock()
+	defer p.offersMu.Unlock()
+	if o, ok := p.offers[key]; ok && o.ip.IP.Equal(ip) {
+		o.probing = false
+		p.offers[key] = o
+	}
+}
+
+// abandoned is an address that answered a probe
+type abandoned struct {
+	ip      net.IPNet
+	expires time.Time
+}
+
+// expireAbandoned returns to the pool the addresses abandoned until the
+// given time, and returns how many were freed
+func (p *PluginState) expireAbandoned(now time.Time) int {
+	p.offersMu.Lock()
+	defer p.offersMu.Unlock()
+	return p.expireAbandonedLocked(now)
+}
+
+func (p *PluginState) expireAbandonedLocked(now time.Time) int {
+	n := 0
+	for k, a := range p.abandoned {
+		if !a.expires.After(now) {
+			delete(p.abandoned, k)
+			p.free(a.ip)
+			n++
+		}
+	}
+	return n
+}
+
+// probeICMP sends an ICMP echo request to an address. It needs a raw socket,
+// or unprivileged ICMP sockets where they are allowed (net.ipv4.ping_group_range
+// on Linux).
+func probeICMP(ip net.IP, _ int, timeout time.Duration) (bool, error) {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	var dst net.Addr = &net.IPAddr{IP: ip}
+	if err != nil {
+		var uerr error
+		if conn, uerr = icmp.ListenPacket("udp4", "0.0.0.0"); uerr != nil {
+			return false, err
+		}
+		dst = &net.UDPAddr{IP: ip}
+	}
+	defer conn.Close()
+
+	id := os.Getpid() & 0xffff
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: 1, Data: []byte("coredhcp")},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return false, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return false, err
+	}
+	if _, err := conn.WriteTo(b, dst); err != nil {
+		return false, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				return false, nil
+			}
+			return false, err
+		}
+		// raw sockets receive all the ICMP messages of the host
+		var from net.IP
+		switch a := peer.(type) {
+		case *net.IPAddr:
+			from = a.IP
+		case *net.UDPAddr:
+			from = a.IP
+		}
+		if !from.Equal(ip) {
+			continue
+		}
+		reply, err := icmp.ParseMessage(1, buf[:n])
+		if err == nil && reply.Type == ipv4.ICMPTypeEchoReply {
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+//go:build linux
+// +build linux
+
+package rangeplugin
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// htons converts a short from host to network byte order, for the protocol
+// of packet sockets
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// probeARP sends an ARP probe (RFC 5227) for an address on an interface, and
+// waits for a reply from it. Without an interface, it falls back to ICMP.
+func probeARP(ip net.IP, ifindex int, timeout time.Duration) (bool, error) {
+	if ifindex == 0 {
+		return probeICMP(ip, ifindex, timeout)
+	}
+	iface, err := net.InterfaceByIndex(ifindex)
+	if err != nil {
+		return false, err
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return false, fmt.Errorf("interface %s is not an Ethernet interface", iface.Name)
+	}
+
+	eth := layers.Ethernet{
+		SrcMAC:       iface.HardwareAddr,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   iface.HardwareAddr,
+		SourceProtAddress: net.IPv4zero.To4(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    ip.To4(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, &eth, &arp); err != nil {
+		return false, fmt.Errorf("cannot serialize ARP probe: %v", err)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return false, fmt.Errorf("cannot open socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	addr := syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ARP), Ifindex: iface.Index}
+	if err := syscall.Bind(fd, &addr); err != nil {
+		return false, fmt.Errorf("cannot bind socket to %s: %v", iface.Name, err)
+	}
+	if err := syscall.Sendto(fd, buf.Bytes(), 0, &addr); err != nil {
+		return false, fmt.Errorf("cannot send ARP probe: %v", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	frame := make([]byte, 1500)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return false, nil
+		}
+		tv := syscall.NsecToTimeval(left.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return false, err
+		}
+		n, _, err := syscall.Recvfrom(fd, frame, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		packet := gopacket.NewPacket(frame[:n], layers.LayerTypeEthernet, gopacket.NoCopy)
+		reply, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+		if !ok || reply.Operation != layers.ARPReply {
+			continue
+		}
+		if bytes.Equal(reply.SourceProtAddress, ip.To4()) {
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+//go:build !linux
+// +build !linux
+
+package rangeplugin
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// probeARP is only supported on Linux
+func probeARP(net.IP, int, time.Duration) (bool, error) {
+	return false, errors.New("ARP probes are only supported on Linux")
+}
@@ -0,0 +1,128 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/scratchpad"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProber answers for the addresses in use, and records the probes
+type fakeProber struct {
+	mu     sync.Mutex
+	used   map[string]bool
+	probes []string
+	ifaces []int
+}
+
+func (f *fakeProber) probe(ip net.IP, ifindex int, _ time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.probes = append(f.probes, ip.String())
+	f.ifaces = append(f.ifaces, ifindex)
+	return f.used[ip.String()], nil
+}
+
+func TestParseProber(t *testing.T) {
+	for _, name := range []string{"none", "icmp", "ARP"} {
+		_, err := parseProber(name)
+		assert.NoError(t, err, name)
+	}
+	probe, err := parseProber("none")
+	require.NoError(t, err)
+	assert.Nil(t, probe)
+	_, err = parseProber("nmap")
+	assert.Error(t, err)
+
+	for _, args := range [][]string{
+		{"1h", "client-id", "ping"},
+		{"1h", "client-id", "icmp", "0s"},
+		{"1h", "client-id", "icmp", "1s", "-1h"},
+	} {
+		args = append([]string{filepath.Join(t.TempDir(), "leases.txt"), "10.0.0.0", "10.0.0.10", "1h"}, args...)
+		_, _, err := setupRange(args...)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	_, lc, err := setupRange(filepath.Join(t.TempDir(), "leases.txt"), "10.0.0.0", "10.0.0.10", "1h", "1h", "client-id", "icmp", "100ms", "10m")
+	require.NoError(t, err)
+	defer lc.Close()
+	p := lc.(*PluginState)
+	fake := &fakeProber{used: map[string]bool{"10.0.0.0": true, "10.0.0.1": true}}
+	p.probe = fake.probe
+
+	// addresses in use are skipped
+	req, resp := newRequestFor(t, "02:00:00:00:00:00", dhcpv4.MessageTypeDiscover, nil)
+	scratchpad.InterfaceIndex.Set(scratchpad.Attach4(req), 3)
+	defer scratchpad.Release4(req)
+	resp, _ = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 2)))
+	assert.Equal(t, []string{"10.0.0.0", "10.0.0.1", "10.0.0.2"}, fake.probes)
+	assert.Equal(t, []int{3, 3, 3}, fake.ifaces)
+
+	// offers and leases are not probed again
+	resp = exchange(t, p.Handler4, "02:00:00:00:00:00", dhcpv4.MessageTypeDiscover, nil, nil)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 2)))
+	resp = exchange(t, p.Handler4, "02:00:00:00:00:00", dhcpv4.MessageTypeRequest, net.IPv4(10, 0, 0, 2), serverID)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 2)))
+	resp = exchange(t, p.Handler4, "02:00:00:00:00:00", dhcpv4.MessageTypeDiscover, nil, nil)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 2)))
+	assert.Len(t, fake.probes, 3)
+
+	// abandoned addresses can't be requested until the cooldown expires
+	resp = exchange(t, p.Handler4, "02:00:00:00:00:01", dhcpv4.MessageTypeRequest, net.IPv4(10, 0, 0, 0), nil)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+	assert.Equal(t, 0, p.expireAbandoned(time.Now()))
+	assert.Equal(t, 2, p.expireAbandoned(time.Now().Add(10*time.Minute)))
+	resp = exchange(t, p.Handler4, "02:00:00:00:00:01", dhcpv4.MessageTypeRequest, net.IPv4(10, 0, 0, 0), nil)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 0)))
+
+	// relayed requests are not probed on the receiving interface, and
+	// addresses still in use are abandoned again
+	req, resp = newRequestFor(t, "02:00:00:00:00:02", dhcpv4.MessageTypeDiscover, nil)
+	req.GatewayIPAddr = net.IPv4(192, 168, 0, 1)
+	scratchpad.InterfaceIndex.Set(scratchpad.Attach4(req), 3)
+	defer scratchpad.Release4(req)
+	resp, _ = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 3)))
+	assert.Equal(t, []int{0, 0}, fake.ifaces[len(fake.ifaces)-2:])
+	assert.Len(t, p.abandoned, 1)
+}
+
+func TestProbeGivesUp(t *testing.T) {
+	_, lc, err := setupRange(filepath.Join(t.TempDir(), "leases.txt"), "10.0.0.0", "10.0.0.10", "1h", "1h", "client-id", "icmp")
+	require.NoError(t, err)
+	defer lc.Close()
+	p := lc.(*PluginState)
+	fake := &fakeProber{used: map[string]bool{}}
+	for i := 0; i <= 10; i++ {
+		fake.used[net.IPv4(10, 0, 0, byte(i)).String()] = true
+	}
+	p.probe = fake.probe
+
+	resp := exchange(t, p.Handler4, "02:00:00:00:00:00", dhcpv4.MessageTypeDiscover, nil, nil)
+	assert.Nil(t, resp)
+	assert.Len(t, fake.probes, maxProbes)
+	assert.Len(t, p.abandoned, maxProbes)
+	assert.Empty(t, p.offers)
+
+	// retransmissions are ignored while the offer is probed
+	p.offers["02:00:00:00:00:01"] = offer{ip: net.IPNet{IP: net.IPv4(10, 0, 0, 9)}, expires: time.Now().Add(time.Minute), probing: true}
+	resp = exchange(t, p.Handler4, "02:00:00:00:00:01", dhcpv4.MessageTypeDiscover, nil, nil)
+	assert.Nil(t, resp)
+	assert.Len(t, fake.probes, maxProbes)
+}
@@ -0,0 +1,349 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package range6
+
+import (
+	"net"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/coredhcp/coredhcp/plugins/leasestore"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcpIana "github.com/insomniacslk/dhcp/iana"
+)
+
+// offer is an address reserved for an IA between the Advertise and the
+// Request. Offers are only kept in memory, so that clients that never send a
+// Request don't hold an address for the whole valid lifetime.
+type offer struct {
+	ip      net.IP
+	expires time.Time
+}
+
+// binding is the outcome of a Request, Renew or Rebind for one IA_NA
+type binding struct {
+	ia *dhcpv6.OptIANA
+	// bound are the addresses leased to the IA
+	bound []net.IP
+	// gone are the addresses the IA cannot use anymore, which are returned
+	// with zero lifetimes
+	gone []net.IP
+	// offered is the address reserved by the Advertise, until it is bound
+	offered net.IP
+	// allocated is the address allocated for this exchange, freed if the
+	// lease cannot be persisted
+	allocated net.IP
+	status    dhcpIana.StatusCode
+}
+
+// Handler6 handles the IA_NA options of DHCPv6 messages
+func (p *PluginState) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	msg, err := req.GetInnerMessage()
+	if err != nil {
+		log.Error(err)
+		return nil, true
+	}
+	ianas := msg.Options.IANA()
+	if len(ianas) == 0 {
+		return resp, false
+	}
+	client := msg.Options.ClientID()
+	if client == nil {
+		log.Error("Invalid packet received, no clientID")
+		return nil, true
+	}
+	duid := client.ToBytes()
+
+	switch msg.Type() {
+	case dhcpv6.MessageTypeSolicit:
+		if msg.GetOneOption(dhcpv6.OptionRapidCommit) == nil {
+			p.advertise(duid, ianas, resp)
+			return resp, false
+		}
+		return p.assign(duid, ianas, msg.Type(), resp)
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+		return p.assign(duid, ianas, msg.Type(), resp)
+	case dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		return p.release(duid, ianas, msg.Type() == dhcpv6.MessageTypeDecline, resp)
+	}
+	return resp, false
+}
+
+// hint returns the first address the client asked for in an IA, if any
+func hint(ia *dhcpv6.OptIANA) net.IP {
+	if a := ia.Options.OneAddress(); a != nil {
+		return a.IPv6Addr
+	}
+	return nil
+}
+
+func (p *PluginState) iaNA(id [4]byte, bound, gone []net.IP) *dhcpv6.OptIANA {
+	ia := &dhcpv6.OptIANA{IaId: id, T1: p.t1, T2: p.t2}
+	for _, ip := range bound {
+		ia.Options.Add(&dhcpv6.OptIAAddress{
+			IPv6Addr:          ip,
+			PreferredLifetime: p.preferredLifetime,
+			ValidLifetime:     p.validLifetime,
+		})
+	}
+	for _, ip := range gone {
+		ia.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: ip})
+	}
+	return ia
+}
+
+func iaStatus(id [4]byte, code dhcpIana.StatusCode, message string) *dhcpv6.OptIANA {
+	ia := &dhcpv6.OptIANA{IaId: id}
+	ia.Options.Add(&dhcpv6.OptStatusCode{StatusCode: code, StatusMessage: message})
+	return ia
+}
+
+// advertise reserves an address for each IA of a Solicit
+func (p *PluginState) advertise(duid []byte, ianas []*dhcpv6.OptIANA, resp dhcpv6.DHCPv6) {
+	for _, ia := range ianas {
+		key := iaKey(duid, ia.IaId)
+		ip, err := p.reserve(key, hint(ia))
+		if err != nil {
+			log.Errorf("Could not allocate IP for IA %s: %v", key, err)
+			resp.AddOption(iaStatus(ia.IaId, dhcpIana.StatusNoAddrsAvail, "no addresses available"))
+			continue
+		}
+		log.Printf("advertising IP address %s to IA %s", ip, key)
+		resp.AddOption(p.iaNA(ia.IaId, []net.IP{ip}, nil))
+	}
+}
+
+// reserve returns the address to advertise to an IA: the one it holds if any
+// and it is in the pool, or one reserved until the offer expires
+func (p *PluginState) reserve(key string, requested net.IP) (net.IP, error) {
+	for _, l := range p.leases.ByKey(key) {
+		if p.allocator.Contains(l.IP()) {
+			return l.IP(), nil
+		}
+	}
+	p.offersMu.Lock()
+	defer p.offersMu.Unlock()
+	now := time.Now()
+	if o, ok := p.offers[key]; ok {
+		o.expires = now.Add(p.offerTimeout)
+		p.offers[key] = o
+		return o.ip, nil
+	}
+	n, err := p.allocator.Allocate(net.IPNet{IP: requested})
+	if err == allocators.ErrNoAddrAvail && p.expireOffersLocked(now) > 0 {
+		n, err = p.allocator.Allocate(net.IPNet{IP: requested})
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.offers[key] = offer{ip: n.IP, expires: now.Add(p.offerTimeout)}
+	return n.IP, nil
+}
+
+// takeOffer removes the offer made to an IA, and returns its address if any
+func (p *PluginState) takeOffer(key string) net.IP {
+	p.offersMu.Lock()
+	defer p.offersMu.Unlock()
+	o, ok := p.offers[key]
+	if !ok {
+		return nil
+	}
+	delete(p.offers, key)
+	return o.ip
+}
+
+// expireOffers frees the addresses of the offers expired at the given time,
+// and returns how many were freed
+func (p *PluginState) expireOffers(now time.Time) int {
+	p.offersMu.Lock()
+	defer p.offersMu.Unlock()
+	return p.expireOffersLocked(now)
+}
+
+func (p *PluginState) expireOffersLocked(now time.Time) int {
+	n := 0
+	for key, o := range p.offers {
+		if o.expires.After(now) {
+			continue
+		}
+		delete(p.offers, key)
+		p.free(o.ip)
+		n++
+	}
+	return n
+}
+
+// assign binds addresses to the IAs of a Request, a Renew, a Rebind or a
+// Solicit with rapid commit, in a single transaction
+func (p *PluginState) assign(duid []byte, ianas []*dhcpv6.OptIANA, mt dhcpv6.MessageType, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	bindings := make([]binding, len(ianas))
+	for i, ia := range ianas {
+		bindings[i].ia = ia
+		bindings[i].offered = p.takeOffer(iaKey(duid, ia.IaId))
+	}
+	expires := p.expiry()
+	err := p.leases.Update(func(tx leasestore.Tx) error {
+		for i := range bindings {
+			if err := p.bind(tx, iaKey(duid, bindings[i].ia.IaId), &bindings[i], mt, expires); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	p.Lock()
+	p.saveErr = err
+	p.Unlock()
+	for _, b := range bindings {
+		if b.offered != nil {
+			p.free(b.offered)
+		}
+		if err != nil && b.allocated != nil {
+			p.free(b.allocated)
+		}
+	}
+	if err != nil {
+		log.Errorf("Could not persist the leases of client %x: %v", duid, err)
+		return nil, true
+	}
+
+	for _, b := range bindings {
+		key := iaKey(duid, b.ia.IaId)
+		switch b.status {
+		case dhcpIana.StatusNoAddrsAvail:
+			log.Errorf("Could not allocate IP for IA %s: no addresses available", key)
+			resp.AddOption(iaStatus(b.ia.IaId, b.status, "no addresses available"))
+			continue
+		case dhcpIana.StatusNoBinding:
+			log.Printf("%s for unknown IA %s", mt, key)
+			resp.AddOption(iaStatus(b.ia.IaId, b.status, "no binding for the IA"))
+			continue
+		}
+		for _, ip := range b.gone {
+			log.Printf("IP address %s of IA %s is no longer served", ip, key)
+		}
+		log.Printf("assigning IP addresses %v to IA %s", b.bound, key)
+		resp.AddOption(p.iaNA(b.ia.IaId, b.bound, b.gone))
+	}
+	return resp, false
+}
+
+// bind extends the leases of an IA, or leases it the address it was offered
+// or a new one. Leases outside of the pool are ended, and the IA is moved to
+// an address of the pool.
+func (p *PluginState) bind(tx leasestore.Tx, key string, b *binding, mt dhcpv6.MessageType, expires time.Time) error {
+	leases := tx.ByKey(key)
+	if len(leases) == 0 && (mt == dhcpv6.MessageTypeRenew || mt == dhcpv6.MessageTypeRebind) {
+		// RFC 8415 section 18.3.5: on a Rebind, the addresses that are
+		// not ours are returned with zero lifetimes
+		if mt == dhcpv6.MessageTypeRebind {
+			for _, a := range b.ia.Options.Addresses() {
+				if !p.allocator.Contains(a.IPv6Addr) {
+					b.gone = append(b.gone, a.IPv6Addr)
+				}
+			}
+		}
+		if len(b.gone) == 0 {
+			b.status = dhcpIana.StatusNoBinding
+		}
+		return nil
+	}
+	for _, l := range leases {
+		if !p.allocator.Contains(l.IP()) {
+			if err := tx.Delete(l.Addr); err != nil {
+				return err
+			}
+			b.gone = append(b.gone, l.IP())
+			continue
+		}
+		l.Expires = expires
+		if err := tx.Put(l); err != nil {
+			return err
+		}
+		b.bound = append(b.bound, l.IP())
+	}
+	if len(b.bound) > 0 {
+		return nil
+	}
+
+	ip := b.offered
+	b.offered = nil
+	if ip == nil {
+		n, err := p.allocator.Allocate(net.IPNet{IP: hint(b.ia)})
+		if err != nil {
+			b.status = dhcpIana.StatusNoAddrsAvail
+			return nil
+		}
+		ip = n.IP
+	}
+	b.allocated = ip
+	b.bound = append(b.bound, ip)
+	return tx.Put(leasestore.Lease{Key: key, Addr: leasestore.FromIP(ip), Expires: expires})
+}
+
+// release ends the leases of the addresses listed in the IAs of a Release or
+// a Decline. Declined addresses are kept out of the pool for the grace period.
+func (p *PluginState) release(duid []byte, ianas []*dhcpv6.OptIANA, decline bool, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	var (
+		freed   []net.IP
+		unbound []*dhcpv6.OptIANA
+	)
+	now := time.Now()
+	err := p.leases.Update(func(tx leasestore.Tx) error {
+		freed, unbound = nil, nil
+		for _, ia := range ianas {
+			found := false
+			key := iaKey(duid, ia.IaId)
+			for _, l := range tx.ByKey(key) {
+				for _, a := range ia.Options.Addresses() {
+					if !a.IPv6Addr.Equal(l.IP()) {
+						continue
+					}
+					found = true
+					var err error
+					switch {
+					case decline && p.allocator.Contains(l.IP()):
+						log.Warningf("IP address %s was declined by IA %s", l.IP(), key)
+						err = tx.Put(leasestore.Lease{Key: declinedKey, Addr: l.Addr, Expires: now})
+					default:
+						log.Printf("IP address %s was released by IA %s", l.IP(), key)
+						err = tx.Delete(l.Addr)
+						if p.allocator.Contains(l.IP()) {
+							freed = append(freed, l.IP())
+						}
+					}
+					if err != nil {
+						return err
+					}
+				}
+			}
+			if !found {
+				unbound = append(unbound, ia)
+			}
+		}
+		return nil
+	})
+	p.Lock()
+	p.saveErr = err
+	p.Unlock()
+	if err != nil {
+		log.Errorf("Could not persist the leases of client %x: %v", duid, err)
+		return nil, true
+	}
+	for _, ip := range freed {
+		p.free(ip)
+	}
+
+	// RFC 8415 sections 18.3.7 and 18.3.8
+	message := "addresses released"
+	if decline {
+		message = "addresses declined"
+	}
+	// other plugins may answer for other IAs of the same message
+	resp.UpdateOption(&dhcpv6.OptStatusCode{StatusCode: dhcpIana.StatusSuccess, StatusMessage: message})
+	for _, ia := range unbound {
+		resp.AddOption(iaStatus(ia.IaId, dhcpIana.StatusNoBinding, "no binding for the IA"))
+	}
+	return resp, false
+}
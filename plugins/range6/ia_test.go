@@ -0,0 +1,203 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package range6
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/plugins/leasestore"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcpIana "github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var duid = &dhcpv6.DUIDLL{
+	HWType:        dhcpIana.HWTypeEthernet,
+	LinkLayerAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01},
+}
+
+// ia returns an IA_NA, with the given addresses
+func ia(id byte, addrs ...string) *dhcpv6.OptIANA {
+	o := &dhcpv6.OptIANA{IaId: [4]byte{0, 0, 0, id}}
+	for _, a := range addrs {
+		o.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP(a)})
+	}
+	return o
+}
+
+// exchange sends a message with the given IAs through the handler, and
+// returns the reply
+func exchange(t *testing.T, h handler.Handler6, mt dhcpv6.MessageType, ias ...*dhcpv6.OptIANA) *dhcpv6.Message {
+	req, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	req.MessageType = mt
+	req.AddOption(dhcpv6.OptClientID(duid))
+	for _, o := range ias {
+		req.AddOption(o)
+	}
+	var resp *dhcpv6.Message
+	switch mt {
+	case dhcpv6.MessageTypeSolicit:
+		resp, err = dhcpv6.NewAdvertiseFromSolicit(req)
+	case dhcpv6.MessageTypeDecline:
+		// as built by the server
+		resp = &dhcpv6.Message{MessageType: dhcpv6.MessageTypeReply, TransactionID: req.TransactionID}
+	default:
+		resp, err = dhcpv6.NewReplyFromMessage(req)
+	}
+	require.NoError(t, err)
+	r, stop := h(req, resp)
+	require.NotNil(t, r)
+	assert.False(t, stop)
+	return r.(*dhcpv6.Message)
+}
+
+// addresses returns the addresses of the IA_NA options of a reply, and their
+// valid lifetimes
+func addresses(m *dhcpv6.Message) map[string]time.Duration {
+	ret := make(map[string]time.Duration)
+	for _, o := range m.Options.IANA() {
+		for _, a := range o.Options.Addresses() {
+			ret[a.IPv6Addr.String()] = a.ValidLifetime
+		}
+	}
+	return ret
+}
+
+func iaStatusCode(t *testing.T, m *dhcpv6.Message) dhcpIana.StatusCode {
+	ianas := m.Options.IANA()
+	require.Len(t, ianas, 1)
+	status := ianas[0].Options.Status()
+	if status == nil {
+		return dhcpIana.StatusSuccess
+	}
+	return status.StatusCode
+}
+
+func TestSolicitRequest(t *testing.T) {
+	h, lc, _ := setup(t, "2001:db8::1-2001:db8::3", "1h", "30m")
+	p := lc.(*PluginState)
+
+	adv := exchange(t, h, dhcpv6.MessageTypeSolicit, ia(1), ia(2, "2001:db8::3"))
+	assert.Equal(t, map[string]time.Duration{"2001:db8::1": time.Hour, "2001:db8::3": time.Hour}, addresses(adv))
+	ianas := adv.Options.IANA()
+	require.Len(t, ianas, 2)
+	assert.Equal(t, 15*time.Minute, ianas[0].T1)
+	assert.Equal(t, 24*time.Minute, ianas[0].T2)
+	assert.Equal(t, 30*time.Minute, ianas[0].Options.OneAddress().PreferredLifetime)
+	assert.Equal(t, 0, p.leases.Len())
+
+	// the advertised addresses are kept for the Request
+	adv = exchange(t, h, dhcpv6.MessageTypeSolicit, ia(1), ia(2))
+	assert.Equal(t, map[string]time.Duration{"2001:db8::1": time.Hour, "2001:db8::3": time.Hour}, addresses(adv))
+	reply := exchange(t, h, dhcpv6.MessageTypeRequest, ia(1), ia(2), ia(3))
+	assert.Equal(t, map[string]time.Duration{
+		"2001:db8::1": time.Hour, "2001:db8::2": time.Hour, "2001:db8::3": time.Hour,
+	}, addresses(reply))
+	assert.Equal(t, 3, p.leases.Len())
+	assert.Empty(t, p.offers)
+
+	// and then there are none
+	reply = exchange(t, h, dhcpv6.MessageTypeRequest, ia(4))
+	assert.Equal(t, dhcpIana.StatusNoAddrsAvail, iaStatusCode(t, reply))
+
+	// Renew extends the leases
+	l := p.leases.ByKey(iaKey(duid.ToBytes(), [4]byte{0, 0, 0, 1}))
+	require.Len(t, l, 1)
+	require.NoError(t, p.leases.Put(leasestore.Lease{Key: l[0].Key, Addr: l[0].Addr, Expires: time.Now()}))
+	reply = exchange(t, h, dhcpv6.MessageTypeRenew, ia(1, "2001:db8::1"))
+	assert.Equal(t, map[string]time.Duration{"2001:db8::1": time.Hour}, addresses(reply))
+	l = p.leases.ByKey(l[0].Key)
+	require.Len(t, l, 1)
+	assert.True(t, l[0].Expires.After(time.Now().Add(59*time.Minute)))
+}
+
+func TestRapidCommit(t *testing.T) {
+	h, lc, _ := setup(t, "2001:db8::/126", "1h")
+
+	req, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	req.MessageType = dhcpv6.MessageTypeSolicit
+	req.AddOption(dhcpv6.OptClientID(duid))
+	req.AddOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionRapidCommit})
+	req.AddOption(ia(1))
+	resp, err := dhcpv6.NewReplyFromMessage(req)
+	require.NoError(t, err)
+	r, _ := h(req, resp)
+	assert.Equal(t, map[string]time.Duration{"2001:db8::1": time.Hour}, addresses(r.(*dhcpv6.Message)))
+	assert.Equal(t, 1, lc.(*PluginState).leases.Len())
+}
+
+func TestUnknownBindings(t *testing.T) {
+	h, _, _ := setup(t, "2001:db8::/126", "1h")
+
+	reply := exchange(t, h, dhcpv6.MessageTypeRenew, ia(1, "2001:db8::1"))
+	assert.Equal(t, dhcpIana.StatusNoBinding, iaStatusCode(t, reply))
+	reply = exchange(t, h, dhcpv6.MessageTypeRebind, ia(1, "2001:db8::1"))
+	assert.Equal(t, dhcpIana.StatusNoBinding, iaStatusCode(t, reply))
+
+	// addresses of another link are invalidated on Rebind
+	reply = exchange(t, h, dhcpv6.MessageTypeRebind, ia(1, "2001:db8:1::1"))
+	assert.Equal(t, dhcpIana.StatusSuccess, iaStatusCode(t, reply))
+	assert.Equal(t, map[string]time.Duration{"2001:db8:1::1": 0}, addresses(reply))
+
+	reply = exchange(t, h, dhcpv6.MessageTypeRelease, ia(1, "2001:db8::1"))
+	assert.Equal(t, dhcpIana.StatusSuccess, reply.Options.Status().StatusCode)
+	assert.Equal(t, dhcpIana.StatusNoBinding, iaStatusCode(t, reply))
+}
+
+func TestReleaseDecline(t *testing.T) {
+	h, lc, _ := setup(t, "2001:db8::1-2001:db8::2", "1h", "1h", "30m", "48m", "10m")
+	p := lc.(*PluginState)
+
+	exchange(t, h, dhcpv6.MessageTypeRequest, ia(1), ia(2))
+	assert.Equal(t, 2, p.leases.Len())
+
+	reply := exchange(t, h, dhcpv6.MessageTypeRelease, ia(1, "2001:db8::1"))
+	assert.Equal(t, dhcpIana.StatusSuccess, reply.Options.Status().StatusCode)
+	assert.Empty(t, reply.Options.IANA())
+	assert.Equal(t, 1, p.leases.Len())
+
+	reply = exchange(t, h, dhcpv6.MessageTypeDecline, ia(2, "2001:db8::2"))
+	assert.Equal(t, dhcpIana.StatusSuccess, reply.Options.Status().StatusCode)
+	l, ok := p.leases.ByAddr(leasestore.FromIP(net.ParseIP("2001:db8::2")))
+	require.True(t, ok)
+	assert.Equal(t, declinedKey, l.Key)
+
+	// the released address is given out again, not the declined one
+	reply = exchange(t, h, dhcpv6.MessageTypeRequest, ia(2))
+	assert.Equal(t, map[string]time.Duration{"2001:db8::1": time.Hour}, addresses(reply))
+	reply = exchange(t, h, dhcpv6.MessageTypeRequest, ia(3))
+	assert.Equal(t, dhcpIana.StatusNoAddrsAvail, iaStatusCode(t, reply))
+
+	// until the grace period is over
+	n, err := p.reap(time.Now().Add(11 * time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	reply = exchange(t, h, dhcpv6.MessageTypeRequest, ia(3))
+	assert.Equal(t, map[string]time.Duration{"2001:db8::2": time.Hour}, addresses(reply))
+}
+
+func TestOrphans(t *testing.T) {
+	h, lc, _ := setup(t, "2001:db8::/126", "1h")
+	p := lc.(*PluginState)
+	key := iaKey(duid.ToBytes(), [4]byte{0, 0, 0, 1})
+	require.NoError(t, p.leases.Put(leasestore.Lease{
+		Key:     key,
+		Addr:    leasestore.FromIP(net.ParseIP("2001:db8:1::1")),
+		Expires: time.Now().Add(time.Hour),
+	}))
+
+	// the client is moved to an address of the pool
+	reply := exchange(t, h, dhcpv6.MessageTypeRenew, ia(1, "2001:db8:1::1"))
+	assert.Equal(t, map[string]time.Duration{"2001:db8:1::1": 0, "2001:db8::1": time.Hour}, addresses(reply))
+	l := p.leases.ByKey(key)
+	require.Len(t, l, 1)
+	assert.Equal(t, "2001:db8::1", l[0].IP().String())
+}
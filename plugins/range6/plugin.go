@@ -0,0 +1,387 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package range6 implements a plugin allocating DHCPv6 addresses (IA_NA)
+// from a pool, the DHCPv6 counterpart of the range plugin.
+//
+// Each IA_NA of a client gets its own lease, keyed by the DUID of the client
+// and the IAID. Leases are persisted to a lease file, and freed once expired
+// for longer than the grace period.
+package range6
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/coredhcp/coredhcp/plugins/leasestore"
+)
+
+var log = logger.GetLogger("plugins/range6")
+
+// Plugin wraps plugin registration information
+var Plugin = plugins.Plugin{
+	Name:            "range6",
+	SetupLifecycle6: setupRange6,
+	Args6: &plugins.ArgSpec{
+		Args: []plugins.Arg{
+			{Name: "file", Type: plugins.ArgString, Description: "file storing the allocated leases across restarts"},
+			{Name: "pool", Type: plugins.ArgString, Description: "prefix or start-end range the addresses are allocated from"},
+			{Name: "valid_lifetime", Type: plugins.ArgDuration, Description: "valid lifetime of the addresses, and duration of the leases"},
+			{Name: "preferred_lifetime", Type: plugins.ArgDuration, Optional: true,
+				Description: "preferred lifetime of the addresses, defaults to the valid lifetime"},
+			{Name: "t1", Type: plugins.ArgDuration, Optional: true,
+				Description: "time after which clients renew, defaults to half the preferred lifetime"},
+			{Name: "t2", Type: plugins.ArgDuration, Optional: true,
+				Description: "time after which clients rebind, defaults to 0.8 times the preferred lifetime"},
+			{Name: "grace", Type: plugins.ArgDuration, Optional: true,
+				Description: "time after which expired and declined addresses are freed, defaults to the valid lifetime"},
+		},
+		Examples: []string{
+			"leases6.txt 2001:db8::/112 1h",
+			"leases6.txt 2001:db8::100-2001:db8::1ff 2h 1h 30m 48m 24h",
+		},
+	},
+}
+
+const (
+	// reapInterval is how often expired leases and offers are looked for
+	reapInterval = time.Minute
+	// offerTimeout is how long the addresses advertised to a client stay
+	// reserved, waiting for its Request
+	offerTimeout = 30 * time.Second
+	// declinedKey is the key of the leases holding the addresses declined
+	// by clients, which are kept out of the pool for the grace period
+	declinedKey = "declined"
+)
+
+// poolAllocator allocates the addresses of the pool, and tells which
+// addresses are part of it
+type poolAllocator interface {
+	allocators.Allocator
+	Contains(ip net.IP) bool
+}
+
+// PluginState is the data held by an instance of the range6 plugin
+type PluginState struct {
+	// Lock for the plugin state below. Allocations are serialized by the
+	// lease store transactions.
+	sync.Mutex
+	validLifetime     time.Duration
+	preferredLifetime time.Duration
+	t1, t2            time.Duration
+	grace             time.Duration
+	reapInterval      time.Duration
+	stop              chan struct{}
+	done              chan struct{}
+	// leases holds the IA -> address leases
+	leases    leasestore.Store
+	allocator poolAllocator
+	closed    bool
+	// saveErr is the error of the last failed attempt to persist a lease, if
+	// the following ones failed as well
+	saveErr error
+
+	// offersMu protects the offers, which are not persisted
+	offersMu     sync.Mutex
+	offers       map[string]offer
+	offerTimeout time.Duration
+}
+
+// iaKey returns the key of the lease of an IA of a client
+func iaKey(duid []byte, iaid [4]byte) string {
+	return hex.EncodeToString(duid) + ":" + hex.EncodeToString(iaid[:])
+}
+
+// validKey returns whether a key of the lease file could have been computed
+// by iaKey
+func validKey(key string) bool {
+	if key == declinedKey {
+		return true
+	}
+	duid, iaid, ok := strings.Cut(key, ":")
+	if !ok {
+		return false
+	}
+	d, err := hex.DecodeString(duid)
+	if err != nil || len(d) == 0 {
+		return false
+	}
+	i, err := hex.DecodeString(iaid)
+	return err == nil && len(i) == 4
+}
+
+// expiry returns the expiry of a lease given now, rounded up to the second
+// as it is stored
+func (p *PluginState) expiry() time.Time {
+	return time.Now().Add(p.validLifetime).Truncate(time.Second).Add(time.Second)
+}
+
+// free returns an address to the allocator
+func (p *PluginState) free(ip net.IP) {
+	if err := p.allocator.Free(net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}); err != nil {
+		log.Warningf("Could not free IP %s: %v", ip, err)
+	}
+}
+
+// Start starts freeing the expired leases
+func (p *PluginState) Start() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return errors.New("lease file is closed")
+	}
+	if p.stop != nil {
+		return nil
+	}
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.reaper()
+	return nil
+}
+
+// reaper periodically frees the expired leases, until the plugin is closed
+func (p *PluginState) reaper() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.reapInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := p.reap(time.Now()); err != nil {
+			log.Errorf("Could not free expired leases: %v", err)
+		} else if n > 0 {
+			log.Printf("Freed %d expired leases", n)
+		}
+		if n := p.expireOffers(time.Now()); n > 0 {
+			log.Debugf("Freed %d expired offers", n)
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reap frees the leases that expired for longer than the grace period at the
+// given time, and returns how many were freed
+func (p *PluginState) reap(now time.Time) (int, error) {
+	var expired []leasestore.Lease
+	err := p.leases.Update(func(tx leasestore.Tx) error {
+		expired = tx.ExpiredBefore(now.Add(-p.grace))
+		for _, l := range expired {
+			if err := tx.Delete(l.Addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range expired {
+		if !p.allocator.Contains(l.IP()) {
+			continue
+		}
+		log.Debugf("Freeing IP address %s of %s, expired at %s", l.IP(), l.Key, l.Expires)
+		p.free(l.IP())
+	}
+	return len(expired), nil
+}
+
+// Close stops freeing expired leases and closes the lease file. No leases can
+// be allocated afterwards
+func (p *PluginState) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.stop != nil {
+		close(p.stop)
+		<-p.done
+	}
+	return p.leases.Close()
+}
+
+// Healthy reports whether leases can be persisted to the lease file
+func (p *PluginState) Healthy() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return errors.New("lease file is closed")
+	}
+	if p.saveErr != nil {
+		return fmt.Errorf("failed to persist leases: %w", p.saveErr)
+	}
+	return nil
+}
+
+// parsePool parses the addresses to allocate from, given as a prefix or as a
+// `start-end` range. The first address of a prefix is the Subnet-Router
+// anycast address (RFC 4291), and is left out.
+func parsePool(s string) (start, end net.IP, err error) {
+	if strings.Contains(s, "/") {
+		ip, prefix, err := net.ParseCIDR(s)
+		if err != nil || ip.To4() != nil {
+			return nil, nil, fmt.Errorf("invalid IPv6 prefix: %v", s)
+		}
+		start = prefix.IP.To16()
+		end = make(net.IP, net.IPv6len)
+		for i := range end {
+			end[i] = start[i] | ^prefix.Mask[i]
+		}
+		if ones, _ := prefix.Mask.Size(); ones < 127 {
+			start, _ = allocators.AddPrefixes(start, 1, 128)
+		}
+		return start, end, nil
+	}
+	first, last, ok := strings.Cut(s, "-")
+	start, end = net.ParseIP(first), net.ParseIP(last)
+	if !ok || start == nil || start.To4() != nil || end == nil || end.To4() != nil {
+		return nil, nil, fmt.Errorf("invalid IPv6 range: %v", s)
+	}
+	return start, end, nil
+}
+
+func parseDuration(name, s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s: %v", name, s)
+	}
+	return d, nil
+}
+
+func setupRange6(args ...string) (handler.Handler6, plugins.Lifecycle, error) {
+	var (
+		err error
+		p   PluginState
+	)
+
+	if len(args) < 3 {
+		return nil, nil, fmt.Errorf("invalid number of arguments, want: 3 (file name, pool, valid lifetime), got: %d", len(args))
+	}
+	filename := args[0]
+	if filename == "" {
+		return nil, nil, errors.New("file name cannot be empty")
+	}
+	start, end, err := parsePool(args[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	p.allocator, err = bitmap.NewIPv6RangeAllocator(start, end)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create an allocator: %w", err)
+	}
+
+	if p.validLifetime, err = parseDuration("valid lifetime", args[2]); err != nil {
+		return nil, nil, err
+	}
+	p.preferredLifetime = p.validLifetime
+	if len(args) > 3 {
+		if p.preferredLifetime, err = parseDuration("preferred lifetime", args[3]); err != nil {
+			return nil, nil, err
+		}
+		if p.preferredLifetime > p.validLifetime {
+			return nil, nil, errors.New("the preferred lifetime cannot be longer than the valid lifetime")
+		}
+	}
+	// RFC 8415 section 21.4 recommends 0.5 and 0.8 times the preferred
+	// lifetime
+	p.t1 = p.preferredLifetime / 2
+	p.t2 = p.preferredLifetime * 4 / 5
+	if len(args) > 4 {
+		if p.t1, err = parseDuration("T1", args[4]); err != nil {
+			return nil, nil, err
+		}
+		if p.t2 < p.t1 {
+			p.t2 = p.t1
+		}
+	}
+	if len(args) > 5 {
+		if p.t2, err = parseDuration("T2", args[5]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if p.t1 > p.t2 {
+		return nil, nil, errors.New("T1 cannot be later than T2")
+	}
+	if p.t2 > p.preferredLifetime {
+		return nil, nil, errors.New("T1 and T2 cannot be later than the preferred lifetime")
+	}
+	p.grace = p.validLifetime
+	if len(args) > 6 {
+		if p.grace, err = parseDuration("grace period", args[6]); err != nil {
+			return nil, nil, err
+		}
+	}
+	p.reapInterval = reapInterval
+	p.offers = make(map[string]offer)
+	p.offerTimeout = offerTimeout
+
+	p.leases, err = leasestore.OpenFile(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load records from file: %v", err)
+	}
+	orphans, err := p.reallocate()
+	if err != nil {
+		p.leases.Close()
+		return nil, nil, err
+	}
+	log.Printf("Loaded %d DHCPv6 leases from %s", p.leases.Len(), filename)
+	if orphans > 0 {
+		log.Warningf("%d leases are outside of the pool, and are kept until they expire", orphans)
+	}
+
+	return p.Handler6, &p, nil
+}
+
+// reallocate marks the addresses of the stored leases as allocated, and
+// returns how many leases are outside of the pool
+func (p *PluginState) reallocate() (int, error) {
+	var (
+		err     error
+		orphans int
+	)
+	p.leases.Each(func(l leasestore.Lease) bool {
+		if !validKey(l.Key) {
+			err = fmt.Errorf("malformed lease key: %s", l.Key)
+			return false
+		}
+		if !l.Addr.Addr().Is6() || l.Addr.Addr().Is4In6() || !l.Addr.IsSingleIP() {
+			err = fmt.Errorf("expected an IPv6 address, got: %v", l.Addr)
+			return false
+		}
+		if !p.allocator.Contains(l.IP()) {
+			orphans++
+			return true
+		}
+		ip, e := p.allocator.Allocate(l.IPNet())
+		if e != nil {
+			err = fmt.Errorf("failed to re-allocate leased ip %v: %v", l.IP(), e)
+			return false
+		}
+		if !ip.IP.Equal(l.IP()) {
+			err = fmt.Errorf("allocator did not re-allocate requested leased ip %v: %v", l.IP(), ip.String())
+			return false
+		}
+		return true
+	})
+	return orphans, err
+}
+
+// iaid returns an IAID as an integer, for logging
+func iaid(id [4]byte) uint32 {
+	return binary.BigEndian.Uint32(id[:])
+}
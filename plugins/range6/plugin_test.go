@@ -0,0 +1,120 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package range6
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setup(t *testing.T, args ...string) (handler.Handler6, plugins.Lifecycle, string) {
+	filename := filepath.Join(t.TempDir(), "leases6.txt")
+	h, lc, err := setupRange6(append([]string{filename}, args...)...)
+	require.NoError(t, err)
+	t.Cleanup(func() { lc.Close() })
+	return h, lc, filename
+}
+
+func TestParsePool(t *testing.T) {
+	for pool, want := range map[string][2]string{
+		"2001:db8::/120":               {"2001:db8::1", "2001:db8::ff"},
+		"2001:db8::5/127":              {"2001:db8::4", "2001:db8::5"},
+		"2001:db8::10-2001:db8::1:0":   {"2001:db8::10", "2001:db8::1:0"},
+		"2001:db8::10-2001:db8::10":    {"2001:db8::10", "2001:db8::10"},
+		"2001:db8:0:1::/64":            {"2001:db8:0:1::1", "2001:db8:0:1:ffff:ffff:ffff:ffff"},
+		"2001:db8::ff-2001:db8::1:100": {"2001:db8::ff", "2001:db8::1:100"},
+	} {
+		start, end, err := parsePool(pool)
+		require.NoError(t, err, pool)
+		assert.Equal(t, want[0], start.String(), pool)
+		assert.Equal(t, want[1], end.String(), pool)
+	}
+	for _, bad := range []string{"", "2001:db8::", "2001:db8::/130", "10.0.0.0/24", "10.0.0.1-10.0.0.2", "2001:db8::1-"} {
+		_, _, err := parsePool(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	_, lc, _ := setup(t, "2001:db8::/120", "2h", "1h")
+	p := lc.(*PluginState)
+	assert.Equal(t, 2*time.Hour, p.validLifetime)
+	assert.Equal(t, time.Hour, p.preferredLifetime)
+	assert.Equal(t, 30*time.Minute, p.t1)
+	assert.Equal(t, 48*time.Minute, p.t2)
+	assert.Equal(t, 2*time.Hour, p.grace)
+
+	// T2 is not earlier than T1
+	_, lc, _ = setup(t, "2001:db8::/120", "2h", "1h", "50m")
+	assert.Equal(t, 50*time.Minute, lc.(*PluginState).t2)
+
+	_, lc, _ = setup(t, "2001:db8::/120", "2h", "1h", "50m", "55m", "1m")
+	p = lc.(*PluginState)
+	assert.Equal(t, 50*time.Minute, p.t1)
+	assert.Equal(t, 55*time.Minute, p.t2)
+	assert.Equal(t, time.Minute, p.grace)
+
+	filename := filepath.Join(t.TempDir(), "leases6.txt")
+	for _, bad := range [][]string{
+		{filename},
+		{"", "2001:db8::/120", "1h"},
+		{filename, "10.0.0.0/24", "1h"},
+		{filename, "2001:db8::/64", "1h"},
+		{filename, "2001:db8::/120", "-1h"},
+		{filename, "2001:db8::/120", "1h", "2h"},
+		{filename, "2001:db8::/120", "1h", "1h", "30m", "20m"},
+		{filename, "2001:db8::/120", "2h", "1h", "50m", "2h"},
+		{filename, "2001:db8::/120", "2h", "1h", "90m"},
+	} {
+		_, _, err := setupRange6(bad...)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestLoadLeases(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leases6.txt")
+	leases := `00030001020000000001:00000001 2001:db8::1 2000-01-01T00:00:00Z
+00030001020000000001:00000002 2001:db8::2 2000-01-01T00:00:00Z
+00030001020000000002:00000001 2001:db8:1::1 2000-01-01T00:00:00Z
+declined 2001:db8::3 2000-01-01T00:00:00Z
+`
+	require.NoError(t, os.WriteFile(filename, []byte(leases), 0640))
+	_, lc, err := setupRange6(filename, "2001:db8::1-2001:db8::4", "1h")
+	require.NoError(t, err)
+	defer lc.Close()
+	p := lc.(*PluginState)
+	n, err := p.allocator.Allocate(net.IPNet{})
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::4", n.IP.String())
+
+	// expired leases are freed after the grace period, orphans are dropped
+	freed, err := p.reap(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 4, freed)
+	assert.Equal(t, 0, p.leases.Len())
+	n, err = p.allocator.Allocate(net.IPNet{})
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", n.IP.String())
+
+	for _, bad := range []string{
+		"0003:0001 2001:db8::1 2000-01-01T00:00:00Z\n",
+		"00030001:000001 2001:db8::1 2000-01-01T00:00:00Z\n",
+		"00030001:00000001 10.0.0.1 2000-01-01T00:00:00Z\n",
+		"00030001:00000001 2001:db8::/64 2000-01-01T00:00:00Z\n",
+	} {
+		filename := filepath.Join(t.TempDir(), "leases6.txt")
+		require.NoError(t, os.WriteFile(filename, []byte(bad), 0640))
+		_, _, err := setupRange6(filename, "2001:db8::1-2001:db8::4", "1h")
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Registry holds the plugins that can be referenced from a configuration.
+// Programs embedding coredhcp, or tests running in parallel, can use their own
+// registry instead of DefaultRegistry.
+type Registry struct {
+	mu      sync.RWMutex
+	plugins map[string]*Plugin
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{plugins: make(map[string]*Plugin)}
+}
+
+// DefaultRegistry is the registry used by RegisterPlugin, and by LoadPlugins
+// and server.Start when they are not given a registry. It is backed by
+// RegisteredPlugins.
+var DefaultRegistry = &Registry{plugins: RegisteredPlugins}
+
+// Register adds a plugin to the registry. It returns an error if a plugin with
+// the same name is already registered.
+func (r *Registry) Register(plugin *Plugin) error {
+	if plugin == nil {
+		return errors.New("cannot register nil plugin")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.plugins[plugin.Name]; ok {
+		return fmt.Errorf("plugin '%s' is already registered", plugin.Name)
+	}
+	log.Printf("Registering plugin '%s'", plugin.Name)
+	r.plugins[plugin.Name] = plugin
+	return nil
+}
+
+// Lookup returns the plugin registered with the given name, if any
+func (r *Registry) Lookup(name string) (*Plugin, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	plugin, ok := r.plugins[name]
+	return plugin, ok
+}
+
+// Names returns the names of the registered plugins, sorted
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.plugins))
+	for name := range r.plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
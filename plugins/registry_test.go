@@ -0,0 +1,53 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"testing"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	p := &Plugin{Name: "test_registry"}
+	require.NoError(t, reg.Register(p))
+	assert.Error(t, reg.Register(&Plugin{Name: "test_registry"}))
+	assert.Error(t, reg.Register(nil))
+
+	found, ok := reg.Lookup("test_registry")
+	assert.True(t, ok)
+	assert.Same(t, p, found)
+	_, ok = reg.Lookup("nonexistent")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"test_registry"}, reg.Names())
+
+	// registries are independent from each other and from the default one
+	_, ok = DefaultRegistry.Lookup("test_registry")
+	assert.False(t, ok)
+	assert.NoError(t, NewRegistry().Register(&Plugin{Name: "test_registry"}))
+}
+
+func TestDefaultRegistry(t *testing.T) {
+	require.NoError(t, RegisterPlugin(&Plugin{
+		Name:   "test_default",
+		Setup4: func(args ...string) (handler.Handler4, error) { return passthrough4, nil },
+	}))
+	defer delete(RegisteredPlugins, "test_default")
+	assert.Error(t, RegisterPlugin(&Plugin{Name: "test_default"}))
+	_, ok := DefaultRegistry.Lookup("test_default")
+	assert.True(t, ok)
+
+	conf := config.New()
+	conf.Server4 = &config.ServerConfig{Plugins: []config.PluginConfig{{Name: "test_default"}}}
+	h4, _, err := LoadPlugins(nil, conf)
+	require.NoError(t, err)
+	assert.Len(t, h4, 1)
+	_, _, err = LoadPlugins(NewRegistry(), conf)
+	assert.Error(t, err)
+}
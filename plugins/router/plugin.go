@@ -20,30 +20,38 @@ var log = logger.GetLogger("plugins/router")
 var Plugin = plugins.Plugin{
 	Name:   "router",
 	Setup4: setup4,
+	Args4: &plugins.ArgSpec{
+		Args: []plugins.Arg{
+			{Name: "router", Type: plugins.ArgIPv4, Variadic: true, Description: "default router to advertise"},
+		},
+		Examples: []string{"192.168.1.1"},
+	},
+	// only useful along with an address
+	Constraints4: &plugins.Constraints{RequiresOneOf: []string{"file", "range", "exec"}},
 }
 
-var (
-	routers []net.IP
-)
-
 func setup4(args ...string) (handler.Handler4, error) {
 	log.Printf("Loaded plugin for DHCPv4.")
 	if len(args) < 1 {
 		return nil, errors.New("need at least one router IP address")
 	}
+	var routers []net.IP
 	for _, arg := range args {
 		router := net.ParseIP(arg)
 		if router.To4() == nil {
-			return Handler4, errors.New("expected an router IP address, got: " + arg)
+			return nil, errors.New("expected an router IP address, got: " + arg)
 		}
 		routers = append(routers, router)
 	}
 	log.Infof("loaded %d router IP addresses.", len(routers))
-	return Handler4, nil
+	return makeHandler4(routers), nil
 }
 
-//Handler4 handles DHCPv4 packets for the router plugin
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	resp.Options.Update(dhcpv4.OptRouter(routers...))
-	return resp, false
+// makeHandler4 returns a handler for DHCPv4 packets advertising the given
+// routers
+func makeHandler4(routers []net.IP) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		resp.Options.Update(dhcpv4.OptRouter(routers...))
+		return resp, false
+	}
 }
@@ -24,75 +24,83 @@ var Plugin = plugins.Plugin{
 	Name:   "server_id",
 	Setup6: setup6,
 	Setup4: setup4,
+	Args6: &plugins.ArgSpec{
+		Args: []plugins.Arg{
+			{Name: "type", Type: plugins.ArgString, Description: "DUID type",
+				Choices: []string{"LL", "LLT", "DUID-LL", "DUID-LLT", "DUID_LL", "DUID_LLT"}},
+			{Name: "address", Type: plugins.ArgMAC, Description: "link-layer address of the DUID"},
+		},
+		Examples: []string{"LL 00:de:ad:be:ef:00"},
+	},
+	Args4: &plugins.ArgSpec{
+		Args: []plugins.Arg{
+			{Name: "address", Type: plugins.ArgIPv4, Description: "address of this server"},
+		},
+		Examples: []string{"10.10.10.1"},
+	},
+	// requests for other servers must be dropped before any plugin answers
+	Constraints6: &plugins.Constraints{Precedes: []string{"file", "nbp", "prefix", "range6", "temporary", "exec"}},
+	Constraints4: &plugins.Constraints{Precedes: []string{"file", "nbp", "range", "exec"}},
 }
 
-// v6ServerID is the DUID of the v6 server
-var (
-	v6ServerID dhcpv6.DUID
-	v4ServerID net.IP
-)
-
-// Handler6 handles DHCPv6 packets for the server_id plugin.
-func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
-	if v6ServerID == nil {
-		log.Fatal("BUG: Plugin is running uninitialized!")
-		return nil, true
-	}
-
-	msg, err := req.GetInnerMessage()
-	if err != nil {
-		// BUG: this should already have failed in the main handler. Abort
-		log.Error(err)
-		return nil, true
-	}
-
-	if sid := msg.Options.ServerID(); sid != nil {
-		// RFC8415 §16.{2,5,7}
-		// These message types MUST be discarded if they contain *any* ServerID option
-		if msg.MessageType == dhcpv6.MessageTypeSolicit ||
-			msg.MessageType == dhcpv6.MessageTypeConfirm ||
-			msg.MessageType == dhcpv6.MessageTypeRebind {
+// makeHandler6 returns a handler for DHCPv6 packets for the server_id plugin,
+// using the given server DUID
+func makeHandler6(v6ServerID dhcpv6.DUID) handler.Handler6 {
+	return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		msg, err := req.GetInnerMessage()
+		if err != nil {
+			// BUG: this should already have failed in the main handler. Abort
+			log.Error(err)
 			return nil, true
 		}
 
-		// Approximately all others MUST be discarded if the ServerID doesn't match
-		if !sid.Equal(v6ServerID) {
-			log.Infof("requested server ID does not match this server's ID. Got %v, want %v", sid, v6ServerID)
+		if sid := msg.Options.ServerID(); sid != nil {
+			// RFC8415 §16.{2,5,7}
+			// These message types MUST be discarded if they contain *any* ServerID option
+			if msg.MessageType == dhcpv6.MessageTypeSolicit ||
+				msg.MessageType == dhcpv6.MessageTypeConfirm ||
+				msg.MessageType == dhcpv6.MessageTypeRebind {
+				return nil, true
+			}
+
+			// Approximately all others MUST be discarded if the ServerID doesn't match
+			if !sid.Equal(v6ServerID) {
+				log.Infof("requested server ID does not match this server's ID. Got %v, want %v", sid, v6ServerID)
+				return nil, true
+			}
+		} else if msg.MessageType == dhcpv6.MessageTypeRequest ||
+			msg.MessageType == dhcpv6.MessageTypeRenew ||
+			msg.MessageType == dhcpv6.MessageTypeDecline ||
+			msg.MessageType == dhcpv6.MessageTypeRelease {
+			// RFC8415 §16.{6,8,10,11}
+			// These message types MUST be discarded if they *don't* contain a ServerID option
 			return nil, true
 		}
-	} else if msg.MessageType == dhcpv6.MessageTypeRequest ||
-		msg.MessageType == dhcpv6.MessageTypeRenew ||
-		msg.MessageType == dhcpv6.MessageTypeDecline ||
-		msg.MessageType == dhcpv6.MessageTypeRelease {
-		// RFC8415 §16.{6,8,10,11}
-		// These message types MUST be discarded if they *don't* contain a ServerID option
-		return nil, true
+		dhcpv6.WithServerID(v6ServerID)(resp)
+		return resp, false
 	}
-	dhcpv6.WithServerID(v6ServerID)(resp)
-	return resp, false
 }
 
-// Handler4 handles DHCPv4 packets for the server_id plugin.
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	if v4ServerID == nil {
-		log.Fatal("BUG: Plugin is running uninitialized!")
-		return nil, true
-	}
-	if req.OpCode != dhcpv4.OpcodeBootRequest {
-		log.Warningf("not a BootRequest, ignoring")
+// makeHandler4 returns a handler for DHCPv4 packets for the server_id plugin,
+// using the given server address
+func makeHandler4(v4ServerID net.IP) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if req.OpCode != dhcpv4.OpcodeBootRequest {
+			log.Warningf("not a BootRequest, ignoring")
+			return resp, false
+		}
+		if req.ServerIPAddr != nil &&
+			!req.ServerIPAddr.Equal(net.IPv4zero) &&
+			!req.ServerIPAddr.Equal(v4ServerID) {
+			// This request is not for us, drop it.
+			log.Infof("requested server ID does not match this server's ID. Got %v, want %v", req.ServerIPAddr, v4ServerID)
+			return nil, true
+		}
+		resp.ServerIPAddr = make(net.IP, net.IPv4len)
+		copy(resp.ServerIPAddr[:], v4ServerID)
+		resp.UpdateOption(dhcpv4.OptServerIdentifier(v4ServerID))
 		return resp, false
 	}
-	if req.ServerIPAddr != nil &&
-		!req.ServerIPAddr.Equal(net.IPv4zero) &&
-		!req.ServerIPAddr.Equal(v4ServerID) {
-		// This request is not for us, drop it.
-		log.Infof("requested server ID does not match this server's ID. Got %v, want %v", req.ServerIPAddr, v4ServerID)
-		return nil, true
-	}
-	resp.ServerIPAddr = make(net.IP, net.IPv4len)
-	copy(resp.ServerIPAddr[:], v4ServerID)
-	resp.UpdateOption(dhcpv4.OptServerIdentifier(v4ServerID))
-	return resp, false
 }
 
 func setup4(args ...string) (handler.Handler4, error) {
@@ -107,8 +115,7 @@ func setup4(args ...string) (handler.Handler4, error) {
 	if serverID.To4() == nil {
 		return nil, errors.New("not a valid IPv4 address")
 	}
-	v4ServerID = serverID.To4()
-	return Handler4, nil
+	return makeHandler4(serverID.To4()), nil
 }
 
 func setup6(args ...string) (handler.Handler6, error) {
@@ -129,6 +136,7 @@ func setup6(args ...string) (handler.Handler6, error) {
 	if err != nil {
 		return nil, err
 	}
+	var v6ServerID dhcpv6.DUID
 	switch duidType {
 	case "ll", "duid-ll", "duid_ll":
 		v6ServerID = &dhcpv6.DUIDLL{
@@ -151,5 +159,5 @@ func setup6(args ...string) (handler.Handler6, error) {
 	}
 	log.Printf("using %s %s", duidType, duidValue)
 
-	return Handler6, nil
+	return makeHandler6(v6ServerID), nil
 }
@@ -24,7 +24,7 @@ func TestRejectBadServerIDV6(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	v6ServerID = makeTestDUID("0000000000000000")
+	v6ServerID := makeTestDUID("0000000000000000")
 
 	req.MessageType = dhcpv6.MessageTypeRenew
 	dhcpv6.WithClientID(makeTestDUID("1000000000000000"))(req)
@@ -35,7 +35,7 @@ func TestRejectBadServerIDV6(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	resp, stop := Handler6(req, stub)
+	resp, stop := makeHandler6(v6ServerID)(req, stub)
 	if resp != nil {
 		t.Error("server_id is sending a response message to a request with mismatched ServerID")
 	}
@@ -49,7 +49,7 @@ func TestRejectUnexpectedServerIDV6(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	v6ServerID = makeTestDUID("0000000000000000")
+	v6ServerID := makeTestDUID("0000000000000000")
 
 	req.MessageType = dhcpv6.MessageTypeSolicit
 	dhcpv6.WithClientID(makeTestDUID("1000000000000000"))(req)
@@ -60,7 +60,7 @@ func TestRejectUnexpectedServerIDV6(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	resp, stop := Handler6(req, stub)
+	resp, stop := makeHandler6(v6ServerID)(req, stub)
 	if resp != nil {
 		t.Error("server_id is sending a response message to a solicit with a ServerID")
 	}
@@ -74,7 +74,7 @@ func TestAddServerIDV6(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	v6ServerID = makeTestDUID("0000000000000000")
+	v6ServerID := makeTestDUID("0000000000000000")
 
 	req.MessageType = dhcpv6.MessageTypeRebind
 	dhcpv6.WithClientID(makeTestDUID("1000000000000000"))(req)
@@ -84,7 +84,7 @@ func TestAddServerIDV6(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	resp, _ := Handler6(req, stub)
+	resp, _ := makeHandler6(v6ServerID)(req, stub)
 	if resp == nil {
 		t.Fatal("plugin did not return an answer")
 	}
@@ -101,7 +101,7 @@ func TestRejectInnerMessageServerID(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	v6ServerID = makeTestDUID("0000000000000000")
+	v6ServerID := makeTestDUID("0000000000000000")
 
 	req.MessageType = dhcpv6.MessageTypeSolicit
 	dhcpv6.WithClientID(makeTestDUID("1000000000000000"))(req)
@@ -117,7 +117,7 @@ func TestRejectInnerMessageServerID(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	resp, stop := Handler6(relayedRequest, stub)
+	resp, stop := makeHandler6(v6ServerID)(relayedRequest, stub)
 	if resp != nil {
 		t.Error("server_id is sending a response message to a relayed solicit with a ServerID")
 	}
@@ -42,6 +42,15 @@ var Plugin = plugins.Plugin{
 	Name:   pluginName,
 	Setup6: setup6,
 	Setup4: setup4,
+	Args6:  sleepArgs,
+	Args4:  sleepArgs,
+}
+
+var sleepArgs = &plugins.ArgSpec{
+	Args: []plugins.Arg{
+		{Name: "delay", Type: plugins.ArgDuration, Description: "delay to introduce before the next plugin"},
+	},
+	Examples: []string{"300ms"},
 }
 
 func setup6(args ...string) (handler.Handler6, error) {
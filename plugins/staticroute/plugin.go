@@ -21,13 +21,28 @@ var log = logger.GetLogger("plugins/staticroute")
 var Plugin = plugins.Plugin{
 	Name:   "staticroute",
 	Setup4: setup4,
+	Args4: &plugins.ArgSpec{
+		Args: []plugins.Arg{
+			{Name: "route", Type: plugins.ArgString, Variadic: true, Description: "<destination>,<gateway> pair, the destination in CIDR notation"},
+		},
+		Examples: []string{"10.20.20.0/24,10.10.10.1"},
+	},
 }
 
-var routes dhcpv4.Routes
-
 func setup4(args ...string) (handler.Handler4, error) {
 	log.Printf("loaded plugin for DHCPv4.")
-	routes = make(dhcpv4.Routes, 0)
+	routes, err := parseRoutes(args...)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("loaded %d static routes.", len(routes))
+
+	return makeHandler4(routes), nil
+}
+
+// parseRoutes parses static routes given as <destination>,<gateway> pairs
+func parseRoutes(args ...string) (dhcpv4.Routes, error) {
+	routes := make(dhcpv4.Routes, 0)
 
 	if len(args) < 1 {
 		return nil, errors.New("need at least one static route")
@@ -37,37 +52,38 @@ func setup4(args ...string) (handler.Handler4, error) {
 	for _, arg := range args {
 		fields := strings.Split(arg, ",")
 		if len(fields) != 2 {
-			return Handler4, errors.New("expected a destination/gateway pair, got: " + arg)
+			return nil, errors.New("expected a destination/gateway pair, got: " + arg)
 		}
 
 		route := &dhcpv4.Route{}
 		_, route.Dest, err = net.ParseCIDR(fields[0])
 		if err != nil {
-			return Handler4, errors.New("expected a destination subnet, got: " + fields[0])
+			return nil, errors.New("expected a destination subnet, got: " + fields[0])
 		}
 
 		route.Router = net.ParseIP(fields[1])
 		if route.Router == nil {
-			return Handler4, errors.New("expected a gateway address, got: " + fields[1])
+			return nil, errors.New("expected a gateway address, got: " + fields[1])
 		}
 
 		routes = append(routes, route)
 		log.Debugf("adding static route %s", route)
 	}
 
-	log.Printf("loaded %d static routes.", len(routes))
-
-	return Handler4, nil
+	return routes, nil
 }
 
-// Handler4 handles DHCPv4 packets for the static routes plugin
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	if len(routes) > 0 {
-		resp.Options.Update(dhcpv4.Option{
-			Code:  dhcpv4.OptionCode(dhcpv4.OptionClasslessStaticRoute),
-			Value: routes,
-		})
-	}
+// makeHandler4 returns a handler for DHCPv4 packets advertising the given
+// static routes
+func makeHandler4(routes dhcpv4.Routes) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if len(routes) > 0 {
+			resp.Options.Update(dhcpv4.Option{
+				Code:  dhcpv4.OptionCode(dhcpv4.OptionClasslessStaticRoute),
+				Value: routes,
+			})
+		}
 
-	return resp, false
+		return resp, false
+	}
 }
@@ -7,39 +7,41 @@ package staticroute
 import (
 	"testing"
 
+	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestSetup4(t *testing.T) {
-	assert.Empty(t, routes)
-
-	var err error
+func TestParseRoutes(t *testing.T) {
+	var (
+		routes dhcpv4.Routes
+		err    error
+	)
 	// no args
-	_, err = setup4()
+	routes, err = parseRoutes()
 	if assert.Error(t, err) {
 		assert.Equal(t, "need at least one static route", err.Error())
 	}
 
 	// invalid arg
-	_, err = setup4("foo")
+	routes, err = parseRoutes("foo")
 	if assert.Error(t, err) {
 		assert.Equal(t, "expected a destination/gateway pair, got: foo", err.Error())
 	}
 
 	// invalid destination
-	_, err = setup4("foo,")
+	routes, err = parseRoutes("foo,")
 	if assert.Error(t, err) {
 		assert.Equal(t, "expected a destination subnet, got: foo", err.Error())
 	}
 
 	// invalid gateway
-	_, err = setup4("10.0.0.0/8,foo")
+	routes, err = parseRoutes("10.0.0.0/8,foo")
 	if assert.Error(t, err) {
 		assert.Equal(t, "expected a gateway address, got: foo", err.Error())
 	}
 
 	// valid route
-	_, err = setup4("10.0.0.0/8,192.168.1.1")
+	routes, err = parseRoutes("10.0.0.0/8,192.168.1.1")
 	if assert.NoError(t, err) {
 		if assert.Equal(t, 1, len(routes)) {
 			assert.Equal(t, "10.0.0.0/8", routes[0].Dest.String())
@@ -48,7 +50,7 @@ func TestSetup4(t *testing.T) {
 	}
 
 	// multiple valid routes
-	_, err = setup4("10.0.0.0/8,192.168.1.1", "192.168.2.0/24,192.168.1.100")
+	routes, err = parseRoutes("10.0.0.0/8,192.168.1.1", "192.168.2.0/24,192.168.1.100")
 	if assert.NoError(t, err) {
 		if assert.Equal(t, 2, len(routes)) {
 			assert.Equal(t, "10.0.0.0/8", routes[0].Dest.String())
@@ -0,0 +1,420 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package temporary implements a plugin giving temporary addresses (IA_TA,
+// RFC 8415 section 21.5) to privacy-sensitive clients.
+//
+// The addresses are picked at random in a prefix, so that they can't be
+// guessed from the previous ones, and each Solicit or Request gets a fresh
+// one. The addresses given out are tracked, and aren't given out again until
+// their valid lifetime and the reuse delay are over. They are only tracked
+// in memory: with the large prefixes used for temporary addresses, picking
+// an address again after a restart is unlikely.
+package temporary
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcpIana "github.com/insomniacslk/dhcp/iana"
+)
+
+var log = logger.GetLogger("plugins/temporary")
+
+// Plugin wraps plugin registration information
+var Plugin = plugins.Plugin{
+	Name:            "temporary",
+	SetupLifecycle6: setupTemporary,
+	Args6: &plugins.ArgSpec{
+		Args: []plugins.Arg{
+			{Name: "prefix", Type: plugins.ArgPrefix, Description: "prefix the temporary addresses are picked from"},
+			{Name: "valid_lifetime", Type: plugins.ArgDuration, Description: "valid lifetime of the addresses"},
+			{Name: "preferred_lifetime", Type: plugins.ArgDuration, Optional: true,
+				Description: "preferred lifetime of the addresses, defaults to the valid lifetime"},
+			{Name: "reuse_delay", Type: plugins.ArgDuration, Optional: true,
+				Description: "time after the end of the valid lifetime before an address is given out again, defaults to the valid lifetime"},
+		},
+		Examples: []string{"2001:db8:0:1::/64 1h", "2001:db8:0:1::/64 1h 30m 24h"},
+	},
+}
+
+const (
+	// maxAttempts is how many random addresses are tried before giving up,
+	// when the prefix is almost exhausted
+	maxAttempts = 16
+	// purgeInterval is how often the addresses that can be reused are
+	// forgotten
+	purgeInterval = time.Minute
+	// maxRecords is the number of addresses tracked at most, so that clients
+	// flooding the server with new IAs can't exhaust its memory
+	maxRecords = 1 << 16
+)
+
+// record tracks an address given out to an IA
+type record struct {
+	key string
+	// issued is when the address was given out
+	issued time.Time
+	// expires is the end of the valid lifetime of the address, or when it
+	// was released
+	expires time.Time
+	// reuse is when the address can be given out again
+	reuse time.Time
+}
+
+// PluginState is the data held by an instance of the temporary plugin
+type PluginState struct {
+	sync.Mutex
+	prefix            *net.IPNet
+	validLifetime     time.Duration
+	preferredLifetime time.Duration
+	reuseDelay        time.Duration
+	// records holds the addresses given out, indexed by their 16-byte form
+	records       map[string]record
+	maxRecords    int
+	purgeInterval time.Duration
+	stop          chan struct{}
+	done          chan struct{}
+	closed        bool
+}
+
+// iaKey returns the key identifying an IA of a client
+func iaKey(duid []byte, iaid [4]byte) string {
+	return hex.EncodeToString(duid) + ":" + hex.EncodeToString(iaid[:])
+}
+
+func parseDuration(name, s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s: %v", name, s)
+	}
+	return d, nil
+}
+
+func setupTemporary(args ...string) (handler.Handler6, plugins.Lifecycle, error) {
+	p, err := newPluginState(args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("loaded plugin for DHCPv6, giving temporary addresses from %s", p.prefix)
+	return p.Handler6, p, nil
+}
+
+func newPluginState(args ...string) (*PluginState, error) {
+	var (
+		err error
+		p   PluginState
+	)
+	if len(args) < 2 {
+		return nil, fmt.Errorf("invalid number of arguments, want: 2 (prefix, valid lifetime), got: %d", len(args))
+	}
+	ip, prefix, err := net.ParseCIDR(args[0])
+	if err != nil || ip.To4() != nil {
+		return nil, fmt.Errorf("invalid IPv6 prefix: %v", args[0])
+	}
+	if ones, _ := prefix.Mask.Size(); ones > 120 {
+		return nil, fmt.Errorf("prefix %s is too long to pick random addresses from, use a /120 or shorter", prefix)
+	}
+	p.prefix = prefix
+	if p.validLifetime, err = parseDuration("valid lifetime", args[1]); err != nil {
+		return nil, err
+	}
+	p.preferredLifetime = p.validLifetime
+	if len(args) > 2 {
+		if p.preferredLifetime, err = parseDuration("preferred lifetime", args[2]); err != nil {
+			return nil, err
+		}
+		if p.preferredLifetime > p.validLifetime {
+			return nil, errors.New("the preferred lifetime cannot be longer than the valid lifetime")
+		}
+	}
+	p.reuseDelay = p.validLifetime
+	if len(args) > 3 {
+		if p.reuseDelay, err = parseDuration("reuse delay", args[3]); err != nil {
+			return nil, err
+		}
+	}
+	p.records = make(map[string]record)
+	p.maxRecords = maxRecords
+	p.purgeInterval = purgeInterval
+	return &p, nil
+}
+
+// Start starts forgetting the addresses that can be given out again
+func (p *PluginState) Start() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return errors.New("plugin is closed")
+	}
+	if p.stop != nil {
+		return nil
+	}
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.purger()
+	return nil
+}
+
+// purger periodically forgets the addresses that can be given out again,
+// until the plugin is closed
+func (p *PluginState) purger() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.purgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		p.Lock()
+		if n := p.purgeLocked(time.Now()); n > 0 {
+			log.Debugf("Forgot %d temporary addresses", n)
+		}
+		p.Unlock()
+	}
+}
+
+// Close stops forgetting the addresses that can be given out again
+func (p *PluginState) Close() error {
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		return nil
+	}
+	p.closed = true
+	stop, done := p.stop, p.done
+	p.Unlock()
+	// the purger takes the lock
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return nil
+}
+
+// Healthy reports whether addresses can still be tracked
+func (p *PluginState) Healthy() error {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.records) >= p.maxRecords {
+		return fmt.Errorf("%d temporary addresses given out, no more can be tracked", len(p.records))
+	}
+	return nil
+}
+
+// reserved returns whether an address of the prefix must not be given out:
+// the Subnet-Router anycast address (RFC 4291), and the reserved anycast
+// interface identifiers of /64 prefixes (RFC 2526)
+func (p *PluginState) reserved(ip net.IP) bool {
+	host := true
+	for i := range ip {
+		if ip[i]&^p.prefix.Mask[i] != 0 {
+			host = false
+			break
+		}
+	}
+	if host {
+		return true
+	}
+	if ones, _ := p.prefix.Mask.Size(); ones != 64 {
+		return false
+	}
+	iid := ip[8:]
+	for _, b := range []byte{0xfd, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff} {
+		if iid[0] != b {
+			return false
+		}
+		iid = iid[1:]
+	}
+	return iid[0] >= 0x80
+}
+
+// random returns a random address of the prefix
+func (p *PluginState) random() (net.IP, error) {
+	ip := make(net.IP, net.IPv6len)
+	if _, err := rand.Read(ip); err != nil {
+		return nil, err
+	}
+	for i := range ip {
+		ip[i] = p.prefix.IP[i] | ip[i]&^p.prefix.Mask[i]
+	}
+	return ip, nil
+}
+
+// purgeLocked forgets the addresses that can be given out again, and returns
+// how many were forgotten
+func (p *PluginState) purgeLocked(now time.Time) int {
+	n := 0
+	for ip, r := range p.records {
+		if r.reuse.After(now) {
+			continue
+		}
+		delete(p.records, ip)
+		n++
+	}
+	return n
+}
+
+// allocate gives out a fresh random address to an IA
+func (p *PluginState) allocate(key string, now time.Time) (net.IP, error) {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.records) >= p.maxRecords {
+		p.purgeLocked(now)
+		if len(p.records) >= p.maxRecords {
+			return nil, fmt.Errorf("%d temporary addresses given out, no more can be tracked", len(p.records))
+		}
+	}
+	for i := 0; i < maxAttempts; i++ {
+		ip, err := p.random()
+		if err != nil {
+			return nil, err
+		}
+		if p.reserved(ip) {
+			continue
+		}
+		if r, ok := p.records[string(ip)]; ok && r.reuse.After(now) {
+			continue
+		}
+		expires := now.Add(p.validLifetime)
+		p.records[string(ip)] = record{key: key, issued: now, expires: expires, reuse: expires.Add(p.reuseDelay)}
+		return ip, nil
+	}
+	return nil, fmt.Errorf("no free address found in %d attempts", maxAttempts)
+}
+
+// Handler6 handles the IA_TA options of DHCPv6 messages
+func (p *PluginState) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	msg, err := req.GetInnerMessage()
+	if err != nil {
+		log.Error(err)
+		return nil, true
+	}
+	iatas := msg.Options.IATA()
+	if len(iatas) == 0 {
+		return resp, false
+	}
+	client := msg.Options.ClientID()
+	if client == nil {
+		log.Error("Invalid packet received, no clientID")
+		return nil, true
+	}
+	duid := client.ToBytes()
+	now := time.Now()
+
+	switch msg.Type() {
+	case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest:
+		for _, ia := range iatas {
+			resp.AddOption(p.assign(iaKey(duid, ia.IaId), ia.IaId, now))
+		}
+	case dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+		for _, ia := range iatas {
+			resp.AddOption(p.confirm(iaKey(duid, ia.IaId), ia, now))
+		}
+	case dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		decline := msg.Type() == dhcpv6.MessageTypeDecline
+		for _, ia := range iatas {
+			if !p.release(iaKey(duid, ia.IaId), ia, decline, now) {
+				resp.AddOption(iaStatus(ia.IaId, dhcpIana.StatusNoBinding, "no binding for the IA"))
+			}
+		}
+		// other plugins may answer for other IAs of the same message
+		resp.UpdateOption(&dhcpv6.OptStatusCode{StatusCode: dhcpIana.StatusSuccess})
+	}
+	return resp, false
+}
+
+func iaStatus(id [4]byte, code dhcpIana.StatusCode, message string) *dhcpv6.OptIATA {
+	ia := &dhcpv6.OptIATA{IaId: id}
+	ia.Options.Add(&dhcpv6.OptStatusCode{StatusCode: code, StatusMessage: message})
+	return ia
+}
+
+// lifetimes returns the remaining lifetimes of an address given out at issued
+func (p *PluginState) lifetimes(issued, now time.Time) (preferred, valid time.Duration) {
+	if preferred = issued.Add(p.preferredLifetime).Sub(now); preferred < 0 {
+		preferred = 0
+	}
+	if valid = issued.Add(p.validLifetime).Sub(now); valid < 0 {
+		valid = 0
+	}
+	return preferred, valid
+}
+
+// assign answers an IA_TA of a Solicit or a Request with a fresh address
+func (p *PluginState) assign(key string, id [4]byte, now time.Time) *dhcpv6.OptIATA {
+	ip, err := p.allocate(key, now)
+	if err != nil {
+		log.Errorf("Could not allocate a temporary address for IA %s: %v", key, err)
+		return iaStatus(id, dhcpIana.StatusNoAddrsAvail, "no addresses available")
+	}
+	log.Debugf("assigning temporary address %s to IA %s", ip, key)
+	ia := &dhcpv6.OptIATA{IaId: id}
+	ia.Options.Add(&dhcpv6.OptIAAddress{
+		IPv6Addr:          ip,
+		PreferredLifetime: p.preferredLifetime,
+		ValidLifetime:     p.validLifetime,
+	})
+	return ia
+}
+
+// confirm answers an IA_TA of a Renew or a Rebind with the
+// remaining lifetimes of its addresses. Temporary addresses are not extended,
+// and the ones not given out to the IA get zero lifetimes.
+func (p *PluginState) confirm(key string, req *dhcpv6.OptIATA, now time.Time) *dhcpv6.OptIATA {
+	addrs := req.Options.Addresses()
+	if len(addrs) == 0 {
+		return iaStatus(req.IaId, dhcpIana.StatusNoBinding, "no binding for the IA")
+	}
+	p.Lock()
+	defer p.Unlock()
+	ia := &dhcpv6.OptIATA{IaId: req.IaId}
+	for _, a := range addrs {
+		opt := &dhcpv6.OptIAAddress{IPv6Addr: a.IPv6Addr}
+		if r, ok := p.records[string(a.IPv6Addr.To16())]; ok && r.key == key && r.expires.After(now) {
+			opt.PreferredLifetime, opt.ValidLifetime = p.lifetimes(r.issued, now)
+		}
+		ia.Options.Add(opt)
+	}
+	return ia
+}
+
+// release ends the addresses of an IA_TA of a Release or a Decline, which
+// are still not given out again until the reuse delay is over. It returns
+// false if none of the addresses were given out to the IA.
+func (p *PluginState) release(key string, ia *dhcpv6.OptIATA, decline bool, now time.Time) bool {
+	p.Lock()
+	defer p.Unlock()
+	found := false
+	for _, a := range ia.Options.Addresses() {
+		ip := string(a.IPv6Addr.To16())
+		r, ok := p.records[ip]
+		if !ok || r.key != key {
+			continue
+		}
+		found = true
+		if r.expires.After(now) {
+			r.expires = now
+		}
+		if decline {
+			log.Warningf("Temporary address %s was declined by IA %s", a.IPv6Addr, key)
+			if reuse := now.Add(p.reuseDelay); reuse.After(r.reuse) {
+				r.reuse = reuse
+			}
+		}
+		p.records[ip] = r
+	}
+	return found
+}
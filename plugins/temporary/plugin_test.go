@@ -0,0 +1,183 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package temporary
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcpIana "github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var duid = &dhcpv6.DUIDLL{
+	HWType:        dhcpIana.HWTypeEthernet,
+	LinkLayerAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01},
+}
+
+func iata(id byte, addrs ...net.IP) *dhcpv6.OptIATA {
+	o := &dhcpv6.OptIATA{IaId: [4]byte{0, 0, 0, id}}
+	for _, a := range addrs {
+		o.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: a})
+	}
+	return o
+}
+
+// exchange sends a message with the given IAs through the handler, and
+// returns the IA_TAs of the reply and its status
+func exchange(t *testing.T, h handler.Handler6, mt dhcpv6.MessageType, ias ...*dhcpv6.OptIATA) ([]*dhcpv6.OptIATA, *dhcpv6.OptStatusCode) {
+	req, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	req.MessageType = mt
+	req.AddOption(dhcpv6.OptClientID(duid))
+	for _, o := range ias {
+		req.AddOption(o)
+	}
+	resp, err := dhcpv6.NewReplyFromMessage(req)
+	require.NoError(t, err)
+	r, stop := h(req, resp)
+	require.NotNil(t, r)
+	assert.False(t, stop)
+	m := r.(*dhcpv6.Message)
+	return m.Options.IATA(), m.Options.Status()
+}
+
+func TestSetup(t *testing.T) {
+	for _, bad := range [][]string{
+		{"2001:db8::/64"},
+		{"10.0.0.0/8", "1h"},
+		{"2001:db8::/121", "1h"},
+		{"2001:db8::/64", "1h", "2h"},
+		{"2001:db8::/64", "1h", "1h", "-1h"},
+	} {
+		_, err := newPluginState(bad...)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestReserved(t *testing.T) {
+	p, err := newPluginState("2001:db8::/64", "1h")
+	require.NoError(t, err)
+	for ip, want := range map[string]bool{
+		"2001:db8::":                    true,
+		"2001:db8::1":                   false,
+		"2001:db8::fdff:ffff:ffff:ff80": true,
+		"2001:db8::fdff:ffff:ffff:ffff": true,
+		"2001:db8::fdff:ffff:ffff:ff7f": false,
+		"2001:db8::fdff:ffff:fffe:ffff": false,
+		"2001:db8::ffff:ffff:ffff:ffff": false,
+	} {
+		assert.Equal(t, want, p.reserved(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestTemporary(t *testing.T) {
+	h, _, err := setupTemporary("2001:db8::/64", "1h", "10m")
+	require.NoError(t, err)
+	_, prefix, _ := net.ParseCIDR("2001:db8::/64")
+
+	// each Request gets a fresh address
+	seen := make(map[string]bool)
+	var last net.IP
+	for i := 0; i < 10; i++ {
+		ias, _ := exchange(t, h, dhcpv6.MessageTypeRequest, iata(1))
+		require.Len(t, ias, 1)
+		a := ias[0].Options.OneAddress()
+		require.NotNil(t, a)
+		assert.True(t, prefix.Contains(a.IPv6Addr))
+		assert.False(t, seen[a.IPv6Addr.String()])
+		seen[a.IPv6Addr.String()] = true
+		assert.Equal(t, time.Hour, a.ValidLifetime)
+		assert.Equal(t, 10*time.Minute, a.PreferredLifetime)
+		last = a.IPv6Addr
+	}
+
+	// addresses are not extended, and only valid for the IA they were
+	// given to
+	ias, _ := exchange(t, h, dhcpv6.MessageTypeRenew, iata(1, last), iata(2, last))
+	require.Len(t, ias, 2)
+	assert.InDelta(t, float64(time.Hour), float64(ias[0].Options.OneAddress().ValidLifetime), float64(time.Second))
+	assert.Equal(t, time.Duration(0), ias[1].Options.OneAddress().ValidLifetime)
+
+	ias, status := exchange(t, h, dhcpv6.MessageTypeRelease, iata(1, last), iata(2, last))
+	assert.Equal(t, dhcpIana.StatusSuccess, status.StatusCode)
+	require.Len(t, ias, 1)
+	assert.Equal(t, dhcpIana.StatusNoBinding, ias[0].Options.Status().StatusCode)
+	ias, _ = exchange(t, h, dhcpv6.MessageTypeRebind, iata(1, last))
+	assert.Equal(t, time.Duration(0), ias[0].Options.OneAddress().ValidLifetime)
+}
+
+func TestFreshAddresses(t *testing.T) {
+	h, _, err := setupTemporary("2001:db8::/64", "1h", "10m")
+	require.NoError(t, err)
+
+	// consecutive Requests for the same IA get different addresses
+	first, _ := exchange(t, h, dhcpv6.MessageTypeRequest, iata(1))
+	second, _ := exchange(t, h, dhcpv6.MessageTypeRequest, iata(1))
+	require.Len(t, first, 1)
+	require.Len(t, second, 1)
+	assert.NotEqual(t, first[0].Options.OneAddress().IPv6Addr, second[0].Options.OneAddress().IPv6Addr)
+}
+
+func TestReuse(t *testing.T) {
+	p, err := newPluginState("2001:db8::/120", "1h", "1h", "1h")
+	require.NoError(t, err)
+
+	// the 255 addresses of the prefix are given out once
+	now := time.Now()
+	for i := 0; i < 100000 && len(p.records) < 255; i++ {
+		p.allocate("key", now)
+	}
+	_, err = p.allocate("key", now)
+	assert.Error(t, err)
+	assert.Len(t, p.records, 255)
+
+	// and can be given out again after their lifetime and the reuse delay
+	_, err = p.allocate("key", now.Add(time.Hour))
+	assert.Error(t, err)
+	_, err = p.allocate("key", now.Add(2*time.Hour))
+	assert.NoError(t, err)
+}
+
+func TestMaxRecords(t *testing.T) {
+	p, err := newPluginState("2001:db8::/64", "1h", "10m")
+	require.NoError(t, err)
+	now := time.Now()
+
+	// the number of addresses tracked is bounded
+	p.maxRecords = 2
+	for i := 0; i < 2; i++ {
+		_, err = p.allocate("key", now)
+		require.NoError(t, err)
+	}
+	_, err = p.allocate("key", now)
+	assert.Error(t, err)
+	assert.Error(t, p.Healthy())
+
+	// until the addresses can be given out again
+	_, err = p.allocate("key", now.Add(3*time.Hour))
+	assert.NoError(t, err)
+	assert.NoError(t, p.Healthy())
+}
+
+func TestPurge(t *testing.T) {
+	p, err := newPluginState("2001:db8::/64", "1ms", "1ms", "0s")
+	require.NoError(t, err)
+	p.purgeInterval = time.Millisecond
+	_, err = p.allocate("key", time.Now())
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	defer p.Close()
+	assert.Eventually(t, func() bool {
+		p.Lock()
+		defer p.Unlock()
+		return len(p.records) == 0
+	}, 5*time.Second, time.Millisecond)
+	require.NoError(t, p.Close())
+}
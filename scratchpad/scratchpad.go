@@ -0,0 +1,177 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package scratchpad implements a bag of typed values attached to each
+// request, that the plugins handling the request can read and write to
+// exchange information without modifying the response.
+//
+// Plugins declare the keys they provide as package variables:
+//
+//	var Reserved = scratchpad.NewKey[bool]("file.reserved")
+//
+// and use them from their handlers:
+//
+//	Reserved.Set(scratchpad.For4(req), true)
+//	...
+//	if reserved, _ := file.Reserved.Get(scratchpad.For4(req)); reserved {
+//
+// The server attaches a new pad to each request before running the plugins,
+// and releases it once the response is sent.
+package scratchpad
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// InterfaceIndex holds the index of the interface a request was received on,
+// set by the server when it is known
+var InterfaceIndex = NewKey[int]("ifindex")
+
+// Key identifies a value of type T in a pad. Keys are compared by identity,
+// the name is only used for logging: two keys with the same name are
+// different keys.
+type Key[T any] struct {
+	name string
+}
+
+// NewKey returns a new key for values of type T
+func NewKey[T any](name string) *Key[T] {
+	return &Key[T]{name: name}
+}
+
+// Name returns the name of the key
+func (k *Key[T]) Name() string {
+	return k.name
+}
+
+// Get returns the value stored for the key, and whether there is one
+func (k *Key[T]) Get(p *Pad) (T, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.values[k]
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	return e.value.(T), true
+}
+
+// Set stores a value for the key, replacing the previous one
+func (k *Key[T]) Set(p *Pad, value T) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.values == nil {
+		p.values = make(map[interface{}]entry)
+	}
+	p.values[k] = entry{name: k.name, value: value}
+}
+
+// Delete removes the value stored for the key, if any
+func (k *Key[T]) Delete(p *Pad) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.values, k)
+}
+
+type entry struct {
+	name  string
+	value interface{}
+}
+
+// Pad holds the values set by the plugins while handling a request. The zero
+// value is an empty pad ready to use.
+type Pad struct {
+	mu     sync.Mutex
+	values map[interface{}]entry
+}
+
+// Fields returns the values of the pad by key name, for logging
+func (p *Pad) Fields() map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fields := make(map[string]interface{}, len(p.values))
+	for _, e := range p.values {
+		fields[e.name] = e.value
+	}
+	return fields
+}
+
+// Len returns the number of values in the pad
+func (p *Pad) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.values)
+}
+
+// String returns the values of the pad as `name=value` pairs, sorted by name
+func (p *Pad) String() string {
+	fields := p.Fields()
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s=%v", name, fields[name])
+	}
+	return b.String()
+}
+
+// pads maps the requests being handled to their pad
+var pads sync.Map
+
+// Attach4 attaches a new pad to a DHCPv4 request, and returns it. Release4
+// must be called once the request is handled.
+func Attach4(req *dhcpv4.DHCPv4) *Pad {
+	p := &Pad{}
+	pads.Store(req, p)
+	return p
+}
+
+// Release4 detaches the pad from a DHCPv4 request
+func Release4(req *dhcpv4.DHCPv4) {
+	pads.Delete(req)
+}
+
+// For4 returns the pad attached to a DHCPv4 request. If the request has none,
+// for example when a handler is called outside of the server, a new empty
+// pad is returned, which is not attached to the request.
+func For4(req *dhcpv4.DHCPv4) *Pad {
+	if p, ok := pads.Load(req); ok {
+		return p.(*Pad)
+	}
+	return &Pad{}
+}
+
+// Attach6 attaches a new pad to a DHCPv6 request, as received by the server
+// (before decapsulating relay messages), and returns it. Release6 must be
+// called once the request is handled.
+func Attach6(req dhcpv6.DHCPv6) *Pad {
+	p := &Pad{}
+	pads.Store(req, p)
+	return p
+}
+
+// Release6 detaches the pad from a DHCPv6 request
+func Release6(req dhcpv6.DHCPv6) {
+	pads.Delete(req)
+}
+
+// For6 returns the pad attached to a DHCPv6 request, see For4
+func For6(req dhcpv6.DHCPv6) *Pad {
+	if p, ok := pads.Load(req); ok {
+		return p.(*Pad)
+	}
+	return &Pad{}
+}
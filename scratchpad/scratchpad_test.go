@@ -0,0 +1,86 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package scratchpad
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeys(t *testing.T) {
+	voip := NewKey[bool]("voip")
+	vlan := NewKey[int]("vlan")
+	other := NewKey[bool]("voip")
+	p := &Pad{}
+
+	_, ok := voip.Get(p)
+	assert.False(t, ok)
+
+	voip.Set(p, true)
+	vlan.Set(p, 42)
+	v, ok := voip.Get(p)
+	assert.True(t, ok)
+	assert.True(t, v)
+	n, _ := vlan.Get(p)
+	assert.Equal(t, 42, n)
+	// keys with the same name are distinct
+	_, ok = other.Get(p)
+	assert.False(t, ok)
+
+	vlan.Set(p, 7)
+	n, _ = vlan.Get(p)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, "vlan=7 voip=true", p.String())
+
+	vlan.Delete(p)
+	_, ok = vlan.Get(p)
+	assert.False(t, ok)
+	assert.Equal(t, 1, p.Len())
+	assert.Equal(t, map[string]interface{}{"voip": true}, p.Fields())
+}
+
+func TestAttach4(t *testing.T) {
+	key := NewKey[string]("class")
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	require.NoError(t, err)
+
+	// without a pad attached, values are not kept
+	key.Set(For4(req), "phone")
+	_, ok := key.Get(For4(req))
+	assert.False(t, ok)
+
+	p := Attach4(req)
+	key.Set(For4(req), "phone")
+	v, ok := key.Get(For4(req))
+	assert.True(t, ok)
+	assert.Equal(t, "phone", v)
+	assert.Same(t, p, For4(req))
+
+	Release4(req)
+	assert.NotSame(t, p, For4(req))
+}
+
+func TestAttach6(t *testing.T) {
+	key := NewKey[string]("class")
+	req, err := dhcpv6.NewSolicit(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	require.NoError(t, err)
+	other, err := dhcpv6.NewSolicit(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	require.NoError(t, err)
+
+	Attach6(req)
+	Attach6(other)
+	key.Set(For6(req), "phone")
+	_, ok := key.Get(For6(other))
+	assert.False(t, ok, "requests have separate pads")
+	v, _ := key.Get(For6(req))
+	assert.Equal(t, "phone", v)
+	Release6(req)
+	Release6(other)
+}
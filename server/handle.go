@@ -12,6 +12,8 @@ import (
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 
+	"github.com/coredhcp/coredhcp/classify"
+	"github.com/coredhcp/coredhcp/scratchpad"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
 )
@@ -20,6 +22,7 @@ import (
 // registered handler in sequence, and reply with the resulting response.
 // It will not reply if the resulting response is `nil`.
 func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.UDPAddr) {
+	defer l.inflight.Done()
 	d, err := dhcpv6.FromBytes(buf)
 	bufpool.Put(&buf)
 	if err != nil {
@@ -46,6 +49,8 @@ func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.U
 	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeConfirm, dhcpv6.MessageTypeRenew,
 		dhcpv6.MessageTypeRebind, dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeInformationRequest:
 		resp, err = dhcpv6.NewReplyFromMessage(msg)
+	case dhcpv6.MessageTypeDecline:
+		resp, err = newReplyFromDecline(msg)
 	default:
 		err = fmt.Errorf("MainHandler6: message type %d not supported", msg.Type())
 	}
@@ -54,9 +59,38 @@ func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.U
 		return
 	}
 
+	tracing := l.tracer.match6(d)
+	pad := scratchpad.Attach6(d)
+	defer func() {
+		if pad.Len() > 0 {
+			if tracing {
+				log.Infof("trace DHCPv6 %s: final scratchpad: %s", msg.TransactionID, pad)
+			} else {
+				log.Debugf("MainHandler6: scratchpad: %s", pad)
+			}
+		}
+		scratchpad.Release6(d)
+	}()
+
+	classes := l.classifier.Classify6(d)
+	if len(classes) > 0 {
+		log.Debugf("MainHandler6: request classified as %v", classes)
+		classify.ClassesKey.Set(pad, classes)
+	}
+
 	var stop bool
 	for _, handler := range l.handlers {
-		resp, stop = handler(d, resp)
+		if !classes.Match(handler.Classes) {
+			if tracing {
+				log.Infof("trace DHCPv6 %s: plugin `%s` skipped, restricted to classes %v", msg.TransactionID, handler.Name, handler.Classes)
+			}
+			continue
+		}
+		if tracing {
+			resp, stop = trace6(handler, d, resp)
+		} else {
+			resp, stop = handler.Handler6(d, resp)
+		}
 		if stop {
 			break
 		}
@@ -98,7 +132,23 @@ func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.U
 	}
 }
 
+// newReplyFromDecline builds the reply to a Decline, which
+// dhcpv6.NewReplyFromMessage doesn't support
+func newReplyFromDecline(msg *dhcpv6.Message) (*dhcpv6.Message, error) {
+	cid := msg.GetOneOption(dhcpv6.OptionClientID)
+	if cid == nil {
+		return nil, fmt.Errorf("client ID cannot be nil when building REPLY")
+	}
+	rep := &dhcpv6.Message{
+		MessageType:   dhcpv6.MessageTypeReply,
+		TransactionID: msg.TransactionID,
+	}
+	rep.AddOption(cid)
+	return rep, nil
+}
+
 func (l *listener4) HandleMsg4(buf []byte, oob *ipv4.ControlMessage, _peer net.Addr) {
+	defer l.inflight.Done()
 	var (
 		resp, tmp *dhcpv4.DHCPv4
 		err       error
@@ -131,9 +181,44 @@ func (l *listener4) HandleMsg4(buf []byte, oob *ipv4.ControlMessage, _peer net.A
 		return
 	}
 
+	tracing := l.tracer.match4(req)
+	pad := scratchpad.Attach4(req)
+	defer func() {
+		if pad.Len() > 0 {
+			if tracing {
+				log.Infof("trace DHCPv4 %s %s: final scratchpad: %s", req.TransactionID, req.ClientHWAddr, pad)
+			} else {
+				log.Debugf("MainHandler4: scratchpad: %s", pad)
+			}
+		}
+		scratchpad.Release4(req)
+	}()
+	switch {
+	case l.Interface.Index != 0:
+		scratchpad.InterfaceIndex.Set(pad, l.Interface.Index)
+	case oob != nil && oob.IfIndex != 0:
+		scratchpad.InterfaceIndex.Set(pad, oob.IfIndex)
+	}
+
+	classes := l.classifier.Classify4(req)
+	if len(classes) > 0 {
+		log.Debugf("MainHandler4: request classified as %v", classes)
+		classify.ClassesKey.Set(pad, classes)
+	}
+
 	resp = tmp
 	for _, handler := range l.handlers {
-		resp, stop = handler(req, resp)
+		if !classes.Match(handler.Classes) {
+			if tracing {
+				log.Infof("trace DHCPv4 %s %s: plugin `%s` skipped, restricted to classes %v", req.TransactionID, req.ClientHWAddr, handler.Name, handler.Classes)
+			}
+			continue
+		}
+		if tracing {
+			resp, stop = trace4(handler, req, resp)
+		} else {
+			resp, stop = handler.Handler4(req, resp)
+		}
 		if stop {
 			break
 		}
@@ -213,6 +298,7 @@ func (l *listener6) Serve() error {
 			log.Printf("Error reading from connection: %v", err)
 			return err
 		}
+		l.inflight.Add(1)
 		go l.HandleMsg6(b[:n], oob, peer.(*net.UDPAddr))
 	}
 }
@@ -229,6 +315,7 @@ func (l *listener4) Serve() error {
 			log.Printf("Error reading from connection: %v", err)
 			return err
 		}
+		l.inflight.Add(1)
 		go l.HandleMsg4(b[:n], oob, peer.(*net.UDPAddr))
 	}
 }
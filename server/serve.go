@@ -8,12 +8,13 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 
+	"github.com/coredhcp/coredhcp/classify"
 	"github.com/coredhcp/coredhcp/config"
-	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
@@ -25,13 +26,21 @@ var log = logger.GetLogger("server")
 type listener6 struct {
 	*ipv6.PacketConn
 	net.Interface
-	handlers []handler.Handler6
+	handlers   []plugins.LoadedHandler6
+	classifier *classify.Classifier
+	tracer     *tracer
+	// inflight counts the requests being handled
+	inflight *sync.WaitGroup
 }
 
 type listener4 struct {
 	*ipv4.PacketConn
 	net.Interface
-	handlers []handler.Handler4
+	handlers   []plugins.LoadedHandler4
+	classifier *classify.Classifier
+	tracer     *tracer
+	// inflight counts the requests being handled
+	inflight *sync.WaitGroup
 }
 
 type listener interface {
@@ -41,7 +50,14 @@ type listener interface {
 // Servers contains state for a running server (with possibly multiple interfaces/listeners)
 type Servers struct {
 	listeners []listener
+	// errors receives the error of each listener when it stops serving
 	errors    chan error
+	handlers4 []plugins.LoadedHandler4
+	handlers6 []plugins.LoadedHandler6
+	// running counts the serving listeners and the requests being handled,
+	// so that the plugins are only closed once they are all done
+	running   sync.WaitGroup
+	closeOnce sync.Once
 }
 
 func listen4(a *net.UDPAddr) (*listener4, error) {
@@ -112,13 +128,44 @@ func listen6(a *net.UDPAddr) (*listener6, error) {
 
 // Start will start the server asynchronously. See `Wait` to wait until
 // the execution ends.
-func Start(config *config.Config) (*Servers, error) {
-	handlers4, handlers6, err := plugins.LoadPlugins(config)
+// The plugin instances with a lifecycle are started before listening, and
+// closed along with the server.
+// The plugins are looked up in reg, or in plugins.DefaultRegistry if nil.
+func Start(reg *plugins.Registry, config *config.Config) (*Servers, error) {
+	handlers4, handlers6, err := plugins.LoadPlugins(reg, config)
 	if err != nil {
 		return nil, err
 	}
-	srv := Servers{
-		errors: make(chan error),
+	listeners := 0
+	if config.Server6 != nil {
+		listeners += len(config.Server6.Addresses)
+	}
+	if config.Server4 != nil {
+		listeners += len(config.Server4.Addresses)
+	}
+	srv := &Servers{
+		// no listener blocks when stopping, even once Wait returned
+		errors:    make(chan error, listeners),
+		handlers4: handlers4,
+		handlers6: handlers6,
+	}
+
+	var classifier4, classifier6 *classify.Classifier
+	if config.Server6 != nil {
+		if classifier6, err = classify.New(config.Server6.Classes); err != nil {
+			err = fmt.Errorf("DHCPv6: invalid client classes: %w", err)
+			goto cleanup
+		}
+	}
+	if config.Server4 != nil {
+		if classifier4, err = classify.New(config.Server4.Classes); err != nil {
+			err = fmt.Errorf("DHCPv4: invalid client classes: %w", err)
+			goto cleanup
+		}
+	}
+
+	if err = srv.startPlugins(); err != nil {
+		goto cleanup
 	}
 
 	// listen
@@ -131,8 +178,13 @@ func Start(config *config.Config) (*Servers, error) {
 				goto cleanup
 			}
 			l6.handlers = handlers6
+			l6.classifier = classifier6
+			l6.tracer = newTracer(config.Server6.Trace)
+			l6.inflight = &srv.running
 			srv.listeners = append(srv.listeners, l6)
+			srv.running.Add(1)
 			go func() {
+				defer srv.running.Done()
 				srv.errors <- l6.Serve()
 			}()
 		}
@@ -147,14 +199,19 @@ func Start(config *config.Config) (*Servers, error) {
 				goto cleanup
 			}
 			l4.handlers = handlers4
+			l4.classifier = classifier4
+			l4.tracer = newTracer(config.Server4.Trace)
+			l4.inflight = &srv.running
 			srv.listeners = append(srv.listeners, l4)
+			srv.running.Add(1)
 			go func() {
+				defer srv.running.Done()
 				srv.errors <- l4.Serve()
 			}()
 		}
 	}
 
-	return &srv, nil
+	return srv, nil
 
 cleanup:
 	srv.Close()
@@ -169,11 +226,61 @@ func (s *Servers) Wait() error {
 	return err
 }
 
-// Close closes all listening connections
+// startPlugins starts the plugin instances that have a lifecycle, in the
+// order they were loaded
+func (s *Servers) startPlugins() error {
+	for _, h := range s.handlers6 {
+		if h.Lifecycle == nil {
+			continue
+		}
+		if err := h.Lifecycle.Start(); err != nil {
+			return fmt.Errorf("DHCPv6: failed to start plugin `%s`: %w", h.Name, err)
+		}
+	}
+	for _, h := range s.handlers4 {
+		if h.Lifecycle == nil {
+			continue
+		}
+		if err := h.Lifecycle.Start(); err != nil {
+			return fmt.Errorf("DHCPv4: failed to start plugin `%s`: %w", h.Name, err)
+		}
+	}
+	return nil
+}
+
+// Healthy returns an error if any of the plugin instances reports it can't
+// handle requests properly
+func (s *Servers) Healthy() error {
+	for _, h := range s.handlers6 {
+		if h.Lifecycle == nil {
+			continue
+		}
+		if err := h.Lifecycle.Healthy(); err != nil {
+			return fmt.Errorf("DHCPv6: plugin `%s` is unhealthy: %w", h.Name, err)
+		}
+	}
+	for _, h := range s.handlers4 {
+		if h.Lifecycle == nil {
+			continue
+		}
+		if err := h.Lifecycle.Healthy(); err != nil {
+			return fmt.Errorf("DHCPv4: plugin `%s` is unhealthy: %w", h.Name, err)
+		}
+	}
+	return nil
+}
+
+// Close closes all listening connections, waits for the requests being
+// handled, then releases the resources held by the plugin instances. It is
+// safe to call several times.
 func (s *Servers) Close() {
 	for _, srv := range s.listeners {
 		if srv != nil {
 			srv.Close()
 		}
 	}
+	s.closeOnce.Do(func() {
+		s.running.Wait()
+		plugins.CloseHandlers(s.handlers4, s.handlers6)
+	})
 }
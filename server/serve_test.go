@@ -0,0 +1,86 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closeLifecycle records when the plugin instance is closed
+type closeLifecycle struct {
+	plugins.NopLifecycle
+	closed chan struct{}
+}
+
+func (l *closeLifecycle) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func TestCloseWaitsForHandlers(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	lc := &closeLifecycle{closed: make(chan struct{})}
+	reg := plugins.NewRegistry()
+	require.NoError(t, reg.Register(&plugins.Plugin{
+		Name: "block",
+		SetupLifecycle4: func(args ...string) (handler.Handler4, plugins.Lifecycle, error) {
+			return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+				close(entered)
+				<-release
+				return nil, true
+			}, lc, nil
+		},
+	}))
+	srv, err := Start(reg, &config.Config{Server4: &config.ServerConfig{
+		Addresses: []net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1)}},
+		Plugins:   []config.PluginConfig{{Name: "block"}},
+	}})
+	require.NoError(t, err)
+
+	conn, err := net.Dial("udp4", srv.listeners[0].(*listener4).LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	req, err := dhcpv4.NewDiscovery(traceMAC)
+	require.NoError(t, err)
+	_, err = conn.Write(req.ToBytes())
+	require.NoError(t, err)
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not handled")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(closed)
+	}()
+	// the plugin is not closed while it handles a request
+	select {
+	case <-lc.closed:
+		t.Fatal("plugin closed while handling a request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	<-lc.closed
+
+	// the listeners don't block on reporting that they stopped
+	assert.Error(t, srv.Wait())
+}
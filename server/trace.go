@@ -0,0 +1,200 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// tracer decides which requests are traced. When a request is traced, each
+// step of the plugin chain is logged with the changes made to the response.
+type tracer struct {
+	all     bool
+	clients [][]byte
+}
+
+func newTracer(conf config.TraceConfig) *tracer {
+	if !conf.Enabled() {
+		return nil
+	}
+	return &tracer{all: conf.All, clients: conf.Clients}
+}
+
+func (t *tracer) matchID(ids ...[]byte) bool {
+	for _, id := range ids {
+		if len(id) == 0 {
+			continue
+		}
+		for _, c := range t.clients {
+			if bytes.Equal(c, id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// match4 returns whether a DHCPv4 request is traced, based on its client
+// hardware address or the DUID in its client identifier
+func (t *tracer) match4(req *dhcpv4.DHCPv4) bool {
+	if t == nil {
+		return false
+	}
+	if t.all {
+		return true
+	}
+	clientID := req.Options.Get(dhcpv4.OptionClientIdentifier)
+	if len(clientID) > 1 {
+		// RFC 4361 identifiers hold a DUID after the type and IAID
+		if clientID[0] == 0xff && len(clientID) > 5 {
+			clientID = clientID[5:]
+		} else {
+			clientID = clientID[1:]
+		}
+	}
+	return t.matchID(req.ClientHWAddr, clientID)
+}
+
+// match6 returns whether a DHCPv6 request is traced, based on the client DUID
+// or the hardware address found in the request
+func (t *tracer) match6(req dhcpv6.DHCPv6) bool {
+	if t == nil {
+		return false
+	}
+	if t.all {
+		return true
+	}
+	var duid []byte
+	if msg, err := req.GetInnerMessage(); err == nil {
+		if cid := msg.Options.ClientID(); cid != nil {
+			duid = cid.ToBytes()
+		}
+	}
+	mac, _ := dhcpv6.ExtractMAC(req)
+	return t.matchID(duid, mac)
+}
+
+// options4 returns a human readable form of the options and the header fields
+// of a DHCPv4 message, that can be compared before and after a plugin runs
+func options4(m *dhcpv4.DHCPv4) map[string]string {
+	if m == nil {
+		return nil
+	}
+	fields := map[string]string{
+		"yiaddr": m.YourIPAddr.String(),
+		"siaddr": m.ServerIPAddr.String(),
+		"sname":  m.ServerHostName,
+		"file":   m.BootFileName,
+	}
+	for code, data := range m.Options {
+		s := strings.TrimSpace(dhcpv4.Options{code: data}.String())
+		name, value := s, ""
+		if i := strings.Index(s, ":"); i >= 0 {
+			name, value = s[:i], strings.TrimSpace(s[i+1:])
+		}
+		fields[fmt.Sprintf("option %d (%s)", code, name)] = value
+	}
+	return fields
+}
+
+// options6 is like options4, for DHCPv6. Repeated options are grouped
+func options6(d dhcpv6.DHCPv6) map[string]string {
+	if d == nil {
+		return nil
+	}
+	msg, err := d.GetInnerMessage()
+	if err != nil {
+		return map[string]string{"message": d.Summary()}
+	}
+	fields := map[string]string{"type": msg.Type().String()}
+	for _, o := range msg.Options.Options {
+		key := fmt.Sprintf("option %d (%s)", uint16(o.Code()), o.Code())
+		value := strings.TrimSpace(strings.TrimPrefix(o.String(), o.Code().String()+":"))
+		if prev, ok := fields[key]; ok {
+			value = prev + ", " + value
+		}
+		fields[key] = value
+	}
+	return fields
+}
+
+// diff describes the changes between two forms returned by options4 or
+// options6, sorted by field
+func diff(before, after map[string]string) string {
+	if after == nil {
+		return "response dropped"
+	}
+	var changes []string
+	for k, a := range after {
+		b, ok := before[k]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("+%s: %s", k, a))
+		case a != b:
+			changes = append(changes, fmt.Sprintf("~%s: %s -> %s", k, b, a))
+		}
+	}
+	for k, b := range before {
+		if _, ok := after[k]; !ok {
+			changes = append(changes, fmt.Sprintf("-%s: %s", k, b))
+		}
+	}
+	if len(changes) == 0 {
+		return "no change"
+	}
+	sort.Slice(changes, func(i, j int) bool { return fieldLess(changes[i][1:], changes[j][1:]) })
+	return strings.Join(changes, "; ")
+}
+
+// fieldLess orders the header fields by name, before the options by code
+func fieldLess(a, b string) bool {
+	var codeA, codeB int
+	_, errA := fmt.Sscanf(a, "option %d", &codeA)
+	_, errB := fmt.Sscanf(b, "option %d", &codeB)
+	switch {
+	case errA != nil && errB != nil:
+		return a < b
+	case errA != nil || errB != nil:
+		return errA != nil
+	case codeA != codeB:
+		return codeA < codeB
+	}
+	return a < b
+}
+
+// trace4 runs a DHCPv4 handler and logs what it changed
+func trace4(h plugins.LoadedHandler4, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	before := options4(resp)
+	start := time.Now()
+	resp, stop := h.Handler4(req, resp)
+	elapsed := time.Since(start)
+	log.Infof("trace DHCPv4 %s %s: plugin `%s` took %s, stop=%v: %s",
+		req.TransactionID, req.ClientHWAddr, h.Name, elapsed, stop, diff(before, options4(resp)))
+	return resp, stop
+}
+
+// trace6 runs a DHCPv6 handler and logs what it changed
+func trace6(h plugins.LoadedHandler6, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	var xid string
+	if msg, err := req.GetInnerMessage(); err == nil {
+		xid = msg.TransactionID.String()
+	}
+	before := options6(resp)
+	start := time.Now()
+	resp, stop := h.Handler6(req, resp)
+	elapsed := time.Since(start)
+	log.Infof("trace DHCPv6 %s: plugin `%s` took %s, stop=%v: %s",
+		xid, h.Name, elapsed, stop, diff(before, options6(resp)))
+	return resp, stop
+}
@@ -0,0 +1,89 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var traceMAC = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+func TestTracerMatch(t *testing.T) {
+	assert.Nil(t, newTracer(config.TraceConfig{}))
+	var none *tracer
+	req4, err := dhcpv4.NewDiscovery(traceMAC)
+	require.NoError(t, err)
+	req6, err := dhcpv6.NewSolicit(traceMAC)
+	require.NoError(t, err)
+	assert.False(t, none.match4(req4))
+	assert.False(t, none.match6(req6))
+
+	all := newTracer(config.TraceConfig{All: true})
+	assert.True(t, all.match4(req4))
+	assert.True(t, all.match6(req6))
+
+	byMAC := newTracer(config.TraceConfig{Clients: [][]byte{traceMAC}})
+	assert.True(t, byMAC.match4(req4))
+	assert.True(t, byMAC.match6(req6))
+
+	duid := req6.Options.ClientID().ToBytes()
+	byDUID := newTracer(config.TraceConfig{Clients: [][]byte{duid}})
+	assert.True(t, byDUID.match6(req6))
+	assert.False(t, byDUID.match4(req4))
+
+	other := newTracer(config.TraceConfig{Clients: [][]byte{{0, 1, 2, 3, 4, 5}}})
+	assert.False(t, other.match4(req4))
+	assert.False(t, other.match6(req6))
+}
+
+func TestDiff(t *testing.T) {
+	req, err := dhcpv4.NewDiscovery(traceMAC)
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithOption(dhcpv4.OptDNS(net.IPv4(192, 0, 2, 53))),
+		dhcpv4.WithOption(dhcpv4.OptHostName("client")))
+	require.NoError(t, err)
+	before := options4(resp)
+	assert.Equal(t, "no change", diff(before, options4(resp)))
+
+	resp.YourIPAddr = net.IPv4(192, 0, 2, 10)
+	resp.UpdateOption(dhcpv4.OptRouter(net.IPv4(192, 0, 2, 1)))
+	resp.UpdateOption(dhcpv4.OptDNS(net.IPv4(192, 0, 2, 54)))
+	resp.Options.Del(dhcpv4.OptionHostName)
+	assert.Equal(t,
+		"~yiaddr: 0.0.0.0 -> 192.0.2.10; "+
+			"+option 3 (Router): 192.0.2.1; "+
+			"~option 6 (Domain Name Server): 192.0.2.53 -> 192.0.2.54; "+
+			"-option 12 (Host Name): client",
+		diff(before, options4(resp)))
+	assert.Equal(t, "response dropped", diff(before, options4(nil)))
+}
+
+func TestTrace6(t *testing.T) {
+	req, err := dhcpv6.NewSolicit(traceMAC)
+	require.NoError(t, err)
+	resp, err := dhcpv6.NewAdvertiseFromSolicit(req)
+	require.NoError(t, err)
+	h := plugins.LoadedHandler6{
+		Name: "test",
+		Handler6: func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+			resp.AddOption(dhcpv6.OptDNS(net.ParseIP("2001:db8::53")))
+			return resp, true
+		},
+	}
+	before := options6(resp)
+	result, stop := trace6(h, req, resp)
+	assert.True(t, stop)
+	assert.Same(t, resp, result)
+	assert.Contains(t, diff(before, options6(result)), "+option 23 (DNS): [2001:db8::53]")
+}